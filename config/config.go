@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"regexp"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -22,8 +26,81 @@ func Init(env string) {
 	if err != nil {
 		log.Fatal("error on parsing configuration file")
 	}
+	err = ResolveSecrets(config)
+	if err != nil {
+		log.Fatalf("error on resolving secrets in configuration file: %s", err.Error())
+	}
 }
 
 func GetConfig() *viper.Viper {
 	return config
 }
+
+var envVariablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Resolves the secrets in the given config, so that no credentials need to be in the config file itself:
+//
+//   - the ${ENV} references in the values are replaced by the value of the environment variable ENV,
+//     e.g. "password: ${ATLAS_DB_PASSWORD}";
+//   - the value of a key ending with "_file" is read from the file it points to, and set as the value of
+//     the key without the suffix, e.g. "password_file: /run/secrets/atlas-db-password" sets "password".
+//
+// Returns an error if an environment variable is not set or if a file can not be read.
+func ResolveSecrets(v *viper.Viper) error {
+	for _, key := range v.AllKeys() {
+		value, err := expandEnvVariables(v.Get(key))
+		if err != nil {
+			return fmt.Errorf("error in %s: %w", key, err)
+		}
+		v.Set(key, value)
+	}
+	for _, key := range v.AllKeys() {
+		if !strings.HasSuffix(key, "_file") {
+			continue
+		}
+		content, err := os.ReadFile(v.GetString(key))
+		if err != nil {
+			return fmt.Errorf("error in %s: %w", key, err)
+		}
+		// the trailing newline is not part of the secret:
+		v.Set(strings.TrimSuffix(key, "_file"), strings.TrimRight(string(content), "\r\n"))
+	}
+	return nil
+}
+
+// Replaces the ${ENV} references in the given value, including in the values of its lists and maps.
+func expandEnvVariables(value interface{}) (interface{}, error) {
+	var err error
+	switch typedValue := value.(type) {
+	case string:
+		result := envVariablePattern.ReplaceAllStringFunc(typedValue, func(reference string) string {
+			name := envVariablePattern.FindStringSubmatch(reference)[1]
+			envValue, isSet := os.LookupEnv(name)
+			if !isSet {
+				err = fmt.Errorf("environment variable %s is not set", name)
+			}
+			return envValue
+		})
+		return result, err
+	case []interface{}:
+		result := make([]interface{}, len(typedValue))
+		for i, item := range typedValue {
+			result[i], err = expandEnvVariables(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			result[key], err = expandEnvVariables(item)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/middlewares"
+	"github.com/uc-cdis/cohort-middleware/models"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// An analysis that runs with the parameters given in an AnalysisRequest. The v1 endpoints
+// build the AnalysisRequest from their path and query parameters, while the /v2 endpoints
+// decode it from the JSON request body (see NewAnalysisHandler).
+type Analysis func(c *gin.Context, request *utils.AnalysisRequest)
+
+// Returns a /v2 handler that decodes the AnalysisRequest in the request body and runs the given analysis with it.
+func NewAnalysisHandler(analysis Analysis) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request == nil || c.Request.Body == nil {
+			middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("bad request - no request body")))
+			return
+		}
+		request, err := utils.DecodeAnalysisRequest(c.Request.Body)
+		if err != nil {
+			log.Printf("Error: %s", err.Error())
+			middlewares.AbortWithError(c, "bad request", err)
+			return
+		}
+		analysis(c, request)
+	}
+}
+
+// Aborts the request with a bad request error if the given AnalysisRequest does not have the
+// fields required by the analysis (see utils.AnalysisRequest.CheckRequiredFields). Returns false if aborted.
+func checkRequiredFields(c *gin.Context, request *utils.AnalysisRequest, minCohorts int, maxCohorts int, fields ...string) bool {
+	err := request.CheckRequiredFields(minCohorts, maxCohorts, fields...)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", err)
+		return false
+	}
+	return true
+}
+
+// Aborts the request with a bad request error if the given AnalysisRequest has variables of other
+// types than the given ones (see utils.AnalysisRequest.CheckVariableTypes). Returns false if aborted.
+func checkVariableTypes(c *gin.Context, request *utils.AnalysisRequest, variableTypes ...string) bool {
+	err := request.CheckVariableTypes(variableTypes...)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", err)
+		return false
+	}
+	return true
+}
+
+// Aborts the request with a bad request error if any of the given fields is set in the given
+// AnalysisRequest (see utils.AnalysisRequest.CheckUnsupportedFields). Returns false if aborted.
+func checkUnsupportedFields(c *gin.Context, request *utils.AnalysisRequest, fields ...string) bool {
+	err := request.CheckUnsupportedFields(fields...)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", err)
+		return false
+	}
+	return true
+}
+
+// The response header with the aggregation reports of the CSV exports (see addAggregationReports).
+const AGGREGATION_REPORTS_HEADER = "X-Observation-Aggregation"
+
+// Adds the given aggregation reports to the response, under "aggregation", if there are any. There are only
+// reports for the concepts that have an aggregation policy (see models.GetAggregationPolicy).
+func addAggregationReports(response gin.H, aggregationReports []models.AggregationReport) gin.H {
+	if len(aggregationReports) > 0 {
+		response["aggregation"] = aggregationReports
+	}
+	return response
+}
+
+// Aborts the request with an access denied error if the user does not have access to all the
+// cohorts in the given AnalysisRequest, including the ones in its variables. Returns false if aborted.
+func checkAnalysisAccess(c *gin.Context, teamProjectAuthz middlewares.TeamProjectAuthzI, request *utils.AnalysisRequest, otherCohortPairs ...utils.CustomDichotomousVariableDef) bool {
+	conceptIdsAndCohortPairs := request.GetConceptIdsAndCohortPairs()
+	_, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(conceptIdsAndCohortPairs)
+	cohortIds := append(append([]int{}, request.CohortIds...), utils.GetTemporalVariablesCohortIds(utils.GetTemporalVariables(conceptIdsAndCohortPairs))...)
+	validAccessRequest := teamProjectAuthz.TeamProjectValidation(c, cohortIds, append(cohortPairs, otherCohortPairs...))
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		middlewares.AbortWithError(c, "access denied", middlewares.ErrAccessDenied)
+		return false
+	}
+	return true
+}
@@ -3,6 +3,8 @@ package controllers
 import (
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,136 +30,387 @@ func NewCohortDataController(cohortDataModel models.CohortDataI, dataDictionaryM
 	}
 }
 
+// Returns the histogram bins for the values of the given concept in the given cohort. The optional
+// query parameters "binning", "bin-count", "bin-width", "breaks" and "clip-percentiles" control how
+// the bins are calculated (see utils.ParseHistogramOptionsQueryArgs).
 func (u CohortDataController) RetrieveHistogramForCohortIdAndConceptId(c *gin.Context) {
+	request, err := parseAnalysisRequestWithConceptId(c, "histogramid")
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", err)
+		return
+	}
+	histogramOptions, err := utils.ParseHistogramOptionsQueryArgs(c)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+		return
+	}
+	request.Options.Histogram = getHistogramOptionsDef(histogramOptions)
+	u.RetrieveHistogramForAnalysisRequest(c, request)
+}
+
+// Builds the AnalysisRequest for the v1 endpoints that have the :sourceid, :cohortid and the given concept id
+// path parameters and the variables in the request body.
+func parseAnalysisRequestWithConceptId(c *gin.Context, conceptIdParamName string) (*utils.AnalysisRequest, error) {
 	sourceIdStr := c.Param("sourceid")
 	log.Printf("Querying source: %s", sourceIdStr)
 	cohortIdStr := c.Param("cohortid")
 	log.Printf("Querying cohort for cohort definition id: %s", cohortIdStr)
-	histogramIdStr := c.Param("histogramid")
-	if sourceIdStr == "" || cohortIdStr == "" || histogramIdStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
-		return
+	conceptIdStr := c.Param(conceptIdParamName)
+	if sourceIdStr == "" || cohortIdStr == "" || conceptIdStr == "" {
+		return nil, utils.NewInvalidInputError(fmt.Errorf("sourceid, cohortid and %s are mandatory parameters", conceptIdParamName))
+	}
+	variablesRequest, err := utils.ParseVariablesRequest(c)
+	if err != nil {
+		return nil, err
 	}
+	sourceId, _ := strconv.Atoi(sourceIdStr)
+	cohortId, _ := strconv.Atoi(cohortIdStr)
+	conceptId, _ := strconv.ParseInt(conceptIdStr, 10, 64)
+	return &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohortId},
+		Windows:   variablesRequest.Windows,
+		Variables: variablesRequest.Variables,
+		Options:   &utils.AnalysisOptions{ConceptId: &conceptId},
+	}, nil
+}
 
-	filterConceptIdsAndValues, cohortPairs, err := utils.ParseConceptDefsAndDichotomousDefs(c)
+// Returns the JSON equivalent of the given (validated) histogram options.
+func getHistogramOptionsDef(options *utils.HistogramOptions) *utils.HistogramOptionsDef {
+	return &utils.HistogramOptionsDef{
+		Binning:         options.Strategy,
+		BinCount:        options.NumberOfBins,
+		BinWidth:        options.BinWidth,
+		Breaks:          options.Breaks,
+		ClipPercentiles: options.ClipPercentiles,
+	}
+}
+
+// Returns the histogram bins for the values of the concept in options.concept_id in the cohort. The
+// bins are calculated using options.histogram (see utils.HistogramOptionsDef).
+func (u CohortDataController) RetrieveHistogramForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, 1, "options.concept_id") {
+		return
+	}
+	if !checkUnsupportedFields(c, request, "windows.outcome_window") {
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
+		return
+	}
+	filterConceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	temporalVariables := utils.GetTemporalVariables(request.GetConceptIdsAndCohortPairs())
+	histogramData, binMetadata, err := u.cohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(request.SourceId, request.GetCohortId(),
+		*request.Options.ConceptId, filterConceptIdsAndValues, cohortPairs, temporalVariables, request.GetObservationPeriodFilter(), request.GetHistogramOptions())
+	if err != nil {
+		middlewares.AbortWithError(c, "Error retrieving concept details", err)
+		return
+	}
+	aggregationReports, err := u.cohortDataModel.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(request.SourceId, request.GetCohortId(),
+		append([]int64{*request.Options.ConceptId}, utils.ExtractConceptIdsFromCustomConceptVariablesDef(filterConceptIdsAndValues)...))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error parsing request body for prefixed concept ids", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving aggregation reports", err)
 		return
 	}
 
-	sourceId, _ := strconv.Atoi(sourceIdStr)
-	cohortId, _ := strconv.Atoi(cohortIdStr)
-	histogramConceptId, _ := strconv.ParseInt(histogramIdStr, 10, 64)
+	c.JSON(http.StatusOK, addAggregationReports(gin.H{"bins": histogramData, "binMetadata": binMetadata}, aggregationReports))
+}
 
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidation(c, []int{cohortId}, cohortPairs)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+type HistogramSeries struct {
+	CohortId         int                     `json:"cohortId"`
+	ValueAsConceptId int64                   `json:"concept_value_as_concept_id,omitempty"`
+	ValueName        string                  `json:"concept_value_name,omitempty"`
+	Bins             []utils.HistogramColumn `json:"bins"`
+}
+
+// Returns one histogram series per group for the values of the given concept, all sharing the same bin
+// edges so they can be rendered as stacked or overlaid histograms. The groups are either the values
+// of the nominal concept given in the "breakdown-concept-id" query parameter, or the given cohort
+// followed by the cohorts given in the "compare-cohort-ids" query parameter (e.g. "?compare-cohort-ids=2,3").
+// The same binning query parameters as RetrieveHistogramForCohortIdAndConceptId are supported.
+func (u CohortDataController) RetrieveGroupedHistogramForCohortIdAndConceptId(c *gin.Context) {
+	request, err := parseAnalysisRequestWithConceptId(c, "histogramid")
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", err)
+		return
+	}
+	histogramOptions, err := utils.ParseHistogramOptionsQueryArgs(c)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
+	request.Options.Histogram = getHistogramOptionsDef(histogramOptions)
+	breakdownConceptId, err := utils.ParseOptionalBigNumericQueryArg(c, "breakdown-concept-id")
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+		return
+	}
+	if breakdownConceptId != -1 {
+		request.Options.BreakdownConceptId = &breakdownConceptId
+	}
+	compareCohortIds, err := utils.ParseOptionalIntListQueryArg(c, "compare-cohort-ids")
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+		return
+	}
+	request.CohortIds = append(request.CohortIds, compareCohortIds...)
+	u.RetrieveGroupedHistogramForAnalysisRequest(c, request)
+}
+
+// Same as RetrieveGroupedHistogramForCohortIdAndConceptId, with the groups set by either options.breakdown_concept_id
+// or by the other cohorts in cohort_ids.
+func (u CohortDataController) RetrieveGroupedHistogramForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, -1, "options.concept_id") {
+		return
+	}
+	if !checkUnsupportedFields(c, request, "windows.outcome_window") {
+		return
+	}
+	breakdownConceptId := request.Options.BreakdownConceptId
+	if (breakdownConceptId == nil) == (len(request.CohortIds) == 1) {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("exactly one of breakdown-concept-id or compare-cohort-ids should be set")))
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
+		return
+	}
+	sourceId := request.SourceId
+	cohortId := request.GetCohortId()
+	histogramConceptId := *request.Options.ConceptId
+	filterConceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	temporalVariables := utils.GetTemporalVariables(request.GetConceptIdsAndCohortPairs())
+	observationPeriodFilter := request.GetObservationPeriodFilter()
+
+	histogramSeriesList := []*HistogramSeries{}
+	valuesPerGroup := [][]float64{}
+	if breakdownConceptId != nil {
+		breakdownValues, err := u.cohortDataModel.RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptId(sourceId, cohortId, *breakdownConceptId)
+		if err != nil {
+			middlewares.AbortWithError(c, "Error retrieving breakdown concept values", err)
+			return
+		}
+		for _, breakdownValue := range breakdownValues {
+			if breakdownValue.ValueAsConceptID == 0 {
+				continue
+			}
+			breakdownFilter := utils.CustomConceptVariableDef{ConceptId: *breakdownConceptId, ConceptValues: []int64{breakdownValue.ValueAsConceptID}}
+			conceptValues, _, err := u.retrieveConceptValues(sourceId, cohortId, histogramConceptId, append(filterConceptIdsAndValues, breakdownFilter), cohortPairs, temporalVariables, observationPeriodFilter)
+			if err != nil {
+				middlewares.AbortWithError(c, "Error retrieving concept details for breakdown value", err)
+				return
+			}
+			valuesPerGroup = append(valuesPerGroup, conceptValues)
+			histogramSeriesList = append(histogramSeriesList, &HistogramSeries{
+				CohortId:         cohortId,
+				ValueAsConceptId: breakdownValue.ValueAsConceptID,
+				ValueName:        breakdownValue.Name,
+			})
+		}
+	} else {
+		for _, groupCohortId := range request.CohortIds {
+			conceptValues, _, err := u.retrieveConceptValues(sourceId, groupCohortId, histogramConceptId, filterConceptIdsAndValues, cohortPairs, temporalVariables, observationPeriodFilter)
+			if err != nil {
+				middlewares.AbortWithError(c, "Error retrieving concept details for cohort", err)
+				return
+			}
+			valuesPerGroup = append(valuesPerGroup, conceptValues)
+			histogramSeriesList = append(histogramSeriesList, &HistogramSeries{CohortId: groupCohortId})
+		}
+	}
 
-	cohortData, err := u.cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, histogramConceptId, filterConceptIdsAndValues, cohortPairs)
+	histograms, binMetadata := utils.GenerateHistogramDataForGroups(valuesPerGroup, request.GetHistogramOptions())
+	for i, histogramSeries := range histogramSeriesList {
+		histogramSeries.Bins = histograms[i]
+	}
+	aggregationReports, err := u.cohortDataModel.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId, cohortId,
+		append([]int64{histogramConceptId}, utils.ExtractConceptIdsFromCustomConceptVariablesDef(filterConceptIdsAndValues)...))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving aggregation reports", err)
 		return
 	}
 
+	c.JSON(http.StatusOK, addAggregationReports(gin.H{"series": histogramSeriesList, "binMetadata": binMetadata}, aggregationReports))
+}
+
+// Returns the values of the given concept in the given cohort, and the number of distinct persons that
+// have these values (which is less than the number of values for persons with multiple observations).
+func (u CohortDataController) retrieveConceptValues(sourceId int, cohortId int, conceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef,
+	cohortPairs []utils.CustomDichotomousVariableDef, temporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]float64, int, error) {
+	cohortData, err := u.cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, conceptId, filterConceptIdsAndValues, cohortPairs, temporalVariables, observationPeriodFilter)
+	if err != nil {
+		return nil, 0, err
+	}
 	conceptValues := []float64{}
+	personIds := make(map[int64]bool)
 	for _, personData := range cohortData {
 		conceptValues = append(conceptValues, float64(*personData.ConceptValueAsNumber))
+		personIds[personData.PersonId] = true
 	}
+	return conceptValues, len(personIds), nil
+}
 
-	histogramData := utils.GenerateHistogramData(conceptValues)
-
-	c.JSON(http.StatusOK, gin.H{"bins": histogramData})
+type BreakdownValueStats struct {
+	ValueAsConceptId int64               `json:"concept_value_as_concept_id"`
+	ValueName        string              `json:"concept_value_name"`
+	StatsData        *utils.ConceptStats `json:"statsData"`
 }
 
+// Returns summary statistics for the values of the given concept in the given cohort. The optional
+// "percentiles" query parameter sets which percentiles are returned (e.g. "?percentiles=5,50,95") and
+// the optional "breakdown-concept-id" query parameter adds the same statistics for each value of the
+// given nominal concept (e.g. per HARE group).
 func (u CohortDataController) RetrieveStatsForCohortIdAndConceptId(c *gin.Context) {
-	sourceIdStr := c.Param("sourceid")
-	log.Printf("Querying source: %s", sourceIdStr)
-	cohortIdStr := c.Param("cohortid")
-	log.Printf("Querying cohort for cohort definition id: %s", cohortIdStr)
-	conceptIdStr := c.Param("conceptid")
-	if sourceIdStr == "" || cohortIdStr == "" || conceptIdStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
+	request, err := parseAnalysisRequestWithConceptId(c, "conceptid")
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", err)
 		return
 	}
+	request.Options.Percentiles, err = utils.ParsePercentilesQueryArg(c, "percentiles", utils.DEFAULT_PERCENTILES)
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+		return
+	}
+	breakdownConceptId, err := utils.ParseOptionalBigNumericQueryArg(c, "breakdown-concept-id")
+	if err != nil {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+		return
+	}
+	if breakdownConceptId != -1 {
+		request.Options.BreakdownConceptId = &breakdownConceptId
+	}
+	u.RetrieveStatsForAnalysisRequest(c, request)
+}
 
-	filterConceptIdsAndValues, cohortPairs, _ := utils.ParseConceptDefsAndDichotomousDefs(c)
-
-	sourceId, _ := strconv.Atoi(sourceIdStr)
-	cohortId, _ := strconv.Atoi(cohortIdStr)
-	conceptId, _ := strconv.ParseInt(conceptIdStr, 10, 64)
-
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidation(c, []int{cohortId}, cohortPairs)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+// Same as RetrieveStatsForCohortIdAndConceptId, for the concept in options.concept_id, with the
+// percentiles in options.percentiles and the optional options.breakdown_concept_id.
+func (u CohortDataController) RetrieveStatsForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, 1, "options.concept_id") {
 		return
 	}
+	if !checkUnsupportedFields(c, request, "windows.outcome_window") {
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
+		return
+	}
+	sourceId := request.SourceId
+	cohortId := request.GetCohortId()
+	conceptId := *request.Options.ConceptId
+	percentiles := request.GetPercentiles()
+	filterConceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	temporalVariables := utils.GetTemporalVariables(request.GetConceptIdsAndCohortPairs())
+	observationPeriodFilter := request.GetObservationPeriodFilter()
 
-	cohortData, err := u.cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, conceptId, filterConceptIdsAndValues, cohortPairs)
+	statsData, err := u.retrieveExtendedStats(sourceId, cohortId, conceptId, filterConceptIdsAndValues, cohortPairs, temporalVariables, observationPeriodFilter, percentiles)
+	if err != nil {
+		middlewares.AbortWithError(c, "Error retrieving concept details", err)
+		return
+	}
+	aggregationReports, err := u.cohortDataModel.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId, cohortId,
+		append([]int64{conceptId}, utils.ExtractConceptIdsFromCustomConceptVariablesDef(filterConceptIdsAndValues)...))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving aggregation reports", err)
+		return
+	}
+	if request.Options.BreakdownConceptId == nil {
+		c.JSON(http.StatusOK, addAggregationReports(gin.H{"statsData": statsData}, aggregationReports))
 		return
 	}
+	breakdownConceptId := *request.Options.BreakdownConceptId
 
-	conceptValues := []float64{}
-	for _, personData := range cohortData {
-		conceptValues = append(conceptValues, float64(*personData.ConceptValueAsNumber))
+	// same stats, but for each value of the breakdown concept:
+	breakdownValues, err := u.cohortDataModel.RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptId(sourceId, cohortId, breakdownConceptId)
+	if err != nil {
+		middlewares.AbortWithError(c, "Error retrieving breakdown concept values", err)
+		return
+	}
+	breakdownValueStatsList := []*BreakdownValueStats{}
+	for _, breakdownValue := range breakdownValues {
+		if breakdownValue.ValueAsConceptID == 0 {
+			continue
+		}
+		breakdownFilter := utils.CustomConceptVariableDef{ConceptId: breakdownConceptId, ConceptValues: []int64{breakdownValue.ValueAsConceptID}}
+		breakdownValueStats, err := u.retrieveExtendedStats(sourceId, cohortId, conceptId,
+			append(filterConceptIdsAndValues, breakdownFilter), cohortPairs, temporalVariables, observationPeriodFilter, percentiles)
+		if err != nil {
+			middlewares.AbortWithError(c, "Error retrieving concept details for breakdown value", err)
+			return
+		}
+		breakdownValueStatsList = append(breakdownValueStatsList, &BreakdownValueStats{
+			ValueAsConceptId: breakdownValue.ValueAsConceptID,
+			ValueName:        breakdownValue.Name,
+			StatsData:        breakdownValueStats,
+		})
 	}
+	c.JSON(http.StatusOK, addAggregationReports(gin.H{"statsData": statsData, "statsDataByBreakdownValue": breakdownValueStatsList}, aggregationReports))
+}
 
-	statsData := utils.GenerateStatsData(cohortId, conceptId, conceptValues)
+func (u CohortDataController) retrieveExtendedStats(sourceId int, cohortId int, conceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef,
+	cohortPairs []utils.CustomDichotomousVariableDef, temporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter,
+	percentiles []float64) (*utils.ConceptStats, error) {
+	conceptValues, numberOfPeopleWithValue, err := u.retrieveConceptValues(sourceId, cohortId, conceptId, filterConceptIdsAndValues, cohortPairs, temporalVariables, observationPeriodFilter)
+	if err != nil {
+		return nil, err
+	}
+	cohortSize, err := u.cohortDataModel.RetrieveCohortSizeBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, filterConceptIdsAndValues, cohortPairs, temporalVariables, observationPeriodFilter)
+	if err != nil {
+		return nil, err
+	}
 
-	c.JSON(http.StatusOK, gin.H{"statsData": statsData})
+	return utils.GenerateExtendedStatsData(cohortId, conceptId, conceptValues, percentiles, cohortSize, numberOfPeopleWithValue), nil
 }
 
 func (u CohortDataController) RetrieveDataBySourceIdAndCohortIdAndVariables(c *gin.Context) {
-	// TODO - add some validation to ensure that only calls from Argo are allowed through since it outputs FULL data?
-
 	// parse and validate all parameters:
 	sourceIdStr := c.Param("sourceid")
 	log.Printf("Querying source: %s", sourceIdStr)
 	cohortIdStr := c.Param("cohortid")
 	log.Printf("Querying cohort for cohort definition id: %s", cohortIdStr)
 	if sourceIdStr == "" || cohortIdStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("sourceid and cohortid are mandatory parameters")))
 		return
 	}
 
-	conceptIdsAndValues, cohortPairs, err := utils.ParseConceptDefsAndDichotomousDefs(c)
-	conceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)
-
+	variablesRequest, err := utils.ParseVariablesRequest(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error parsing request body for prefixed concept ids and dichotomous Ids", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error parsing request body for prefixed concept ids and dichotomous Ids", err)
 		return
 	}
 
 	sourceId, _ := strconv.Atoi(sourceIdStr)
 	cohortId, _ := strconv.Atoi(cohortIdStr)
+	u.RetrieveDataForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohortId},
+		Windows:   variablesRequest.Windows,
+		Variables: variablesRequest.Variables,
+	})
+}
 
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidation(c, []int{cohortId}, cohortPairs)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+// Returns a CSV with the values of the concept variables and the cohort pair variables for each person in the cohort.
+func (u CohortDataController) RetrieveDataForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	// TODO - add some validation to ensure that only calls from Argo are allowed through since it outputs FULL data?
+	if !checkRequiredFields(c, request, 1, 1) {
+		return
+	}
+	if !checkUnsupportedFields(c, request, "windows.outcome_window") {
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
 		return
 	}
+	sourceId := request.SourceId
+	cohortId := request.GetCohortId()
+	conceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	conceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)
+	temporalVariables := utils.GetTemporalVariables(request.GetConceptIdsAndCohortPairs())
 
 	// call model method:
-	cohortData, err := u.cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId, cohortId, conceptIds)
+	cohortData, err := u.cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId, cohortId, conceptIds, temporalVariables, request.GetObservationPeriodFilter())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving concept details", err)
 		return
 	}
 
@@ -165,12 +418,25 @@ func (u CohortDataController) RetrieveDataBySourceIdAndCohortIdAndVariables(c *g
 
 	personIdToCSVValues, err := u.RetrievePeopleIdAndCohort(sourceId, cohortId, cohortPairs, cohortData)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving people ID to csv value map", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving people ID to csv value map", err)
 		return
 	}
 
-	b := GenerateCompleteCSV(partialCSV, personIdToCSVValues, cohortPairs)
+	b, err := GenerateCompleteCSV(partialCSV, personIdToCSVValues, cohortPairs)
+	if err != nil {
+		middlewares.AbortWithError(c, "Error generating CSV", err)
+		return
+	}
+	aggregationReports, err := u.cohortDataModel.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId, cohortId, conceptIds)
+	if err != nil {
+		middlewares.AbortWithError(c, "Error retrieving aggregation reports", err)
+		return
+	}
+	if len(aggregationReports) > 0 {
+		// the CSV has no room for the reports, so they are returned as JSON in a response header:
+		aggregationReportsJson, _ := json.Marshal(aggregationReports)
+		c.Header(AGGREGATION_REPORTS_HEADER, string(aggregationReportsJson))
+	}
 	c.String(http.StatusOK, b.String())
 
 }
@@ -185,7 +451,7 @@ func generateCohortPairsHeaders(cohortPairs []utils.CustomDichotomousVariableDef
 	return cohortPairsHeaders
 }
 
-func GenerateCompleteCSV(partialCSV [][]string, personIdToCSVValues map[int64]map[string]string, cohortPairs []utils.CustomDichotomousVariableDef) *bytes.Buffer {
+func GenerateCompleteCSV(partialCSV [][]string, personIdToCSVValues map[int64]map[string]string, cohortPairs []utils.CustomDichotomousVariableDef) (*bytes.Buffer, error) {
 	b := new(bytes.Buffer)
 	w := csv.NewWriter(b)
 	w.Comma = ',' // CSV
@@ -207,9 +473,9 @@ func GenerateCompleteCSV(partialCSV [][]string, personIdToCSVValues map[int64]ma
 	// a max here in this method?
 	err := w.WriteAll(partialCSV)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to write CSV: %w", err)
 	}
-	return b
+	return b, nil
 }
 
 // This function will take the given cohort data and transform it into a matrix
@@ -278,15 +544,10 @@ func populateConceptValue(row []string, cohortItem models.PersonConceptAndValue,
 	if conceptIdIdx != -1 {
 		// conceptIdIdx+1 because first column is sample.id:
 		conceptIdxInRow := conceptIdIdx + 1
-		if cohortItem.ConceptClassId == "MVP Continuous" {
-			if cohortItem.ConceptValueAsNumber != nil {
-				row[conceptIdxInRow] = strconv.FormatFloat(float64(*cohortItem.ConceptValueAsNumber), 'f', 2, 64)
-			}
-		} else {
-			// default to the ObservationValueAsConceptName for now:
-			if cohortItem.ObservationValueAsConceptName != "" {
-				row[conceptIdxInRow] = cohortItem.ObservationValueAsConceptName
-			}
+		// format the value according to the value kind of the concept (see models.GetConceptTypeRules):
+		conceptValue := models.FormatConceptValue(cohortItem)
+		if conceptValue != "" {
+			row[conceptIdxInRow] = conceptValue
 		}
 	}
 	return row
@@ -295,35 +556,21 @@ func populateConceptValue(row []string, cohortItem models.PersonConceptAndValue,
 func (u CohortDataController) RetrieveCohortOverlapStats(c *gin.Context) {
 	errors := make([]error, 4)
 	var sourceId, caseCohortId, controlCohortId int
-	var conceptIdsAndValues []utils.CustomConceptVariableDef
-	var cohortPairs []utils.CustomDichotomousVariableDef
+	var variablesRequest *utils.VariablesRequest
 	sourceId, errors[0] = utils.ParseNumericArg(c, "sourceid")
 	caseCohortId, errors[1] = utils.ParseNumericArg(c, "casecohortid")
 	controlCohortId, errors[2] = utils.ParseNumericArg(c, "controlcohortid")
-	conceptIdsAndValues, cohortPairs, errors[3] = utils.ParseConceptDefsAndDichotomousDefs(c)
-	conceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)
-
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidation(c, []int{caseCohortId, controlCohortId}, cohortPairs)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
-		return
-	}
-
+	variablesRequest, errors[3] = utils.ParseVariablesRequest(c)
 	if utils.ContainsNonNil(errors) {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
-		return
-	}
-	overlapStats, err := u.cohortDataModel.RetrieveCohortOverlapStats(sourceId, caseCohortId,
-		controlCohortId, conceptIds, cohortPairs)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(utils.GetFirstNonNil(errors)))
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"cohort_overlap": overlapStats})
+	u.RetrieveCohortOverlapStatsForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{caseCohortId, controlCohortId},
+		Windows:   variablesRequest.Windows,
+		Variables: variablesRequest.Variables,
+	})
 }
 
 // Simplified version of RetrieveCohortOverlapStats above, for assessing just the overlap
@@ -334,26 +581,36 @@ func (u CohortDataController) RetrieveCohortOverlapStatsSimple(c *gin.Context) {
 	sourceId, errors[0] = utils.ParseNumericArg(c, "sourceid")
 	caseCohortId, errors[1] = utils.ParseNumericArg(c, "casecohortid")
 	controlCohortId, errors[2] = utils.ParseNumericArg(c, "controlcohortid")
-
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohortIdsList(c, []int{caseCohortId, controlCohortId})
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+	if utils.ContainsNonNil(errors) {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(utils.GetFirstNonNil(errors)))
 		return
 	}
+	u.RetrieveCohortOverlapStatsForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{caseCohortId, controlCohortId},
+	})
+}
 
-	if utils.ContainsNonNil(errors) {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
+// Returns the number of persons that are in both cohorts and match the variables (if any).
+func (u CohortDataController) RetrieveCohortOverlapStatsForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 2, 2) {
 		return
 	}
-	// call RetrieveCohortOverlapStats with last two filters as empty lists:
-	overlapStats, err := u.cohortDataModel.RetrieveCohortOverlapStats(sourceId, caseCohortId,
-		controlCohortId, []int64{}, []utils.CustomDichotomousVariableDef{})
+	if !checkUnsupportedFields(c, request, "windows.observation_window", "windows.outcome_window", "windows.follow_up_window") {
+		return
+	}
+	if !checkVariableTypes(c, request, utils.CONCEPT_VARIABLE_TYPE, utils.CUSTOM_DICHOTOMOUS_VARIABLE_TYPE) {
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
+		return
+	}
+	conceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	conceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)
+	overlapStats, err := u.cohortDataModel.RetrieveCohortOverlapStats(request.SourceId, request.CohortIds[0],
+		request.CohortIds[1], conceptIds, cohortPairs)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving stats", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"cohort_overlap": overlapStats})
@@ -440,18 +697,45 @@ func (u CohortDataController) RetrievePeopleIdAndCohort(sourceId int, cohortId i
 
 func (u CohortDataController) RetrieveDataDictionary(c *gin.Context) {
 
-	var dataDictionary, error = u.dataDictionaryModel.GetDataDictionary()
+	var dataDictionary, err = u.dataDictionaryModel.GetDataDictionary()
 
 	if dataDictionary == nil {
-		c.JSON(http.StatusServiceUnavailable, error)
+		if err == nil {
+			err = utils.NewUpstreamUnavailableError(errors.New("data dictionary is not available yet"))
+		}
+		middlewares.AbortWithError(c, "Error retrieving data dictionary", err)
 	} else {
 		c.JSON(http.StatusOK, dataDictionary)
 	}
 
 }
 
+// Returns the data dictionary computed only over the persons in the given cohort.
+func (u CohortDataController) RetrieveCohortDataDictionary(c *gin.Context) {
+	sourceId, cohortId, err := utils.ParseSourceAndCohortId(c)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+		return
+	}
+	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortId)
+	if !validAccessRequest {
+		log.Printf("Error: invalid request")
+		middlewares.AbortWithError(c, "access denied", middlewares.ErrAccessDenied)
+		return
+	}
+
+	dataDictionary, err := u.dataDictionaryModel.GetCohortDataDictionary(sourceId, cohortId)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "Error retrieving cohort data dictionary", err)
+		return
+	}
+	c.JSON(http.StatusOK, dataDictionary)
+}
+
 func (u CohortDataController) GenerateDataDictionary(c *gin.Context) {
 	log.Printf("Generating Data Dictionary...")
-	go u.dataDictionaryModel.GenerateDataDictionary()
+	utils.RunInBackground("data dictionary generation", u.dataDictionaryModel.GenerateDataDictionary)
 	c.JSON(http.StatusOK, "Data Dictionary Kicked Off")
 }
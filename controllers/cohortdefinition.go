@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"sort"
@@ -34,21 +35,18 @@ func (u CohortDefinitionController) RetriveById(c *gin.Context) {
 		validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortDefinitionId)
 		if !validAccessRequest {
 			log.Printf("Error: invalid request")
-			c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-			c.Abort()
+			middlewares.AbortWithError(c, "access denied", middlewares.ErrAccessDenied)
 			return
 		}
 		cohortDefinition, err := u.cohortDefinitionModel.GetCohortDefinitionById(cohortDefinitionId)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinition", "error": err.Error()})
-			c.Abort()
+			middlewares.AbortWithError(c, "Error retrieving cohortDefinition", err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"cohort_definition": cohortDefinition})
 		return
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-	c.Abort()
+	middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("id is a mandatory parameter")))
 }
 
 func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.Context) {
@@ -57,24 +55,21 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.
 	sourceId, err1 := utils.ParseNumericArg(c, "sourceid")
 	teamProject := c.Query("team-project")
 	if teamProject == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error while parsing request", "error": "team-project is a mandatory parameter but was found to be empty!"})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error while parsing request", utils.NewInvalidInputError(errors.New("team-project is a mandatory parameter but was found to be empty!")))
 		return
 	}
 	// validate teamproject access permission:
 	validAccessRequest := u.teamProjectAuthz.HasAccessToTeamProject(c, teamProject)
 	if !validAccessRequest {
 		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+		middlewares.AbortWithError(c, "access denied", middlewares.ErrAccessDenied)
 		return
 	}
 
 	if err1 == nil {
 		cohortDefinitionsAndStats, err := u.cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId, teamProject)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinitions for 'team project' role", "error": err.Error()})
-			c.Abort()
+			middlewares.AbortWithError(c, "Error retrieving cohortDefinitions for 'team project' role", err)
 			return
 		}
 		// all users should be allowed to see the cohorts shared with the default global role,
@@ -84,8 +79,7 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.
 		log.Printf("INFO: found %s as global_reader_role", globalReaderRole)
 		globalCohortDefinitionsAndStats, err := u.cohortDefinitionModel.GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceId, globalReaderRole)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinition for 'global reader' role", "error": err.Error()})
-			c.Abort()
+			middlewares.AbortWithError(c, "Error retrieving cohortDefinition for 'global reader' role", err)
 			return
 		}
 		// remove overlaps (if any):
@@ -98,8 +92,7 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndTeamProject(c *gin.
 		return
 
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"message": err1.Error()})
-	c.Abort()
+	middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err1))
 }
 
 func MakeUniqueListOfCohortStats(input []*models.CohortDefinitionStats) []*models.CohortDefinitionStats {
@@ -118,37 +111,21 @@ func MakeUniqueListOfCohortStats(input []*models.CohortDefinitionStats) []*model
 func (u CohortDefinitionController) RetriveStatsBySourceIdAndCohortIdAndObservationWindow(c *gin.Context) {
 	// This method returns the cohortdefinition details and filtered size for a
 	// given cohort_definition Id and observation window (aka "look back window").
-
-	sourceId, cohortId, err := utils.ParseSourceAndCohortId(c)
-	if err != nil {
-		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
-		return
-	}
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortId)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
-		return
-	}
-
-	observationWindow, err := utils.ParseNumericArg(c, "observationwindow")
-	if err != nil {
-		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
-		return
-	}
-
-	cohortDefinitionAndStats, err := u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow(sourceId, cohortId, observationWindow)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohortDefinition stats/details", "error": err.Error()})
-		c.Abort()
+	errors := make([]error, 3)
+	var sourceId, cohortId, observationWindow int
+	sourceId, errors[0] = utils.ParseNumericArg(c, "sourceid")
+	cohortId, errors[1] = utils.ParseNumericArg(c, "cohortid")
+	observationWindow, errors[2] = utils.ParseNumericArg(c, "observationwindow")
+	if utils.ContainsNonNil(errors) {
+		log.Printf("Error: %s", utils.GetFirstNonNil(errors).Error())
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(utils.GetFirstNonNil(errors)))
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"cohort_definition_and_stats": cohortDefinitionAndStats})
+	u.RetrieveStatsForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohortId},
+		Windows:   &utils.AnalysisWindows{ObservationWindow: &observationWindow},
+	})
 }
 
 // Retrieve stats for  number of persons in cohort1 that have the given observation window and also
@@ -170,33 +147,16 @@ func (u CohortDefinitionController) retriveStatsBySourceIdAndCohortIdAndObservat
 	cohort1Id, errors[1] = utils.ParseNumericArg(c, "cohort1")
 	cohort2Id, errors[2] = utils.ParseNumericArg(c, "cohort2")
 	observationWindow1stCohort, errors[3] = utils.ParseNumericArg(c, "observationwindow1stcohort")
-
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohortIdsList(c, []int{cohort1Id, cohort2Id})
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
-		return
-	}
-
 	if utils.ContainsNonNil(errors) {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
-		return
-	}
-	var cohortDefinitionAndStats *models.CohortDefinitionStats
-	var err error
-	if filterOn2ndCohortEntryFirst {
-		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohortAnd2ndCohortEntryFirst(sourceId, cohort1Id, cohort2Id, observationWindow1stCohort)
-	} else {
-		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohort(sourceId, cohort1Id, cohort2Id, observationWindow1stCohort)
-	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(utils.GetFirstNonNil(errors)))
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"cohort_definition_and_stats": cohortDefinitionAndStats})
+	u.RetrieveStatsForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohort1Id, cohort2Id},
+		Windows:   &utils.AnalysisWindows{ObservationWindow: &observationWindow1stCohort},
+		Options:   &utils.AnalysisOptions{SecondCohortEntryFirst: filterOn2ndCohortEntryFirst},
+	})
 }
 
 // Retrieve stats for  number of persons in cohort1 that have the given observation window and also
@@ -209,25 +169,73 @@ func (u CohortDefinitionController) RetriveStatsBySourceIdAndCohortIdAndObservat
 	cohort2Id, errors[2] = utils.ParseNumericArg(c, "cohort2")
 	observationWindow1stCohort, errors[3] = utils.ParseNumericArg(c, "observationwindow1stcohort")
 	outcomeWindow2ndCohort, errors[4] = utils.ParseNumericArg(c, "outcomeWindow2ndCohort")
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohortIdsList(c, []int{cohort1Id, cohort2Id})
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+	if utils.ContainsNonNil(errors) {
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(utils.GetFirstNonNil(errors)))
 		return
 	}
+	u.RetrieveStatsForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohort1Id, cohort2Id},
+		Windows:   &utils.AnalysisWindows{ObservationWindow: &observationWindow1stCohort, OutcomeWindow: &outcomeWindow2ndCohort},
+	})
+}
 
-	if utils.ContainsNonNil(errors) {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-		c.Abort()
+// Retrieve the cohort definition details and the number of persons in the first cohort that have the
+// given observation window. If a second cohort is given, only the persons that are also present in the
+// second cohort are counted, optionally restricted to the ones that entered the second cohort first
+// (options.second_cohort_entry_first) or that entered it within the outcome window (windows.outcome_window).
+// With a single cohort, the count can instead be restricted by temporal variables (see utils.CustomTemporalVariableDef).
+func (u CohortDefinitionController) RetrieveStatsForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, 2, "windows.observation_window") {
+		return
+	}
+	if !checkUnsupportedFields(c, request, "windows.follow_up_window") {
+		return
+	}
+	if !checkVariableTypes(c, request, utils.TEMPORAL_VARIABLE_TYPE) {
+		return
+	}
+	if len(request.CohortIds) > 1 && len(request.Variables) > 0 {
+		middlewares.AbortWithError(c, "bad request", &utils.ValidationError{FieldErrors: []utils.FieldError{
+			{Field: "variables", Message: "is only allowed with a single cohort id"}}})
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
+		return
+	}
+	sourceId := request.SourceId
+	observationWindow := *request.Windows.ObservationWindow
+	outcomeWindow := request.Windows.OutcomeWindow
+	secondCohortEntryFirst := request.GetOptions().SecondCohortEntryFirst
+	if len(request.CohortIds) == 1 && (outcomeWindow != nil || secondCohortEntryFirst) {
+		middlewares.AbortWithError(c, "bad request", &utils.ValidationError{FieldErrors: []utils.FieldError{
+			{Field: "cohort_ids", Message: "should have a second cohort id when windows.outcome_window or options.second_cohort_entry_first is set"}}})
+		return
+	}
+	if outcomeWindow != nil && secondCohortEntryFirst {
+		middlewares.AbortWithError(c, "bad request", &utils.ValidationError{FieldErrors: []utils.FieldError{
+			{Field: "options.second_cohort_entry_first", Message: "is not allowed together with windows.outcome_window"}}})
 		return
 	}
-	cohortDefinitionAndStats, err := u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohortAndOutcomeWindow2ndCohort(
-		sourceId, cohort1Id, cohort2Id, observationWindow1stCohort, outcomeWindow2ndCohort)
 
+	var cohortDefinitionAndStats *models.CohortDefinitionStats
+	var err error
+	switch {
+	case len(request.CohortIds) == 1 && len(request.Variables) > 0:
+		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(sourceId, request.GetCohortId(),
+			observationWindow, utils.GetTemporalVariables(request.GetConceptIdsAndCohortPairs()))
+	case len(request.CohortIds) == 1:
+		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow(sourceId, request.GetCohortId(), observationWindow)
+	case outcomeWindow != nil:
+		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohortAndOutcomeWindow2ndCohort(
+			sourceId, request.CohortIds[0], request.CohortIds[1], observationWindow, *outcomeWindow)
+	case secondCohortEntryFirst:
+		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohortAnd2ndCohortEntryFirst(sourceId, request.CohortIds[0], request.CohortIds[1], observationWindow)
+	default:
+		cohortDefinitionAndStats, err = u.cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohort(sourceId, request.CohortIds[0], request.CohortIds[1], observationWindow)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving stats", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"cohort_definition_and_stats": cohortDefinitionAndStats})
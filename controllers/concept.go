@@ -2,14 +2,18 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/utils"
@@ -37,16 +41,14 @@ func (u ConceptController) RetriveAllBySourceId(c *gin.Context) {
 		concepts, err := u.conceptModel.RetriveAllBySourceId(sourceId)
 		if err != nil {
 			log.Printf("Error: %s", err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
-			c.Abort()
+			middlewares.AbortWithError(c, "Error retrieving concept details", err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"concepts": concepts})
 		return
 	}
 	log.Printf("Error: bad request")
-	c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-	c.Abort()
+	middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("sourceid is a mandatory parameter")))
 }
 
 func (u ConceptController) RetrieveInfoBySourceIdAndConceptIds(c *gin.Context) {
@@ -54,8 +56,7 @@ func (u ConceptController) RetrieveInfoBySourceIdAndConceptIds(c *gin.Context) {
 	sourceId, conceptIds, err := utils.ParseSourceIdAndConceptIds(c)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
 
@@ -63,8 +64,7 @@ func (u ConceptController) RetrieveInfoBySourceIdAndConceptIds(c *gin.Context) {
 	conceptInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptIds(sourceId, conceptIds)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving concept details", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"concepts": conceptInfo})
@@ -75,8 +75,7 @@ func (u ConceptController) RetrieveInfoBySourceIdAndConceptTypes(c *gin.Context)
 	sourceId, conceptTypes, err := utils.ParseSourceIdAndConceptTypes(c)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
 
@@ -84,77 +83,275 @@ func (u ConceptController) RetrieveInfoBySourceIdAndConceptTypes(c *gin.Context)
 	conceptInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptTypes(sourceId, conceptTypes)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept details", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving concept details", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"concepts": conceptInfo})
 }
 
+// Flushes the concept info cache, for all sources or only for the source given in the URL.
+func (u ConceptController) FlushConceptInfoCache(c *gin.Context) {
+	numberOfEntries := 0
+	if c.Param("sourceid") != "" {
+		sourceId, err := utils.ParseNumericArg(c, "sourceid")
+		if err != nil {
+			log.Printf("Error: %s", err.Error())
+			middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
+			return
+		}
+		numberOfEntries = u.conceptModel.FlushInfoCacheBySourceId(sourceId)
+	} else {
+		numberOfEntries = u.conceptModel.FlushInfoCache()
+	}
+	log.Printf("Flushed %d entries from the concept info cache", numberOfEntries)
+	c.JSON(http.StatusOK, gin.H{"message": "concept cache flushed", "flushed_entries": numberOfEntries})
+}
+
 func (u ConceptController) RetrieveBreakdownStatsBySourceIdAndCohortId(c *gin.Context) {
 	sourceId, cohortId, err := utils.ParseSourceAndCohortId(c)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidationForCohort(c, cohortId)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+	breakdownConceptId, err := utils.ParseBigNumericArg(c, "breakdownconceptid")
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
+	u.RetrieveBreakdownStatsForAnalysisRequest(c, &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohortId},
+		Options:   &utils.AnalysisOptions{BreakdownConceptId: &breakdownConceptId},
+	})
+}
 
-	breakdownConceptId, err := utils.ParseBigNumericArg(c, "breakdownconceptid")
+func (u ConceptController) RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables(c *gin.Context) {
+	request, err := parseAnalysisRequestWithBreakdownConceptId(c)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId, cohortId, breakdownConceptId)
+	u.RetrieveBreakdownStatsForAnalysisRequest(c, request)
+}
+
+// Builds the AnalysisRequest for the v1 endpoints that have the :sourceid, :cohortid and :breakdownconceptid
+// path parameters and the variables in the request body.
+func parseAnalysisRequestWithBreakdownConceptId(c *gin.Context) (*utils.AnalysisRequest, error) {
+	sourceId, cohortId, err := utils.ParseSourceAndCohortId(c)
+	if err != nil {
+		return nil, err
+	}
+	variablesRequest, err := utils.ParseVariablesRequest(c)
+	if err != nil {
+		return nil, err
+	}
+	breakdownConceptId, err := utils.ParseBigNumericArg(c, "breakdownconceptid")
+	if err != nil {
+		return nil, err
+	}
+	return &utils.AnalysisRequest{
+		SourceId:  sourceId,
+		CohortIds: []int{cohortId},
+		Windows:   variablesRequest.Windows,
+		Variables: variablesRequest.Variables,
+		Options:   &utils.AnalysisOptions{BreakdownConceptId: &breakdownConceptId},
+	}, nil
+}
+
+// Returns the number of persons in the cohort for each value of the breakdown concept. If the request has
+// variables (even an empty list), only the persons that match the variables are counted.
+func (u ConceptController) RetrieveBreakdownStatsForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, 1, "options.breakdown_concept_id") {
+		return
+	}
+	if !checkUnsupportedFields(c, request, "windows.outcome_window") {
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
+		return
+	}
+	breakdownConceptId := *request.Options.BreakdownConceptId
+	var breakdownStats []*models.ConceptBreakdown
+	var err error
+	if request.Variables == nil {
+		breakdownStats, err = u.retrieveBreakdownStatsForBaseCohort(request.SourceId, request.GetCohortId(), request.GetObservationPeriodFilter(), breakdownConceptId)
+	} else {
+		conceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+		conceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)
+		temporalVariables := utils.GetTemporalVariables(request.GetConceptIdsAndCohortPairs())
+		breakdownStats, err = u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(request.SourceId, request.GetCohortId(), conceptIds, cohortPairs, temporalVariables, request.GetObservationPeriodFilter(), breakdownConceptId)
+	}
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving stats", err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"concept_breakdown": breakdownStats})
+	conceptIdsAndValues, _ := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	aggregationReports, err := u.conceptModel.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(request.SourceId, request.GetCohortId(),
+		append([]int64{breakdownConceptId}, utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)...))
+	if err != nil {
+		middlewares.AbortWithError(c, "Error retrieving aggregation reports", err)
+		return
+	}
+	c.JSON(http.StatusOK, addAggregationReports(gin.H{"concept_breakdown": breakdownStats}, aggregationReports))
 }
 
-func (u ConceptController) RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables(c *gin.Context) {
-	sourceId, cohortId, conceptIds, cohortPairs, err := utils.ParseSourceIdAndCohortIdAndVariablesList(c)
+// Returns the breakdown stats for the whole cohort, or only for the persons in the cohort that have the
+// observation period given by observationPeriodFilter, if not nil.
+func (u ConceptController) retrieveBreakdownStatsForBaseCohort(sourceId int, cohortId int, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
+	if observationPeriodFilter == nil {
+		return u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId, cohortId, breakdownConceptId)
+	}
+	return u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, []int64{},
+		[]utils.CustomDichotomousVariableDef{}, []utils.CustomTemporalVariableDef{}, observationPeriodFilter, breakdownConceptId)
+}
+
+// Returns a contingency table for the given cohort, broken down by the values of the breakdown concept (rows)
+// and by either the values of a second concept or the two cohorts of a dichotomous cohort pair (columns).
+// Only the persons that match the variables in the request body are counted, like in RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables.
+func (u ConceptController) RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(c *gin.Context) {
+	request, err := parseAnalysisRequestWithBreakdownConceptId(c)
+	if err == nil {
+		if c.Param("crosstabconceptid") != "" {
+			var crossTabConceptId int64
+			crossTabConceptId, err = utils.ParseBigNumericArg(c, "crosstabconceptid")
+			request.Options.CrossTabConceptId = &crossTabConceptId
+		} else {
+			request.Options.CrossTabCohortIds = make([]int, 2)
+			request.Options.CrossTabCohortIds[0], err = utils.ParseNumericArg(c, "cohort1")
+			if err == nil {
+				request.Options.CrossTabCohortIds[1], err = utils.ParseNumericArg(c, "cohort2")
+			}
+		}
+	}
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidation(c, []int{cohortId}, cohortPairs)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+	u.RetrieveCrossTabStatsForAnalysisRequest(c, request)
+}
+
+// Same as RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables, with the columns set by either
+// options.cross_tab_concept_id or options.cross_tab_cohort_ids.
+func (u ConceptController) RetrieveCrossTabStatsForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, 1, "options.breakdown_concept_id", "options.cross_tab") {
+		return
+	}
+	if !checkUnsupportedFields(c, request, "windows.observation_window", "windows.outcome_window", "windows.follow_up_window") {
+		return
+	}
+	if !checkVariableTypes(c, request, utils.CONCEPT_VARIABLE_TYPE, utils.CUSTOM_DICHOTOMOUS_VARIABLE_TYPE) {
+		return
+	}
+	sourceId := request.SourceId
+	cohortId := request.GetCohortId()
+	breakdownConceptId := *request.Options.BreakdownConceptId
+	conceptIdsAndValues, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(request.GetConceptIdsAndCohortPairs())
+	conceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(conceptIdsAndValues)
+	var crossTabCohortPair *utils.CustomDichotomousVariableDef
+	otherCohortPairs := []utils.CustomDichotomousVariableDef{}
+	if request.Options.CrossTabCohortIds != nil {
+		crossTabCohortPair = &utils.CustomDichotomousVariableDef{
+			CohortDefinitionId1: request.Options.CrossTabCohortIds[0],
+			CohortDefinitionId2: request.Options.CrossTabCohortIds[1],
+		}
+		otherCohortPairs = append(otherCohortPairs, *crossTabCohortPair)
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request, otherCohortPairs...) {
 		return
 	}
 
-	breakdownConceptId, err := utils.ParseBigNumericArg(c, "breakdownconceptid")
+	var err error
+	var crossTabCells []*models.ConceptCrossTabCell
+	if crossTabCohortPair != nil {
+		crossTabCells, err = u.conceptModel.RetrieveCrossTabStatsByCohortPairBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, conceptIds, cohortPairs, breakdownConceptId, *crossTabCohortPair)
+	} else {
+		crossTabCells, err = u.conceptModel.RetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, conceptIds, cohortPairs, breakdownConceptId, *request.Options.CrossTabConceptId)
+	}
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving stats", err)
 		return
 	}
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, conceptIds, cohortPairs, breakdownConceptId)
+
+	rowValues := []int64{}
+	columnValues := []int64{}
+	for _, crossTabCell := range crossTabCells {
+		if utils.Pos(crossTabCell.RowValueAsConceptId, rowValues) == -1 {
+			rowValues = append(rowValues, crossTabCell.RowValueAsConceptId)
+		}
+		if crossTabCohortPair == nil && utils.Pos(crossTabCell.ColumnValue, columnValues) == -1 {
+			columnValues = append(columnValues, crossTabCell.ColumnValue)
+		}
+	}
+	rows, err := u.getConceptValueHeaders(sourceId, rowValues)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "Error retrieving concept details", err)
+		return
+	}
+	var columns []utils.ContingencyTableHeader
+	if crossTabCohortPair != nil {
+		columns, err = u.getCohortHeaders([]int{crossTabCohortPair.CohortDefinitionId1, crossTabCohortPair.CohortDefinitionId2})
+	} else {
+		columns, err = u.getConceptValueHeaders(sourceId, columnValues)
+	}
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving stats", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving column details", err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"concept_breakdown": breakdownStats})
+
+	counts := make([][]int, len(rows))
+	for i, row := range rows {
+		counts[i] = make([]int, len(columns))
+		for j, column := range columns {
+			for _, crossTabCell := range crossTabCells {
+				if crossTabCell.RowValueAsConceptId == row.Value && crossTabCell.ColumnValue == column.Value {
+					counts[i][j] = crossTabCell.NpersonsInCohortWithValues
+				}
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"cross_tab": utils.GenerateContingencyTable(rows, columns, counts)})
+}
+
+// Returns a contingency table header for each of the given concept values, sorted by concept id.
+func (u ConceptController) getConceptValueHeaders(sourceId int, conceptValues []int64) ([]utils.ContingencyTableHeader, error) {
+	headers := []utils.ContingencyTableHeader{}
+	if len(conceptValues) == 0 {
+		return headers, nil
+	}
+	conceptsInfo, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptIds(sourceId, conceptValues)
+	if err != nil {
+		return nil, err
+	}
+	conceptIdToConceptName := make(map[int64]string)
+	for _, conceptInfo := range conceptsInfo {
+		conceptIdToConceptName[conceptInfo.ConceptId] = conceptInfo.ConceptName
+	}
+	sort.Slice(conceptValues, func(i, j int) bool { return conceptValues[i] < conceptValues[j] })
+	for _, conceptValue := range conceptValues {
+		headers = append(headers, utils.ContingencyTableHeader{Value: conceptValue, Name: conceptIdToConceptName[conceptValue]})
+	}
+	return headers, nil
+}
+
+// Returns a contingency table header for each of the given cohorts, in the given order.
+func (u ConceptController) getCohortHeaders(cohortIds []int) ([]utils.ContingencyTableHeader, error) {
+	headers := []utils.ContingencyTableHeader{}
+	for _, cohortId := range cohortIds {
+		cohortName, err := u.cohortDefinitionModel.GetCohortName(cohortId)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, utils.ContingencyTableHeader{Value: int64(cohortId), Name: cohortName})
+	}
+	return headers, nil
 }
 
 func getConceptValueToPeopleCount(breakdownStats []*models.ConceptBreakdown) map[string]int {
@@ -170,10 +367,10 @@ func getConceptValueToPeopleCount(breakdownStats []*models.ConceptBreakdown) map
 	return conceptValuesToPeopleCount
 }
 
-func generateRowForVariable(variableName string, breakdownConceptValuesToPeopleCount map[string]int, sortedBreakdownConceptValues []string) []string {
+func generateRowForVariable(variableName string, breakdownConceptValuesToPeopleCount map[string]int, sortedBreakdownConceptValues []string) ([]string, error) {
 	// validate:
 	if variableName == "" {
-		panic("unexpected error: variableName should be set!")
+		return nil, utils.NewInternalError(errors.New("unexpected error: variableName should be set"))
 	}
 	cohortSize := 0
 	for _, peopleCount := range breakdownConceptValuesToPeopleCount {
@@ -186,46 +383,63 @@ func generateRowForVariable(variableName string, breakdownConceptValuesToPeopleC
 		row = append(row, strconv.Itoa(breakdownConceptValuesToPeopleCount[concept]))
 	}
 
-	return row
+	return row, nil
 }
 
 func (u ConceptController) RetrieveAttritionTable(c *gin.Context) {
-	sourceId, cohortId, conceptIdsAndCohortPairs, err := utils.ParseSourceIdAndCohortIdAndVariablesAsSingleList(c)
+	u.retrieveAttritionTableInFormat(c, utils.CSV_FORMAT)
+}
+
+func (u ConceptController) retrieveAttritionTableInFormat(c *gin.Context, format string) {
+	request, err := parseAnalysisRequestWithBreakdownConceptId(c)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(err))
 		return
 	}
-	_, cohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(conceptIdsAndCohortPairs)
-	validAccessRequest := u.teamProjectAuthz.TeamProjectValidation(c, []int{cohortId}, cohortPairs)
-	if !validAccessRequest {
-		log.Printf("Error: invalid request")
-		c.JSON(http.StatusForbidden, gin.H{"message": "access denied"})
-		c.Abort()
+	request.Options.Format = format
+	u.RetrieveAttritionTableForAnalysisRequest(c, request)
+}
+
+// Returns the attrition table for the cohort, with one step for each of the variables, as CSV or
+// as JSON (see RetrieveAttritionTableAsJson), depending on options.format (CSV by default).
+func (u ConceptController) RetrieveAttritionTableForAnalysisRequest(c *gin.Context, request *utils.AnalysisRequest) {
+	if !checkRequiredFields(c, request, 1, 1, "options.breakdown_concept_id") {
 		return
 	}
-
-	breakdownConceptId, err := utils.ParseBigNumericArg(c, "breakdownconceptid")
-	if err != nil {
-		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{"message": "bad request", "error": err.Error()})
-		c.Abort()
+	if !checkUnsupportedFields(c, request, "windows.outcome_window") {
+		return
+	}
+	if !checkAnalysisAccess(c, u.teamProjectAuthz, request) {
 		return
 	}
+	sourceId := request.SourceId
+	cohortId := request.GetCohortId()
+	breakdownConceptId := *request.Options.BreakdownConceptId
+	conceptIdsAndCohortPairs := request.GetConceptIdsAndCohortPairs()
+	observationPeriodFilter := request.GetObservationPeriodFilter()
 	cohortName, err := u.cohortDefinitionModel.GetCohortName(cohortId)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving cohort name", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving cohort name", err)
 		return
 	}
 
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId, cohortId, breakdownConceptId)
+	breakdownStats, err := u.retrieveBreakdownStatsForBaseCohort(sourceId, cohortId, observationPeriodFilter, breakdownConceptId)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept breakdown for given cohortId", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving concept breakdown for given cohortId", err)
+		return
+	}
+
+	if request.Options.Format == utils.JSON_FORMAT {
+		attritionTable, err := u.GenerateAttritionTable(c.Request.Context(), sourceId, cohortId, cohortName, conceptIdsAndCohortPairs, observationPeriodFilter, breakdownConceptId, breakdownStats)
+		if err != nil {
+			log.Printf("Error: %s", err.Error())
+			middlewares.AbortWithError(c, "Error retrieving concept breakdown rows for filter conceptIds and cohortPairs", err)
+			return
+		}
+		c.JSON(http.StatusOK, attritionTable)
 		return
 	}
 
@@ -234,59 +448,323 @@ func (u ConceptController) RetrieveAttritionTable(c *gin.Context) {
 	headerAndNonFilteredRow, err := u.GenerateHeaderAndNonFilteredRow(breakdownStats, sortedConceptValues, cohortName)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error generating concept breakdown header and cohort rows", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error generating concept breakdown header and cohort rows", err)
 		return
 	}
-	otherAttritionRows, err := u.GetAttritionRowForConceptIdsAndCohortPairs(sourceId, cohortId, conceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
+	otherAttritionRows, err := u.GetAttritionRowForConceptIdsAndCohortPairs(c.Request.Context(), sourceId, cohortId, conceptIdsAndCohortPairs, observationPeriodFilter, breakdownConceptId, sortedConceptValues)
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error retrieving concept breakdown rows for filter conceptIds and cohortPairs", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error retrieving concept breakdown rows for filter conceptIds and cohortPairs", err)
+		return
+	}
+	b, err := GenerateAttritionCSV(headerAndNonFilteredRow, otherAttritionRows)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		middlewares.AbortWithError(c, "Error generating attrition CSV", err)
 		return
 	}
-	b := GenerateAttritionCSV(headerAndNonFilteredRow, otherAttritionRows)
 	c.String(http.StatusOK, b.String())
 }
 
-func (u ConceptController) GetAttritionRowForConceptIdsAndCohortPairs(sourceId int, cohortId int, conceptIdsAndCohortPairs []interface{}, breakdownConceptId int64, sortedConceptValues []string) ([][]string, error) {
-	var otherAttritionRows [][]string
-	for idx, conceptIdOrCohortPair := range conceptIdsAndCohortPairs {
+func (u ConceptController) GetAttritionRowForConceptIdsAndCohortPairs(ctx context.Context, sourceId int, cohortId int, conceptIdsAndCohortPairs []interface{}, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64, sortedConceptValues []string) ([][]string, error) {
+	otherAttritionRows := make([][]string, len(conceptIdsAndCohortPairs))
+	err := runAttritionSteps(ctx, sourceId, len(conceptIdsAndCohortPairs), func(ctx context.Context, idx int) error {
 		// attrition filter: run each query with an increasingly longer list of filterConceptIdsAndCohortPairs, until the last query is run with them all:
 		filterConceptIdsAndCohortPairs := conceptIdsAndCohortPairs[0 : idx+1]
-
-		attritionRow, err := u.GetAttritionRowForConceptIdOrCohortPair(sourceId, cohortId, conceptIdOrCohortPair, filterConceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
+		variableName, breakdownStats, err := u.getAttritionStepNameAndBreakdownStats(ctx, sourceId, cohortId, conceptIdsAndCohortPairs[idx], filterConceptIdsAndCohortPairs, observationPeriodFilter, breakdownConceptId)
 		if err != nil {
-			log.Printf("Error: %s", err.Error())
-			return nil, err
+			return err
 		}
-		otherAttritionRows = append(otherAttritionRows, attritionRow)
+		log.Printf("Generating row for variable with name %s", variableName)
+		otherAttritionRows[idx], err = generateRowForVariable(variableName, getConceptValueToPeopleCount(breakdownStats), sortedConceptValues)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		return nil, err
 	}
 	return otherAttritionRows, nil
 }
 
-func (u ConceptController) GetAttritionRowForConceptIdOrCohortPair(sourceId int, cohortId int, conceptIdOrCohortPair interface{}, filterConceptIdsAndCohortPairs []interface{}, breakdownConceptId int64, sortedConceptValues []string) ([]string, error) {
+// Default limits on the number of attrition steps that are queried at the same time, for a
+// single request and for all requests on the same data source. Can be overridden in the config
+// with attrition_max_parallel_steps and attrition_max_parallel_steps_per_source.
+const DEFAULT_MAX_PARALLEL_ATTRITION_STEPS = 4
+const DEFAULT_MAX_PARALLEL_ATTRITION_STEPS_PER_SOURCE = 8
+
+var attritionSourceSlots = make(map[int]chan bool)
+var attritionSourceSlotsMutex sync.Mutex
+
+// Runs runStep for each of the attrition steps 0 to numberOfSteps-1 in parallel, respecting the
+// per request and per data source limits. Each step is expected to store its own result, so that the
+// order of the steps is preserved. When a step fails, the context given to the other steps is cancelled
+// (stopping their queries), the steps that did not start yet are skipped, and the error is returned.
+// The same happens when the given context is done (e.g. when the client disconnects).
+func runAttritionSteps(parentCtx context.Context, sourceId int, numberOfSteps int, runStep func(ctx context.Context, idx int) error) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+	requestSlots := make(chan bool, getMaxParallelAttritionSteps("attrition_max_parallel_steps", DEFAULT_MAX_PARALLEL_ATTRITION_STEPS))
+	sourceSlots := getAttritionSourceSlots(sourceId)
+	var firstError error
+	var firstErrorOnce sync.Once
+	wg := sync.WaitGroup{}
+	for idx := 0; idx < numberOfSteps; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			select {
+			case requestSlots <- true:
+				defer func() { <-requestSlots }()
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case sourceSlots <- true:
+				defer func() { <-sourceSlots }()
+			case <-ctx.Done():
+				return
+			}
+			// another step could have failed while waiting for the slots:
+			if ctx.Err() != nil {
+				return
+			}
+			err := runStepAndRecover(ctx, idx, runStep)
+			if err != nil {
+				firstErrorOnce.Do(func() {
+					firstError = err
+					cancel()
+				})
+			}
+		}(idx)
+	}
+	wg.Wait()
+	if firstError == nil && parentCtx.Err() != nil {
+		return parentCtx.Err()
+	}
+	return firstError
+}
+
+// Runs the given step, turning a panic into an error, since a panic in a goroutine other than the
+// one of the request itself would not be handled by the gin Recovery middleware.
+func runStepAndRecover(ctx context.Context, idx int, runStep func(ctx context.Context, idx int) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("attrition step %d failed: %v", idx, r)
+		}
+	}()
+	return runStep(ctx, idx)
+}
+
+// Returns the slots channel that limits the number of attrition steps running at the same time
+// on the given data source, over all requests.
+func getAttritionSourceSlots(sourceId int) chan bool {
+	attritionSourceSlotsMutex.Lock()
+	defer attritionSourceSlotsMutex.Unlock()
+	sourceSlots, exists := attritionSourceSlots[sourceId]
+	if !exists {
+		sourceSlots = make(chan bool, getMaxParallelAttritionSteps("attrition_max_parallel_steps_per_source", DEFAULT_MAX_PARALLEL_ATTRITION_STEPS_PER_SOURCE))
+		attritionSourceSlots[sourceId] = sourceSlots
+	}
+	return sourceSlots
+}
+
+func getMaxParallelAttritionSteps(configKey string, defaultValue int) int {
+	conf := config.GetConfig()
+	maxParallelSteps := defaultValue
+	if conf != nil && conf.IsSet(configKey) {
+		maxParallelSteps = conf.GetInt(configKey)
+	}
+	if maxParallelSteps < 1 {
+		maxParallelSteps = 1
+	}
+	return maxParallelSteps
+}
+
+func (u ConceptController) GetAttritionRowForConceptIdOrCohortPair(ctx context.Context, sourceId int, cohortId int, conceptIdOrCohortPair interface{}, filterConceptIdsAndCohortPairs []interface{}, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64, sortedConceptValues []string) ([]string, error) {
+	variableName, breakdownStats, err := u.getAttritionStepNameAndBreakdownStats(ctx, sourceId, cohortId, conceptIdOrCohortPair, filterConceptIdsAndCohortPairs, observationPeriodFilter, breakdownConceptId)
+	if err != nil {
+		return nil, err
+	}
+	conceptValuesToPeopleCount := getConceptValueToPeopleCount(breakdownStats)
+	log.Printf("Generating row for variable with name %s", variableName)
+	return generateRowForVariable(variableName, conceptValuesToPeopleCount, sortedConceptValues)
+}
+
+// Returns the display name of the given variable and the breakdown stats for the persons in the cohort that
+// match all the variables in filterConceptIdsAndCohortPairs.
+func (u ConceptController) getAttritionStepNameAndBreakdownStats(ctx context.Context, sourceId int, cohortId int, conceptIdOrCohortPair interface{}, filterConceptIdsAndCohortPairs []interface{}, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) (string, []*models.ConceptBreakdown, error) {
 	filterConceptIdsAndValues, filterCohortPairs := utils.GetConceptIdsAndValuesAndCohortPairsAsSeparateLists(filterConceptIdsAndCohortPairs)
 	filterConceptIds := utils.ExtractConceptIdsFromCustomConceptVariablesDef(filterConceptIdsAndValues)
-	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortId, filterConceptIds, filterCohortPairs, breakdownConceptId)
+	filterTemporalVariables := utils.GetTemporalVariables(filterConceptIdsAndCohortPairs)
+	breakdownStats, err := u.conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsWithContext(ctx, sourceId, cohortId, filterConceptIds, filterCohortPairs, filterTemporalVariables, observationPeriodFilter, breakdownConceptId)
 	if err != nil {
-		return nil, fmt.Errorf("could not retrieve concept Breakdown for concepts %v dichotomous variables %v due to error: %s", filterConceptIds, filterCohortPairs, err.Error())
+		return "", nil, fmt.Errorf("could not retrieve concept Breakdown for concepts %v dichotomous variables %v temporal variables %v due to error: %w", filterConceptIds, filterCohortPairs, filterTemporalVariables, err)
 	}
-	conceptValuesToPeopleCount := getConceptValueToPeopleCount(breakdownStats)
 	variableName := ""
 	switch convertedItem := conceptIdOrCohortPair.(type) {
 	case utils.CustomConceptVariableDef:
 		conceptInformation, err := u.conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, convertedItem.ConceptId)
 		if err != nil {
-			return nil, fmt.Errorf("could not retrieve concept details for %v due to error: %s", convertedItem, err.Error())
+			return "", nil, fmt.Errorf("could not retrieve concept details for %v due to error: %s", convertedItem, err.Error())
 		}
 		variableName = conceptInformation.ConceptName
 	case utils.CustomDichotomousVariableDef:
 		variableName = convertedItem.ProvidedName
+	case utils.CustomTemporalVariableDef:
+		variableName = convertedItem.ProvidedName
 	}
-	log.Printf("Generating row for variable with name %s", variableName)
-	generatedRow := generateRowForVariable(variableName, conceptValuesToPeopleCount, sortedConceptValues)
-	return generatedRow, nil
+	return variableName, breakdownStats, nil
+}
+
+// The variable that is applied as a filter in an attrition step, in the same format as used in the request body.
+type AttritionStepVariable struct {
+	VariableType  string  `json:"variable_type"`
+	ConceptId     int64   `json:"concept_id,omitempty"`
+	ConceptValues []int64 `json:"values,omitempty"`
+	ProvidedName  string  `json:"provided_name,omitempty"`
+	CohortIds     []int   `json:"cohort_ids,omitempty"`
+	CohortId      int     `json:"cohort_id,omitempty"`
+	Anchor        string  `json:"anchor,omitempty"`
+	Relation      string  `json:"relation,omitempty"`
+	MinDays       *int    `json:"min_days,omitempty"`
+	MaxDays       *int    `json:"max_days,omitempty"`
+	Occurrence    string  `json:"occurrence,omitempty"`
+}
+
+type AttritionStepBreakdownValue struct {
+	ConceptValue             string  `json:"concept_value"`
+	ValueName                string  `json:"concept_value_name"`
+	NpersonsRemaining        int     `json:"persons_count"`
+	NpersonsRemoved          int     `json:"removed_persons_count"`
+	PercentagePersonsRemoved float64 `json:"removed_percentage"`
+}
+
+// One step of the attrition table. Step 0 is the cohort itself, and every next step adds the filter
+// of its variable to the filters of the previous steps. The removed counts and percentages are relative
+// to the previous step.
+type AttritionStep struct {
+	Step                     int                           `json:"step"`
+	Name                     string                        `json:"name"`
+	Variable                 *AttritionStepVariable        `json:"variable,omitempty"`
+	NpersonsRemaining        int                           `json:"persons_count"`
+	NpersonsRemoved          int                           `json:"removed_persons_count"`
+	PercentagePersonsRemoved float64                       `json:"removed_percentage"`
+	Breakdown                []AttritionStepBreakdownValue `json:"breakdown"`
+}
+
+type AttritionTable struct {
+	CohortName         string          `json:"cohort_name"`
+	BreakdownConceptId int64           `json:"breakdown_concept_id"`
+	Steps              []AttritionStep `json:"steps"`
+}
+
+// Same as RetrieveAttritionTable, but returns the attrition table as JSON, with the variable
+// definition and the number of persons removed at each step.
+func (u ConceptController) RetrieveAttritionTableAsJson(c *gin.Context) {
+	u.retrieveAttritionTableInFormat(c, utils.JSON_FORMAT)
+}
+
+// Generates the attrition table, starting with the cohort itself (using the given breakdownStats for the
+// whole cohort) and then adding one step for each item in conceptIdsAndCohortPairs.
+func (u ConceptController) GenerateAttritionTable(ctx context.Context, sourceId int, cohortId int, cohortName string, conceptIdsAndCohortPairs []interface{}, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64, breakdownStats []*models.ConceptBreakdown) (*AttritionTable, error) {
+	sortedConceptValues := getSortedConceptValues(breakdownStats)
+	conceptValuesToConceptName := getConceptValueToConceptName(breakdownStats)
+	attritionTable := &AttritionTable{
+		CohortName:         cohortName,
+		BreakdownConceptId: breakdownConceptId,
+		Steps:              []AttritionStep{},
+	}
+	stepNames := make([]string, len(conceptIdsAndCohortPairs))
+	stepBreakdownStats := make([][]*models.ConceptBreakdown, len(conceptIdsAndCohortPairs))
+	err := runAttritionSteps(ctx, sourceId, len(conceptIdsAndCohortPairs), func(ctx context.Context, idx int) error {
+		// attrition filter: same as in GetAttritionRowForConceptIdsAndCohortPairs:
+		filterConceptIdsAndCohortPairs := conceptIdsAndCohortPairs[0 : idx+1]
+		var err error
+		stepNames[idx], stepBreakdownStats[idx], err = u.getAttritionStepNameAndBreakdownStats(ctx, sourceId, cohortId, conceptIdsAndCohortPairs[idx], filterConceptIdsAndCohortPairs, observationPeriodFilter, breakdownConceptId)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		return nil, err
+	}
+
+	previousStep := generateAttritionStep(nil, cohortName, breakdownStats, sortedConceptValues, conceptValuesToConceptName)
+	attritionTable.Steps = append(attritionTable.Steps, previousStep)
+	for idx, conceptIdOrCohortPair := range conceptIdsAndCohortPairs {
+		step := generateAttritionStep(&previousStep, stepNames[idx], stepBreakdownStats[idx], sortedConceptValues, conceptValuesToConceptName)
+		step.Step = idx + 1
+		step.Variable = getAttritionStepVariable(conceptIdOrCohortPair)
+		attritionTable.Steps = append(attritionTable.Steps, step)
+		previousStep = step
+	}
+	return attritionTable, nil
+}
+
+// Generates an attrition step with the given name and breakdown stats. The removed counts are calculated
+// with respect to the given previous step, or set to 0 if there is no previous step.
+func generateAttritionStep(previousStep *AttritionStep, name string, breakdownStats []*models.ConceptBreakdown, sortedConceptValues []string, conceptValuesToConceptName map[string]string) AttritionStep {
+	conceptValuesToPeopleCount := getConceptValueToPeopleCount(breakdownStats)
+	step := AttritionStep{Name: name, Breakdown: []AttritionStepBreakdownValue{}}
+	for _, peopleCount := range conceptValuesToPeopleCount {
+		step.NpersonsRemaining += peopleCount
+	}
+	for i, conceptValue := range sortedConceptValues {
+		breakdownValue := AttritionStepBreakdownValue{
+			ConceptValue:      conceptValue,
+			ValueName:         conceptValuesToConceptName[conceptValue],
+			NpersonsRemaining: conceptValuesToPeopleCount[conceptValue],
+		}
+		if previousStep != nil {
+			breakdownValue.NpersonsRemoved, breakdownValue.PercentagePersonsRemoved = getRemovedCountAndPercentage(previousStep.Breakdown[i].NpersonsRemaining, breakdownValue.NpersonsRemaining)
+		}
+		step.Breakdown = append(step.Breakdown, breakdownValue)
+	}
+	if previousStep != nil {
+		step.NpersonsRemoved, step.PercentagePersonsRemoved = getRemovedCountAndPercentage(previousStep.NpersonsRemaining, step.NpersonsRemaining)
+	}
+	return step
+}
+
+func getRemovedCountAndPercentage(previousCount int, count int) (int, float64) {
+	removed := previousCount - count
+	if previousCount == 0 {
+		return removed, 0
+	}
+	return removed, 100 * float64(removed) / float64(previousCount)
+}
+
+func getAttritionStepVariable(conceptIdOrCohortPair interface{}) *AttritionStepVariable {
+	switch convertedItem := conceptIdOrCohortPair.(type) {
+	case utils.CustomConceptVariableDef:
+		return &AttritionStepVariable{
+			VariableType:  "concept",
+			ConceptId:     convertedItem.ConceptId,
+			ConceptValues: convertedItem.ConceptValues,
+		}
+	case utils.CustomDichotomousVariableDef:
+		return &AttritionStepVariable{
+			VariableType: "custom_dichotomous",
+			ProvidedName: convertedItem.ProvidedName,
+			CohortIds:    []int{convertedItem.CohortDefinitionId1, convertedItem.CohortDefinitionId2},
+		}
+	case utils.CustomTemporalVariableDef:
+		variable := &AttritionStepVariable{
+			VariableType: utils.TEMPORAL_VARIABLE_TYPE,
+			ProvidedName: convertedItem.ProvidedName,
+			CohortId:     convertedItem.CohortDefinitionId,
+			Relation:     convertedItem.Relation,
+			Occurrence:   convertedItem.Occurrence,
+		}
+		// anchor and offsets do not apply to the "during" relation:
+		if convertedItem.Relation != utils.RELATION_DURING {
+			minDays := convertedItem.MinDays
+			variable.Anchor = convertedItem.Anchor
+			variable.MinDays = &minDays
+			variable.MaxDays = convertedItem.MaxDays
+		}
+		return variable
+	}
+	return nil
 }
 
 func getSortedConceptValues(breakdownStats []*models.ConceptBreakdown) []string {
@@ -346,7 +824,7 @@ func (u ConceptController) GenerateHeaderAndNonFilteredRow(breakdownStats []*mod
 	}, nil
 }
 
-func GenerateAttritionCSV(headerAndNonFilteredRow [][]string, filteredRows [][]string) *bytes.Buffer {
+func GenerateAttritionCSV(headerAndNonFilteredRow [][]string, filteredRows [][]string) (*bytes.Buffer, error) {
 	var rows [][]string
 	rows = append(rows, headerAndNonFilteredRow...)
 	rows = append(rows, filteredRows...)
@@ -357,7 +835,7 @@ func GenerateAttritionCSV(headerAndNonFilteredRow [][]string, filteredRows [][]s
 
 	err := w.WriteAll(rows)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to write CSV: %w", err)
 	}
-	return b
+	return b, nil
 }
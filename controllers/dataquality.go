@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/middlewares"
+	"github.com/uc-cdis/cohort-middleware/models"
+)
+
+type DataQualityController struct {
+	dataQualityModel models.DataQualityI
+}
+
+func NewDataQualityController(dataQualityModel models.DataQualityI) DataQualityController {
+	return DataQualityController{
+		dataQualityModel: dataQualityModel,
+	}
+}
+
+// Runs the data quality rules in the config (see models.GetDataQualityConfig) on all data sources and
+// returns the report. The report is also returned when it fails on the severity thresholds, since
+// the request itself succeeded.
+func (u DataQualityController) RetrieveDataQualityReport(c *gin.Context) {
+	report, err := u.dataQualityModel.RunDataQualityRules(models.GetDataQualityConfig())
+	if err != nil {
+		middlewares.AbortWithError(c, "Error running data quality rules", err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/middlewares"
+	"github.com/uc-cdis/cohort-middleware/models"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// The default timeout of each readiness check, in seconds (see readiness_check_timeout_seconds in the config).
+const DEFAULT_READINESS_CHECK_TIMEOUT_SECONDS = 2
+
+// The error returned for a component that failed its readiness check (the details are logged).
+const READINESS_CHECK_FAILED_MESSAGE = "unavailable"
+
+type ReadinessController struct {
+	readinessModel models.ReadinessI
+	httpClient     middlewares.HttpClientI
+}
+
+func NewReadinessController(readinessModel models.ReadinessI, httpClient middlewares.HttpClientI) ReadinessController {
+	return ReadinessController{
+		readinessModel: readinessModel,
+		httpClient:     httpClient,
+	}
+}
+
+// Returns the status of each component the service depends on: the Atlas DB, the schemas of each source,
+// the data dictionary and Arborist. Returns 503 if a critical component failed, so that no requests are
+// routed to the service. Unlike /_health, this queries all components, so it should be called less often.
+// As the endpoint is not authenticated, the errors of the components are only logged, as they can contain
+// details like host, user and database names.
+func (u ReadinessController) Status(c *gin.Context) {
+	timeout := time.Duration(DEFAULT_READINESS_CHECK_TIMEOUT_SECONDS) * time.Second
+	if conf := config.GetConfig(); conf != nil && conf.IsSet("readiness_check_timeout_seconds") {
+		timeout = time.Duration(conf.GetInt("readiness_check_timeout_seconds")) * time.Second
+	}
+	componentStatuses := u.readinessModel.CheckComponents(c.Request.Context(), timeout)
+	componentStatuses = append(componentStatuses, utils.CheckComponent(c.Request.Context(), "arborist", true, timeout, func(ctx context.Context) error {
+		return middlewares.CheckArboristHealth(ctx, u.httpClient)
+	}))
+	for i := range componentStatuses {
+		if componentStatuses[i].Error != "" {
+			log.Printf("WARNING: readiness check of %s failed: %s", componentStatuses[i].Component, componentStatuses[i].Error)
+			componentStatuses[i].Error = READINESS_CHECK_FAILED_MESSAGE
+		}
+	}
+	if !utils.IsReady(componentStatuses) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "components": componentStatuses})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "components": componentStatuses})
+}
@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+type SchemaController struct{}
+
+// Returns the JSON Schema of the "variables" request body used by the concept-stats and
+// cohort-data endpoints, so that clients can validate their requests.
+func (u SchemaController) RetrieveVariablesSchema(c *gin.Context) {
+	c.Header("Content-Type", "application/schema+json")
+	c.JSON(http.StatusOK, utils.GetVariablesRequestJsonSchema())
+}
@@ -1,11 +1,14 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 type SourceController struct{}
@@ -18,15 +21,13 @@ func (u SourceController) RetriveById(c *gin.Context) {
 		sourceId, _ := strconv.Atoi(c.Param("id"))
 		source, err := sourceModel.GetSourceById(sourceId)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error to retrieve source", "error": err.Error()})
-			c.Abort()
+			middlewares.AbortWithError(c, "Error to retrieve source", err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"source": source})
 		return
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-	c.Abort()
+	middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("id is a mandatory parameter")))
 }
 
 func (u SourceController) RetriveByName(c *gin.Context) {
@@ -34,22 +35,19 @@ func (u SourceController) RetriveByName(c *gin.Context) {
 	if sourceName != "" {
 		source, err := sourceModel.GetSourceByName(sourceName)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error to retrieve source", "error": err.Error()})
-			c.Abort()
+			middlewares.AbortWithError(c, "Error to retrieve source", err)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"source": source})
 		return
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"message": "bad request"})
-	c.Abort()
+	middlewares.AbortWithError(c, "bad request", utils.NewInvalidInputError(errors.New("name is a mandatory parameter")))
 }
 
 func (u SourceController) RetriveAll(c *gin.Context) {
 	source, err := sourceModel.GetAllSources()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Error to retrieve source", "error": err.Error()})
-		c.Abort()
+		middlewares.AbortWithError(c, "Error to retrieve source", err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"sources": source})
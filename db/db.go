@@ -30,7 +30,7 @@ func Init() {
 
 	dbSchema := c.GetString("atlas_db.schema")
 	log.Printf("connecting to main 'postgresql' db...")
-	db, _ := gorm.Open(postgres.New(
+	db, err := gorm.Open(postgres.New(
 		postgres.Config{
 			DSN:                  dsn,
 			PreferSimpleProtocol: true,
@@ -39,6 +39,10 @@ func Init() {
 			TablePrefix:   fmt.Sprintf("%s.", dbSchema),
 			SingularTable: true,
 		}})
+	if err != nil {
+		// the service still starts, and reports the Atlas DB as not ready at /_ready:
+		log.Printf("Error: could not connect to main 'postgresql' db: %s", err.Error())
+	}
 	atlasDB = new(utils.DbAndSchema)
 	atlasDB.Db = db
 	atlasDB.Schema = dbSchema
@@ -50,3 +54,15 @@ func GetAtlasDB() *utils.DbAndSchema {
 	}
 	return atlasDB
 }
+
+// Closes the connection pool of the Atlas DB.
+func Close() error {
+	if atlasDB == nil || atlasDB.Db == nil {
+		return nil
+	}
+	sqlDb, err := atlasDB.Db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.Close()
+}
@@ -1,31 +1,117 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/db"
+	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/server"
 	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
-func runDataValidation() {
-	conf := config.GetConfig()
-	observationConceptIdsToCheck, _ := utils.SliceAtoi(conf.GetStringSlice("validate.single_observation_for_concept_ids"))
-	var cohortDataModel = new(models.CohortData)
-	nrIssues, _ := cohortDataModel.ValidateObservationData(observationConceptIdsToCheck)
-	if nrIssues > 0 {
-		log.Printf("WARNING: found %d data issues!", nrIssues)
+// Runs the data quality rules in the config and returns the JSON report, and whether it
+// failed on the severity thresholds (see models.GetDataQualityConfig).
+func runDataValidation() ([]byte, bool, error) {
+	var dataQualityModel = new(models.DataQuality)
+	report, err := dataQualityModel.RunDataQualityRules(models.GetDataQualityConfig())
+	if err != nil {
+		return nil, false, err
 	}
+	reportJson, _ := json.MarshalIndent(report, "", "  ")
+	for _, failureReason := range report.FailureReasons {
+		log.Printf("WARNING: data quality check failed: %s", failureReason)
+	}
+	return reportJson, report.Failed, nil
 }
 
 func main() {
 	environment := flag.String("e", "development", "Environment/prefix of config file name")
+	validateOnly := flag.Bool("validate", false, "Only run the data quality rules, print the JSON report and exit (with status 1 if the report failed)")
 	flag.Parse()
 	config.Init(*environment)
+	validateConfig()
 	db.Init()
-	runDataValidation()
+	validateDataSources()
+	dataQualityConfig := models.GetDataQualityConfig()
+	if *validateOnly {
+		if len(dataQualityConfig.Rules) == 0 {
+			log.Print("WARNING: no data quality rules configured for validation (validate.rules)")
+		}
+		reportJson, failed, err := runDataValidation()
+		if err != nil {
+			log.Fatalf("Error running data quality rules: %s", err.Error())
+		}
+		fmt.Println(string(reportJson))
+		closeConnections()
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	// the service also starts when the data quality rules can not be run (e.g. when the Atlas DB is not
+	// reachable yet, which is reported at /_ready), unless the rules are set to stop it:
+	if len(dataQualityConfig.Rules) > 0 {
+		reportJson, failed, err := runDataValidation()
+		if err != nil && dataQualityConfig.FailStartup {
+			log.Fatalf("Error running data quality rules: %s", err.Error())
+		} else if err != nil {
+			log.Printf("ERROR: could not run the data quality rules: %s", err.Error())
+		} else {
+			log.Printf("Data quality report: %s", reportJson)
+			if failed && dataQualityConfig.FailStartup {
+				log.Fatal("Data quality report failed on the severity thresholds (validate.fail_thresholds), stopping...")
+			}
+		}
+	}
+	// returns after a graceful shutdown, once the in-flight requests are done:
 	server.Init()
+	closeConnections()
+}
+
+// Stops the service if a config entry that is only read when it is first needed is invalid, so that
+// the service does not start with part of its config silently ignored.
+func validateConfig() {
+	validations := []func() error{
+		models.ValidateConceptTypeRules,
+		models.ValidateAggregationConfig,
+		models.ValidateDataQualityConfig,
+		utils.ValidateSourcePasswordDecryption,
+		middlewares.ValidateRateLimitSettings,
+		middlewares.ValidateHeavyQuerySettings,
+	}
+	for _, validate := range validations {
+		if err := validate(); err != nil {
+			log.Fatalf("Error in the configuration: %s", err.Error())
+		}
+	}
+}
+
+// Stops the service if the config does not match the data in the sources. Unlike validateConfig, this
+// needs the DB, and sources that can not be queried yet are skipped.
+func validateDataSources() {
+	validations := []func() error{
+		models.ValidateAggregationConceptTypes,
+		models.ValidateDerivedConceptIds,
+	}
+	for _, validate := range validations {
+		if err := validate(); err != nil {
+			log.Fatalf("Error in the configuration: %s", err.Error())
+		}
+	}
+}
+
+// Closes the connection pools of the data sources and of the Atlas DB.
+func closeConnections() {
+	if err := utils.CloseDataSources(); err != nil {
+		log.Printf("Error while closing the data source connections: %s", err.Error())
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Error while closing the Atlas DB connection: %s", err.Error())
+	}
 }
@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 func AuthMiddleware() gin.HandlerFunc {
@@ -24,19 +26,24 @@ func AuthMiddleware() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		req, err := PrepareNewArboristRequest(ctx)
 		if err != nil {
-			ctx.AbortWithStatus(500)
 			log.Printf("Error while preparing Arborist request: %s", err.Error())
+			AbortWithError(ctx, "error while checking access", err)
 			return
 		}
 		client := &http.Client{}
 		// send the request to Arborist:
-		resp, _ := client.Do(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Error while sending Arborist request: %s", err.Error())
+			AbortWithError(ctx, "error while checking access", utils.NewUpstreamUnavailableError(err))
+			return
+		}
 
 		// arborist will return with 200 if the user has been granted access to the cohort-middleware URL in ctx:
 		if resp.StatusCode != 200 {
 			// return Unauthorized otherwise:
 			log.Printf("Got response status %d from Arborist. Aborting this cohort-middleware request with 401...", resp.StatusCode)
-			ctx.AbortWithStatus(401)
+			AbortWithError(ctx, "access denied", utils.NewUnauthorizedError(fmt.Errorf("access denied by Arborist (status %d)", resp.StatusCode)))
 			return
 		}
 
@@ -46,7 +53,7 @@ func AuthMiddleware() gin.HandlerFunc {
 
 // this function will take the request from the given ctx, validated it for the presence of an "Authorization / Bearer" token
 // and then return the URL that can be used to consult Arborist regarding cohort-middleware access permissions. This function
-// returns an error if "Authorization / Bearer" token is missing in ctx
+// returns an unauthorized error if "Authorization / Bearer" token is missing in ctx
 func PrepareNewArboristRequest(ctx *gin.Context) (*http.Request, error) {
 
 	resourcePath := fmt.Sprintf("/cohort-middleware%s", ctx.Request.URL.Path)
@@ -64,7 +71,7 @@ func PrepareNewArboristRequestForResourceAndService(ctx *gin.Context, resourcePa
 	// validate:
 	authorization := ctx.Request.Header.Get("Authorization")
 	if authorization == "" {
-		return nil, errors.New("missing Authorization header")
+		return nil, utils.NewUnauthorizedError(errors.New("missing Authorization header"))
 	}
 
 	// build up the request URL string:
@@ -77,10 +84,35 @@ func PrepareNewArboristRequestForResourceAndService(ctx *gin.Context, resourcePa
 	// make request object / validate URL:
 	req, err := http.NewRequest("GET", arboristAuth, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unexpected error while assembling the Arborist request URL in cohort-middleware: %s", err.Error())
+		return nil, utils.NewInternalError(fmt.Errorf("unexpected error while assembling the Arborist request URL in cohort-middleware: %s", err.Error()))
 	}
 
 	// make sure to pass on the auth/bearer token string in this new request:
 	req.Header.Set("Authorization", authorization)
 	return req, nil
 }
+
+// Checks that Arborist can be reached, using its /health endpoint. Arborist is not checked
+// when it is not used (i.e. when arborist_endpoint is "NONE", in local DEV mode).
+func CheckArboristHealth(ctx context.Context, httpClient HttpClientI) error {
+	c := config.GetConfig()
+	arboristEndpoint := c.GetString("arborist_endpoint")
+	if arboristEndpoint == "NONE" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", arboristEndpoint+"/health", nil)
+	if err != nil {
+		return fmt.Errorf("unexpected error while assembling the Arborist health request URL: %s", err.Error())
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got response status %d from Arborist", resp.StatusCode)
+	}
+	return nil
+}
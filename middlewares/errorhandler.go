@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+const REQUEST_ID_KEY = "request_id"
+
+// Error used when a team project authorization check fails.
+var ErrAccessDenied = utils.NewForbiddenError(errors.New("access denied"))
+
+// Middleware that assigns a request id to each request (reusing the X-Request-Id header
+// if the caller sent one) and makes sure that every error, including panics and errors
+// added to the context with ctx.Error() that did not result in a response yet, ends up
+// as a JSON error response (see AbortWithError).
+func ErrorHandlerMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestId := ctx.GetHeader(REQUEST_ID_HEADER)
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+		ctx.Set(REQUEST_ID_KEY, requestId)
+		ctx.Header(REQUEST_ID_HEADER, requestId)
+
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Recovered from panic in request %s: %v", requestId, r)
+				if !ctx.Writer.Written() {
+					AbortWithError(ctx, "unexpected error", utils.NewInternalError(fmt.Errorf("%v", r)))
+				} else {
+					ctx.Abort()
+				}
+			}
+		}()
+
+		ctx.Next()
+
+		if len(ctx.Errors) > 0 && !ctx.Writer.Written() {
+			AbortWithError(ctx, "request failed", ctx.Errors.Last().Err)
+		}
+	}
+}
+
+// Writes the JSON error response for the given error and aborts the request. The
+// HTTP status code and the "code" field are derived from the type of the error (see
+// utils.GetErrorCode), "message" describes what failed and "error" holds the details. For
+// validation errors, "field_errors" lists the fields of the request that are missing or invalid.
+func AbortWithError(ctx *gin.Context, message string, err error) {
+	response := gin.H{
+		"code":       utils.GetErrorCode(err),
+		"message":    message,
+		"error":      err.Error(),
+		"request_id": ctx.GetString(REQUEST_ID_KEY),
+	}
+	var validationError *utils.ValidationError
+	if errors.As(err, &validationError) {
+		response["field_errors"] = validationError.FieldErrors
+	}
+	ctx.JSON(utils.GetHttpStatusForError(err), response)
+	ctx.Abort()
+}
+
+func newRequestId() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(bytes)
+}
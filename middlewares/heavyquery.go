@@ -0,0 +1,197 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// The default time a heavy query waits in the queue of its source, and the default Retry-After of the
+// "source busy" errors, in seconds.
+const DEFAULT_HEAVY_QUERY_QUEUE_TIMEOUT_SECONDS = 30
+const DEFAULT_HEAVY_QUERY_RETRY_AFTER_SECONDS = 30
+
+// The limits on the heavy queries (e.g. attrition tables and full data exports) per data source.
+// A zero MaxConcurrentPerSource means no limit.
+type HeavyQuerySettings struct {
+	MaxConcurrentPerSource int `mapstructure:"max_concurrent_per_source"`
+	// the number of heavy queries that can wait for a slot, the others are rejected right away
+	// (defaults to MaxConcurrentPerSource):
+	MaxQueuedPerSource  int `mapstructure:"max_queued_per_source"`
+	QueueTimeoutSeconds int `mapstructure:"queue_timeout_seconds"`
+	RetryAfterSeconds   int `mapstructure:"retry_after_seconds"`
+}
+
+// Returns the heavy query limits from the optional heavy_queries entry in the config, e.g.:
+//
+//	heavy_queries:
+//	  max_concurrent_per_source: 4
+//	  max_queued_per_source: 20
+//	  queue_timeout_seconds: 30
+//	  retry_after_seconds: 30
+//
+// Invalid settings are logged and result in no limit (see ValidateHeavyQuerySettings).
+func GetHeavyQuerySettings() HeavyQuerySettings {
+	settings, err := readHeavyQuerySettings()
+	if err != nil {
+		log.Printf("ERROR: %s, not limiting the heavy queries", err.Error())
+		return HeavyQuerySettings{
+			QueueTimeoutSeconds: DEFAULT_HEAVY_QUERY_QUEUE_TIMEOUT_SECONDS,
+			RetryAfterSeconds:   DEFAULT_HEAVY_QUERY_RETRY_AFTER_SECONDS,
+		}
+	}
+	return settings
+}
+
+// Returns an error if the heavy_queries entry in the config is invalid.
+func ValidateHeavyQuerySettings() error {
+	_, err := readHeavyQuerySettings()
+	return err
+}
+
+func readHeavyQuerySettings() (HeavyQuerySettings, error) {
+	settings := HeavyQuerySettings{
+		QueueTimeoutSeconds: DEFAULT_HEAVY_QUERY_QUEUE_TIMEOUT_SECONDS,
+		RetryAfterSeconds:   DEFAULT_HEAVY_QUERY_RETRY_AFTER_SECONDS,
+	}
+	conf := config.GetConfig()
+	if conf == nil || !conf.IsSet("heavy_queries") {
+		return settings, nil
+	}
+	if err := conf.UnmarshalKey("heavy_queries", &settings); err != nil {
+		return HeavyQuerySettings{}, fmt.Errorf("invalid heavy_queries: %w", err)
+	}
+	if _, isSet := conf.GetStringMap("heavy_queries")["max_queued_per_source"]; !isSet {
+		settings.MaxQueuedPerSource = settings.MaxConcurrentPerSource
+	}
+	if settings.MaxConcurrentPerSource < 0 || settings.MaxQueuedPerSource < 0 || settings.QueueTimeoutSeconds < 0 || settings.RetryAfterSeconds < 0 {
+		return HeavyQuerySettings{}, fmt.Errorf("invalid heavy_queries settings %+v", settings)
+	}
+	return settings, nil
+}
+
+type sourceQueryQueue struct {
+	slots  chan bool
+	queued int
+}
+
+// A semaphore per data source, limiting the number of heavy queries that run at the same time on the
+// source, with a bounded queue of the queries waiting for a slot. It is safe for concurrent use.
+type SourceConcurrencyLimiter struct {
+	settings HeavyQuerySettings
+	mutex    sync.Mutex
+	sources  map[int]*sourceQueryQueue
+}
+
+func NewSourceConcurrencyLimiter(settings HeavyQuerySettings) *SourceConcurrencyLimiter {
+	return &SourceConcurrencyLimiter{settings: settings, sources: make(map[int]*sourceQueryQueue)}
+}
+
+// Waits for a slot on the given source, up to the queue timeout, and returns the function that releases it.
+// Returns an "upstream unavailable" error if the queue of the source is full or the timeout is reached,
+// and the context error if the context is done first (e.g. when the client disconnects).
+func (l *SourceConcurrencyLimiter) Acquire(ctx context.Context, sourceId int) (func(), error) {
+	if l.settings.MaxConcurrentPerSource == 0 {
+		return func() {}, nil
+	}
+	l.mutex.Lock()
+	queue, exists := l.sources[sourceId]
+	if !exists {
+		queue = &sourceQueryQueue{slots: make(chan bool, l.settings.MaxConcurrentPerSource)}
+		l.sources[sourceId] = queue
+	}
+	// take a free slot right away if there is one:
+	select {
+	case queue.slots <- true:
+		l.mutex.Unlock()
+		return func() { <-queue.slots }, nil
+	default:
+	}
+	if queue.queued >= l.settings.MaxQueuedPerSource {
+		l.mutex.Unlock()
+		return nil, utils.NewUpstreamUnavailableError(fmt.Errorf("too many heavy queries on source %d", sourceId))
+	}
+	queue.queued++
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		queue.queued--
+		l.mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Duration(l.settings.QueueTimeoutSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case queue.slots <- true:
+		return func() { <-queue.slots }, nil
+	case <-timer.C:
+		return nil, utils.NewUpstreamUnavailableError(fmt.Errorf("timed out waiting for the other heavy queries on source %d", sourceId))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Middleware that runs the request only once it has a heavy query slot on its data source (see
+// SourceConcurrencyLimiter). Requests that do not get a slot are rejected with a "source busy" error
+// (503) and a Retry-After header. The source id is the "sourceid" path parameter or, for the v2
+// endpoints, the "source_id" of the JSON request body.
+func HeavyQueryMiddleware(limiter *SourceConcurrencyLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		sourceId, err := getRequestSourceId(ctx)
+		if err != nil {
+			AbortWithError(ctx, "error reading request body", err)
+			return
+		}
+		if sourceId <= 0 {
+			// the handler reports the invalid request:
+			ctx.Next()
+			return
+		}
+		release, err := limiter.Acquire(ctx.Request.Context(), sourceId)
+		if err != nil {
+			if ctx.Request.Context().Err() != nil {
+				// the client is gone, there is no one to respond to:
+				ctx.Abort()
+				return
+			}
+			setRetryAfter(ctx, time.Duration(limiter.settings.RetryAfterSeconds)*time.Second)
+			AbortWithError(ctx, "source busy", err)
+			return
+		}
+		defer release()
+		ctx.Next()
+	}
+}
+
+// Returns the source id of the request, or 0 if it has none (or an invalid one). Returns an error
+// only if the request body can not be read.
+func getRequestSourceId(ctx *gin.Context) (int, error) {
+	if sourceIdParam := ctx.Param("sourceid"); sourceIdParam != "" {
+		sourceId, _ := strconv.Atoi(sourceIdParam)
+		return sourceId, nil
+	}
+	if ctx.Request.Body == nil {
+		return 0, nil
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return 0, err
+	}
+	// the handler reads the body again:
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	var request struct {
+		SourceId int `json:"source_id"`
+	}
+	_ = json.Unmarshal(body, &request)
+	return request.SourceId, nil
+}
@@ -0,0 +1,185 @@
+package middlewares
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// The route classes that can have their own rate limits. All authorized routes count for the
+// default class, and the analysis and export routes also count for their own class.
+const (
+	DEFAULT_ROUTE_CLASS  = "default"
+	ANALYSIS_ROUTE_CLASS = "analysis"
+	EXPORT_ROUTE_CLASS   = "export"
+)
+
+const RETRY_AFTER_HEADER = "Retry-After"
+
+// The token bucket settings of a route class. A zero RequestsPerMinute means no limit.
+type RateLimitSettings struct {
+	RequestsPerMinute float64 `mapstructure:"requests_per_minute"`
+	// the number of requests that can be made at once, after a quiet period (defaults to 1):
+	Burst int `mapstructure:"burst"`
+}
+
+// Returns the rate limit settings of the given route class from the optional rate_limits entry in the config, e.g.:
+//
+//	rate_limits:
+//	  default:
+//	    requests_per_minute: 300
+//	    burst: 50
+//	  export:
+//	    requests_per_minute: 6
+//	    burst: 2
+//
+// Invalid settings are logged and result in no limit (see ValidateRateLimitSettings).
+func GetRateLimitSettings(routeClass string) RateLimitSettings {
+	settings, err := readRateLimitSettings(routeClass)
+	if err != nil {
+		log.Printf("ERROR: %s, not limiting the %s routes", err.Error(), routeClass)
+		return RateLimitSettings{Burst: 1}
+	}
+	return settings
+}
+
+// Returns an error if the rate_limits entry of any of the route classes is invalid.
+func ValidateRateLimitSettings() error {
+	for _, routeClass := range []string{DEFAULT_ROUTE_CLASS, ANALYSIS_ROUTE_CLASS, EXPORT_ROUTE_CLASS} {
+		if _, err := readRateLimitSettings(routeClass); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRateLimitSettings(routeClass string) (RateLimitSettings, error) {
+	var settings RateLimitSettings
+	conf := config.GetConfig()
+	if conf == nil || !conf.IsSet("rate_limits."+routeClass) {
+		return settings, nil
+	}
+	if err := conf.UnmarshalKey("rate_limits."+routeClass, &settings); err != nil {
+		return RateLimitSettings{}, fmt.Errorf("invalid rate_limits.%s: %w", routeClass, err)
+	}
+	if settings.RequestsPerMinute < 0 {
+		return RateLimitSettings{}, fmt.Errorf("invalid rate_limits.%s.requests_per_minute %v", routeClass, settings.RequestsPerMinute)
+	}
+	if settings.Burst < 1 {
+		settings.Burst = 1
+	}
+	return settings, nil
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// How often the buckets that are full again (i.e. of users that have been quiet) are removed.
+const rateLimiterCleanupInterval = 10 * time.Minute
+
+// A token bucket rate limiter, with a bucket per key (i.e. per user). Each bucket holds up to Burst
+// tokens and is refilled at RequestsPerMinute, and each request takes a token. It is safe for concurrent use.
+type RateLimiter struct {
+	routeClass  string
+	settings    RateLimitSettings
+	mutex       sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+	// the clock, which tests can replace:
+	Now func() time.Time
+}
+
+func NewRateLimiter(routeClass string, settings RateLimitSettings) *RateLimiter {
+	return &RateLimiter{
+		routeClass:  routeClass,
+		settings:    settings,
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+		Now:         time.Now,
+	}
+}
+
+// Takes a token from the bucket of the given key. Returns false if there is none left, together
+// with the time until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.settings.RequestsPerMinute == 0 {
+		return true, 0
+	}
+	tokensPerSecond := l.settings.RequestsPerMinute / 60
+	burst := float64(l.settings.Burst)
+	now := l.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.lastCleanup) > rateLimiterCleanupInterval {
+		for bucketKey, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*tokensPerSecond >= burst {
+				delete(l.buckets, bucketKey)
+			}
+		}
+		l.lastCleanup = now
+	}
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, lastRefill: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*tokensPerSecond)
+	bucket.lastRefill = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / tokensPerSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Middleware that rejects the requests of a user that is over the rate limit of the given limiter
+// with a "too many requests" error (429) and a Retry-After header. Should run after AuthMiddleware,
+// so that the user identity is verified (see GetUserIdentity).
+func RateLimitMiddleware(limiter *RateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		allowed, retryAfter := limiter.Allow(GetUserIdentity(ctx))
+		if !allowed {
+			setRetryAfter(ctx, retryAfter)
+			AbortWithError(ctx, "rate limit exceeded",
+				utils.NewTooManyRequestsError(fmt.Errorf("too many %s requests, retry in %s", limiter.routeClass, retryAfter.Round(time.Second))))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Sets the Retry-After header to the given duration, rounded up to whole seconds.
+func setRetryAfter(ctx *gin.Context, retryAfter time.Duration) {
+	ctx.Header(RETRY_AFTER_HEADER, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// Returns the identity of the user that made the request, i.e. the "sub" claim of the bearer token,
+// or the client IP if there is no token. The token is not verified here, that is done by Arborist (see
+// AuthMiddleware).
+func GetUserIdentity(ctx *gin.Context) string {
+	authorization := ctx.Request.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	tokenParts := strings.Split(token, ".")
+	if len(tokenParts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(tokenParts[1], "="))
+		var claims struct {
+			Sub string `json:"sub"`
+		}
+		if err == nil && json.Unmarshal(payload, &claims) == nil && claims.Sub != "" {
+			return "user:" + claims.Sub
+		}
+	}
+	return "ip:" + ctx.ClientIP()
+}
@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// Middleware that limits the size of the request bodies to maxBodyBytes (no limit if it is zero).
+// Requests that announce a larger body are rejected with a "request too large" error, and reading
+// beyond the limit fails for requests that do not announce their size.
+func MaxBodySizeMiddleware(maxBodyBytes int64) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if maxBodyBytes <= 0 || ctx.Request.Body == nil {
+			ctx.Next()
+			return
+		}
+		if ctx.Request.ContentLength > maxBodyBytes {
+			AbortWithError(ctx, "request body too large",
+				utils.NewRequestTooLargeError(fmt.Errorf("request body of %d bytes exceeds the maximum of %d bytes", ctx.Request.ContentLength, maxBodyBytes)))
+			return
+		}
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxBodyBytes)
+		ctx.Next()
+	}
+}
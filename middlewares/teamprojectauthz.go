@@ -39,11 +39,16 @@ func (u TeamProjectAuthz) HasAccessToTeamProject(ctx *gin.Context, teamProject s
 
 	req, err := PrepareNewArboristRequestForResourceAndService(ctx, teamProjectAsResourcePath, teamProjectAccessService)
 	if err != nil {
-		ctx.AbortWithStatus(500)
-		panic("Error while preparing Arborist request")
+		// the caller responds with an access denied error:
+		log.Printf("Error while preparing Arborist request: %s", err.Error())
+		return false
 	}
 	// send the request to Arborist:
-	resp, _ := u.httpClient.Do(req)
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Error while sending Arborist request: %s", err.Error())
+		return false
+	}
 	log.Printf("Got response status %d from Arborist...", resp.StatusCode)
 
 	// arborist will return with 200 if the user has been granted access to the cohort-middleware URL in ctx:
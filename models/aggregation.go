@@ -0,0 +1,257 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+// How a single value is chosen for a person that has multiple observations of the same concept.
+type AggregationPolicy string
+
+const (
+	// all observations are used, as they are (the default):
+	NO_AGGREGATION AggregationPolicy = ""
+	// the value of the first or last observation, by observation_date:
+	AGGREGATE_FIRST AggregationPolicy = "first"
+	AGGREGATE_LAST  AggregationPolicy = "last"
+	// the smallest, largest or mean value (continuous concepts only):
+	AGGREGATE_MIN  AggregationPolicy = "min"
+	AGGREGATE_MAX  AggregationPolicy = "max"
+	AGGREGATE_MEAN AggregationPolicy = "mean"
+	// the most frequent value, or the smallest of the most frequent values:
+	AGGREGATE_MODE AggregationPolicy = "mode"
+	// persons with multiple observations are left out:
+	AGGREGATE_REJECT AggregationPolicy = "reject"
+)
+
+var AGGREGATION_POLICIES = []AggregationPolicy{AGGREGATE_FIRST, AGGREGATE_LAST, AGGREGATE_MIN, AGGREGATE_MAX, AGGREGATE_MEAN, AGGREGATE_MODE, AGGREGATE_REJECT}
+
+// The policies that are only supported for continuous concepts, and therefore can not be the default policy.
+var CONTINUOUS_ONLY_AGGREGATION_POLICIES = []AggregationPolicy{AGGREGATE_MIN, AGGREGATE_MAX, AGGREGATE_MEAN}
+
+type AggregationRule struct {
+	ConceptId int64             `mapstructure:"concept_id"`
+	Policy    AggregationPolicy `mapstructure:"policy"`
+}
+
+type AggregationConfig struct {
+	Default  AggregationPolicy `mapstructure:"default"`
+	Concepts []AggregationRule `mapstructure:"concepts"`
+}
+
+// The number of persons in a cohort that have multiple observations of a concept, and
+// for whom the aggregation policy of the concept was used to get a single value.
+type AggregationReport struct {
+	ConceptId                       int64             `json:"concept_id"`
+	Policy                          AggregationPolicy `json:"policy"`
+	PersonsWithMultipleObservations int64             `json:"persons_with_multiple_observations"`
+}
+
+var aggregationConfig AggregationConfig
+var aggregationConfigOnce sync.Once
+
+// Returns the aggregation policies from the observation_aggregation entry in the config, e.g.:
+//
+//	observation_aggregation:
+//	  default: last
+//	  concepts:
+//	    - concept_id: 2000006885
+//	      policy: mean
+//
+// The policies are only read once. An invalid entry, which ValidateAggregationConfig already rejects at
+// startup, is logged and results in all the observations being used.
+func GetAggregationConfig() AggregationConfig {
+	aggregationConfigOnce.Do(func() {
+		result, err := readAggregationConfig()
+		if err != nil {
+			log.Printf("ERROR: %s, using no aggregation", err.Error())
+			return
+		}
+		aggregationConfig = result
+	})
+	return aggregationConfig
+}
+
+// Returns an error if the observation_aggregation entry in the config can not be read, has
+// an unknown policy, or has a continuous only policy (e.g. mean) as the default.
+func ValidateAggregationConfig() error {
+	_, err := readAggregationConfig()
+	return err
+}
+
+func readAggregationConfig() (AggregationConfig, error) {
+	var result AggregationConfig
+	conf := config.GetConfig()
+	if conf == nil || !conf.IsSet("observation_aggregation") {
+		return result, nil
+	}
+	err := conf.UnmarshalKey("observation_aggregation", &result)
+	if err != nil {
+		return result, fmt.Errorf("invalid observation_aggregation config: %w", err)
+	}
+	policies := []AggregationPolicy{result.Default}
+	for _, rule := range result.Concepts {
+		policies = append(policies, rule.Policy)
+	}
+	for _, policy := range policies {
+		if policy != NO_AGGREGATION && !isAggregationPolicyIn(policy, AGGREGATION_POLICIES) {
+			return result, fmt.Errorf("invalid policy [%s] in observation_aggregation config, should be one of %v", policy, AGGREGATION_POLICIES)
+		}
+	}
+	// the default applies to the nominal concepts as well:
+	if isAggregationPolicyIn(result.Default, CONTINUOUS_ONLY_AGGREGATION_POLICIES) {
+		return result, fmt.Errorf("invalid default policy [%s] in observation_aggregation config, %v are only supported for continuous concepts",
+			result.Default, CONTINUOUS_ONLY_AGGREGATION_POLICIES)
+	}
+	return result, nil
+}
+
+func isAggregationPolicyIn(policy AggregationPolicy, policies []AggregationPolicy) bool {
+	for _, aggregationPolicy := range policies {
+		if aggregationPolicy == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if a continuous only policy (e.g. mean) in the observation_aggregation config is set for a
+// concept that is not continuous in one of the sources. As this needs the concept info of the sources, it can
+// only run once the DB is initialized. Concepts that can not be found in a source are skipped.
+func ValidateAggregationConceptTypes() error {
+	aggregationConfig, err := readAggregationConfig()
+	if err != nil {
+		return err
+	}
+	var sourceModel = new(Source)
+	sources, _ := sourceModel.GetAllSources()
+	conceptModel := *new(Concept)
+	for _, rule := range aggregationConfig.Concepts {
+		if !isAggregationPolicyIn(rule.Policy, CONTINUOUS_ONLY_AGGREGATION_POLICIES) || IsDerivedConceptId(rule.ConceptId) {
+			continue
+		}
+		for _, source := range sources {
+			conceptInfo, err := conceptModel.RetrieveInfoBySourceIdAndConceptId(source.SourceId, rule.ConceptId)
+			if err != nil {
+				log.Printf("WARNING: could not check the aggregation policy of concept %d in source %d: %s", rule.ConceptId, source.SourceId, err.Error())
+				continue
+			}
+			valueKind, err := GetValueKind(conceptInfo.ConceptType, conceptInfo.DomainId, conceptInfo.VocabularyId)
+			if err != nil || valueKind != CONTINUOUS {
+				return fmt.Errorf("invalid policy [%s] for concept %d in observation_aggregation config, it is only supported for continuous concepts",
+					rule.Policy, rule.ConceptId)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the aggregation policy for the given concept. The derived variables (see AGE_AT_COHORT_START_CONCEPT_ID)
+// have a single value per person, so they are never aggregated.
+func GetAggregationPolicy(conceptId int64) AggregationPolicy {
+	if IsDerivedConceptId(conceptId) {
+		return NO_AGGREGATION
+	}
+	aggregationConfig := GetAggregationConfig()
+	for _, rule := range aggregationConfig.Concepts {
+		if rule.ConceptId == conceptId {
+			return rule.Policy
+		}
+	}
+	return aggregationConfig.Default
+}
+
+// Returns the SQL subquery with one observation per person for the given concept, chosen according to the given
+// policy, with the same columns as the observation_continuous view. Only the observations that have a value are
+// considered. E.g. for AGGREGATE_LAST and a continuous concept, on the "observation" alias:
+//
+//	SELECT person_id, observation_concept_id, value_as_number, value_as_concept_id, value_as_string FROM (
+//	  SELECT observation_all.person_id, ..., ROW_NUMBER() OVER (PARTITION BY observation_all.person_id
+//	    ORDER BY observation_all.observation_date DESC, observation_all.value_as_number DESC) as observation_rank
+//	  FROM omop.observation_continuous as observation_all
+//	  WHERE observation_all.observation_concept_id = ? AND observation_all.value_as_number is not null) as observation_ranked
+//	WHERE observation_ranked.observation_rank = 1
+func getAggregatedObservationsSQL(omopDataSource *utils.DbAndSchema, sourceId int, conceptId int64, policy AggregationPolicy, alias string) (string, []interface{}, error) {
+	conceptModel := *new(Concept)
+	conceptInfo, err := conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptId)
+	if err != nil {
+		return "", nil, fmt.Errorf("error while trying to get information for conceptId %d: %w", conceptId, err)
+	}
+	valueKind, err := GetValueKind(conceptInfo.ConceptType, conceptInfo.DomainId, conceptInfo.VocabularyId)
+	if err != nil {
+		return "", nil, utils.NewInvalidInputError(fmt.Errorf("error: %s", err.Error()))
+	}
+	allAlias := alias + "_all"
+	rankedAlias := alias + "_ranked"
+	valueColumn := allAlias + "." + valueKindBehaviors[valueKind].ValueColumn
+	columns := []string{"person_id", "observation_concept_id", "value_as_number", "value_as_concept_id", "value_as_string"}
+	allColumnsSQL := ""
+	rankedColumnsSQL := ""
+	for i, column := range columns {
+		if i > 0 {
+			allColumnsSQL += ", "
+			rankedColumnsSQL += ", "
+		}
+		allColumnsSQL += allAlias + "." + column
+		rankedColumnsSQL += rankedAlias + "." + column
+	}
+	fromSQL := " FROM " + omopDataSource.Schema + ".observation_continuous as " + allAlias + omopDataSource.GetViewDirective() +
+		" WHERE " + allAlias + ".observation_concept_id = ? AND " + valueKindBehaviors[valueKind].NotNullCheck(allAlias)
+	args := []interface{}{conceptId}
+
+	var rankedSQL string
+	switch policy {
+	case AGGREGATE_FIRST, AGGREGATE_LAST:
+		order := "ASC"
+		if policy == AGGREGATE_LAST {
+			order = "DESC"
+		}
+		rankedSQL = "SELECT " + allColumnsSQL + ", ROW_NUMBER() OVER (PARTITION BY " + allAlias + ".person_id ORDER BY " +
+			allAlias + ".observation_date " + order + ", " + valueColumn + " " + order + ") as observation_rank" + fromSQL
+	case AGGREGATE_MODE:
+		rankedSQL = "SELECT " + allColumnsSQL + ", ROW_NUMBER() OVER (PARTITION BY " + allAlias + ".person_id ORDER BY COUNT(*) DESC, " +
+			valueColumn + " ASC) as observation_rank" + fromSQL + " GROUP BY " + allColumnsSQL
+	case AGGREGATE_REJECT:
+		// rank 1 is only given to the persons that have exactly one observation:
+		rankedSQL = "SELECT " + allColumnsSQL + ", COUNT(*) OVER (PARTITION BY " + allAlias + ".person_id) as observation_rank" + fromSQL
+	case AGGREGATE_MIN, AGGREGATE_MAX, AGGREGATE_MEAN:
+		if valueKind != CONTINUOUS {
+			return "", nil, utils.NewInvalidInputError(fmt.Errorf("aggregation policy %s is only supported for continuous concepts, not for concept %d", policy, conceptId))
+		}
+		aggregateFunction := map[AggregationPolicy]string{AGGREGATE_MIN: "MIN", AGGREGATE_MAX: "MAX", AGGREGATE_MEAN: "AVG"}[policy]
+		return "SELECT " + allAlias + ".person_id, " + allAlias + ".observation_concept_id, " +
+			aggregateFunction + "(CAST(" + allAlias + ".value_as_number AS FLOAT)) as value_as_number, " +
+			"CAST(NULL AS INTEGER) as value_as_concept_id, CAST(NULL AS VARCHAR(60)) as value_as_string" + fromSQL +
+			" GROUP BY " + allAlias + ".person_id, " + allAlias + ".observation_concept_id", args, nil
+	default:
+		return "", nil, utils.NewInternalError(fmt.Errorf("unsupported aggregation policy %s", policy))
+	}
+	return "SELECT " + rankedColumnsSQL + " FROM (" + rankedSQL + ") as " + rankedAlias + " WHERE " + rankedAlias + ".observation_rank = 1", args, nil
+}
+
+// Same as CohortData.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds.
+func (h Concept) RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]AggregationReport, error) {
+	return CohortData{}.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId, cohortDefinitionId, conceptIds)
+}
+
+// Returns, for each of the given concepts that has an aggregation policy, the number of persons in the
+// cohort that have multiple observations of the concept (see GetAggregationPolicy).
+func (h CohortData) RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]AggregationReport, error) {
+	aggregationReports := []AggregationReport{}
+	for _, conceptId := range conceptIds {
+		policy := GetAggregationPolicy(conceptId)
+		if policy == NO_AGGREGATION {
+			continue
+		}
+		count, err := h.RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndCohortIdAndConceptId(sourceId, cohortDefinitionId, conceptId)
+		if err != nil {
+			return nil, err
+		}
+		aggregationReports = append(aggregationReports, AggregationReport{ConceptId: conceptId, Policy: policy, PersonsWithMultipleObservations: count})
+	}
+	return aggregationReports, nil
+}
@@ -3,17 +3,27 @@ package models
 import (
 	"fmt"
 	"log"
+	"sort"
 
 	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 type CohortDataI interface {
-	RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*PersonConceptAndValue, error)
+	RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*PersonConceptAndValue, error)
 	RetrieveCohortOverlapStats(sourceId int, caseCohortId int, controlCohortId int, otherFilterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef) (CohortOverlapStats, error)
 	RetrieveDataByOriginalCohortAndNewCohort(sourceId int, originalCohortDefinitionId int, cohortDefinitionId int) ([]*PersonIdAndCohort, error)
-	RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*PersonConceptAndValue, error)
+	RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*PersonConceptAndValue, error)
 	RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId int, conceptId int64) ([]*NominalGroupData, error)
 	RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*PersonConceptAndValue, error)
+	RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(sourceId int, conceptId int64) (int64, error)
+	RetrieveHistogramDataBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, histogramConceptId int64) ([]*PersonConceptAndValue, error)
+	RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, conceptId int64) ([]*NominalGroupData, error)
+	RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, conceptId int64) (int64, error)
+	RetrieveCohortSizeBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) (int, error)
+	RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.HistogramMetadata, error)
+	RetrieveHistogramAndValueSummaryBySourceIdAndConceptId(sourceId int, histogramConceptId int64, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.ValueSummary, error)
+	RetrieveHistogramAndValueSummaryBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, histogramConceptId int64, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.ValueSummary, error)
+	RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]AggregationReport, error)
 }
 
 type CohortData struct{}
@@ -22,9 +32,12 @@ type PersonConceptAndValue struct {
 	PersonId                      int64
 	ConceptId                     int64
 	ConceptClassId                string
+	DomainId                      string
+	VocabularyId                  string
 	ObservationValueAsConceptName string
 	ConceptValueAsNumber          *float32
 	ConceptValueAsConceptId       int64
+	ConceptValueAsString          *string
 }
 
 type PersonConceptAndCount struct {
@@ -73,8 +86,36 @@ func (h CohortData) RetrieveDataByOriginalCohortAndNewCohort(sourceId int, origi
 
 // Retrieves observation data.
 // Assumption is that both OMOP and RESULTS schemas
-// are on same DB.
-func (h CohortData) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*PersonConceptAndValue, error) {
+// are on same DB. The values of the derived variables (see AGE_AT_COHORT_START_CONCEPT_ID) and of the
+// concepts with an aggregation policy (see GetAggregationPolicy) are retrieved separately and merged in,
+// keeping the rows ordered by person id.
+func (h CohortData) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*PersonConceptAndValue, error) {
+	plainConceptIds := []int64{}
+	otherConceptIds := []int64{}
+	for _, conceptId := range conceptIds {
+		if IsDerivedConceptId(conceptId) || GetAggregationPolicy(conceptId) != NO_AGGREGATION {
+			otherConceptIds = append(otherConceptIds, conceptId)
+		} else {
+			plainConceptIds = append(plainConceptIds, conceptId)
+		}
+	}
+	if len(otherConceptIds) == 0 {
+		return h.retrieveObservationDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId, cohortDefinitionId, conceptIds, filterTemporalVariables, observationPeriodFilter)
+	}
+	otherData, err := h.retrieveDataPerConceptBySourceIdAndCohortIdOrderedByPersonId(sourceId, cohortDefinitionId, otherConceptIds, filterTemporalVariables, observationPeriodFilter)
+	if err != nil || len(plainConceptIds) == 0 {
+		return otherData, err
+	}
+	cohortData, err := h.retrieveObservationDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId, cohortDefinitionId, plainConceptIds, filterTemporalVariables, observationPeriodFilter)
+	if err != nil {
+		return nil, err
+	}
+	cohortData = append(cohortData, otherData...)
+	sort.SliceStable(cohortData, func(i, j int) bool { return cohortData[i].PersonId < cohortData[j].PersonId })
+	return cohortData, nil
+}
+
+func (h CohortData) retrieveObservationDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*PersonConceptAndValue, error) {
 	log.Printf(">> Using inner join impl. for large cohorts")
 	var dataSourceModel = new(Source)
 	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
@@ -84,39 +125,101 @@ func (h CohortData) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPerso
 	// get the observations for the subjects and the concepts, to build up the data rows to return:
 	var cohortData []*PersonConceptAndValue
 	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
-		Select("observation.person_id, observation.observation_concept_id as concept_id, concept.concept_class_id, value_as_concept.concept_name as observation_value_as_concept_name, observation.value_as_number as concept_value_as_number, observation.value_as_concept_id as concept_value_as_concept_id").
+		Select("observation.person_id, observation.observation_concept_id as concept_id, concept.concept_class_id, concept.domain_id, concept.vocabulary_id, value_as_concept.concept_name as observation_value_as_concept_name, observation.value_as_number as concept_value_as_number, observation.value_as_concept_id as concept_value_as_concept_id, observation.value_as_string as concept_value_as_string").
 		Joins("INNER JOIN "+resultsDataSource.Schema+".cohort as cohort ON cohort.subject_id = observation.person_id").
 		Joins("INNER JOIN "+omopDataSource.Schema+".concept as concept ON concept.concept_id = observation.observation_concept_id").
 		Joins("LEFT JOIN "+omopDataSource.Schema+".concept as value_as_concept ON value_as_concept.concept_id = observation.value_as_concept_id").
 		Where("cohort.cohort_definition_id = ?", cohortDefinitionId).
 		Where("observation.observation_concept_id in (?)", conceptIds).
 		Order("observation.person_id asc") // this order is important!
+	query = QueryFilterByObservationPeriodHelper(query, observationPeriodFilter, resultsDataSource, omopDataSource, "cohort")
+	query = QueryFilterByTemporalVariablesHelper(query, filterTemporalVariables, resultsDataSource, "cohort")
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
 	meta_result := query.Scan(&cohortData)
 	return cohortData, meta_result.Error
 }
 
-func (h CohortData) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*PersonConceptAndValue, error) {
+// Same as retrieveObservationDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId, but with a query per concept, so that
+// it also supports the derived variables and the concepts with an aggregation policy (see JoinObservationsHelper).
+func (h CohortData) retrieveDataPerConceptBySourceIdAndCohortIdOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64, filterTemporalVariables []utils.CustomTemporalVariableDef,
+	observationPeriodFilter *utils.ObservationPeriodFilter) ([]*PersonConceptAndValue, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+
+	conceptModel := *new(Concept)
+	allCohortData := []*PersonConceptAndValue{}
+	for _, conceptId := range conceptIds {
+		conceptInfo, err := conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptId)
+		if err != nil {
+			return nil, err
+		}
+		var cohortData []*PersonConceptAndValue
+		query := resultsDataSource.Db.Table(resultsDataSource.Schema + ".cohort as cohort").
+			Select("distinct(observation.person_id), observation.observation_concept_id as concept_id, " +
+				"value_as_concept.concept_name as observation_value_as_concept_name, observation.value_as_number as concept_value_as_number, " +
+				"observation.value_as_concept_id as concept_value_as_concept_id, observation.value_as_string as concept_value_as_string")
+		query = JoinObservationsHelper(query, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, conceptId, "observation", "cohort.subject_id").
+			Joins("LEFT JOIN "+omopDataSource.Schema+".concept as value_as_concept ON value_as_concept.concept_id = observation.value_as_concept_id").
+			Where("cohort.cohort_definition_id = ?", cohortDefinitionId)
+		query = QueryFilterByObservationPeriodHelper(query, observationPeriodFilter, resultsDataSource, omopDataSource, "cohort")
+		query = QueryFilterByTemporalVariablesHelper(query, filterTemporalVariables, resultsDataSource, "cohort")
+		query, cancel := utils.AddTimeoutToQuery(query)
+		defer cancel()
+		meta_result := query.Scan(&cohortData)
+		if meta_result.Error != nil {
+			return nil, meta_result.Error
+		}
+		for _, item := range cohortData {
+			// these determine how the value is formatted (see FormatConceptValue):
+			item.ConceptClassId = conceptInfo.ConceptType
+			item.DomainId = conceptInfo.DomainId
+			item.VocabularyId = conceptInfo.VocabularyId
+		}
+		allCohortData = append(allCohortData, cohortData...)
+	}
+	sort.SliceStable(allCohortData, func(i, j int) bool { return allCohortData[i].PersonId < allCohortData[j].PersonId })
+	return allCohortData, nil
+}
+
+func (h CohortData) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*PersonConceptAndValue, error) {
 	var dataSourceModel = new(Source)
 	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
 	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
 
 	// get the observations for the subjects and the concepts, to build up the data rows to return:
 	var cohortData []*PersonConceptAndValue
-	query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, cohortDefinitionId, "unionAndIntersect").
+	query := QueryFilterByCohortPairsAndBaseCohortFiltersHelper(filterCohortPairs, filterTemporalVariables, observationPeriodFilter, resultsDataSource, omopDataSource, cohortDefinitionId, "unionAndIntersect").
 		Select("distinct(observation.person_id), observation.observation_concept_id as concept_id, observation.value_as_number as concept_value_as_number").
-		Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()+" ON unionAndIntersect.subject_id = observation.person_id").
 		Where("observation.observation_concept_id = ?", histogramConceptId).
 		Where("observation.value_as_number is not null")
+	query = JoinObservationsHelper(query, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, histogramConceptId, "observation", "unionAndIntersect.subject_id")
 
-	query = QueryFilterByConceptIdsAndValuesHelper(query, sourceId, filterConceptIdsAndValues, omopDataSource, resultsDataSource.Schema, "unionAndIntersect.subject_id")
+	query = QueryFilterByConceptIdsAndValuesHelper(query, sourceId, filterConceptIdsAndValues, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, "unionAndIntersect.subject_id")
 	query, cancel := utils.AddTimeoutToQuery(query)
 	defer cancel()
 	meta_result := query.Scan(&cohortData)
 	return cohortData, meta_result.Error
 }
 
+// Returns the number of persons in the given cohort that remain after applying the given filters.
+func (h CohortData) RetrieveCohortSizeBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) (int, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+
+	var cohortSize int
+	query := QueryFilterByCohortPairsAndBaseCohortFiltersHelper(filterCohortPairs, filterTemporalVariables, observationPeriodFilter, resultsDataSource, omopDataSource, cohortDefinitionId, "unionAndIntersect").
+		Select("count(distinct(unionAndIntersect.subject_id)) as cohort_size")
+
+	query = QueryFilterByConceptIdsAndValuesHelper(query, sourceId, filterConceptIdsAndValues, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, "unionAndIntersect.subject_id")
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&cohortSize)
+	return cohortSize, meta_result.Error
+}
+
 func (h CohortData) RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*PersonConceptAndValue, error) {
 	var dataSourceModel = new(Source)
 	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
@@ -134,6 +237,26 @@ func (h CohortData) RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, hi
 	return cohortData, meta_result.Error
 }
 
+// Returns the number of persons that have more than one observation for the given conceptId.
+func (h CohortData) RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(sourceId int, conceptId int64) (int64, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	var count int64
+
+	personsWithMultipleObservations := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+		Select("observation.person_id").
+		Where("observation.observation_concept_id = ?", conceptId).
+		Group("observation.person_id").
+		Having("count(*) > 1")
+	query := omopDataSource.Db.Table("(?) as persons_with_multiple_observations", personsWithMultipleObservations).
+		Select("count(*)")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&count)
+	return count, meta_result.Error
+}
+
 func (h CohortData) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId int, conceptId int64) ([]*NominalGroupData, error) {
 	var dataSourceModel = new(Source)
 	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
@@ -154,6 +277,67 @@ func (h CohortData) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourc
 	return cohortData, meta_result.Error
 }
 
+// Same as RetrieveHistogramDataBySourceIdAndConceptId, but only for the persons in the given cohort.
+func (h CohortData) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, histogramConceptId int64) ([]*PersonConceptAndValue, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	var cohortData []*PersonConceptAndValue
+
+	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+		Select("distinct(observation.person_id), observation.observation_concept_id as concept_id, observation.value_as_number as concept_value_as_number").
+		Joins("INNER JOIN (SELECT DISTINCT subject_id FROM "+resultsDataSource.Schema+".cohort WHERE cohort_definition_id = ?) as cohort ON cohort.subject_id = observation.person_id", cohortDefinitionId).
+		Where("observation.observation_concept_id = ?", histogramConceptId).
+		Where("observation.value_as_number is not null")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&cohortData)
+	return cohortData, meta_result.Error
+}
+
+// Same as RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds, but only for the persons in the given cohort.
+func (h CohortData) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, conceptId int64) ([]*NominalGroupData, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	var cohortData []*NominalGroupData
+
+	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+		Select("c1.concept_name as name, count(distinct observation.person_id) as person_count, observation.value_as_string as value_as_string, observation.value_as_concept_id as value_as_concept_id").
+		Joins("INNER JOIN (SELECT DISTINCT subject_id FROM "+resultsDataSource.Schema+".cohort WHERE cohort_definition_id = ?) as cohort ON cohort.subject_id = observation.person_id", cohortDefinitionId).
+		Joins("LEFT JOIN "+omopDataSource.Schema+".concept as c1 ON c1.concept_id = observation.value_as_concept_id").
+		Where("observation.observation_concept_id = ?", conceptId).
+		Group("observation.observation_concept_id, observation.value_as_string, observation.value_as_concept_id, c1.concept_name")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&cohortData)
+	return cohortData, meta_result.Error
+}
+
+// Same as RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId, but only for the persons in the given cohort.
+func (h CohortData) RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, conceptId int64) (int64, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	var count int64
+
+	personsWithMultipleObservations := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+		Select("observation.person_id").
+		Joins("INNER JOIN (SELECT DISTINCT subject_id FROM "+resultsDataSource.Schema+".cohort WHERE cohort_definition_id = ?) as cohort ON cohort.subject_id = observation.person_id", cohortDefinitionId).
+		Where("observation.observation_concept_id = ?", conceptId).
+		Group("observation.person_id").
+		Having("count(*) > 1")
+	query := omopDataSource.Db.Table("(?) as persons_with_multiple_observations", personsWithMultipleObservations).
+		Select("count(*)")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&count)
+	return count, meta_result.Error
+}
+
 // Assesses the overlap between case and control cohorts. It does this after filtering the cohorts and keeping only
 // the persons that have data for each of the selected filterConceptIds and filterCohortPairs.
 func (h CohortData) RetrieveCohortOverlapStats(sourceId int, caseCohortId int, controlCohortId int,
@@ -169,7 +353,7 @@ func (h CohortData) RetrieveCohortOverlapStats(sourceId int, caseCohortId int, c
 		Joins("INNER JOIN " + resultsDataSource.Schema + ".cohort as control_cohort ON control_cohort.subject_id = case_cohort_unionedAndIntersectedWithFilters.subject_id") // this one allows for the intersection between case and control and the assessment of the overlap
 
 	if len(filterConceptIds) > 0 {
-		query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, "control_cohort.subject_id")
+		query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, caseCohortId, "control_cohort.subject_id")
 	}
 	query = query.Where("control_cohort.cohort_definition_id = ?", controlCohortId)
 	query, cancel := utils.AddTimeoutToQuery(query)
@@ -185,7 +369,8 @@ func (p *PersonConceptAndCount) String() string {
 
 // Some observations are only expected once for each person. This code implements a validation that
 // checks if any person has a duplicated entry for any of these observations and prints out WARNINGS
-// to the log if this is the case.
+// to the log if this is the case. This is the same check as the duplicate_observations data quality rule
+// (see DataQuality.RunDataQualityRules).
 func (h CohortData) ValidateObservationData(observationConceptIdsToCheck []int64) (int, error) {
 	if len(observationConceptIdsToCheck) == 0 {
 		log.Print("WARNING: no concepts configured for validation. Skipping data integrity check...")
@@ -201,25 +386,16 @@ func (h CohortData) ValidateObservationData(observationConceptIdsToCheck []int64
 
 		log.Printf("INFO: checking if no duplicate data is found for concept ids %v in `observation` table of data source %d...",
 			observationConceptIdsToCheck, source.SourceId)
-		var personConceptAndCount []*PersonConceptAndCount
-		query := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
-			Select("observation.person_id, observation.observation_concept_id as concept_id, count(*)").
-			Where("observation.observation_concept_id in (?)", observationConceptIdsToCheck).
-			Group("observation.person_id, observation.observation_concept_id").
-			Having("count(*) > 1")
-
-		query, cancel := utils.AddTimeoutToQuery(query)
-		defer cancel()
-		meta_result := query.Scan(&personConceptAndCount)
-		if meta_result.Error != nil {
-			return -1, meta_result.Error
-		} else if len(personConceptAndCount) == 0 {
+		count, err := countDuplicateObservations(omopDataSource, observationConceptIdsToCheck)
+		if err != nil {
+			return -1, err
+		} else if count == 0 {
 			log.Printf("INFO: no issues found in observation table of data source %d.", source.SourceId)
 		} else {
 			log.Printf("WARNING: !!! found a total of %d `person` records with duplicated `observation` entries for one or more concepts "+
 				"where this is not expected (in data source=%d).",
-				len(personConceptAndCount), source.SourceId)
-			countIssues += len(personConceptAndCount)
+				count, source.SourceId)
+			countIssues += int(count)
 		}
 	}
 	return countIssues, nil
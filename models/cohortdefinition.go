@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"time"
 
 	"log"
 
@@ -18,6 +19,7 @@ type CohortDefinitionI interface {
 	GetCohortDefinitionIdsForTeamProject(teamProject string) ([]int, error)
 	GetTeamProjectsThatMatchAllCohortDefinitionIds(uniqueCohortDefinitionIdsList []int) ([]string, error)
 	GetCohortDefinitionStatsByObservationWindow(sourceId int, cohortId int, observationWindow int) (*CohortDefinitionStats, error)
+	GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(sourceId int, cohortId int, observationWindow int, temporalVariables []utils.CustomTemporalVariableDef) (*CohortDefinitionStats, error)
 	GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohort(sourceId int, cohort1Id int, cohort2Id int, observationWindow1stCohort int) (*CohortDefinitionStats, error)
 	GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohortAndOutcomeWindow2ndCohort(sourceId int, cohort1Id int, cohort2Id int, observationWindow1stCohort int, outcomeWindow2ndCohort int) (*CohortDefinitionStats, error)
 	GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohortAnd2ndCohortEntryFirst(sourceId int, cohort1Id int, cohort2Id int, observationWindow1stCohort int) (*CohortDefinitionStats, error)
@@ -131,6 +133,33 @@ func (h CohortDefinition) GetAllCohortDefinitionsAndStatsOrderBySizeDesc(sourceI
 	return cohortDefinitionStats, meta_result.Error
 }
 
+type CohortGenerationInfo struct {
+	StartTime *time.Time
+}
+
+// Returns the start time of the last valid generation of the given cohort in the given source.
+// This timestamp changes whenever the cohort is regenerated, so it can be used to detect
+// if the cohort members have changed.
+func (h CohortDefinition) GetCohortGenerationTimestamp(sourceId int, cohortId int) (time.Time, error) {
+	atlasDb := db.GetAtlasDB().Db
+	var cohortGenerationInfo *CohortGenerationInfo
+	query := atlasDb.Table(db.GetAtlasDB().Schema+".cohort_generation_info").
+		Select("start_time").
+		Where("id = ?", cohortId).
+		Where("source_id = ?", sourceId).
+		Where("is_valid = true").
+		Where("is_canceled = false")
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&cohortGenerationInfo)
+	if meta_result.Error != nil {
+		return time.Time{}, meta_result.Error
+	} else if cohortGenerationInfo == nil || cohortGenerationInfo.StartTime == nil {
+		return time.Time{}, fmt.Errorf("could not find a valid generation for cohortId=%d in sourceId=%d", cohortId, sourceId)
+	}
+	return *cohortGenerationInfo.StartTime, nil
+}
+
 func (h CohortDefinition) GetCohortName(cohortId int) (string, error) {
 	cohortDefinition, err := h.GetCohortDefinitionById(cohortId)
 	if err != nil || cohortDefinition == nil {
@@ -165,6 +194,32 @@ func (h CohortDefinition) GetCohortDefinitionStatsByObservationWindow(sourceId i
 	return &cohortStats, nil
 }
 
+// Same as GetCohortDefinitionStatsByObservationWindow, but only counts the persons that match each of the given
+// temporalVariables, e.g. the persons that entered another cohort within 30 days after entering this cohort.
+func (h CohortDefinition) GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(sourceId int, cohortId int, observationWindow int, temporalVariables []utils.CustomTemporalVariableDef) (*CohortDefinitionStats, error) {
+	var cohortStats CohortDefinitionStats
+	var dataSourceModel = new(Source)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+
+	// Query to filter and count persons in cohort:
+	query := QueryFilterByCohortIdAndObservationWindowHelper(resultsDataSource, omopDataSource, cohortId, observationWindow)
+	query = QueryFilterByTemporalVariablesHelper(query, temporalVariables, resultsDataSource, "cohort")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&cohortStats)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	}
+	var err error
+	cohortStats.Name, err = h.GetCohortName(cohortId)
+	if err != nil {
+		return nil, err
+	}
+	return &cohortStats, nil
+}
+
 // Get the number of persons in a cohort1 that have an observation period equal or longer than
 // the given observationWindow (aka "look back window"), and are also present in cohort2.
 func (h CohortDefinition) GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohort(sourceId int, cohort1Id int, cohort2Id int, observationWindow1stCohort int) (*CohortDefinitionStats, error) {
@@ -209,16 +264,16 @@ func (h CohortDefinition) GetCohortDefinitionStatsByObservationWindow1stCohortAn
 		Where("cohort2.cohort_definition_id = ?", cohort2Id)
 
 	// Outcome must occur within "outcomeWindow2ndCohort days" of cohort1Id start:
-	switch resultsDataSource.Db.Name() {
+	switch resultsDataSource.Vendor {
 	case "sqlserver":
 		query = query.Where("cohort2.cohort_start_date < DATEADD(DAY, ?, cohort.cohort_start_date)", outcomeWindow2ndCohort).
 			Where("cohort2.cohort_start_date > cohort.cohort_start_date") // TODO - plus 1 or more days when we later add "outcome observation window start, relative to cohort1 entry"
 
-	case "postgres":
+	case "postgresql":
 		query = query.Where("cohort2.cohort_start_date < ((INTERVAL '1 day' * ?) + cohort.cohort_start_date)", outcomeWindow2ndCohort).
 			Where("cohort2.cohort_start_date > cohort.cohort_start_date") // TODO - plus 1 or more days when we later add "outcome observation window start, relative to cohort1 entry"
 	default:
-		log.Fatal("Unsupported dialect")
+		return nil, utils.NewInternalError(fmt.Errorf("unsupported dialect %s", resultsDataSource.Vendor))
 	}
 
 	query, cancel := utils.AddTimeoutToQuery(query)
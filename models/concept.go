@@ -1,7 +1,9 @@
 package models
 
 import (
+	"context"
 	"fmt"
+	"sort"
 
 	"github.com/uc-cdis/cohort-middleware/utils"
 )
@@ -12,7 +14,13 @@ type ConceptI interface {
 	RetrieveInfoBySourceIdAndConceptIds(sourceId int, conceptIds []int64) ([]*ConceptSimple, error)
 	RetrieveInfoBySourceIdAndConceptTypes(sourceId int, conceptTypes []string) ([]*ConceptSimple, error)
 	RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohortDefinitionId int, breakdownConceptId int64) ([]*ConceptBreakdown, error)
-	RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error)
+	RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*ConceptBreakdown, error)
+	RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsWithContext(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*ConceptBreakdown, error)
+	RetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, rowConceptId int64, columnConceptId int64) ([]*ConceptCrossTabCell, error)
+	RetrieveCrossTabStatsByCohortPairBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, rowConceptId int64, columnCohortPair utils.CustomDichotomousVariableDef) ([]*ConceptCrossTabCell, error)
+	RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]AggregationReport, error)
+	FlushInfoCacheBySourceId(sourceId int) int
+	FlushInfoCache() int
 }
 type Concept struct {
 	ConceptId   int64  `json:"concept_id"`
@@ -26,6 +34,8 @@ type ConceptSimple struct {
 	ConceptName       string `json:"concept_name"`
 	ConceptCode       string `json:"concept_code"`
 	ConceptType       string `json:"concept_type"`
+	DomainId          string `json:"-"`
+	VocabularyId      string `json:"-"`
 }
 
 type ConceptBreakdown struct {
@@ -35,6 +45,14 @@ type ConceptBreakdown struct {
 	NpersonsInCohortWithValue int    `json:"persons_in_cohort_with_value"`
 }
 
+// The number of persons that have the given row value and column value. The column value is either
+// the value_as_concept_id of the column concept, or the id of the cohort in the column cohort pair.
+type ConceptCrossTabCell struct {
+	RowValueAsConceptId        int64 `json:"row_value_as_concept_id"`
+	ColumnValue                int64 `json:"column_value"`
+	NpersonsInCohortWithValues int   `json:"persons_in_cohort_with_values"`
+}
+
 type Observation struct {
 	ObservationId int64
 }
@@ -62,34 +80,51 @@ func (h Concept) RetrieveInfoBySourceIdAndConceptId(sourceId int, conceptId int6
 		return nil, err
 	} else if len(result) == 0 {
 		// given concept_id not found, return error:
-		return nil, fmt.Errorf("unexpected error: did not find concept")
+		return nil, utils.NewNotFoundError(fmt.Errorf("unexpected error: did not find concept"))
 	}
 	return result[0], err
 }
 
 // Retrieve just a simple list of concept names and type info for given list of conceptIds.
-// Raises an error if any of the concepts is not found.
+// Raises an error if any of the concepts is not found. The concept info is cached (see conceptInfoCache).
 func (h Concept) RetrieveInfoBySourceIdAndConceptIds(sourceId int, conceptIds []int64) ([]*ConceptSimple, error) {
+	conceptItems, err := retrieveConceptInfoUsingCache(sourceId, conceptIds, retrieveInfoBySourceIdAndConceptIdsFromDb)
+	if err != nil {
+		return nil, err
+	}
+	if len(conceptItems) != len(conceptIds) {
+		return nil, utils.NewNotFoundError(fmt.Errorf("unexpected error: did not find the expected number of concepts"))
+	}
+	sort.SliceStable(conceptItems, func(i, j int) bool { return conceptItems[i].ConceptName < conceptItems[j].ConceptName })
+	return conceptItems, nil
+}
+
+// Retrieves the info of the given concepts from the concept table. The info of the derived
+// variables (see AGE_AT_COHORT_START_CONCEPT_ID) is not in that table, and is added as is.
+func retrieveInfoBySourceIdAndConceptIdsFromDb(sourceId int, conceptIds []int64) ([]*ConceptSimple, error) {
 	var dataSourceModel = new(Source)
 	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
 
 	var conceptItems []*ConceptSimple
-	query := omopDataSource.Db.Model(&Concept{}).
-		Select("concept_id, concept_name, concept_code, concept_class_id as concept_type").
-		Where("concept_id in (?)", conceptIds).
-		Order("concept_name")
-	query, cancel := utils.AddTimeoutToQuery(query)
-	defer cancel()
-	meta_result := query.Scan(&conceptItems)
-	if meta_result.Error != nil {
-		return nil, meta_result.Error
+	regularConceptIds, derivedConceptIds := SplitDerivedConceptIds(conceptIds)
+	if len(regularConceptIds) > 0 {
+		query := omopDataSource.Db.Model(&Concept{}).
+			Select("concept_id, concept_name, concept_code, concept_class_id as concept_type, domain_id, vocabulary_id").
+			Where("concept_id in (?)", regularConceptIds).
+			Order("concept_name")
+		query, cancel := utils.AddTimeoutToQuery(query)
+		defer cancel()
+		meta_result := query.Scan(&conceptItems)
+		if meta_result.Error != nil {
+			return nil, meta_result.Error
+		}
 	}
 	for _, conceptItem := range conceptItems {
 		// set prefixed_concept_id:
 		conceptItem.PrefixedConceptId = GetPrefixedConceptId(conceptItem.ConceptId)
 	}
-	if len(conceptItems) != len(conceptIds) {
-		return nil, fmt.Errorf("unexpected error: did not find the expected number of concepts")
+	for _, derivedConceptId := range derivedConceptIds {
+		conceptItems = append(conceptItems, getDerivedConceptInfo(derivedConceptId))
 	}
 	return conceptItems, nil
 }
@@ -129,7 +164,7 @@ func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohor
 	// this is identical to the result of the function below if called with empty filterConceptIds[] and empty filterCohortPairs... so call that:
 	filterConceptIds := []int64{}
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
-	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, breakdownConceptId)
+	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, breakdownConceptId)
 }
 
 // Basically same goal as described in function above, but only count persons that have a non-null value for each
@@ -140,7 +175,13 @@ func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortId(sourceId int, cohor
 //	{ConceptValue: "B", NPersonsInCohortWithValue: N-M-X},
 //
 // where X is the number of persons that have NO value or just a "null" value for one or more of the ids in the given filterConceptIds.
-func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
+func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
+	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsWithContext(context.Background(), sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, filterTemporalVariables, observationPeriodFilter, breakdownConceptId)
+}
+
+// Same as RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs, but stops the query
+// when the given context is cancelled (e.g. because another query running in parallel failed).
+func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsWithContext(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*ConceptBreakdown, error) {
 
 	var dataSourceModel = new(Source)
 	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
@@ -148,27 +189,103 @@ func (h Concept) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCoho
 
 	// count persons, grouping by concept value:
 	var conceptBreakdownList []*ConceptBreakdown
-	query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, cohortDefinitionId, "unionAndIntersect").
+	query := QueryFilterByCohortPairsAndBaseCohortFiltersHelper(filterCohortPairs, filterTemporalVariables, observationPeriodFilter, resultsDataSource, omopDataSource, cohortDefinitionId, "unionAndIntersect").
 		Select("observation.value_as_concept_id, count(distinct(observation.person_id)) as npersons_in_cohort_with_value").
-		Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()+" ON unionAndIntersect.subject_id = observation.person_id").
-		Where("observation.observation_concept_id = ?", breakdownConceptId).
-		Where(GetConceptValueNotNullCheckBasedOnConceptType("observation", sourceId, breakdownConceptId))
+		Where("observation.observation_concept_id = ?", breakdownConceptId)
+	query = JoinObservationsHelper(query, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, breakdownConceptId, "observation", "unionAndIntersect.subject_id")
+	query = AddConceptValueNotNullCheckToQuery(query, "observation", sourceId, breakdownConceptId)
 
-	query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, "unionAndIntersect.subject_id")
+	query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, "unionAndIntersect.subject_id")
 
-	query, cancel := utils.AddTimeoutToQuery(query)
+	query, cancel := utils.AddTimeoutAndParentContextToQuery(ctx, query)
 	defer cancel()
 	meta_result := query.Group("observation.value_as_concept_id").
 		Scan(&conceptBreakdownList)
 
+	if meta_result.Error != nil || len(conceptBreakdownList) == 0 {
+		return conceptBreakdownList, meta_result.Error
+	}
 	// Add concept value (coded value) and concept name for each of the value_as_concept_id values:
+	valueAsConceptIds := []int64{}
 	for _, conceptBreakdownItem := range conceptBreakdownList {
-		conceptInfo, error := h.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptBreakdownItem.ValueAsConceptId)
-		if error != nil {
-			return nil, error
-		}
+		valueAsConceptIds = append(valueAsConceptIds, conceptBreakdownItem.ValueAsConceptId)
+	}
+	conceptsInfo, err := h.RetrieveInfoBySourceIdAndConceptIds(sourceId, valueAsConceptIds)
+	if err != nil {
+		return nil, err
+	}
+	conceptIdToConceptInfo := make(map[int64]*ConceptSimple)
+	for _, conceptInfo := range conceptsInfo {
+		conceptIdToConceptInfo[conceptInfo.ConceptId] = conceptInfo
+	}
+	for _, conceptBreakdownItem := range conceptBreakdownList {
+		conceptInfo := conceptIdToConceptInfo[conceptBreakdownItem.ValueAsConceptId]
 		conceptBreakdownItem.ConceptValue = conceptInfo.ConceptCode
 		conceptBreakdownItem.ValueName = conceptInfo.ConceptName
 	}
-	return conceptBreakdownList, meta_result.Error
+	return conceptBreakdownList, nil
+}
+
+// Same as RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs, but breaks the cohort down by
+// the values of two concepts at the same time. It returns the number of persons for each combination of a
+// rowConceptId value and a columnConceptId value, e.g.:
+//
+//	{RowValueAsConceptId: A, ColumnValue: X, NpersonsInCohortWithValues: M},
+//	{RowValueAsConceptId: A, ColumnValue: Y, NpersonsInCohortWithValues: N},
+//	{RowValueAsConceptId: B, ColumnValue: X, NpersonsInCohortWithValues: O},
+//
+// Combinations without any persons are not returned.
+func (h Concept) RetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, rowConceptId int64, columnConceptId int64) ([]*ConceptCrossTabCell, error) {
+
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+
+	// count persons, grouping by both concept values:
+	var conceptCrossTabCells []*ConceptCrossTabCell
+	query := QueryFilterByCohortPairsHelper(filterCohortPairs, resultsDataSource, cohortDefinitionId, "unionAndIntersect").
+		Select("row_observation.value_as_concept_id as row_value_as_concept_id, column_observation.value_as_concept_id as column_value, count(distinct(row_observation.person_id)) as npersons_in_cohort_with_values").
+		Where("row_observation.observation_concept_id = ?", rowConceptId).
+		Where("column_observation.observation_concept_id = ?", columnConceptId)
+	query = JoinObservationsHelper(query, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, rowConceptId, "row_observation", "unionAndIntersect.subject_id")
+	query = JoinObservationsHelper(query, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, columnConceptId, "column_observation", "unionAndIntersect.subject_id")
+	query = AddConceptValueNotNullCheckToQuery(query, "row_observation", sourceId, rowConceptId)
+	query = AddConceptValueNotNullCheckToQuery(query, "column_observation", sourceId, columnConceptId)
+
+	query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, "unionAndIntersect.subject_id")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Group("row_observation.value_as_concept_id, column_observation.value_as_concept_id").
+		Scan(&conceptCrossTabCells)
+	return conceptCrossTabCells, meta_result.Error
+}
+
+// Same as RetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs, but with the columns being the two
+// cohorts of the given dichotomous columnCohortPair. Like for any other dichotomous variable, the persons that are
+// in both cohorts of the pair are left out.
+func (h Concept) RetrieveCrossTabStatsByCohortPairBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, rowConceptId int64, columnCohortPair utils.CustomDichotomousVariableDef) ([]*ConceptCrossTabCell, error) {
+
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+
+	// count persons, grouping by concept value and by cohort of the pair:
+	var conceptCrossTabCells []*ConceptCrossTabCell
+	allCohortPairs := append(append([]utils.CustomDichotomousVariableDef{}, filterCohortPairs...), columnCohortPair)
+	query := QueryFilterByCohortPairsHelper(allCohortPairs, resultsDataSource, cohortDefinitionId, "unionAndIntersect").
+		Select("row_observation.value_as_concept_id as row_value_as_concept_id, pair_cohort.cohort_definition_id as column_value, count(distinct(row_observation.person_id)) as npersons_in_cohort_with_values").
+		Joins("INNER JOIN "+resultsDataSource.Schema+".cohort as pair_cohort ON unionAndIntersect.subject_id = pair_cohort.subject_id").
+		Where("row_observation.observation_concept_id = ?", rowConceptId).
+		Where("pair_cohort.cohort_definition_id in (?)", []int{columnCohortPair.CohortDefinitionId1, columnCohortPair.CohortDefinitionId2})
+	query = JoinObservationsHelper(query, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, rowConceptId, "row_observation", "unionAndIntersect.subject_id")
+	query = AddConceptValueNotNullCheckToQuery(query, "row_observation", sourceId, rowConceptId)
+
+	query = QueryFilterByConceptIdsHelper(query, sourceId, filterConceptIds, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, "unionAndIntersect.subject_id")
+
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Group("row_observation.value_as_concept_id, pair_cohort.cohort_definition_id").
+		Scan(&conceptCrossTabCells)
+	return conceptCrossTabCells, meta_result.Error
 }
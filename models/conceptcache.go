@@ -0,0 +1,103 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+)
+
+// Default time after which the entries in the concept info cache expire. Can be overridden
+// in the config with concept_cache_ttl_seconds (where 0 disables the cache).
+const DEFAULT_CONCEPT_CACHE_TTL = 1 * time.Hour
+
+type conceptInfoCacheEntry struct {
+	concept   ConceptSimple
+	expiresAt time.Time
+}
+
+// Cache of concept info (name, code and type), keyed by source and concept id. Concept info
+// hardly ever changes, but is needed for almost every query (e.g. to check the concept type
+// in GetConceptValueNotNullCheckBasedOnConceptType).
+var conceptInfoCache = make(map[int]map[int64]*conceptInfoCacheEntry)
+var conceptInfoCacheMutex sync.Mutex
+
+func getConceptCacheTTL() time.Duration {
+	conf := config.GetConfig()
+	if conf != nil && conf.IsSet("concept_cache_ttl_seconds") {
+		return time.Duration(conf.GetInt("concept_cache_ttl_seconds")) * time.Second
+	}
+	return DEFAULT_CONCEPT_CACHE_TTL
+}
+
+// Returns the info for the given concept ids, taking it from the cache where possible and retrieving
+// all the missing or expired ones with a single call to retrieveFromDb. Concepts that are not found
+// are left out of the result, and duplicate ids are only returned once.
+func retrieveConceptInfoUsingCache(sourceId int, conceptIds []int64,
+	retrieveFromDb func(sourceId int, conceptIds []int64) ([]*ConceptSimple, error)) ([]*ConceptSimple, error) {
+	cacheTTL := getConceptCacheTTL()
+	if cacheTTL <= 0 {
+		return retrieveFromDb(sourceId, conceptIds)
+	}
+	now := time.Now()
+	conceptItems := []*ConceptSimple{}
+	missingConceptIds := []int64{}
+	seenConceptIds := make(map[int64]bool)
+	conceptInfoCacheMutex.Lock()
+	for _, conceptId := range conceptIds {
+		if seenConceptIds[conceptId] {
+			continue
+		}
+		seenConceptIds[conceptId] = true
+		cacheEntry := conceptInfoCache[sourceId][conceptId]
+		if cacheEntry != nil && now.Before(cacheEntry.expiresAt) {
+			// return a copy, so that callers can't change the cached entry:
+			concept := cacheEntry.concept
+			conceptItems = append(conceptItems, &concept)
+		} else {
+			missingConceptIds = append(missingConceptIds, conceptId)
+		}
+	}
+	conceptInfoCacheMutex.Unlock()
+	if len(missingConceptIds) == 0 {
+		return conceptItems, nil
+	}
+
+	retrievedConceptItems, err := retrieveFromDb(sourceId, missingConceptIds)
+	if err != nil {
+		return nil, err
+	}
+	conceptInfoCacheMutex.Lock()
+	if conceptInfoCache[sourceId] == nil {
+		conceptInfoCache[sourceId] = make(map[int64]*conceptInfoCacheEntry)
+	}
+	for _, conceptItem := range retrievedConceptItems {
+		conceptInfoCache[sourceId][conceptItem.ConceptId] = &conceptInfoCacheEntry{
+			concept:   *conceptItem,
+			expiresAt: now.Add(cacheTTL),
+		}
+	}
+	conceptInfoCacheMutex.Unlock()
+	return append(conceptItems, retrievedConceptItems...), nil
+}
+
+// Removes all entries of the given source from the concept info cache. Returns the number of removed entries.
+func (h Concept) FlushInfoCacheBySourceId(sourceId int) int {
+	conceptInfoCacheMutex.Lock()
+	defer conceptInfoCacheMutex.Unlock()
+	numberOfEntries := len(conceptInfoCache[sourceId])
+	delete(conceptInfoCache, sourceId)
+	return numberOfEntries
+}
+
+// Removes all entries from the concept info cache. Returns the number of removed entries.
+func (h Concept) FlushInfoCache() int {
+	conceptInfoCacheMutex.Lock()
+	defer conceptInfoCacheMutex.Unlock()
+	numberOfEntries := 0
+	for _, sourceCache := range conceptInfoCache {
+		numberOfEntries += len(sourceCache)
+	}
+	conceptInfoCache = make(map[int]map[int64]*conceptInfoCacheEntry)
+	return numberOfEntries
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+)
+
+// The kinds of values a concept can have. The kind of a concept determines in which observation
+// field its values are found, how they are formatted in CSV, and which statistics can be made for them.
+type ValueKind string
+
+const (
+	CONTINUOUS ValueKind = "continuous"
+	NOMINAL    ValueKind = "nominal"
+	BINARY     ValueKind = "binary"
+	DATE       ValueKind = "date"
+	TEXT       ValueKind = "text"
+)
+
+// The statistics that can be made for the values of a concept.
+type ValueStatsType string
+
+const (
+	// histogram and summary statistics over value_as_number:
+	NUMERIC_STATS ValueStatsType = "numeric"
+	// bar graph and breakdowns by value_as_concept_id:
+	CATEGORICAL_STATS ValueStatsType = "categorical"
+	NO_STATS          ValueStatsType = "none"
+)
+
+type ValueKindBehavior struct {
+	// returns the SQL condition that checks if the observation with the given alias has a value:
+	NotNullCheck func(observationTableAlias string) string
+	// returns the CSV representation of the value of the given observation, or "" if it has no value:
+	FormatValue func(item PersonConceptAndValue) string
+	StatsType   ValueStatsType
+	// the observation field with the value, used to order the values (see getAggregatedObservationsSQL):
+	ValueColumn string
+}
+
+func numberNotNullCheck(observationTableAlias string) string {
+	return observationTableAlias + ".value_as_number is not null"
+}
+
+func conceptNotNullCheck(observationTableAlias string) string {
+	return observationTableAlias + ".value_as_concept_id is not null and " + observationTableAlias + ".value_as_concept_id != 0"
+}
+
+func stringNotNullCheck(observationTableAlias string) string {
+	return observationTableAlias + ".value_as_string is not null and " + observationTableAlias + ".value_as_string <> ''"
+}
+
+func formatNumberValue(item PersonConceptAndValue) string {
+	if item.ConceptValueAsNumber == nil {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*item.ConceptValueAsNumber), 'f', 2, 64)
+}
+
+func formatConceptValue(item PersonConceptAndValue) string {
+	return item.ObservationValueAsConceptName
+}
+
+func formatStringValue(item PersonConceptAndValue) string {
+	if item.ConceptValueAsString == nil {
+		return ""
+	}
+	return *item.ConceptValueAsString
+}
+
+// Dates are stored as text in value_as_string (the observation_continuous view has no
+// value_as_datetime). Known date(time) formats are written as yyyy-mm-dd, other values as is.
+func formatDateValue(item PersonConceptAndValue) string {
+	value := formatStringValue(item)
+	for _, layout := range []string{time.DateOnly, time.RFC3339, time.DateTime, "2006-01-02T15:04:05"} {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date.Format(time.DateOnly)
+		}
+	}
+	return value
+}
+
+var valueKindBehaviors = map[ValueKind]ValueKindBehavior{
+	CONTINUOUS: {NotNullCheck: numberNotNullCheck, FormatValue: formatNumberValue, StatsType: NUMERIC_STATS, ValueColumn: "value_as_number"},
+	NOMINAL:    {NotNullCheck: conceptNotNullCheck, FormatValue: formatConceptValue, StatsType: CATEGORICAL_STATS, ValueColumn: "value_as_concept_id"},
+	BINARY:     {NotNullCheck: conceptNotNullCheck, FormatValue: formatConceptValue, StatsType: CATEGORICAL_STATS, ValueColumn: "value_as_concept_id"},
+	DATE:       {NotNullCheck: stringNotNullCheck, FormatValue: formatDateValue, StatsType: NO_STATS, ValueColumn: "value_as_string"},
+	TEXT:       {NotNullCheck: stringNotNullCheck, FormatValue: formatStringValue, StatsType: NO_STATS, ValueColumn: "value_as_string"},
+}
+
+// A rule of the concept type registry. The empty fields match any value, and the first
+// rule that matches a concept determines the value kind of that concept.
+type ConceptTypeRule struct {
+	ConceptClassId string    `mapstructure:"concept_class_id"`
+	DomainId       string    `mapstructure:"domain_id"`
+	VocabularyId   string    `mapstructure:"vocabulary_id"`
+	ValueKind      ValueKind `mapstructure:"value_kind"`
+}
+
+// The rules used when no concept_types are set in the config.
+var DEFAULT_CONCEPT_TYPE_RULES = []ConceptTypeRule{
+	{ConceptClassId: "MVP Continuous", ValueKind: CONTINUOUS},
+	{ConceptClassId: "MVP Nominal", ValueKind: NOMINAL},
+}
+
+var conceptTypeRules []ConceptTypeRule
+var conceptTypeRulesOnce sync.Once
+
+// Returns the concept type rules from the concept_types entry in the config, e.g.:
+//
+//	concept_types:
+//	  - concept_class_id: 'MVP Continuous'
+//	    value_kind: continuous
+//	  - domain_id: 'Observation'
+//	    vocabulary_id: 'MVP'
+//	    value_kind: text
+//
+// The rules are only read once. If the entry can not be read, the error is logged and the default
+// rules are used instead (ValidateConceptTypeRules reports the same error at startup).
+func GetConceptTypeRules() []ConceptTypeRule {
+	conceptTypeRulesOnce.Do(func() {
+		rules, err := readConceptTypeRules()
+		if err != nil {
+			log.Printf("ERROR: %s, using the default concept types", err.Error())
+			rules = DEFAULT_CONCEPT_TYPE_RULES
+		}
+		conceptTypeRules = rules
+	})
+	return conceptTypeRules
+}
+
+// Returns an error if the concept_types entry in the config can not be read, or has a rule
+// with an unknown value_kind.
+func ValidateConceptTypeRules() error {
+	_, err := readConceptTypeRules()
+	return err
+}
+
+func readConceptTypeRules() ([]ConceptTypeRule, error) {
+	conf := config.GetConfig()
+	if conf == nil || !conf.IsSet("concept_types") {
+		return DEFAULT_CONCEPT_TYPE_RULES, nil
+	}
+	var rules []ConceptTypeRule
+	err := conf.UnmarshalKey("concept_types", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid concept_types config: %w", err)
+	}
+	for _, rule := range rules {
+		if _, exists := valueKindBehaviors[rule.ValueKind]; !exists {
+			return nil, fmt.Errorf("invalid value_kind [%s] in concept_types config", rule.ValueKind)
+		}
+	}
+	return rules, nil
+}
+
+// Returns the value kind of the first rule that matches the given concept class, domain and vocabulary.
+// The value kinds of the derived variables (see AGE_AT_COHORT_START_CONCEPT_ID) are fixed.
+func GetValueKind(conceptClassId string, domainId string, vocabularyId string) (ValueKind, error) {
+	if valueKind, isDerived := getDerivedValueKind(conceptClassId, vocabularyId); isDerived {
+		return valueKind, nil
+	}
+	for _, rule := range GetConceptTypeRules() {
+		if (rule.ConceptClassId == "" || rule.ConceptClassId == conceptClassId) &&
+			(rule.DomainId == "" || rule.DomainId == domainId) &&
+			(rule.VocabularyId == "" || rule.VocabularyId == vocabularyId) {
+			return rule.ValueKind, nil
+		}
+	}
+	return "", fmt.Errorf("concept type not supported [%s]", conceptClassId)
+}
+
+// Returns the behavior for the value kind of the given concept.
+func GetValueKindBehaviorForConcept(conceptInfo *ConceptSimple) (ValueKindBehavior, error) {
+	valueKind, err := GetValueKind(conceptInfo.ConceptType, conceptInfo.DomainId, conceptInfo.VocabularyId)
+	if err != nil {
+		return ValueKindBehavior{}, err
+	}
+	return valueKindBehaviors[valueKind], nil
+}
+
+// Returns the CSV representation of the value of the given observation, based on the value kind of its concept.
+// Values of concepts that are not in the registry are formatted as nominal values.
+func FormatConceptValue(item PersonConceptAndValue) string {
+	valueKind, err := GetValueKind(item.ConceptClassId, item.DomainId, item.VocabularyId)
+	if err != nil {
+		valueKind = NOMINAL
+	}
+	return valueKindBehaviors[valueKind].FormatValue(item)
+}
@@ -1,9 +1,11 @@
 package models
 
 import (
-	"log"
+	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 // More type "tranformation" related functions below....
@@ -16,12 +18,15 @@ func GetPrefixedConceptId(conceptId int64) string {
 }
 
 // The reverse of above function:
-func GetConceptId(prefixedConceptId string) int64 {
+func GetConceptId(prefixedConceptId string) (int64, error) {
 	// validate: it should start with ID_
 	if strings.Index(prefixedConceptId, "ID_") != 0 {
-		log.Panicf("Prefixed concept id should start with ID_ . However, found this instead: %s", prefixedConceptId)
+		return 0, utils.NewInvalidInputError(fmt.Errorf("prefixed concept id should start with ID_ . However, found this instead: %s", prefixedConceptId))
 	}
 	var conceptId = strings.Split(prefixedConceptId, "ID_")[1]
-	var result, _ = strconv.ParseInt(conceptId, 10, 64)
-	return result
+	result, err := strconv.ParseInt(conceptId, 10, 64)
+	if err != nil {
+		return 0, utils.NewInvalidInputError(fmt.Errorf("invalid prefixed concept id %s: %w", prefixedConceptId, err))
+	}
+	return result, nil
 }
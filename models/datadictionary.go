@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ import (
 type DataDictionaryI interface {
 	GenerateDataDictionary()
 	GetDataDictionary() (*DataDictionaryModel, error)
+	GetCohortDataDictionary(sourceId int, cohortDefinitionId int) (*DataDictionaryModel, error)
 }
 
 type DataDictionary struct {
@@ -38,7 +40,17 @@ type DataDictionaryEntry struct {
 	MaxValue                         float64         `json:"maxValue"`
 	MeanValue                        float64         `json:"meanValue"`
 	StandardDeviation                float64         `json:"standardDeviation"`
+	MedianValue                      float64         `json:"medianValue"`
+	FirstQuartileValue               float64         `json:"firstQuartileValue"`
+	ThirdQuartileValue               float64         `json:"thirdQuartileValue"`
+	FirstPercentileValue             float64         `json:"firstPercentileValue"`
+	NinetyNinthPercentileValue       float64         `json:"ninetyNinthPercentileValue"`
+	NumberOfDistinctValues           int64           `json:"numberOfDistinctValues"`
+	ModeValue                        string          `json:"modeValue"`
+	NumberOfPeopleWithMultipleValues int64           `json:"numberOfPeopleWithMultipleValues"`
 	ValueSummary                     json.RawMessage `json:"valueSummary"`
+	// from the concept table, to find the value kind of the concept (see getValueStatsType):
+	DomainId string `json:"-" gorm:"->"`
 }
 
 type DataDictionaryResult struct {
@@ -55,7 +67,17 @@ type DataDictionaryResult struct {
 	MaxValue                         float64         `json:"maxValue"`
 	MeanValue                        float64         `json:"meanValue"`
 	StandardDeviation                float64         `json:"standardDeviation"`
+	MedianValue                      float64         `json:"medianValue"`
+	FirstQuartileValue               float64         `json:"firstQuartileValue"`
+	ThirdQuartileValue               float64         `json:"thirdQuartileValue"`
+	FirstPercentileValue             float64         `json:"firstPercentileValue"`
+	NinetyNinthPercentileValue       float64         `json:"ninetyNinthPercentileValue"`
+	NumberOfDistinctValues           int64           `json:"numberOfDistinctValues"`
+	ModeValue                        string          `json:"modeValue"`
+	NumberOfPeopleWithMultipleValues int64           `json:"numberOfPeopleWithMultipleValues"`
 	ValueSummary                     json.RawMessage `json:"valueSummary"`
+	// only used while generating the results, it is not stored (see DataDictionaryEntry):
+	DomainId string `json:"-" gorm:"->"`
 }
 
 var ResultCache *DataDictionaryModel = nil
@@ -66,18 +88,19 @@ func (u DataDictionary) GetDataDictionary() (*DataDictionaryModel, error) {
 		return ResultCache, nil
 	} else {
 		//Read from DB
-		var source = new(Source)
-		sources, _ := source.GetAllSources()
-		if len(sources) < 1 {
-			panic("Error: No data source found")
-		} else if len(sources) > 1 {
-			panic("More than one data source! Exiting")
-		}
 		var dataSourceModel = new(Source)
-		omopDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Omop)
-		miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Misc)
+		sourceId, err := dataSourceModel.GetSingleSourceId()
+		if err != nil {
+			return nil, err
+		}
+		omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+		miscDataSource := dataSourceModel.GetDataSource(sourceId, Misc)
 
-		if u.CheckIfDataDictionaryIsFilled(miscDataSource) {
+		filled, err := u.CheckIfDataDictionaryIsFilled(miscDataSource)
+		if err != nil {
+			return nil, err
+		}
+		if filled {
 			var newDataDictionary DataDictionaryModel
 			var dataDictionaryEntries []*DataDictionaryResult
 			//Get total number of person ids
@@ -90,7 +113,7 @@ func (u DataDictionary) GetDataDictionary() (*DataDictionaryModel, error) {
 
 			if meta_result.Error != nil {
 				log.Printf("ERROR: Failed to get number of person_ids")
-				return nil, errors.New("data dictionary is not available yet")
+				return nil, utils.NewUpstreamUnavailableError(errors.New("data dictionary is not available yet"))
 			} else {
 				log.Printf("INFO: Total number of person_ids from observation view is %v.", newDataDictionary.Total)
 			}
@@ -103,7 +126,7 @@ func (u DataDictionary) GetDataDictionary() (*DataDictionaryModel, error) {
 
 			if meta_result.Error != nil {
 				log.Printf("ERROR: Failed to get data entries")
-				return nil, errors.New("data dictionary is not available yet")
+				return nil, utils.NewUpstreamUnavailableError(errors.New("data dictionary is not available yet"))
 			} else {
 				log.Printf("INFO: Got data entries")
 			}
@@ -113,9 +136,227 @@ func (u DataDictionary) GetDataDictionary() (*DataDictionaryModel, error) {
 			ResultCache = &newDataDictionary
 			return &newDataDictionary, nil
 		} else {
-			return nil, errors.New("data dictionary is not available yet")
+			return nil, utils.NewUpstreamUnavailableError(errors.New("data dictionary is not available yet"))
+		}
+	}
+}
+
+// Default maximum number of cohort data dictionaries in the cache. Can be overridden in the
+// config with cohort_data_dictionary_cache_size (where 0 disables the cache).
+const DEFAULT_COHORT_DATA_DICTIONARY_CACHE_SIZE = 50
+
+type cohortDataDictionaryCacheEntry struct {
+	generationTimestamp time.Time
+	dataDictionary      *DataDictionaryModel
+	lastUsed            time.Time
+}
+
+// A cohort data dictionary that is being computed, which other requests for the same cohort
+// generation wait for (on done) instead of computing it again.
+type cohortDataDictionaryComputation struct {
+	generationTimestamp time.Time
+	done                chan bool
+	dataDictionary      *DataDictionaryModel
+	err                 error
+}
+
+// Cache of cohort scoped data dictionaries, keyed by source and cohort. Each entry is only
+// valid for the cohort generation it was computed for (see GetCohortGenerationTimestamp), and
+// the least recently used entry is removed when the cache is full.
+var cohortDataDictionaryCache = make(map[string]*cohortDataDictionaryCacheEntry)
+var cohortDataDictionaryComputations = make(map[string]*cohortDataDictionaryComputation)
+var cohortDataDictionaryCacheMutex sync.Mutex
+
+func getCohortDataDictionaryCacheSize() int {
+	conf := config.GetConfig()
+	if conf != nil && conf.IsSet("cohort_data_dictionary_cache_size") {
+		return conf.GetInt("cohort_data_dictionary_cache_size")
+	}
+	return DEFAULT_COHORT_DATA_DICTIONARY_CACHE_SIZE
+}
+
+// Returns the same information as GetDataDictionary, but computed only over the persons
+// in the given cohort. Only concepts that have at least one observation for a person in
+// the cohort are included, and "total" is the number of persons in the cohort.
+// Concurrent requests for the same cohort share a single computation, and the result is
+// only cached if all the concepts could be computed.
+func (u DataDictionary) GetCohortDataDictionary(sourceId int, cohortDefinitionId int) (*DataDictionaryModel, error) {
+	var cohortDefinitionModel = new(CohortDefinition)
+	generationTimestamp, err := cohortDefinitionModel.GetCohortGenerationTimestamp(sourceId, cohortDefinitionId)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := fmt.Sprintf("source:%d,cohort:%d", sourceId, cohortDefinitionId)
+
+	//Read from cache, or wait for the same computation in another request
+	cohortDataDictionaryCacheMutex.Lock()
+	cacheEntry := cohortDataDictionaryCache[cacheKey]
+	if cacheEntry != nil && cacheEntry.generationTimestamp.Equal(generationTimestamp) {
+		cacheEntry.lastUsed = time.Now()
+		cohortDataDictionaryCacheMutex.Unlock()
+		return cacheEntry.dataDictionary, nil
+	}
+	computation := cohortDataDictionaryComputations[cacheKey]
+	if computation != nil && computation.generationTimestamp.Equal(generationTimestamp) {
+		cohortDataDictionaryCacheMutex.Unlock()
+		<-computation.done
+		return computation.dataDictionary, computation.err
+	}
+	computation = &cohortDataDictionaryComputation{generationTimestamp: generationTimestamp, done: make(chan bool)}
+	cohortDataDictionaryComputations[cacheKey] = computation
+	cohortDataDictionaryCacheMutex.Unlock()
+
+	computation.dataDictionary, computation.err = u.computeCohortDataDictionary(sourceId, cohortDefinitionId)
+
+	cohortDataDictionaryCacheMutex.Lock()
+	if cohortDataDictionaryComputations[cacheKey] == computation {
+		delete(cohortDataDictionaryComputations, cacheKey)
+	}
+	if computation.err == nil {
+		//set in cache, replacing any entry for an older generation of this cohort
+		addToCohortDataDictionaryCache(cacheKey, &cohortDataDictionaryCacheEntry{
+			generationTimestamp: generationTimestamp,
+			dataDictionary:      computation.dataDictionary,
+			lastUsed:            time.Now(),
+		})
+	}
+	cohortDataDictionaryCacheMutex.Unlock()
+	close(computation.done)
+	return computation.dataDictionary, computation.err
+}
+
+// Adds the entry to the cache, removing the least recently used entries if the cache is full.
+// Expects cohortDataDictionaryCacheMutex to be locked.
+func addToCohortDataDictionaryCache(cacheKey string, entry *cohortDataDictionaryCacheEntry) {
+	cacheSize := getCohortDataDictionaryCacheSize()
+	if cacheSize <= 0 {
+		return
+	}
+	delete(cohortDataDictionaryCache, cacheKey)
+	for len(cohortDataDictionaryCache) >= cacheSize {
+		var leastRecentlyUsedKey string
+		for key, cacheEntry := range cohortDataDictionaryCache {
+			if leastRecentlyUsedKey == "" || cacheEntry.lastUsed.Before(cohortDataDictionaryCache[leastRecentlyUsedKey].lastUsed) {
+				leastRecentlyUsedKey = key
+			}
+		}
+		delete(cohortDataDictionaryCache, leastRecentlyUsedKey)
+	}
+	cohortDataDictionaryCache[cacheKey] = entry
+}
+
+// Computes the cohort data dictionary (see GetCohortDataDictionary). Returns the first error
+// of any of the concepts, as an incomplete data dictionary should not be returned or cached.
+func (u DataDictionary) computeCohortDataDictionary(sourceId int, cohortDefinitionId int) (*DataDictionaryModel, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+	miscDataSource := dataSourceModel.GetDataSource(sourceId, Misc)
+
+	var newDataDictionary DataDictionaryModel
+	query := resultsDataSource.Db.Table(resultsDataSource.Schema+".cohort as cohort").
+		Select("count(distinct cohort.subject_id) as total, null as data").
+		Where("cohort.cohort_definition_id = ?", cohortDefinitionId)
+	query, cancel := utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
+	defer cancel()
+	meta_result := query.Scan(&newDataDictionary)
+	if meta_result.Error != nil {
+		log.Printf("ERROR: Failed to get cohort size")
+		return nil, meta_result.Error
+	}
+
+	dataDictionaryEntries, err := u.getCohortDataDictionaryEntries(omopDataSource, resultsDataSource, miscDataSource, cohortDefinitionId)
+	if err != nil {
+		log.Printf("ERROR: Failed to get cohort data dictionary entries")
+		return nil, err
+	}
+
+	conf := config.GetConfig()
+	var maxWorkerSize = conf.GetInt("worker_pool_size")
+	if maxWorkerSize < 1 {
+		maxWorkerSize = 1
+	}
+	var c = new(CohortData)
+	workerSlots := make(chan bool, maxWorkerSize)
+	wg := sync.WaitGroup{}
+	var firstErr error
+	var firstErrMutex sync.Mutex
+	setFirstErr := func(err error) {
+		firstErrMutex.Lock()
+		defer firstErrMutex.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	for _, d := range dataDictionaryEntries {
+		wg.Add(1)
+		workerSlots <- true
+		go func(data *DataDictionaryEntry) {
+			defer wg.Done()
+			defer func() { <-workerSlots }()
+			statsType := data.getValueStatsType()
+			if statsType == NUMERIC_STATS {
+				histogramData, valueSummary, err := c.RetrieveHistogramAndValueSummaryBySourceIdAndCohortIdAndConceptId(sourceId, cohortDefinitionId, data.ConceptID, utils.GetDefaultHistogramOptions())
+				setFirstErr(err)
+				populateNumericValueSummaryAndStats(data, histogramData, valueSummary)
+			} else if statsType == CATEGORICAL_STATS {
+				nominalValueData, err := c.RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptId(sourceId, cohortDefinitionId, data.ConceptID)
+				setFirstErr(err)
+				populateNominalValueSummaryAndStats(data, nominalValueData)
+			}
+			var err error
+			data.NumberOfPeopleWithMultipleValues, err = c.RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndCohortIdAndConceptId(sourceId, cohortDefinitionId, data.ConceptID)
+			setFirstErr(err)
+		}(d)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		log.Printf("ERROR: Failed to get the stats of the cohort data dictionary entries")
+		return nil, firstErr
+	}
+
+	dataDictionaryResults := []*DataDictionaryResult{}
+	for _, d := range dataDictionaryEntries {
+		result := DataDictionaryResult(*d)
+		dataDictionaryResults = append(dataDictionaryResults, &result)
+	}
+	newDataDictionary.Data, _ = json.Marshal(dataDictionaryResults)
+	return &newDataDictionary, nil
+}
+
+// Returns the entries of the data_dictionary view, but with the people counts and
+// min/max/mean/sd values computed only over the persons in the given cohort.
+func (u DataDictionary) getCohortDataDictionaryEntries(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema,
+	miscDataSource *utils.DbAndSchema, cohortDefinitionId int) ([]*DataDictionaryEntry, error) {
+	standardDeviationFunction := "stddev"
+	if omopDataSource.Vendor == "sqlserver" {
+		standardDeviationFunction = "stdev"
+	}
+	valueIsFilledCheck := "(data_dictionary.value_stored_as = 'Number' and observation.value_as_number is not null) or " +
+		"(data_dictionary.value_stored_as <> 'Number' and observation.value_as_concept_id is not null and observation.value_as_concept_id <> 0)"
+	var dataDictionaryEntries []*DataDictionaryEntry
+	//see ddl_results_and_cdm.sql Data_Dictionary view
+	query := miscDataSource.Db.Table(miscDataSource.Schema+".data_dictionary as data_dictionary").
+		Select("data_dictionary.vocabulary_id, data_dictionary.concept_id, data_dictionary.concept_code, data_dictionary.concept_name, "+
+			"data_dictionary.concept_class_id, data_dictionary.value_stored_as, concept.domain_id, "+
+			"count(distinct observation.person_id) as number_of_people_with_variable, "+
+			"count(distinct case when "+valueIsFilledCheck+" then observation.person_id end) as number_of_people_where_value_is_filled, "+
+			"count(distinct case when not ("+valueIsFilledCheck+") then observation.person_id end) as number_of_people_where_value_is_null, "+
+			"min(observation.value_as_number) as min_value, "+
+			"max(observation.value_as_number) as max_value, "+
+			"avg(observation.value_as_number) as mean_value, "+
+			standardDeviationFunction+"(observation.value_as_number) as standard_deviation").
+		Joins("INNER JOIN "+omopDataSource.Schema+".observation as observation ON observation.observation_concept_id = data_dictionary.concept_id").
+		Joins("LEFT JOIN "+omopDataSource.Schema+".concept as concept ON concept.concept_id = data_dictionary.concept_id").
+		Joins("INNER JOIN (SELECT DISTINCT subject_id FROM "+resultsDataSource.Schema+".cohort WHERE cohort_definition_id = ?) as cohort ON cohort.subject_id = observation.person_id", cohortDefinitionId).
+		Group("data_dictionary.vocabulary_id, data_dictionary.concept_id, data_dictionary.concept_code, data_dictionary.concept_name, " +
+			"data_dictionary.concept_class_id, data_dictionary.value_stored_as, concept.domain_id").
+		Order("data_dictionary.concept_id")
+
+	query, cancel := utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
+	defer cancel()
+	meta_result := query.Scan(&dataDictionaryEntries)
+	return dataDictionaryEntries, meta_result.Error
 }
 
 // Generate Data Dictionary Json
@@ -128,23 +369,29 @@ func (u DataDictionary) GenerateDataDictionary() {
 
 	entryCh := make(chan *DataDictionaryResult, maxWorkerSize)
 
-	var source = new(Source)
-	sources, _ := source.GetAllSources()
-	if len(sources) < 1 {
-		panic("Error: No data source found")
-	} else if len(sources) > 1 {
-		panic("More than one data source! Exiting")
-	}
 	var dataSourceModel = new(Source)
-	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Misc)
+	sourceId, err := dataSourceModel.GetSingleSourceId()
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		return
+	}
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	miscDataSource := dataSourceModel.GetDataSource(sourceId, Misc)
 
-	if u.CheckIfDataDictionaryIsFilled(miscDataSource) {
+	filled, err := u.CheckIfDataDictionaryIsFilled(miscDataSource)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		return
+	}
+	if filled {
 		log.Print("Data Dictionary Result already filled. Skipping generation.")
 		return
 	} else {
 		var dataDictionaryEntries []*DataDictionaryEntry
 		//see ddl_results_and_cdm.sql Data_Dictionary view
-		query := miscDataSource.Db.Table(miscDataSource.Schema + ".data_dictionary")
+		query := miscDataSource.Db.Table(miscDataSource.Schema + ".data_dictionary as data_dictionary").
+			Select("data_dictionary.*, concept.domain_id").
+			Joins("LEFT JOIN " + omopDataSource.Schema + ".concept as concept ON concept.concept_id = data_dictionary.concept_id")
 
 		query, cancel := utils.AddSpecificTimeoutToQuery(query, 600*time.Second)
 		defer cancel()
@@ -174,7 +421,7 @@ func (u DataDictionary) GenerateDataDictionary() {
 
 			for _, d := range partialDataList {
 				wg.Add(1)
-				go GenerateData(d, sources[0].SourceId, &wg, entryCh)
+				go GenerateData(d, sourceId, &wg, entryCh)
 				resultEntry := <-entryCh
 				partialResultList = append(partialResultList, resultEntry)
 			}
@@ -182,13 +429,19 @@ func (u DataDictionary) GenerateDataDictionary() {
 			resultDataList = append(resultDataList, partialResultList...)
 			if len(resultDataList) >= batchSize {
 				log.Printf("%v row of results reached, flush to db.", batchSize)
-				u.WriteResultToDB(miscDataSource, resultDataList)
+				if err := u.WriteResultToDB(miscDataSource, resultDataList); err != nil {
+					log.Printf("Error: %s", err.Error())
+					return
+				}
 				resultDataList = []*DataDictionaryResult{}
 			}
 		}
 
 		if len(resultDataList) > 0 {
-			u.WriteResultToDB(miscDataSource, resultDataList)
+			if err := u.WriteResultToDB(miscDataSource, resultDataList); err != nil {
+				log.Printf("Error: %s", err.Error())
+				return
+			}
 		}
 
 		log.Printf("INFO: Data dictionary generation complete")
@@ -196,29 +449,39 @@ func (u DataDictionary) GenerateDataDictionary() {
 	}
 }
 
+// Returns the type of statistics to generate for the entry, based on the value kind of its
+// concept (see GetConceptTypeRules), or on value_stored_as if its concept type is not registered.
+func (data *DataDictionaryEntry) getValueStatsType() ValueStatsType {
+	valueKind, err := GetValueKind(data.ConceptClassId, data.DomainId, data.VocabularyID)
+	if err == nil {
+		return valueKindBehaviors[valueKind].StatsType
+	}
+	switch data.ValueStoredAs {
+	case "Number":
+		return NUMERIC_STATS
+	case "Concept Id":
+		return CATEGORICAL_STATS
+	}
+	return NO_STATS
+}
+
 func GenerateData(data *DataDictionaryEntry, sourceId int, wg *sync.WaitGroup, ch chan *DataDictionaryResult) {
 	var c = new(CohortData)
 
-	if data.ValueStoredAs == "Number" {
+	statsType := data.getValueStatsType()
+	if statsType == NUMERIC_STATS {
 		//If histogram concept classes
 		log.Printf("Generate histogram for Concept id %v.", data.ConceptClassId)
-		var cohortData []*PersonConceptAndValue
-
-		cohortData, _ = c.RetrieveHistogramDataBySourceIdAndConceptId(sourceId, data.ConceptID)
-
-		conceptValues := []float64{}
-		for _, personData := range cohortData {
-			conceptValues = append(conceptValues, float64(*personData.ConceptValueAsNumber))
-		}
-		log.Printf("INFO: concept id %v data size is %v", data.ConceptID, len(conceptValues))
-		histogramData := utils.GenerateHistogramData(conceptValues)
-		data.ValueSummary, _ = json.Marshal(histogramData)
-	} else if data.ValueStoredAs == "Concept Id" {
+		histogramData, valueSummary, _ := c.RetrieveHistogramAndValueSummaryBySourceIdAndConceptId(sourceId, data.ConceptID, utils.GetDefaultHistogramOptions())
+		populateNumericValueSummaryAndStats(data, histogramData, valueSummary)
+	} else if statsType == CATEGORICAL_STATS {
 		//If bar graph concept classes
 		log.Printf("Generate bar graph for Concept id %v.", data.ConceptClassId)
 		nominalValueData, _ := c.RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId, data.ConceptID)
-		data.ValueSummary, _ = json.Marshal(nominalValueData)
+		populateNominalValueSummaryAndStats(data, nominalValueData)
 	}
+	// same check as ValidateObservationData, but for this concept only:
+	data.NumberOfPeopleWithMultipleValues, _ = c.RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(sourceId, data.ConceptID)
 	result := DataDictionaryResult(*data)
 
 	//send result to channel
@@ -226,18 +489,63 @@ func GenerateData(data *DataDictionaryEntry, sourceId int, wg *sync.WaitGroup, c
 	wg.Done()
 }
 
-func (u DataDictionary) WriteResultToDB(dbSource *utils.DbAndSchema, resultDataList []*DataDictionaryResult) bool {
+// Sets the histogram value summary and the distribution stats of the given
+// data dictionary entry, based on the given histogram and numeric value summary.
+func populateNumericValueSummaryAndStats(data *DataDictionaryEntry, histogramData []utils.HistogramColumn, valueSummary *utils.ValueSummary) {
+	data.ValueSummary, _ = json.Marshal(histogramData)
+	if valueSummary != nil {
+		log.Printf("INFO: concept id %v data size is %v", data.ConceptID, valueSummary.NumberOfValues)
+		data.MedianValue = valueSummary.Median
+		data.FirstQuartileValue = valueSummary.FirstQuartile
+		data.ThirdQuartileValue = valueSummary.ThirdQuartile
+		data.FirstPercentileValue = valueSummary.FirstPercentile
+		data.NinetyNinthPercentileValue = valueSummary.NinetyNinthPercentile
+		data.NumberOfDistinctValues = valueSummary.NumberOfDistinctValues
+	}
+}
+
+// Sets the bar graph value summary, the number of distinct values and the mode
+// of the given data dictionary entry, based on the given nominal value data.
+func populateNominalValueSummaryAndStats(data *DataDictionaryEntry, nominalValueData []*NominalGroupData) {
+	data.ValueSummary, _ = json.Marshal(nominalValueData)
+	data.NumberOfDistinctValues, data.ModeValue = GetNumberOfDistinctValuesAndMode(nominalValueData)
+}
+
+// Returns the number of distinct (non-empty) values found in the given nominal value data, and
+// the name of the value that was observed for the largest number of persons (aka the "mode").
+func GetNumberOfDistinctValuesAndMode(nominalValueData []*NominalGroupData) (int64, string) {
+	var numberOfDistinctValues int64 = 0
+	modeValue := ""
+	var modePersonCount int64 = 0
+	for _, nominalValue := range nominalValueData {
+		if nominalValue.ValueAsConceptID == 0 && nominalValue.ValueAsString == "" {
+			// empty value, skip:
+			continue
+		}
+		numberOfDistinctValues++
+		if nominalValue.PersonCount > modePersonCount {
+			modePersonCount = nominalValue.PersonCount
+			modeValue = nominalValue.Name
+			if modeValue == "" {
+				modeValue = nominalValue.ValueAsString
+			}
+		}
+	}
+	return numberOfDistinctValues, modeValue
+}
+
+func (u DataDictionary) WriteResultToDB(dbSource *utils.DbAndSchema, resultDataList []*DataDictionaryResult) error {
 
 	result := dbSource.Db.Create(resultDataList)
 	if result.Error != nil {
 		log.Printf("ERROR: Failed to insert data into table")
-		panic("")
+		return fmt.Errorf("failed to insert data dictionary results: %w", result.Error)
 	}
 	log.Printf("Write to DB succeeded.")
-	return true
+	return nil
 }
 
-func (u DataDictionary) CheckIfDataDictionaryIsFilled(dbSource *utils.DbAndSchema) bool {
+func (u DataDictionary) CheckIfDataDictionaryIsFilled(dbSource *utils.DbAndSchema) (bool, error) {
 	var dataDictionaryResult []*DataDictionaryResult
 	query := dbSource.Db.Table(dbSource.Schema + ".data_dictionary_result")
 
@@ -246,12 +554,12 @@ func (u DataDictionary) CheckIfDataDictionaryIsFilled(dbSource *utils.DbAndSchem
 	meta_result := query.Scan(&dataDictionaryResult)
 	if meta_result.Error != nil {
 		log.Printf("ERROR: Failed to get data dictionary result")
-		panic("")
+		return false, fmt.Errorf("failed to get data dictionary result: %w", meta_result.Error)
 	} else if len(dataDictionaryResult) > 0 {
 		log.Printf("INFO: Data Dictionary Result Table is filled.")
-		return true
+		return true, nil
 	} else {
 		log.Printf("INFO: Data Dictionary Result Table is empty.")
-		return false
+		return false, nil
 	}
 }
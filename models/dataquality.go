@@ -0,0 +1,333 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+type DataQualityI interface {
+	RunDataQualityRules(dataQualityConfig DataQualityConfig) (*DataQualityReport, error)
+}
+
+type DataQuality struct{}
+
+// The checks that can be configured in the data quality rules.
+type DataQualityCheck string
+
+const (
+	// persons with more than one observation of any of the rule's concept_ids:
+	DUPLICATE_OBSERVATIONS DataQualityCheck = "duplicate_observations"
+	// observations of the rule's (continuous) concept_ids with a value below min_value or above max_value:
+	OUT_OF_RANGE_VALUES DataQualityCheck = "out_of_range_values"
+	// person ids in the observation table that are not in the person table:
+	ORPHAN_PERSON_IDS DataQualityCheck = "orphan_person_ids"
+	// subjects in the cohort table that have no observation_period:
+	COHORT_SUBJECTS_WITHOUT_OBSERVATION_PERIOD DataQualityCheck = "cohort_subjects_without_observation_period"
+	// observation concept ids that are not in the concept table:
+	UNKNOWN_CONCEPTS DataQualityCheck = "unknown_concepts"
+	// concepts in the observation_continuous view with a concept class that is not in the rule's concept_class_ids:
+	UNEXPECTED_CONCEPT_CLASSES DataQualityCheck = "unexpected_concept_classes"
+)
+
+type DataQualitySeverity string
+
+const (
+	SEVERITY_INFO    DataQualitySeverity = "info"
+	SEVERITY_WARNING DataQualitySeverity = "warning"
+	SEVERITY_ERROR   DataQualitySeverity = "error"
+)
+
+var DATA_QUALITY_SEVERITIES = []DataQualitySeverity{SEVERITY_INFO, SEVERITY_WARNING, SEVERITY_ERROR}
+
+type DataQualityRule struct {
+	// optional, defaults to the name of the check:
+	Name     string              `mapstructure:"name"`
+	Check    DataQualityCheck    `mapstructure:"check"`
+	Severity DataQualitySeverity `mapstructure:"severity"`
+	// the concepts checked by duplicate_observations and out_of_range_values:
+	ConceptIds []int64 `mapstructure:"concept_ids"`
+	// the (inclusive) range of out_of_range_values, at least one of them should be set:
+	MinValue *float64 `mapstructure:"min_value"`
+	MaxValue *float64 `mapstructure:"max_value"`
+	// the expected concept classes of unexpected_concept_classes:
+	ConceptClassIds []string `mapstructure:"concept_class_ids"`
+}
+
+type DataQualityConfig struct {
+	Rules []DataQualityRule `mapstructure:"rules"`
+	// the maximum number of issues per severity, above which the report fails (no maximum if not set):
+	FailThresholds map[DataQualitySeverity]int64 `mapstructure:"fail_thresholds"`
+	// whether the service should stop at startup when the report fails:
+	FailStartup bool `mapstructure:"fail_startup"`
+}
+
+// The result of a single rule on a single data source. Error is set when the rule could not be checked.
+type DataQualityResult struct {
+	Rule        string              `json:"rule"`
+	Check       DataQualityCheck    `json:"check"`
+	Severity    DataQualitySeverity `json:"severity"`
+	SourceId    int                 `json:"source_id"`
+	Issues      int64               `json:"issues"`
+	Description string              `json:"description"`
+	Error       string              `json:"error,omitempty"`
+}
+
+type DataQualityReport struct {
+	GeneratedAt      time.Time                     `json:"generated_at"`
+	Results          []DataQualityResult           `json:"results"`
+	IssuesBySeverity map[DataQualitySeverity]int64 `json:"issues_by_severity"`
+	Failed           bool                          `json:"failed"`
+	FailureReasons   []string                      `json:"failure_reasons,omitempty"`
+}
+
+type dataQualityCheckDef struct {
+	// what the number of issues counts:
+	Description string
+	// returns the number of issues found by the given rule in the given data source:
+	countIssues func(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error)
+}
+
+var dataQualityChecks = map[DataQualityCheck]dataQualityCheckDef{
+	DUPLICATE_OBSERVATIONS:                     {Description: "(person, concept) pairs with more than one observation", countIssues: countDuplicateObservationsIssues},
+	OUT_OF_RANGE_VALUES:                        {Description: "observations with a value out of range", countIssues: countOutOfRangeValuesIssues},
+	ORPHAN_PERSON_IDS:                          {Description: "person ids in observation that are not in person", countIssues: countOrphanPersonIdsIssues},
+	COHORT_SUBJECTS_WITHOUT_OBSERVATION_PERIOD: {Description: "cohort subjects without an observation_period", countIssues: countCohortSubjectsWithoutObservationPeriodIssues},
+	UNKNOWN_CONCEPTS:                           {Description: "observation concept ids that are not in concept", countIssues: countUnknownConceptsIssues},
+	UNEXPECTED_CONCEPT_CLASSES:                 {Description: "observation_continuous concepts with an unexpected concept class", countIssues: countUnexpectedConceptClassesIssues},
+}
+
+var dataQualityConfig DataQualityConfig
+var dataQualityConfigOnce sync.Once
+
+// Returns the data quality rules and thresholds from the validate entry in the config, e.g.:
+//
+//	validate:
+//	  rules:
+//	    - check: duplicate_observations
+//	      severity: warning
+//	      concept_ids: [2000007027]
+//	    - check: out_of_range_values
+//	      severity: error
+//	      concept_ids: [2000006885]
+//	      min_value: 0
+//	      max_value: 300
+//	  fail_thresholds:
+//	    error: 0
+//	  fail_startup: true
+//
+// The concepts in the older validate.single_observation_for_concept_ids entry are checked by an extra
+// duplicate_observations rule with severity warning. The config is only read once; when it is invalid
+// (which ValidateDataQualityConfig reports at startup), the error is logged and no rules are run.
+func GetDataQualityConfig() DataQualityConfig {
+	dataQualityConfigOnce.Do(func() {
+		result, err := readDataQualityConfig()
+		if err != nil {
+			log.Printf("ERROR: %s, not running any data quality rules", err.Error())
+			return
+		}
+		dataQualityConfig = result
+	})
+	return dataQualityConfig
+}
+
+// Returns an error if the validate entry in the config can not be read, or has an invalid rule or threshold.
+func ValidateDataQualityConfig() error {
+	_, err := readDataQualityConfig()
+	return err
+}
+
+func readDataQualityConfig() (DataQualityConfig, error) {
+	var result DataQualityConfig
+	conf := config.GetConfig()
+	if conf == nil {
+		return result, nil
+	}
+	if conf.IsSet("validate") {
+		err := conf.UnmarshalKey("validate", &result)
+		if err != nil {
+			return DataQualityConfig{}, fmt.Errorf("invalid validate config: %w", err)
+		}
+	}
+	singleObservationConceptIds, _ := utils.SliceAtoi(conf.GetStringSlice("validate.single_observation_for_concept_ids"))
+	if len(singleObservationConceptIds) > 0 {
+		result.Rules = append(result.Rules, DataQualityRule{Name: "single_observation_for_concept_ids", Check: DUPLICATE_OBSERVATIONS,
+			Severity: SEVERITY_WARNING, ConceptIds: singleObservationConceptIds})
+	}
+	for i := range result.Rules {
+		err := validateDataQualityRule(&result.Rules[i])
+		if err != nil {
+			return DataQualityConfig{}, fmt.Errorf("invalid rule in validate config: %w", err)
+		}
+	}
+	for severity := range result.FailThresholds {
+		if !isDataQualitySeverity(severity) {
+			return DataQualityConfig{}, fmt.Errorf("invalid severity [%s] in validate.fail_thresholds config, should be one of %v", severity, DATA_QUALITY_SEVERITIES)
+		}
+	}
+	return result, nil
+}
+
+// Checks the given rule, and sets the default name and severity if these are not set.
+func validateDataQualityRule(rule *DataQualityRule) error {
+	if _, exists := dataQualityChecks[rule.Check]; !exists {
+		return fmt.Errorf("unknown check [%s]", rule.Check)
+	}
+	if rule.Name == "" {
+		rule.Name = string(rule.Check)
+	}
+	if rule.Severity == "" {
+		rule.Severity = SEVERITY_WARNING
+	} else if !isDataQualitySeverity(rule.Severity) {
+		return fmt.Errorf("rule %s has an unknown severity [%s], should be one of %v", rule.Name, rule.Severity, DATA_QUALITY_SEVERITIES)
+	}
+	switch rule.Check {
+	case DUPLICATE_OBSERVATIONS:
+		if len(rule.ConceptIds) == 0 {
+			return fmt.Errorf("rule %s needs concept_ids", rule.Name)
+		}
+	case OUT_OF_RANGE_VALUES:
+		if len(rule.ConceptIds) == 0 || (rule.MinValue == nil && rule.MaxValue == nil) {
+			return fmt.Errorf("rule %s needs concept_ids and min_value and/or max_value", rule.Name)
+		}
+	case UNEXPECTED_CONCEPT_CLASSES:
+		if len(rule.ConceptClassIds) == 0 {
+			return fmt.Errorf("rule %s needs concept_class_ids", rule.Name)
+		}
+	}
+	return nil
+}
+
+func isDataQualitySeverity(severity DataQualitySeverity) bool {
+	for _, dataQualitySeverity := range DATA_QUALITY_SEVERITIES {
+		if dataQualitySeverity == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the given rules on all data sources, and returns the report with the number of issues found by each rule
+// in each data source. A rule that could not be checked (e.g. because a table is missing) is reported with its
+// error, but does not stop the other rules. The report fails if the number of issues of any severity is above its threshold.
+func (h DataQuality) RunDataQualityRules(dataQualityConfig DataQualityConfig) (*DataQualityReport, error) {
+	var sourceModel = new(Source)
+	sources, err := sourceModel.GetAllSources()
+	if err != nil {
+		return nil, err
+	}
+	report := DataQualityReport{GeneratedAt: time.Now().UTC(), Results: []DataQualityResult{}, IssuesBySeverity: map[DataQualitySeverity]int64{}}
+	for _, source := range sources {
+		omopDataSource := sourceModel.GetDataSource(source.SourceId, Omop)
+		resultsDataSource := sourceModel.GetDataSource(source.SourceId, Results)
+		for _, rule := range dataQualityConfig.Rules {
+			check := dataQualityChecks[rule.Check]
+			log.Printf("INFO: checking data quality rule %s on data source %d...", rule.Name, source.SourceId)
+			result := DataQualityResult{Rule: rule.Name, Check: rule.Check, Severity: rule.Severity, SourceId: source.SourceId, Description: check.Description}
+			result.Issues, err = check.countIssues(omopDataSource, resultsDataSource, rule)
+			if err != nil {
+				log.Printf("WARNING: data quality rule %s could not be checked on data source %d: %s", rule.Name, source.SourceId, err.Error())
+				result.Error = err.Error()
+			} else if result.Issues > 0 {
+				log.Printf("WARNING: data quality rule %s found %d %s in data source %d (severity %s).",
+					rule.Name, result.Issues, check.Description, source.SourceId, rule.Severity)
+			}
+			report.Results = append(report.Results, result)
+			report.IssuesBySeverity[rule.Severity] += result.Issues
+		}
+	}
+	report.FailureReasons = report.GetFailureReasons(dataQualityConfig.FailThresholds)
+	report.Failed = len(report.FailureReasons) > 0
+	return &report, nil
+}
+
+// Returns, for each severity with a threshold, a message if the number of issues with that severity is above the threshold.
+func (r DataQualityReport) GetFailureReasons(failThresholds map[DataQualitySeverity]int64) []string {
+	failureReasons := []string{}
+	for _, severity := range DATA_QUALITY_SEVERITIES {
+		threshold, hasThreshold := failThresholds[severity]
+		if hasThreshold && r.IssuesBySeverity[severity] > threshold {
+			failureReasons = append(failureReasons, fmt.Sprintf("found %d issues with severity %s, more than the threshold of %d",
+				r.IssuesBySeverity[severity], severity, threshold))
+		}
+	}
+	sort.Strings(failureReasons)
+	return failureReasons
+}
+
+func countDuplicateObservationsIssues(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error) {
+	return countDuplicateObservations(omopDataSource, rule.ConceptIds)
+}
+
+// Returns the number of (person, concept) pairs with more than one observation, for the given concepts.
+func countDuplicateObservations(omopDataSource *utils.DbAndSchema, conceptIds []int64) (int64, error) {
+	duplicateObservations := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
+		Select("observation.person_id, observation.observation_concept_id").
+		Where("observation.observation_concept_id in (?)", conceptIds).
+		Group("observation.person_id, observation.observation_concept_id").
+		Having("count(*) > 1")
+	query := omopDataSource.Db.Table("(?) as duplicate_observations", duplicateObservations).
+		Select("count(*)")
+	return scanDataQualityCount(query)
+}
+
+func countOutOfRangeValuesIssues(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error) {
+	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
+		Select("count(*)").
+		Where("observation.observation_concept_id in (?)", rule.ConceptIds).
+		Where("observation.value_as_number is not null")
+	if rule.MinValue != nil && rule.MaxValue != nil {
+		query = query.Where("(observation.value_as_number < ? OR observation.value_as_number > ?)", *rule.MinValue, *rule.MaxValue)
+	} else if rule.MinValue != nil {
+		query = query.Where("observation.value_as_number < ?", *rule.MinValue)
+	} else {
+		query = query.Where("observation.value_as_number > ?", *rule.MaxValue)
+	}
+	return scanDataQualityCount(query)
+}
+
+func countOrphanPersonIdsIssues(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error) {
+	query := omopDataSource.Db.Table(omopDataSource.Schema + ".observation as observation").
+		Select("count(distinct observation.person_id)").
+		Joins("LEFT JOIN " + omopDataSource.Schema + ".person as person ON person.person_id = observation.person_id").
+		Where("person.person_id is null")
+	return scanDataQualityCount(query)
+}
+
+func countCohortSubjectsWithoutObservationPeriodIssues(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error) {
+	query := resultsDataSource.Db.Table(resultsDataSource.Schema + ".cohort as cohort").
+		Select("count(distinct cohort.subject_id)").
+		Joins("LEFT JOIN " + omopDataSource.Schema + ".observation_period as observation_period ON observation_period.person_id = cohort.subject_id").
+		Where("observation_period.person_id is null")
+	return scanDataQualityCount(query)
+}
+
+func countUnknownConceptsIssues(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error) {
+	query := omopDataSource.Db.Table(omopDataSource.Schema + ".observation as observation").
+		Select("count(distinct observation.observation_concept_id)").
+		Joins("LEFT JOIN " + omopDataSource.Schema + ".concept as concept ON concept.concept_id = observation.observation_concept_id").
+		Where("concept.concept_id is null")
+	return scanDataQualityCount(query)
+}
+
+func countUnexpectedConceptClassesIssues(omopDataSource *utils.DbAndSchema, resultsDataSource *utils.DbAndSchema, rule DataQualityRule) (int64, error) {
+	query := omopDataSource.Db.Table(omopDataSource.Schema+".observation_continuous as observation"+omopDataSource.GetViewDirective()).
+		Select("count(distinct observation.observation_concept_id)").
+		Joins("INNER JOIN "+omopDataSource.Schema+".concept as concept ON concept.concept_id = observation.observation_concept_id").
+		Where("concept.concept_class_id not in (?)", rule.ConceptClassIds)
+	return scanDataQualityCount(query)
+}
+
+func scanDataQualityCount(query *gorm.DB) (int64, error) {
+	var count int64
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&count)
+	return count, meta_result.Error
+}
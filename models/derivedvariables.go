@@ -0,0 +1,187 @@
+package models
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// Concept ids of the derived (virtual) variables. Their values are not read from the observations, but
+// computed from the person table, and they can be used anywhere a concept id is accepted. OMOP leaves the
+// ids above 2000000000 to site specific concepts, so a source could have concepts with the same ids. That
+// is checked at startup (see ValidateDerivedConceptIds).
+const (
+	// the age, in years, of the person at the start of its first entry in the cohort:
+	AGE_AT_COHORT_START_CONCEPT_ID int64 = 3000000001
+	// the gender_concept_id of the person:
+	SEX_CONCEPT_ID int64 = 3000000002
+)
+
+// The vocabulary and concept classes of the derived variables (see GetValueKind).
+const (
+	DERIVED_VOCABULARY_ID            = "Cohort Middleware Derived"
+	DERIVED_CONTINUOUS_CONCEPT_CLASS = "Derived Continuous"
+	DERIVED_NOMINAL_CONCEPT_CLASS    = "Derived Nominal"
+)
+
+type derivedVariable struct {
+	ConceptCode string
+	ConceptName string
+	ConceptType string
+	// returns the SQL subquery with the observation_continuous columns for this variable, and its arguments:
+	getObservationsSQL func(omopDataSource *utils.DbAndSchema, resultsSchemaName string, cohortDefinitionId int, alias string) (string, []interface{}, error)
+}
+
+var derivedVariables = map[int64]derivedVariable{
+	AGE_AT_COHORT_START_CONCEPT_ID: {ConceptCode: "age_at_cohort_start", ConceptName: "Age at cohort start", ConceptType: DERIVED_CONTINUOUS_CONCEPT_CLASS, getObservationsSQL: getAgeAtCohortStartObservationsSQL},
+	SEX_CONCEPT_ID:                 {ConceptCode: "sex", ConceptName: "Sex", ConceptType: DERIVED_NOMINAL_CONCEPT_CLASS, getObservationsSQL: getSexObservationsSQL},
+}
+
+func IsDerivedConceptId(conceptId int64) bool {
+	_, exists := derivedVariables[conceptId]
+	return exists
+}
+
+// Returns an error if one of the sources has a concept with the id of a derived variable, as that concept
+// could then not be queried. Sources that can not be queried are skipped.
+func ValidateDerivedConceptIds() error {
+	derivedConceptIds := []int64{}
+	for conceptId := range derivedVariables {
+		derivedConceptIds = append(derivedConceptIds, conceptId)
+	}
+	var sourceModel = new(Source)
+	sources, _ := sourceModel.GetAllSources()
+	for _, source := range sources {
+		omopDataSource := sourceModel.GetDataSource(source.SourceId, Omop)
+		var clashingConceptIds []int64
+		query := omopDataSource.Db.Model(&Concept{}).
+			Select("concept_id").
+			Where("concept_id in (?)", derivedConceptIds)
+		query, cancel := utils.AddTimeoutToQuery(query)
+		meta_result := query.Scan(&clashingConceptIds)
+		cancel()
+		if meta_result.Error != nil {
+			log.Printf("WARNING: could not check the derived variable concept ids in source %d: %s", source.SourceId, meta_result.Error.Error())
+			continue
+		}
+		if len(clashingConceptIds) > 0 {
+			return fmt.Errorf("source %d has concepts with the ids %v, which are reserved for the derived variables", source.SourceId, clashingConceptIds)
+		}
+	}
+	return nil
+}
+
+// Splits the given concept ids into the ids of regular concepts and the ids of derived variables.
+func SplitDerivedConceptIds(conceptIds []int64) ([]int64, []int64) {
+	regularConceptIds := []int64{}
+	derivedConceptIds := []int64{}
+	for _, conceptId := range conceptIds {
+		if IsDerivedConceptId(conceptId) {
+			derivedConceptIds = append(derivedConceptIds, conceptId)
+		} else {
+			regularConceptIds = append(regularConceptIds, conceptId)
+		}
+	}
+	return regularConceptIds, derivedConceptIds
+}
+
+// Returns the concept info of the given derived variable, in the same form as the info of regular concepts.
+func getDerivedConceptInfo(conceptId int64) *ConceptSimple {
+	variable := derivedVariables[conceptId]
+	return &ConceptSimple{
+		ConceptId:         conceptId,
+		PrefixedConceptId: GetPrefixedConceptId(conceptId),
+		ConceptName:       variable.ConceptName,
+		ConceptCode:       variable.ConceptCode,
+		ConceptType:       variable.ConceptType,
+		DomainId:          "Person",
+		VocabularyId:      DERIVED_VOCABULARY_ID,
+	}
+}
+
+// Returns the value kind of the derived variables, which does not depend on the concept type registry.
+func getDerivedValueKind(conceptClassId string, vocabularyId string) (ValueKind, bool) {
+	if vocabularyId != DERIVED_VOCABULARY_ID {
+		return "", false
+	}
+	switch conceptClassId {
+	case DERIVED_CONTINUOUS_CONCEPT_CLASS:
+		return CONTINUOUS, true
+	case DERIVED_NOMINAL_CONCEPT_CLASS:
+		return NOMINAL, true
+	default:
+		return "", false
+	}
+}
+
+// Adds an INNER JOIN with the observations of the given concept to the query, with the given alias, on the given
+// person id field. For regular concepts this is the observation_continuous view. For derived variables it is a
+// subquery with the same columns (person_id, observation_concept_id, value_as_number, value_as_concept_id and
+// value_as_string), computed for the persons in the given cohort. For concepts with an aggregation policy (see
+// GetAggregationPolicy) it is a subquery with the single observation per person chosen by the policy. The caller
+// still adds the "<alias>.observation_concept_id = ?" filter, so all cases can be used in the same way.
+func JoinObservationsHelper(query *gorm.DB, sourceId int, omopDataSource *utils.DbAndSchema, resultsSchemaName string, cohortDefinitionId int,
+	conceptId int64, observationTableAlias string, personIdFieldForObservationJoin string) *gorm.DB {
+	var observationsSQL string
+	var args []interface{}
+	var err error
+	if variable, isDerived := derivedVariables[conceptId]; isDerived {
+		observationsSQL, args, err = variable.getObservationsSQL(omopDataSource, resultsSchemaName, cohortDefinitionId, observationTableAlias)
+	} else if policy := GetAggregationPolicy(conceptId); policy != NO_AGGREGATION {
+		observationsSQL, args, err = getAggregatedObservationsSQL(omopDataSource, sourceId, conceptId, policy, observationTableAlias)
+	} else {
+		return query.Joins("INNER JOIN " + omopDataSource.Schema + ".observation_continuous as " + observationTableAlias + omopDataSource.GetViewDirective() +
+			" ON " + observationTableAlias + ".person_id = " + personIdFieldForObservationJoin)
+	}
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		query.AddError(err)
+		return query
+	}
+	return query.Joins("INNER JOIN ("+observationsSQL+") as "+observationTableAlias+
+		" ON "+observationTableAlias+".person_id = "+personIdFieldForObservationJoin, args...)
+}
+
+// Returns the age at the start of the first entry in the cohort, in whole years. Missing birth months
+// and days are taken to be January and the 1st.
+func getAgeAtCohortStartObservationsSQL(omopDataSource *utils.DbAndSchema, resultsSchemaName string, cohortDefinitionId int, alias string) (string, []interface{}, error) {
+	cohortAlias := alias + "_cohort"
+	personAlias := alias + "_person"
+	startDate := cohortAlias + ".cohort_start_date"
+	var birthDate, ageSQL string
+	switch omopDataSource.Vendor {
+	case "sqlserver":
+		birthDate = "DATEFROMPARTS(" + personAlias + ".year_of_birth, COALESCE(" + personAlias + ".month_of_birth, 1), COALESCE(" + personAlias + ".day_of_birth, 1))"
+		ageSQL = "DATEDIFF(YEAR, " + birthDate + ", " + startDate + ") - " +
+			"CASE WHEN DATEADD(YEAR, DATEDIFF(YEAR, " + birthDate + ", " + startDate + "), " + birthDate + ") > " + startDate + " THEN 1 ELSE 0 END"
+	case "postgresql":
+		birthDate = "MAKE_DATE(" + personAlias + ".year_of_birth, COALESCE(" + personAlias + ".month_of_birth, 1), COALESCE(" + personAlias + ".day_of_birth, 1))"
+		ageSQL = "DATE_PART('year', AGE(" + startDate + ", " + birthDate + "))"
+	default:
+		return "", nil, utils.NewInternalError(fmt.Errorf("unsupported dialect %s", omopDataSource.Vendor))
+	}
+	observationsSQL := fmt.Sprintf("SELECT %s.subject_id as person_id, %d as observation_concept_id, CAST(%s AS FLOAT) as value_as_number, "+
+		"CAST(NULL AS INTEGER) as value_as_concept_id, CAST(NULL AS VARCHAR(60)) as value_as_string "+
+		"FROM (SELECT subject_id, MIN(cohort_start_date) as cohort_start_date FROM %s.cohort WHERE cohort_definition_id = ? GROUP BY subject_id) as %s "+
+		"INNER JOIN %s.person as %s ON %s.person_id = %s.subject_id "+
+		"WHERE %s.year_of_birth is not null",
+		cohortAlias, AGE_AT_COHORT_START_CONCEPT_ID, ageSQL,
+		resultsSchemaName, cohortAlias,
+		omopDataSource.Schema, personAlias, personAlias, cohortAlias,
+		personAlias)
+	return observationsSQL, []interface{}{cohortDefinitionId}, nil
+}
+
+// Returns the gender_concept_id of the persons as a nominal value.
+func getSexObservationsSQL(omopDataSource *utils.DbAndSchema, resultsSchemaName string, cohortDefinitionId int, alias string) (string, []interface{}, error) {
+	personAlias := alias + "_person"
+	observationsSQL := fmt.Sprintf("SELECT %s.person_id, %d as observation_concept_id, CAST(NULL AS FLOAT) as value_as_number, "+
+		"%s.gender_concept_id as value_as_concept_id, CAST(NULL AS VARCHAR(60)) as value_as_string "+
+		"FROM %s.person as %s",
+		personAlias, SEX_CONCEPT_ID,
+		personAlias,
+		omopDataSource.Schema, personAlias)
+	return observationsSQL, []interface{}{}, nil
+}
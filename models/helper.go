@@ -12,35 +12,38 @@ import (
 //   - It was added here to make it reusable, given these filters need to be added to many of the queries that take in
 //     a list of filters in the form of concept ids.
 func QueryFilterByConceptIdsHelper(query *gorm.DB, sourceId int, filterConceptIds []int64,
-	omopDataSource *utils.DbAndSchema, resultSchemaName string, personIdFieldForObservationJoin string) *gorm.DB {
+	omopDataSource *utils.DbAndSchema, resultSchemaName string, cohortDefinitionId int, personIdFieldForObservationJoin string) *gorm.DB {
+	// retrieve the info of all concepts at once, so that AddConceptValueNotNullCheckToQuery finds it in the cache:
+	preloadConceptInfo(sourceId, filterConceptIds)
 	// iterate over the filterConceptIds, adding a new INNER JOIN and filters for each, so that the resulting set is the
 	// set of persons that have a non-null value for each and every one of the concepts:
 	for i, filterConceptId := range filterConceptIds {
 		observationTableAlias := fmt.Sprintf("observation_filter_%d", i)
 		log.Printf("Adding extra INNER JOIN with alias %s", observationTableAlias)
-		query = query.Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as "+observationTableAlias+omopDataSource.GetViewDirective()+" ON "+observationTableAlias+".person_id = "+personIdFieldForObservationJoin).
-			Where(observationTableAlias+".observation_concept_id = ?", filterConceptId).
-			Where(GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias, sourceId, filterConceptId))
+		query = JoinObservationsHelper(query, sourceId, omopDataSource, resultSchemaName, cohortDefinitionId, filterConceptId, observationTableAlias, personIdFieldForObservationJoin).
+			Where(observationTableAlias+".observation_concept_id = ?", filterConceptId)
+		query = AddConceptValueNotNullCheckToQuery(query, observationTableAlias, sourceId, filterConceptId)
 	}
 	return query
 }
 
 // Same as Query Filter above but adds additional value filter as well
 func QueryFilterByConceptIdsAndValuesHelper(query *gorm.DB, sourceId int, filterConceptIdsAndValues []utils.CustomConceptVariableDef,
-	omopDataSource *utils.DbAndSchema, resultSchemaName string, personIdFieldForObservationJoin string) *gorm.DB {
+	omopDataSource *utils.DbAndSchema, resultSchemaName string, cohortDefinitionId int, personIdFieldForObservationJoin string) *gorm.DB {
+	preloadConceptInfo(sourceId, utils.ExtractConceptIdsFromCustomConceptVariablesDef(filterConceptIdsAndValues))
 	// iterate over the filterConceptIds, adding a new INNER JOIN and filters for each, so that the resulting set is the
 	// set of persons that have a non-null value for each and every one of the concepts:
 	for i, filterConceptIdAndValue := range filterConceptIdsAndValues {
 		observationTableAlias := fmt.Sprintf("observation_filter_%d", i)
 		log.Printf("Adding extra INNER JOIN with alias %s", observationTableAlias)
-		query = query.Joins("INNER JOIN "+omopDataSource.Schema+".observation_continuous as "+observationTableAlias+omopDataSource.GetViewDirective()+" ON "+observationTableAlias+".person_id = "+personIdFieldForObservationJoin).
+		query = JoinObservationsHelper(query, sourceId, omopDataSource, resultSchemaName, cohortDefinitionId, filterConceptIdAndValue.ConceptId, observationTableAlias, personIdFieldForObservationJoin).
 			Where(observationTableAlias+".observation_concept_id = ?", filterConceptIdAndValue.ConceptId)
 
 		//If filter by value, add the value filtering clauses to the query
 		if len(filterConceptIdAndValue.ConceptValues) > 0 {
 			query = query.Where(observationTableAlias+".value_as_concept_id in ?", filterConceptIdAndValue.ConceptValues)
 		} else {
-			query = query.Where(GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias, sourceId, filterConceptIdAndValue.ConceptId))
+			query = AddConceptValueNotNullCheckToQuery(query, observationTableAlias, sourceId, filterConceptIdAndValue.ConceptId)
 		}
 	}
 	return query
@@ -52,10 +55,45 @@ func QueryFilterByConceptIdsAndValuesHelper(query *gorm.DB, sourceId int, filter
 // set of persons that are part of the intersections of cohortDefinitionId and of one of the cohorts in the filterCohortPairs. The EXCEPT
 // clauses exclude the persons that are found in both cohorts of a filterCohortPair.
 func QueryFilterByCohortPairsHelper(filterCohortPairs []utils.CustomDichotomousVariableDef, resultsDataSource *utils.DbAndSchema, cohortDefinitionId int, unionAndIntersectSQLAlias string) *gorm.DB {
+	return QueryFilterByCohortPairsAndBaseCohortFiltersHelper(filterCohortPairs, nil, nil, resultsDataSource, nil, cohortDefinitionId, unionAndIntersectSQLAlias)
+}
+
+// Same as QueryFilterByCohortPairsHelper, but also filters the persons of cohortDefinitionId itself: only the ones that have
+// the observation period given by observationPeriodFilter (if not nil, see GetObservationPeriodConditionSQL) and that match
+// each of the given filterTemporalVariables (see GetTemporalVariableConditionSQL) are kept. The omopDataSource is only used
+// when an observationPeriodFilter is given.
+func QueryFilterByCohortPairsAndBaseCohortFiltersHelper(filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef,
+	observationPeriodFilter *utils.ObservationPeriodFilter, resultsDataSource *utils.DbAndSchema, omopDataSource *utils.DbAndSchema, cohortDefinitionId int, unionAndIntersectSQLAlias string) *gorm.DB {
 	unionAndIntersectSQL := "(" +
 		"SELECT subject_id FROM " + resultsDataSource.Schema + ".cohort WHERE cohort_definition_id=? "
 	var idsList []interface{}
 	idsList = append(idsList, cohortDefinitionId)
+	if len(filterTemporalVariables) > 0 || observationPeriodFilter != nil {
+		unionAndIntersectSQL = "(" +
+			"SELECT main_cohort.subject_id FROM " + resultsDataSource.Schema + ".cohort AS main_cohort "
+		conditionsSQL := ""
+		var conditionsArgs []interface{}
+		if observationPeriodFilter != nil {
+			unionAndIntersectSQL = unionAndIntersectSQL + "INNER JOIN " + omopDataSource.Schema + ".observation_period AS main_observation_period " +
+				"ON main_observation_period.person_id = main_cohort.subject_id "
+			conditionSQL, conditionArgs, err := GetObservationPeriodConditionSQL(resultsDataSource, *observationPeriodFilter, "main_cohort", "main_observation_period")
+			if err != nil {
+				return getQueryWithError(resultsDataSource, err)
+			}
+			conditionsSQL = conditionsSQL + "AND " + conditionSQL + " "
+			conditionsArgs = append(conditionsArgs, conditionArgs...)
+		}
+		for i, filterTemporalVariable := range filterTemporalVariables {
+			conditionSQL, conditionArgs, err := GetTemporalVariableConditionSQL(resultsDataSource, filterTemporalVariable, "main_cohort", i)
+			if err != nil {
+				return getQueryWithError(resultsDataSource, err)
+			}
+			conditionsSQL = conditionsSQL + "AND " + conditionSQL + " "
+			conditionsArgs = append(conditionsArgs, conditionArgs...)
+		}
+		unionAndIntersectSQL = unionAndIntersectSQL + "WHERE main_cohort.cohort_definition_id=? " + conditionsSQL
+		idsList = append(idsList, conditionsArgs...)
+	}
 	if len(filterCohortPairs) > 0 {
 		// INTERSECT UNIONs section:
 		for _, filterCohortPair := range filterCohortPairs {
@@ -83,38 +121,188 @@ func QueryFilterByCohortPairsHelper(filterCohortPairs []utils.CustomDichotomousV
 	return query
 }
 
+// Returns a query on the cohort table that fails with the given error when executed.
+func getQueryWithError(resultsDataSource *utils.DbAndSchema, err error) *gorm.DB {
+	log.Printf("Error: %s", err.Error())
+	query := resultsDataSource.Db.Table(resultsDataSource.Schema + ".cohort")
+	query.AddError(err)
+	return query
+}
+
+// Adds a join with the observation_period table to the query, keeping only the rows of the cohort table with the
+// given alias that have the observation period given by observationPeriodFilter (see GetObservationPeriodConditionSQL).
+// Nothing is added if observationPeriodFilter is nil.
+func QueryFilterByObservationPeriodHelper(query *gorm.DB, observationPeriodFilter *utils.ObservationPeriodFilter, resultsDataSource *utils.DbAndSchema,
+	omopDataSource *utils.DbAndSchema, cohortTableAlias string) *gorm.DB {
+	if observationPeriodFilter == nil {
+		return query
+	}
+	observationPeriodAlias := cohortTableAlias + "_observation_period"
+	conditionSQL, conditionArgs, err := GetObservationPeriodConditionSQL(resultsDataSource, *observationPeriodFilter, cohortTableAlias, observationPeriodAlias)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		query.AddError(err)
+		return query
+	}
+	return query.Joins("INNER JOIN "+omopDataSource.Schema+".observation_period AS "+observationPeriodAlias+" ON "+observationPeriodAlias+".person_id = "+cohortTableAlias+".subject_id").
+		Where(conditionSQL, conditionArgs...)
+}
+
+// Returns the SQL condition, and its arguments, that checks whether the observation period with the given alias covers
+// the look back and follow-up windows of the entry in the cohort table with the given alias. This is the same check as
+// the one in QueryFilterByCohortIdAndObservationWindowHelper, extended with the follow-up window, e.g. on postgres:
+//
+//	main_observation_period.observation_period_start_date <= ((INTERVAL '1 day' * -365) + main_cohort.cohort_start_date)
+//	  AND main_observation_period.observation_period_end_date > main_cohort.cohort_start_date
+//	  AND main_observation_period.observation_period_end_date >= ((INTERVAL '1 day' * 30) + main_cohort.cohort_start_date)
+func GetObservationPeriodConditionSQL(resultsDataSource *utils.DbAndSchema, observationPeriodFilter utils.ObservationPeriodFilter, cohortTableAlias string, observationPeriodAlias string) (string, []interface{}, error) {
+	cohortStartPlusDaysSQL, err := getDateAddSQL(resultsDataSource, cohortTableAlias+".cohort_start_date")
+	if err != nil {
+		return "", nil, err
+	}
+	conditionSQL := observationPeriodAlias + ".observation_period_start_date <= " + cohortStartPlusDaysSQL +
+		" AND " + observationPeriodAlias + ".observation_period_end_date > " + cohortTableAlias + ".cohort_start_date"
+	args := []interface{}{-observationPeriodFilter.ObservationWindow}
+	if observationPeriodFilter.FollowUpWindow > 0 {
+		conditionSQL = conditionSQL + " AND " + observationPeriodAlias + ".observation_period_end_date >= " + cohortStartPlusDaysSQL
+		args = append(args, observationPeriodFilter.FollowUpWindow)
+	}
+	return conditionSQL, args, nil
+}
+
+// Adds a filter to the query for each of the given filterTemporalVariables, keeping only the rows of the cohort
+// table with the given alias that match all of them (see GetTemporalVariableConditionSQL).
+func QueryFilterByTemporalVariablesHelper(query *gorm.DB, filterTemporalVariables []utils.CustomTemporalVariableDef, resultsDataSource *utils.DbAndSchema, cohortTableAlias string) *gorm.DB {
+	for i, filterTemporalVariable := range filterTemporalVariables {
+		conditionSQL, conditionArgs, err := GetTemporalVariableConditionSQL(resultsDataSource, filterTemporalVariable, cohortTableAlias, i)
+		if err != nil {
+			log.Printf("Error: %s", err.Error())
+			query.AddError(err)
+			return query
+		}
+		query = query.Where(conditionSQL, conditionArgs...)
+	}
+	return query
+}
+
+// Returns the SQL condition, and its arguments, that checks whether the person of the entry in the cohort table with
+// the given alias also has an entry in the cohort of the given temporalVariable that starts in the requested relation
+// to it. E.g. for {CohortDefinitionId: 5, Anchor: "start", Relation: "after", MinDays: 0, MaxDays: 30} on postgres:
+//
+//	EXISTS (SELECT 1 FROM results.cohort AS temporal_filter_0 WHERE temporal_filter_0.cohort_definition_id = 5
+//	  AND temporal_filter_0.subject_id = main_cohort.subject_id
+//	  AND temporal_filter_0.cohort_start_date >= ((INTERVAL '1 day' * 0) + main_cohort.cohort_start_date)
+//	  AND temporal_filter_0.cohort_start_date <= ((INTERVAL '1 day' * 30) + main_cohort.cohort_start_date))
+//
+// The index is used to make the table aliases unique when multiple conditions are added to the same query.
+func GetTemporalVariableConditionSQL(resultsDataSource *utils.DbAndSchema, temporalVariable utils.CustomTemporalVariableDef, cohortTableAlias string, index int) (string, []interface{}, error) {
+	otherAlias := fmt.Sprintf("temporal_filter_%d", index)
+	anchorColumn := cohortTableAlias + ".cohort_start_date"
+	if temporalVariable.Anchor == utils.ANCHOR_END {
+		anchorColumn = cohortTableAlias + ".cohort_end_date"
+	}
+	anchorPlusDaysSQL, err := getDateAddSQL(resultsDataSource, anchorColumn)
+	if err != nil {
+		return "", nil, err
+	}
+	conditionSQL := "EXISTS (SELECT 1 FROM " + resultsDataSource.Schema + ".cohort AS " + otherAlias +
+		" WHERE " + otherAlias + ".cohort_definition_id = ? AND " + otherAlias + ".subject_id = " + cohortTableAlias + ".subject_id"
+	args := []interface{}{temporalVariable.CohortDefinitionId}
+	otherStartColumn := otherAlias + ".cohort_start_date"
+	switch temporalVariable.Relation {
+	case utils.RELATION_BEFORE:
+		conditionSQL = conditionSQL + " AND " + otherStartColumn + " <= " + anchorPlusDaysSQL
+		args = append(args, -temporalVariable.MinDays)
+		if temporalVariable.MaxDays != nil {
+			conditionSQL = conditionSQL + " AND " + otherStartColumn + " >= " + anchorPlusDaysSQL
+			args = append(args, -*temporalVariable.MaxDays)
+		}
+	case utils.RELATION_AFTER:
+		conditionSQL = conditionSQL + " AND " + otherStartColumn + " >= " + anchorPlusDaysSQL
+		args = append(args, temporalVariable.MinDays)
+		if temporalVariable.MaxDays != nil {
+			conditionSQL = conditionSQL + " AND " + otherStartColumn + " <= " + anchorPlusDaysSQL
+			args = append(args, *temporalVariable.MaxDays)
+		}
+	case utils.RELATION_DURING:
+		conditionSQL = conditionSQL + " AND " + otherStartColumn + " >= " + cohortTableAlias + ".cohort_start_date" +
+			" AND " + otherStartColumn + " <= " + cohortTableAlias + ".cohort_end_date"
+	default:
+		return "", nil, utils.NewInvalidInputError(fmt.Errorf("unsupported relation %s", temporalVariable.Relation))
+	}
+	if temporalVariable.Occurrence == utils.OCCURRENCE_FIRST {
+		firstEntryAlias := fmt.Sprintf("first_entry_%d", index)
+		conditionSQL = conditionSQL + " AND " + otherStartColumn + " = (SELECT MIN(" + firstEntryAlias + ".cohort_start_date) FROM " +
+			resultsDataSource.Schema + ".cohort AS " + firstEntryAlias + " WHERE " + firstEntryAlias + ".cohort_definition_id = " + otherAlias + ".cohort_definition_id" +
+			" AND " + firstEntryAlias + ".subject_id = " + otherAlias + ".subject_id)"
+	}
+	return conditionSQL + ")", args, nil
+}
+
+// Returns the SQL that adds a number of days, given as a "?" argument, to the given date column.
+func getDateAddSQL(dataSource *utils.DbAndSchema, dateColumn string) (string, error) {
+	switch dataSource.Vendor {
+	case "sqlserver":
+		return "DATEADD(DAY, ?, " + dateColumn + ")", nil
+	case "postgresql":
+		return "((INTERVAL '1 day' * ?) + " + dateColumn + ")", nil
+	default:
+		return "", utils.NewInternalError(fmt.Errorf("unsupported dialect %s", dataSource.Vendor))
+	}
+}
+
 func QueryFilterByCohortIdAndObservationWindowHelper(resultsDataSource *utils.DbAndSchema, omopDataSource *utils.DbAndSchema, cohortId int, observationWindow int) *gorm.DB {
 	// Query to filter and count persons in cohort:
 	query := resultsDataSource.Db.Model(&Cohort{}).
 		Select("count(distinct(cohort.subject_id)) AS cohort_size").
 		Joins("JOIN " + omopDataSource.Schema + ".observation_period ON cohort.subject_id = observation_period.person_id")
 
-	switch resultsDataSource.Db.Name() {
+	switch resultsDataSource.Vendor {
 	case "sqlserver":
 		query = query.Where("observation_period.observation_period_start_date <= DATEADD(DAY, ?, cohort.cohort_start_date)", -observationWindow)
-	case "postgres":
+	case "postgresql":
 		query = query.Where("observation_period.observation_period_start_date <= ((INTERVAL '1 day' * ?) + cohort.cohort_start_date)", -observationWindow)
 	default:
-		log.Fatal("Unsupported dialect")
+		query.AddError(utils.NewInternalError(fmt.Errorf("unsupported dialect %s", resultsDataSource.Vendor)))
 	}
 	query = query.Where("observation_period.observation_period_end_date > cohort.cohort_start_date").
 		Where("cohort.cohort_definition_id = ?", cohortId)
 	return query
 }
 
+// Loads the info of the given concepts into the concept info cache. Errors are ignored here, since
+// they are reported anyway when the info of a single concept is requested.
+func preloadConceptInfo(sourceId int, conceptIds []int64) {
+	if len(conceptIds) > 1 {
+		_, _ = retrieveConceptInfoUsingCache(sourceId, conceptIds, retrieveInfoBySourceIdAndConceptIdsFromDb)
+	}
+}
+
 // This function will get the concept information for given conceptId, and
 // return the best SQL to use for doing a "not null" check on its value in the
-// observation table.
-func GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias string, sourceId int, conceptId int64) string {
+// observation table, based on the value kind of the concept (see GetConceptTypeRules).
+func GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias string, sourceId int, conceptId int64) (string, error) {
 	conceptModel := *new(Concept)
-	conceptInfo, error := conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptId)
-	if error != nil {
-		panic("error while trying to get information for conceptId, or conceptId not found")
-	} else if conceptInfo.ConceptType == "MVP Continuous" {
-		return observationTableAlias + ".value_as_number is not null"
-	} else if conceptInfo.ConceptType == "MVP Nominal" {
-		return observationTableAlias + ".value_as_concept_id is not null and " + observationTableAlias + ".value_as_concept_id != 0"
-	} else {
-		panic(fmt.Sprintf("error: concept type not supported [%s]", conceptInfo.ConceptType))
+	conceptInfo, err := conceptModel.RetrieveInfoBySourceIdAndConceptId(sourceId, conceptId)
+	if err != nil {
+		return "", fmt.Errorf("error while trying to get information for conceptId %d: %w", conceptId, err)
+	}
+	valueKindBehavior, err := GetValueKindBehaviorForConcept(conceptInfo)
+	if err != nil {
+		return "", utils.NewInvalidInputError(fmt.Errorf("error: %s", err.Error()))
+	}
+	return valueKindBehavior.NotNullCheck(observationTableAlias), nil
+}
+
+// Adds the "not null" check returned by GetConceptValueNotNullCheckBasedOnConceptType to the query. If
+// the check cannot be determined, the error is added to the query instead, so that it is returned
+// when the query is executed.
+func AddConceptValueNotNullCheckToQuery(query *gorm.DB, observationTableAlias string, sourceId int, conceptId int64) *gorm.DB {
+	notNullCheck, err := GetConceptValueNotNullCheckBasedOnConceptType(observationTableAlias, sourceId, conceptId)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		query.AddError(err)
+		return query
 	}
+	return query.Where(notNullCheck)
 }
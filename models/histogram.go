@@ -0,0 +1,299 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/uc-cdis/cohort-middleware/utils"
+	"gorm.io/gorm"
+)
+
+// Below this number of values, the histogram is calculated in memory instead of in the DB,
+// since transferring the values is cheaper than the extra summary and binning queries
+// (a var, so that tests can force the DB path):
+var MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM = 1000
+
+type valueAggregates struct {
+	NumberOfValues         int
+	NumberOfDistinctValues int64
+	MinValue               float64
+	MaxValue               float64
+	Sd                     float64
+}
+
+type valueQuantiles struct {
+	Median                float64
+	FirstQuartile         float64
+	ThirdQuartile         float64
+	FirstPercentile       float64
+	NinetyNinthPercentile float64
+}
+
+type clipBounds struct {
+	LowerBound float64
+	UpperBound float64
+}
+
+type histogramBinCount struct {
+	BinIndex    int
+	PersonCount int
+}
+
+// Returns the histogram for the values of the given concept in the given cohort, for the persons that
+// match the given filters. The bins are counted in the DB, unless there are only a few values.
+func (h CohortData) RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.HistogramMetadata, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+
+	valuesQuery := QueryFilterByCohortPairsAndBaseCohortFiltersHelper(filterCohortPairs, filterTemporalVariables, observationPeriodFilter, resultsDataSource, omopDataSource, cohortDefinitionId, "unionAndIntersect").
+		Select("distinct(observation.person_id), observation.value_as_number as value").
+		Where("observation.observation_concept_id = ?", histogramConceptId).
+		Where("observation.value_as_number is not null")
+	valuesQuery = JoinObservationsHelper(valuesQuery, sourceId, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, histogramConceptId, "observation", "unionAndIntersect.subject_id")
+	valuesQuery = QueryFilterByConceptIdsAndValuesHelper(valuesQuery, sourceId, filterConceptIdsAndValues, omopDataSource, resultsDataSource.Schema, cohortDefinitionId, "unionAndIntersect.subject_id")
+
+	histogram, metadata, _, err := retrieveHistogramForValuesQuery(omopDataSource, valuesQuery, options)
+	return histogram, metadata, err
+}
+
+// Returns the histogram and the value summary for the values of the given concept in the whole CDM.
+func (h CohortData) RetrieveHistogramAndValueSummaryBySourceIdAndConceptId(sourceId int, histogramConceptId int64, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.ValueSummary, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+
+	valuesQuery := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+		Select("distinct(observation.person_id), observation.value_as_number as value").
+		Where("observation.observation_concept_id = ?", histogramConceptId).
+		Where("observation.value_as_number is not null")
+
+	histogram, _, summary, err := retrieveHistogramForValuesQuery(omopDataSource, valuesQuery, options)
+	return histogram, summary, err
+}
+
+// Same as RetrieveHistogramAndValueSummaryBySourceIdAndConceptId, but only for the persons in the given cohort.
+func (h CohortData) RetrieveHistogramAndValueSummaryBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, histogramConceptId int64, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.ValueSummary, error) {
+	var dataSourceModel = new(Source)
+	omopDataSource := dataSourceModel.GetDataSource(sourceId, Omop)
+	resultsDataSource := dataSourceModel.GetDataSource(sourceId, Results)
+
+	valuesQuery := omopDataSource.Db.Table(omopDataSource.Schema+".observation as observation").
+		Select("distinct(observation.person_id), observation.value_as_number as value").
+		Joins("INNER JOIN (SELECT DISTINCT subject_id FROM "+resultsDataSource.Schema+".cohort WHERE cohort_definition_id = ?) as cohort ON cohort.subject_id = observation.person_id", cohortDefinitionId).
+		Where("observation.observation_concept_id = ?", histogramConceptId).
+		Where("observation.value_as_number is not null")
+
+	histogram, _, summary, err := retrieveHistogramForValuesQuery(omopDataSource, valuesQuery, options)
+	return histogram, summary, err
+}
+
+// Calculates the histogram for the values returned by valuesQuery (which should have a "value" column).
+// The min, max and quantiles of the values are calculated in the DB, and the values are then binned in
+// the DB as well, so only the bin counts are transferred. Falls back to calculating the histogram in memory
+// if there are less than MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM values. Also returns the summary of the
+// (clipped) values, or nil if there are no values.
+func retrieveHistogramForValuesQuery(dataSource *utils.DbAndSchema, valuesQuery *gorm.DB, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.HistogramMetadata, *utils.ValueSummary, error) {
+	var numberOfValues int
+	query := dataSource.Db.Table("(?) as histogram_values", valuesQuery).
+		Select("count(*)")
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&numberOfValues)
+	if meta_result.Error != nil {
+		return nil, nil, nil, meta_result.Error
+	}
+
+	if numberOfValues == 0 || numberOfValues < MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM {
+		log.Printf("INFO: only %d values found, calculating histogram in memory", numberOfValues)
+		var conceptValues []float64
+		query := dataSource.Db.Table("(?) as histogram_values", valuesQuery).
+			Select("histogram_values.value")
+		query, cancel := utils.AddTimeoutToQuery(query)
+		defer cancel()
+		meta_result := query.Scan(&conceptValues)
+		if meta_result.Error != nil {
+			return nil, nil, nil, meta_result.Error
+		}
+		histogram, metadata := utils.GenerateHistogramDataWithOptions(conceptValues, options)
+		return histogram, metadata, utils.GenerateValueSummary(conceptValues), nil
+	}
+
+	var clipLowerBound, clipUpperBound *float64
+	if len(options.ClipPercentiles) == 2 {
+		bounds, err := retrieveClipBounds(dataSource, valuesQuery, options.ClipPercentiles)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		clipLowerBound, clipUpperBound = &bounds.LowerBound, &bounds.UpperBound
+		valuesQuery = dataSource.Db.Table("(?) as unclipped_values", valuesQuery).
+			Select("unclipped_values.value").
+			Where("unclipped_values.value >= ?", bounds.LowerBound).
+			Where("unclipped_values.value <= ?", bounds.UpperBound)
+	}
+
+	summary, err := retrieveValueSummary(dataSource, valuesQuery)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	histogram, metadata := utils.GenerateEmptyHistogramBins(summary, options)
+	metadata.ClipLowerBound = clipLowerBound
+	metadata.ClipUpperBound = clipUpperBound
+	metadata.NumberOfOutliersExcluded = numberOfValues - summary.NumberOfValues
+
+	binCounts, err := retrieveHistogramBinCounts(dataSource, valuesQuery, histogram, metadata)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	metadata.NumberOfOutliersExcluded += utils.SetHistogramBinCounts(histogram, binCounts)
+	return histogram, metadata, summary, nil
+}
+
+// Returns the SQL for the given percentile function ("percentile_cont" or "percentile_disc") of the
+// values, for the given fraction (between 0 and 1).
+func getPercentileSQL(dataSource *utils.DbAndSchema, percentileFunction string, fraction float64, alias string) string {
+	return getPercentileOfExpressionSQL(dataSource, percentileFunction, fraction, "value") + " as " + alias
+}
+
+// Same as getPercentileSQL, but for the values of the given SQL expression, without an alias. NULL values
+// are left out, and the result is NULL if all values are NULL.
+func getPercentileOfExpressionSQL(dataSource *utils.DbAndSchema, percentileFunction string, fraction float64, valueExpression string) string {
+	switch dataSource.Vendor {
+	case "sqlserver":
+		// only available as window function in SQL Server:
+		return fmt.Sprintf("%s(%v) WITHIN GROUP (ORDER BY %s) OVER ()", strings.ToUpper(percentileFunction), fraction, valueExpression)
+	default:
+		return fmt.Sprintf("%s(%v) WITHIN GROUP (ORDER BY %s)", percentileFunction, fraction, valueExpression)
+	}
+}
+
+// Returns the "nearest rank" percentiles of the values for the given lower and upper percentiles. These match
+// the bounds used when clipping in memory.
+func retrieveClipBounds(dataSource *utils.DbAndSchema, valuesQuery *gorm.DB, clipPercentiles []float64) (*clipBounds, error) {
+	var bounds clipBounds
+	query := dataSource.Db.Table("(?) as histogram_values", valuesQuery).
+		Select(getDistinctDirective(dataSource) +
+			getPercentileSQL(dataSource, "percentile_disc", clipPercentiles[0]/100, "lower_bound") + ", " +
+			getPercentileSQL(dataSource, "percentile_disc", clipPercentiles[1]/100, "upper_bound"))
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&bounds)
+	return &bounds, meta_result.Error
+}
+
+// Window functions return one row per value, so these need to be reduced to a single row:
+func getDistinctDirective(dataSource *utils.DbAndSchema) string {
+	if dataSource.Vendor == "sqlserver" {
+		return "DISTINCT "
+	}
+	return ""
+}
+
+// Returns the summary of the values returned by valuesQuery, calculated in the DB.
+func retrieveValueSummary(dataSource *utils.DbAndSchema, valuesQuery *gorm.DB) (*utils.ValueSummary, error) {
+	standardDeviationFunction := "stddev_samp"
+	if dataSource.Vendor == "sqlserver" {
+		standardDeviationFunction = "STDEV"
+	}
+	var aggregates valueAggregates
+	query := dataSource.Db.Table("(?) as histogram_values", valuesQuery).
+		Select("count(*) as number_of_values, count(distinct value) as number_of_distinct_values, " +
+			"min(value) as min_value, max(value) as max_value, coalesce(" + standardDeviationFunction + "(value), 0) as sd")
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&aggregates)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	}
+
+	// the quartiles are the medians of the lower and upper half of the values (leaving out the middle value if
+	// the number of values is odd), as calculated in memory by stats.Quartile (see utils.GenerateValueDistributionStats
+	// and utils.IQR), and the median if there is only one value:
+	rankedValuesQuery := dataSource.Db.Table("(?) as histogram_values", valuesQuery).
+		Select("value, ROW_NUMBER() OVER (ORDER BY value) as value_rank, COUNT(*) OVER () as number_of_values")
+	medianSQL := getPercentileOfExpressionSQL(dataSource, "percentile_cont", 0.5, "value")
+	firstQuartileSQL := "COALESCE(" + getPercentileOfExpressionSQL(dataSource, "percentile_cont", 0.5,
+		"CASE WHEN value_rank <= number_of_values / 2 THEN value END") + ", " + medianSQL + ")"
+	thirdQuartileSQL := "COALESCE(" + getPercentileOfExpressionSQL(dataSource, "percentile_cont", 0.5,
+		"CASE WHEN value_rank > number_of_values - number_of_values / 2 THEN value END") + ", " + medianSQL + ")"
+	var quantiles valueQuantiles
+	query = dataSource.Db.Table("(?) as ranked_values", rankedValuesQuery).
+		Select(getDistinctDirective(dataSource) +
+			medianSQL + " as median, " +
+			firstQuartileSQL + " as first_quartile, " +
+			thirdQuartileSQL + " as third_quartile, " +
+			getPercentileSQL(dataSource, "percentile_disc", 0.01, "first_percentile") + ", " +
+			getPercentileSQL(dataSource, "percentile_disc", 0.99, "ninety_ninth_percentile"))
+	query, cancel = utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result = query.Scan(&quantiles)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	}
+
+	summary := &utils.ValueSummary{
+		NumberOfValues: aggregates.NumberOfValues,
+		Min:            aggregates.MinValue,
+		Max:            aggregates.MaxValue,
+		Sd:             aggregates.Sd,
+		ValueDistributionStats: utils.ValueDistributionStats{
+			Median:                 quantiles.Median,
+			FirstQuartile:          quantiles.FirstQuartile,
+			ThirdQuartile:          quantiles.ThirdQuartile,
+			FirstPercentile:        quantiles.FirstPercentile,
+			NinetyNinthPercentile:  quantiles.NinetyNinthPercentile,
+			NumberOfDistinctValues: aggregates.NumberOfDistinctValues,
+		},
+	}
+	return summary, nil
+}
+
+// Returns the SQL expression for the index of the histogram bin each value falls in, together with its
+// arguments. For BREAKS, values outside of the break points get index -1.
+func getHistogramBinIndexSQL(dataSource *utils.DbAndSchema, histogram []utils.HistogramColumn, metadata *utils.HistogramMetadata) (string, []interface{}) {
+	numBins := len(histogram)
+	lastBinIndex := numBins - 1
+	if metadata.Strategy == utils.BREAKS {
+		binIndexSQL := "CASE WHEN value < ? OR value > ? THEN -1 "
+		args := []interface{}{histogram[0].Start, histogram[lastBinIndex].End}
+		for binIndex := 0; binIndex < lastBinIndex; binIndex++ {
+			binIndexSQL += fmt.Sprintf("WHEN value < ? THEN %d ", binIndex)
+			args = append(args, histogram[binIndex].End)
+		}
+		binIndexSQL += fmt.Sprintf("ELSE %d END", lastBinIndex)
+		return binIndexSQL, args
+	}
+
+	startValue := histogram[0].Start
+	switch dataSource.Vendor {
+	case "sqlserver":
+		return "CASE WHEN FLOOR((value - ?) / ?) >= ? THEN ? ELSE CAST(FLOOR((value - ?) / ?) AS int) END",
+			[]interface{}{startValue, metadata.BinWidth, numBins, lastBinIndex, startValue, metadata.BinWidth}
+	default:
+		// the max value falls on the end of the last bin, for which width_bucket returns numBins+1:
+		return "LEAST(width_bucket(CAST(value AS float8), CAST(? AS float8), CAST(? AS float8), ?), ?) - 1",
+			[]interface{}{startValue, startValue + metadata.BinWidth*float64(numBins), numBins, numBins}
+	}
+}
+
+// Returns the number of values found in each histogram bin, by bin index, counted in the DB.
+func retrieveHistogramBinCounts(dataSource *utils.DbAndSchema, valuesQuery *gorm.DB, histogram []utils.HistogramColumn, metadata *utils.HistogramMetadata) (map[int]int, error) {
+	binIndexSQL, args := getHistogramBinIndexSQL(dataSource, histogram, metadata)
+	binnedValuesQuery := dataSource.Db.Table("(?) as histogram_values", valuesQuery).
+		Select(binIndexSQL+" as bin_index", args...)
+	var histogramBinCounts []*histogramBinCount
+	query := dataSource.Db.Table("(?) as binned_values", binnedValuesQuery).
+		Select("binned_values.bin_index, count(*) as person_count").
+		Group("binned_values.bin_index")
+	query, cancel := utils.AddTimeoutToQuery(query)
+	defer cancel()
+	meta_result := query.Scan(&histogramBinCounts)
+	if meta_result.Error != nil {
+		return nil, meta_result.Error
+	}
+	binCounts := make(map[int]int)
+	for _, histogramBinCount := range histogramBinCounts {
+		binCounts[histogramBinCount.BinIndex] = histogramBinCount.PersonCount
+	}
+	return binCounts, nil
+}
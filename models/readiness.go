@@ -0,0 +1,118 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/db"
+	"github.com/uc-cdis/cohort-middleware/utils"
+)
+
+type ReadinessI interface {
+	CheckComponents(ctx context.Context, timeout time.Duration) []utils.ComponentStatus
+}
+
+type Readiness struct{}
+
+type readinessSchemaCheck struct {
+	SourceType SourceType
+	Name       string
+	// a table that is expected in the schema:
+	Table    string
+	Critical bool
+}
+
+// The schemas checked for each source. The misc schema is only used for the data dictionary, so it is not critical.
+var readinessSchemaChecks = []readinessSchemaCheck{
+	{SourceType: Omop, Name: "omop", Table: "concept", Critical: true},
+	{SourceType: Results, Name: "results", Table: "cohort", Critical: true},
+	{SourceType: Misc, Name: "misc", Table: "data_dictionary_result", Critical: false},
+}
+
+// Checks the Atlas DB, the omop, results and misc schemas of each source, and the availability of the
+// data dictionary, each with the given timeout. The checks of the sources run in parallel.
+func (h Readiness) CheckComponents(ctx context.Context, timeout time.Duration) []utils.ComponentStatus {
+	atlasDbStatus := utils.CheckComponent(ctx, "atlas_db", true, timeout, checkAtlasDb)
+	componentStatuses := []utils.ComponentStatus{atlasDbStatus}
+	if !atlasDbStatus.Ok {
+		// the sources are read from the Atlas DB:
+		return componentStatuses
+	}
+	var sourceModel = new(Source)
+	sources, err := sourceModel.GetAllSources()
+	if err != nil {
+		return append(componentStatuses, utils.ComponentStatus{Component: "sources", Critical: true, Error: err.Error()})
+	}
+
+	sourceStatuses := make([]utils.ComponentStatus, len(sources)*len(readinessSchemaChecks))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		for j, schemaCheck := range readinessSchemaChecks {
+			wg.Add(1)
+			go func(index int, sourceId int, schemaCheck readinessSchemaCheck) {
+				defer wg.Done()
+				component := fmt.Sprintf("source_%d_%s", sourceId, schemaCheck.Name)
+				sourceStatuses[index] = utils.CheckComponent(ctx, component, schemaCheck.Critical, timeout, func(ctx context.Context) error {
+					return checkSchemaTable(ctx, sourceModel.GetDataSource(sourceId, schemaCheck.SourceType), schemaCheck.Table)
+				})
+			}(i*len(readinessSchemaChecks)+j, source.SourceId, schemaCheck)
+		}
+	}
+	wg.Wait()
+	componentStatuses = append(componentStatuses, sourceStatuses...)
+	return append(componentStatuses, utils.CheckComponent(ctx, "data_dictionary", false, timeout, checkDataDictionaryAvailable))
+}
+
+func checkAtlasDb(ctx context.Context) error {
+	atlasDb := db.GetAtlasDB().Db
+	if atlasDb == nil {
+		return errors.New("not connected")
+	}
+	sqlDb, err := atlasDb.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.PingContext(ctx)
+}
+
+// Checks that the given table can be queried, which also checks the connection and the schema.
+func checkSchemaTable(ctx context.Context, dataSource *utils.DbAndSchema, table string) error {
+	if dataSource.Db == nil {
+		return errors.New("not connected")
+	}
+	if dataSource.Db.Error != nil {
+		return dataSource.Db.Error
+	}
+	var rows []int
+	return dataSource.Db.WithContext(ctx).Table(dataSource.Schema + "." + table).
+		Select("1").
+		Where("1 = 0").
+		Scan(&rows).Error
+}
+
+// The data dictionary is available once it is cached, or once its table is filled (see DataDictionary.GetDataDictionary).
+func checkDataDictionaryAvailable(ctx context.Context) error {
+	if ResultCache != nil {
+		return nil
+	}
+	var dataSourceModel = new(Source)
+	sourceId, err := dataSourceModel.GetSingleSourceId()
+	if err != nil {
+		return err
+	}
+	miscDataSource := dataSourceModel.GetDataSource(sourceId, Misc)
+	var count int64
+	err = miscDataSource.Db.WithContext(ctx).Table(miscDataSource.Schema + ".data_dictionary_result").
+		Select("count(*)").
+		Scan(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("data dictionary is not available yet")
+	}
+	return nil
+}
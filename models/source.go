@@ -1,6 +1,10 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"log"
+
 	"github.com/uc-cdis/cohort-middleware/db"
 	"github.com/uc-cdis/cohort-middleware/utils"
 )
@@ -82,16 +86,40 @@ const (
 
 // Get the data source details for given source id and source type.
 // The source type can be one of the type SourceType.
+// If the source (or its schema for the given source type) is not found, the returned
+// data source fails all queries with a "not found" error, and if the source can not be
+// connected to, with an "upstream unavailable" error. The source password is decrypted
+// first, if source_password_decryption is configured (see utils.GetSourcePasswordDecrypter).
 func (h Source) GetDataSource(sourceId int, sourceType SourceType) *utils.DbAndSchema {
 	dataSource, _ := h.GetSourceByIdWithConnection(sourceId)
-
+	if dataSource == nil {
+		return utils.GetFailingDataSourceDB("", utils.NewNotFoundError(fmt.Errorf("source %d not found", sourceId)))
+	}
 	dbSchema, _ := h.GetSourceSchemaNameBySourceIdAndSourceType(sourceId, sourceType)
+	if dbSchema == nil {
+		return utils.GetFailingDataSourceDB("", utils.NewNotFoundError(fmt.Errorf("schema of type %d not found for source %d", sourceType, sourceId)))
+	}
 	dbSchemaName := dbSchema.SchemaName
-	sourceConnection := utils.SourceConnection{SourceConnection: dataSource.SourceConnection,
-		Username: dataSource.Username,
-		Password: dataSource.Password, // pragma: allowlist secret
+	password := dataSource.Password
+	if decryptPassword := utils.GetSourcePasswordDecrypter(); decryptPassword != nil {
+		var err error
+		password, err = decryptPassword(password)
+		if err != nil {
+			log.Printf("Error decrypting the password of source %d: %s", sourceId, err.Error())
+			return utils.GetFailingDataSourceDB(dbSchemaName, err)
+		}
+	}
+	sourceConnection := utils.SourceConnection{SourceId: sourceId,
+		SourceConnection: dataSource.SourceConnection,
+		Username:         dataSource.Username,
+		Password:         password, // pragma: allowlist secret
+	}
+	dbAndSchema, err := utils.GetDataSourceDB(sourceConnection, dbSchemaName)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		// return a connection that fails all queries with the error, so that it surfaces when the data source is queried:
+		return utils.GetFailingDataSourceDB(dbSchemaName, err)
 	}
-	dbAndSchema := utils.GetDataSourceDB(sourceConnection, dbSchemaName)
 	return dbAndSchema
 }
 
@@ -119,3 +147,15 @@ func (h Source) GetAllSources() ([]*Source, error) {
 	query.Scan(&dataSource)
 	return dataSource, nil
 }
+
+// Returns the id of the one and only source. Returns an error if there is no source or
+// more than one source, as in that case it is unclear which source to use.
+func (h Source) GetSingleSourceId() (int, error) {
+	sources, _ := h.GetAllSources()
+	if len(sources) < 1 {
+		return -1, utils.NewUpstreamUnavailableError(errors.New("no data source found"))
+	} else if len(sources) > 1 {
+		return -1, utils.NewInternalError(errors.New("more than one data source found"))
+	}
+	return sources[0].SourceId, nil
+}
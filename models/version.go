@@ -1,6 +1,7 @@
 package models
 
 import (
+	"log"
 	"time"
 
 	"github.com/uc-cdis/cohort-middleware/db"
@@ -58,15 +59,13 @@ func (h Version) GetSchemaVersion() *DbSchemaVersion {
 		dbSchemaVersion.AtlasSchemaVersion = atlasSchemaVersion.Version
 	}
 
-	var source = new(Source)
-	sources, _ := source.GetAllSources()
-	if len(sources) < 1 {
-		panic("Error: No data source found")
-	} else if len(sources) > 1 {
-		panic("More than one data source! Exiting")
-	}
 	var dataSourceModel = new(Source)
-	dboDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, Dbo)
+	sourceId, err := dataSourceModel.GetSingleSourceId()
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+		return dbSchemaVersion
+	}
+	dboDataSource := dataSourceModel.GetDataSource(sourceId, Dbo)
 
 	var versionInfo *VersionInfo
 	query = dboDataSource.Db.Table(dboDataSource.Schema + ".versioninfo").
@@ -7,21 +7,35 @@ import (
 	"github.com/uc-cdis/cohort-middleware/controllers"
 	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 func NewRouter() *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Logger())
-	r.Use(gin.Recovery())
+	r.Use(middlewares.ErrorHandlerMiddleware())
+	r.Use(middlewares.MaxBodySizeMiddleware(utils.GetServerSettings().MaxBodyBytes))
 
 	health := new(controllers.HealthController)
 	r.GET("/_health", health.Status)
 
+	readiness := controllers.NewReadinessController(*new(models.Readiness), &http.Client{})
+	r.GET("/_ready", readiness.Status)
+
 	version := new(controllers.VersionController)
 	r.GET("/_version", version.Retrieve)
 
+	schema := new(controllers.SchemaController)
+	r.GET("/_schema/variables", schema.RetrieveVariablesSchema)
+
 	authorized := r.Group("/")
 	authorized.Use(middlewares.AuthMiddleware())
+	// rate limits per user and route class, and limits on the number of heavy queries per data source
+	// (see rate_limits and heavy_queries in the config):
+	authorized.Use(middlewares.RateLimitMiddleware(newRateLimiter(middlewares.DEFAULT_ROUTE_CLASS)))
+	analyses := authorized.Group("", middlewares.RateLimitMiddleware(newRateLimiter(middlewares.ANALYSIS_ROUTE_CLASS)))
+	exports := authorized.Group("", middlewares.RateLimitMiddleware(newRateLimiter(middlewares.EXPORT_ROUTE_CLASS)),
+		middlewares.HeavyQueryMiddleware(middlewares.NewSourceConcurrencyLimiter(middlewares.GetHeavyQuerySettings())))
 	{
 		source := new(controllers.SourceController)
 		authorized.GET("/source/by-id/:id", source.RetriveById)
@@ -33,13 +47,13 @@ func NewRouter() *gin.Engine {
 		authorized.GET("/cohortdefinition/by-id/:id", cohortdefinitions.RetriveById)
 
 		// cohort definition statistics:
-		authorized.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-team-project", cohortdefinitions.RetriveStatsBySourceIdAndTeamProject)
-		authorized.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-observation-window/:observationwindow", cohortdefinitions.RetriveStatsBySourceIdAndCohortIdAndObservationWindow)
-		authorized.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-ids/:cohort1/:cohort2/by-observation-window-1st-cohort/:observationwindow1stcohort",
+		analyses.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-team-project", cohortdefinitions.RetriveStatsBySourceIdAndTeamProject)
+		analyses.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-observation-window/:observationwindow", cohortdefinitions.RetriveStatsBySourceIdAndCohortIdAndObservationWindow)
+		analyses.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-ids/:cohort1/:cohort2/by-observation-window-1st-cohort/:observationwindow1stcohort",
 			cohortdefinitions.RetriveStatsBySourceIdAndCohortIdAndObservationWindow1stCohortAndOverlap2ndCohort)
-		authorized.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-ids/:cohort1/:cohort2/by-observation-window-1st-cohort/:observationwindow1stcohort/by-outcome-window-2nd-cohort/:outcomeWindow2ndCohort",
+		analyses.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-ids/:cohort1/:cohort2/by-observation-window-1st-cohort/:observationwindow1stcohort/by-outcome-window-2nd-cohort/:outcomeWindow2ndCohort",
 			cohortdefinitions.RetriveStatsBySourceIdAndCohortIdAndObservationWindow1stCohortAndOverlap2ndCohortAndOutcomeWindow2ndCohort)
-		authorized.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-ids/:cohort1/:cohort2/by-observation-window-1st-cohort/:observationwindow1stcohort/and-cohort2-entry-first",
+		analyses.GET("/cohortdefinition-stats/by-source-id/:sourceid/by-cohort-definition-ids/:cohort1/:cohort2/by-observation-window-1st-cohort/:observationwindow1stcohort/and-cohort2-entry-first",
 			cohortdefinitions.RetriveStatsBySourceIdAndCohortIdAndObservationWindow1stCohortAndOverlap2ndCohortAnd2ndCohortEntryFirst)
 
 		// concept endpoints:
@@ -48,24 +62,36 @@ func NewRouter() *gin.Engine {
 		authorized.GET("/concept/by-source-id/:sourceid", concepts.RetriveAllBySourceId)
 		authorized.POST("/concept/by-source-id/:sourceid", concepts.RetrieveInfoBySourceIdAndConceptIds)
 		authorized.POST("/concept/by-source-id/:sourceid/by-type", concepts.RetrieveInfoBySourceIdAndConceptTypes)
-
-		authorized.GET("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortId)
-		authorized.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables)
-		authorized.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/csv", concepts.RetrieveAttritionTable)
+		// admin endpoints to flush the concept info cache (access to /cohort-middleware/_admin/... can be restricted in Arborist):
+		authorized.DELETE("/_admin/concept-cache", concepts.FlushConceptInfoCache)
+		authorized.DELETE("/_admin/concept-cache/by-source-id/:sourceid", concepts.FlushConceptInfoCache)
+		// admin endpoint to run the data quality rules:
+		dataQuality := controllers.NewDataQualityController(*new(models.DataQuality))
+		authorized.GET("/_admin/data-quality", dataQuality.RetrieveDataQualityReport)
+
+		analyses.GET("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortId)
+		analyses.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid", concepts.RetrieveBreakdownStatsBySourceIdAndCohortIdAndVariables)
+		exports.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/csv", concepts.RetrieveAttritionTable)
+		exports.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/json", concepts.RetrieveAttritionTableAsJson)
+		analyses.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/cross-tab-by-concept-id/:crosstabconceptid", concepts.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables)
+		analyses.POST("/concept-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/breakdown-by-concept-id/:breakdownconceptid/cross-tab-by-cohort-pair/:cohort1/:cohort2", concepts.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables)
 
 		// cohort stats and checks:
 		cohortData := controllers.NewCohortDataController(*new(models.CohortData), *new(models.DataDictionary), middlewares.NewTeamProjectAuthz(*new(models.CohortDefinition), &http.Client{}))
 		// :casecohortid/:controlcohortid are just labels here and have no special meaning. Could also just be :cohortAId/:cohortBId here:
-		authorized.POST("/cohort-stats/check-overlap/by-source-id/:sourceid/by-cohort-definition-ids/:casecohortid/:controlcohortid", cohortData.RetrieveCohortOverlapStats)
-		authorized.GET("/cohort-stats/check-overlap/by-source-id/:sourceid/by-cohort-definition-ids/:casecohortid/:controlcohortid", cohortData.RetrieveCohortOverlapStatsSimple)
+		analyses.POST("/cohort-stats/check-overlap/by-source-id/:sourceid/by-cohort-definition-ids/:casecohortid/:controlcohortid", cohortData.RetrieveCohortOverlapStats)
+		analyses.GET("/cohort-stats/check-overlap/by-source-id/:sourceid/by-cohort-definition-ids/:casecohortid/:controlcohortid", cohortData.RetrieveCohortOverlapStatsSimple)
 		// full data endpoints:
-		authorized.POST("/cohort-data/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveDataBySourceIdAndCohortIdAndVariables)
+		exports.POST("/cohort-data/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveDataBySourceIdAndCohortIdAndVariables)
 
 		// cohort data statistics
-		authorized.POST("/cohort-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-concept-id/:conceptid", cohortData.RetrieveStatsForCohortIdAndConceptId)
+		analyses.POST("/cohort-stats/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-concept-id/:conceptid", cohortData.RetrieveStatsForCohortIdAndConceptId)
 
 		// histogram endpoint
-		authorized.POST("/histogram/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-histogram-concept-id/:histogramid", cohortData.RetrieveHistogramForCohortIdAndConceptId)
+		analyses.POST("/histogram/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-histogram-concept-id/:histogramid", cohortData.RetrieveHistogramForCohortIdAndConceptId)
+
+		// grouped (stacked/overlaid) histogram endpoint
+		analyses.POST("/histogram/by-source-id/:sourceid/by-cohort-definition-id/:cohortid/by-histogram-concept-id/:histogramid/by-group", cohortData.RetrieveGroupedHistogramForCohortIdAndConceptId)
 
 		// Data Dictionary endpoint
 		authorized.GET("/data-dictionary/Retrieve", cohortData.RetrieveDataDictionary)
@@ -73,9 +99,30 @@ func NewRouter() *gin.Engine {
 		// Data Dictionary endpoint
 		authorized.GET("/data-dictionary/Generate", cohortData.GenerateDataDictionary)
 
+		// Cohort scoped Data Dictionary endpoint
+		exports.GET("/data-dictionary/by-source-id/:sourceid/by-cohort-definition-id/:cohortid", cohortData.RetrieveCohortDataDictionary)
+
 		// Get Schema Version
 		authorized.GET("/_schema_version", version.RetrieveSchemaVersion)
+
+		// v2 analysis endpoints, with all parameters in the JSON request body (see utils.AnalysisRequest):
+		v2Analyses := analyses.Group("/v2")
+		v2Exports := exports.Group("/v2")
+		v2Analyses.POST("/cohortdefinition-stats", controllers.NewAnalysisHandler(cohortdefinitions.RetrieveStatsForAnalysisRequest))
+		v2Analyses.POST("/concept-stats/breakdown", controllers.NewAnalysisHandler(concepts.RetrieveBreakdownStatsForAnalysisRequest))
+		v2Exports.POST("/concept-stats/attrition", controllers.NewAnalysisHandler(concepts.RetrieveAttritionTableForAnalysisRequest))
+		v2Analyses.POST("/concept-stats/cross-tab", controllers.NewAnalysisHandler(concepts.RetrieveCrossTabStatsForAnalysisRequest))
+		v2Analyses.POST("/cohort-stats/check-overlap", controllers.NewAnalysisHandler(cohortData.RetrieveCohortOverlapStatsForAnalysisRequest))
+		v2Analyses.POST("/cohort-stats/by-concept", controllers.NewAnalysisHandler(cohortData.RetrieveStatsForAnalysisRequest))
+		v2Exports.POST("/cohort-data", controllers.NewAnalysisHandler(cohortData.RetrieveDataForAnalysisRequest))
+		v2Analyses.POST("/histogram", controllers.NewAnalysisHandler(cohortData.RetrieveHistogramForAnalysisRequest))
+		v2Analyses.POST("/histogram/by-group", controllers.NewAnalysisHandler(cohortData.RetrieveGroupedHistogramForAnalysisRequest))
 	}
 
 	return r
 }
+
+// Returns the rate limiter of the given route class, with the settings in the config.
+func newRateLimiter(routeClass string) *middlewares.RateLimiter {
+	return middlewares.NewRateLimiter(routeClass, middlewares.GetRateLimitSettings(routeClass))
+}
@@ -1,12 +1,55 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
+// Runs the server until it receives a SIGTERM or SIGINT, and then shuts it down gracefully: it stops
+// accepting connections and waits for the in-flight requests and the background jobs (e.g. the data
+// dictionary generation) to finish, up to the shutdown grace period (see utils.GetServerSettings).
 func Init() {
-	r := NewRouter()
-	if err := r.Run(); err != nil {
+	settings := utils.GetServerSettings()
+	server := utils.NewHttpServer(NewRouter(), settings)
+
+	stopContext, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	serverErrors := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s (TLS: %t)", settings.Address, settings.UsesTls())
+		if settings.UsesTls() {
+			serverErrors <- server.ListenAndServeTLS(settings.TlsCertPath, settings.TlsKeyPath)
+		} else {
+			serverErrors <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serverErrors:
+		log.Printf("unhandled server error:\n%s", err.Error())
+		return
+	case <-stopContext.Done():
+		// a second signal stops the process right away:
+		stop()
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests and background jobs...", settings.ShutdownGracePeriod)
+	shutdownContext, cancel := context.WithTimeout(context.Background(), settings.ShutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(shutdownContext); err != nil {
+		log.Printf("WARNING: in-flight requests did not finish in time: %s", err.Error())
+	}
+	if err := <-serverErrors; err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Printf("unhandled server error:\n%s", err.Error())
 	}
+	if err := utils.WaitForBackgroundJobs(shutdownContext); err != nil {
+		log.Printf("WARNING: background jobs did not finish in time: %s", err.Error())
+	}
+	log.Print("Server stopped")
 }
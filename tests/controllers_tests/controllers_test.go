@@ -1,11 +1,13 @@
 package controllers_tests
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uc-cdis/cohort-middleware/config"
@@ -42,6 +45,8 @@ func tearDownSuite() {
 func setUp(t *testing.T) {
 	log.Println("setup for test")
 	dummyModelReturnError = false
+	dummyModelReturnErrorForNumberOfFilters = 0
+	dummyAggregationPolicy = models.NO_AGGREGATION
 	config.Init("mocktest")
 
 	// ensure tearDown is called when test "t" is done:
@@ -67,7 +72,7 @@ var cohortDefinitionControllerWithFailingTeamProjectAuthz = controllers.NewCohor
 
 type dummyCohortDataModel struct{}
 
-func (h dummyCohortDataModel) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]*models.PersonConceptAndValue, error) {
+func (h dummyCohortDataModel) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(sourceId int, cohortDefinitionId int, conceptIds []int64, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*models.PersonConceptAndValue, error) {
 	value := float32(0.0)
 	cohortData := []*models.PersonConceptAndValue{
 		{PersonId: 1, ConceptId: 10, ConceptClassId: "something", ObservationValueAsConceptName: "abc", ConceptValueAsNumber: &value},
@@ -75,18 +80,78 @@ func (h dummyCohortDataModel) RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrde
 	return cohortData, nil
 }
 
-func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef) ([]*models.PersonConceptAndValue, error) {
+func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIds []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) ([]*models.PersonConceptAndValue, error) {
+	value1 := float32(10.0)
+	value2 := float32(20.0)
+	cohortData := []*models.PersonConceptAndValue{
+		{PersonId: 1, ConceptId: histogramConceptId, ConceptValueAsNumber: &value1},
+		{PersonId: 2, ConceptId: histogramConceptId, ConceptValueAsNumber: &value2},
+	}
+	return cohortData, nil
+}
+
+func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*models.PersonConceptAndValue, error) {
 
 	cohortData := []*models.PersonConceptAndValue{}
 	return cohortData, nil
 }
 
-func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndConceptId(sourceId int, histogramConceptId int64) ([]*models.PersonConceptAndValue, error) {
+func (h dummyCohortDataModel) RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(sourceId int, conceptId int64) (int64, error) {
+	return 0, nil
+}
 
+func (h dummyCohortDataModel) RetrieveHistogramDataBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, histogramConceptId int64) ([]*models.PersonConceptAndValue, error) {
 	cohortData := []*models.PersonConceptAndValue{}
 	return cohortData, nil
 }
 
+func (h dummyCohortDataModel) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, conceptId int64) ([]*models.NominalGroupData, error) {
+	cohortData := []*models.NominalGroupData{
+		{Name: "non-Hispanic Black", PersonCount: 4, ValueAsString: "AFR", ValueAsConceptID: 2000007030},
+		{Name: "", PersonCount: 1, ValueAsString: "", ValueAsConceptID: 0},
+	}
+	return cohortData, nil
+}
+
+func (h dummyCohortDataModel) RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, histogramConceptId int64, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.HistogramMetadata, error) {
+	histogramData, binMetadata := utils.GenerateHistogramDataWithOptions([]float64{10, 20}, options)
+	return histogramData, binMetadata, nil
+}
+
+func (h dummyCohortDataModel) RetrieveHistogramAndValueSummaryBySourceIdAndConceptId(sourceId int, histogramConceptId int64, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.ValueSummary, error) {
+	return nil, nil, nil
+}
+
+func (h dummyCohortDataModel) RetrieveHistogramAndValueSummaryBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, histogramConceptId int64, options *utils.HistogramOptions) ([]utils.HistogramColumn, *utils.ValueSummary, error) {
+	return nil, nil, nil
+}
+
+func (h dummyCohortDataModel) RetrieveCohortSizeBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIdsAndValues []utils.CustomConceptVariableDef, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter) (int, error) {
+	return 10, nil
+}
+
+func (h dummyCohortDataModel) RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndCohortIdAndConceptId(sourceId int, cohortDefinitionId int, conceptId int64) (int64, error) {
+	return 0, nil
+}
+
+func (h dummyCohortDataModel) RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]models.AggregationReport, error) {
+	return dummyAggregationReports(conceptIds), nil
+}
+
+// the aggregation policy the dummy models report for all concepts:
+var dummyAggregationPolicy = models.NO_AGGREGATION
+
+func dummyAggregationReports(conceptIds []int64) []models.AggregationReport {
+	aggregationReports := []models.AggregationReport{}
+	if dummyAggregationPolicy == models.NO_AGGREGATION {
+		return aggregationReports
+	}
+	for _, conceptId := range conceptIds {
+		aggregationReports = append(aggregationReports, models.AggregationReport{ConceptId: conceptId, Policy: dummyAggregationPolicy, PersonsWithMultipleObservations: 2})
+	}
+	return aggregationReports
+}
+
 func (h dummyCohortDataModel) RetrieveBarGraphDataBySourceIdAndCohortIdAndConceptIds(sourceId int, conceptId int64) ([]*models.NominalGroupData, error) {
 	cohortData := []*models.NominalGroupData{}
 	return cohortData, nil
@@ -114,6 +179,7 @@ func (h dummyCohortDataModel) RetrieveDataByOriginalCohortAndNewCohort(sourceId
 type dummyCohortDefinitionDataModel struct{}
 
 var dummyModelReturnError bool = false
+var dummyModelReturnErrorForNumberOfFilters int = 0
 
 func (h dummyCohortDefinitionDataModel) GetCohortDefinitionIdsForTeamProject(teamProject string) ([]int, error) {
 	return []int{1}, nil
@@ -169,6 +235,10 @@ func (h dummyCohortDefinitionDataModel) GetCohortDefinitionStatsByObservationWin
 	return nil, nil
 }
 
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(sourceId int, cohortId int, observationWindow int, temporalVariables []utils.CustomTemporalVariableDef) (*models.CohortDefinitionStats, error) {
+	return &models.CohortDefinitionStats{Id: cohortId, CohortSize: 10 - len(temporalVariables)}, nil
+}
+
 func (h dummyCohortDefinitionDataModel) GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohort(sourceId int, cohort1Id int, cohort2Id int, observationWindow1stCohort int) (*models.CohortDefinitionStats, error) {
 	return nil, nil
 }
@@ -285,7 +355,7 @@ func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortId(sourc
 	}
 	return conceptBreakdown, nil
 }
-func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
+func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
 	conceptBreakdown := []*models.ConceptBreakdown{
 		{ConceptValue: "value1", NpersonsInCohortWithValue: 4 - len(filterCohortPairs)}, // simulate decreasing numbers as filter increases - the use of filterCohortPairs instead of filterConceptIds is otherwise meaningless here...
 		{ConceptValue: "value2", NpersonsInCohortWithValue: 7 - len(filterConceptIds)},  // simulate decreasing numbers as filter increases- the use of filterConceptIds instead of filterCohortPairs is otherwise meaningless here...
@@ -295,6 +365,54 @@ func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndCon
 	}
 	return conceptBreakdown, nil
 }
+func (h dummyConceptDataModel) RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsWithContext(ctx context.Context, sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, filterTemporalVariables []utils.CustomTemporalVariableDef, observationPeriodFilter *utils.ObservationPeriodFilter, breakdownConceptId int64) ([]*models.ConceptBreakdown, error) {
+	if dummyModelReturnErrorForNumberOfFilters > 0 && len(filterConceptIds)+len(filterCohortPairs)+len(filterTemporalVariables) == dummyModelReturnErrorForNumberOfFilters {
+		return nil, fmt.Errorf("error for %d filters!", dummyModelReturnErrorForNumberOfFilters)
+	}
+	if dummyModelReturnErrorForNumberOfFilters > 0 {
+		// simulate a slow query, which stops when another step fails:
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return h.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId, cohortDefinitionId, filterConceptIds, filterCohortPairs, filterTemporalVariables, observationPeriodFilter, breakdownConceptId)
+}
+func (h dummyConceptDataModel) RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(sourceId int, cohortDefinitionId int, conceptIds []int64) ([]models.AggregationReport, error) {
+	return dummyAggregationReports(conceptIds), nil
+}
+
+func (h dummyConceptDataModel) FlushInfoCacheBySourceId(sourceId int) int {
+	return sourceId
+}
+func (h dummyConceptDataModel) FlushInfoCache() int {
+	return 100
+}
+func (h dummyConceptDataModel) RetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, rowConceptId int64, columnConceptId int64) ([]*models.ConceptCrossTabCell, error) {
+	crossTabCells := []*models.ConceptCrossTabCell{
+		{RowValueAsConceptId: 1234, ColumnValue: 1234, NpersonsInCohortWithValues: 3},
+		{RowValueAsConceptId: 1234, ColumnValue: 5678, NpersonsInCohortWithValues: 1},
+		{RowValueAsConceptId: 5678, ColumnValue: 1234, NpersonsInCohortWithValues: 1},
+		{RowValueAsConceptId: 5678, ColumnValue: 5678, NpersonsInCohortWithValues: 3},
+	}
+	if dummyModelReturnError {
+		return nil, fmt.Errorf("error!")
+	}
+	return crossTabCells, nil
+}
+func (h dummyConceptDataModel) RetrieveCrossTabStatsByCohortPairBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(sourceId int, cohortDefinitionId int, filterConceptIds []int64, filterCohortPairs []utils.CustomDichotomousVariableDef, rowConceptId int64, columnCohortPair utils.CustomDichotomousVariableDef) ([]*models.ConceptCrossTabCell, error) {
+	crossTabCells := []*models.ConceptCrossTabCell{
+		{RowValueAsConceptId: 1234, ColumnValue: int64(columnCohortPair.CohortDefinitionId1), NpersonsInCohortWithValues: 10},
+		{RowValueAsConceptId: 1234, ColumnValue: int64(columnCohortPair.CohortDefinitionId2), NpersonsInCohortWithValues: 20},
+		{RowValueAsConceptId: 5678, ColumnValue: int64(columnCohortPair.CohortDefinitionId1), NpersonsInCohortWithValues: 30},
+		{RowValueAsConceptId: 5678, ColumnValue: int64(columnCohortPair.CohortDefinitionId2), NpersonsInCohortWithValues: 40},
+	}
+	if dummyModelReturnError {
+		return nil, fmt.Errorf("error!")
+	}
+	return crossTabCells, nil
+}
 
 type dummyDataDictionaryModel struct{}
 
@@ -314,12 +432,20 @@ func (h dummyDataDictionaryModel) GetDataDictionary() (*models.DataDictionaryMod
 	return data, nil
 }
 
+func (h dummyDataDictionaryModel) GetCohortDataDictionary(sourceId int, cohortDefinitionId int) (*models.DataDictionaryModel, error) {
+	return h.GetDataDictionary()
+}
+
 func (h dummyDataDictionaryModel) GenerateDataDictionary() {}
 
 type dummyFailingDataDictionaryModel struct{}
 
 func (h dummyFailingDataDictionaryModel) GetDataDictionary() (*models.DataDictionaryModel, error) {
-	return nil, errors.New("data dictionary is not available yet")
+	return nil, utils.NewUpstreamUnavailableError(errors.New("data dictionary is not available yet"))
+}
+
+func (h dummyFailingDataDictionaryModel) GetCohortDataDictionary(sourceId int, cohortDefinitionId int) (*models.DataDictionaryModel, error) {
+	return nil, errors.New("cohort not found")
 }
 
 func (h dummyFailingDataDictionaryModel) GenerateDataDictionary() {}
@@ -341,6 +467,87 @@ func TestRetrieveHistogramForCohortIdAndConceptIdWithWrongParams(t *testing.T) {
 	}
 }
 
+func TestRetrieveHistogramForCohortIdAndConceptIdWithBinningOptions(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "histogramid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{RawQuery: "binning=fixed-count&bin-count=2"}}
+	requestBody := "{\"variables\":[{\"variable_type\": \"concept\", \"concept_id\": 2000000324}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataController.RetrieveHistogramForCohortIdAndConceptId(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "\"binMetadata\":{\"strategy\":\"fixed-count\",\"binCount\":2") {
+		t.Errorf("Expected bin metadata in output, found %s", result.CustomResponseWriterOut)
+	}
+
+	// an invalid binning strategy should result in an aborted request:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "histogramid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{RawQuery: "binning=unknown"}}
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataController.RetrieveHistogramForCohortIdAndConceptId(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
+func TestRetrieveGroupedHistogramForCohortIdAndConceptId(t *testing.T) {
+	setUp(t)
+	requestBody := "{\"variables\":[{\"variable_type\": \"concept\", \"concept_id\": 2000000324}]}"
+	var groupedHistogramTests = []struct {
+		rawQuery        string
+		expectAbort     bool
+		expectedContent string
+	}{
+		{"breakdown-concept-id=2000007027", false, "\"concept_value_name\":\"non-Hispanic Black\""},
+		{"compare-cohort-ids=5,6&binning=sturges", false, "\"cohortId\":6"},
+		{"", true, "exactly one of"},
+		{"breakdown-concept-id=2000007027&compare-cohort-ids=5", true, "exactly one of"},
+		{"compare-cohort-ids=a", true, "bad request"},
+	}
+	for _, groupedHistogramTest := range groupedHistogramTests {
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "histogramid", Value: "2000006885"})
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = &http.Request{URL: &url.URL{RawQuery: groupedHistogramTest.rawQuery}}
+		requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+		cohortDataController.RetrieveGroupedHistogramForCohortIdAndConceptId(requestContext)
+		if requestContext.IsAborted() != groupedHistogramTest.expectAbort {
+			t.Errorf("Unexpected abort status for query %s", groupedHistogramTest.rawQuery)
+		}
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if !strings.Contains(result.CustomResponseWriterOut, groupedHistogramTest.expectedContent) {
+			t.Errorf("Expected %s in output for query %s, found %s", groupedHistogramTest.expectedContent,
+				groupedHistogramTest.rawQuery, result.CustomResponseWriterOut)
+		}
+	}
+
+	// the same request should fail if the teamProject authorization fails:
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "histogramid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{RawQuery: "compare-cohort-ids=5"}}
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataControllerWithFailingTeamProjectAuthz.RetrieveGroupedHistogramForCohortIdAndConceptId(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "access denied") || !requestContext.IsAborted() {
+		t.Errorf("Expected 'access denied' as result")
+	}
+}
+
 func TestRetrieveHistogramForCohortIdAndConceptIdWithCorrectParams(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -538,6 +745,92 @@ func TestGenerateCSV(t *testing.T) {
 	}
 }
 
+func TestGenerateCSVWithConceptTypeRegistry(t *testing.T) {
+	setUp(t)
+	value1 := float32(2.0)
+	date := "2024-03-05T10:00:00Z"
+	otherDate := "March 2024"
+	text := "some, text"
+	// see concept_types in mocktest.yaml:
+	cohortData := []*models.PersonConceptAndValue{
+		{PersonId: 1, ConceptId: 10, ConceptClassId: "Survey Date", ConceptValueAsString: &date, ConceptValueAsNumber: &value1},
+		{PersonId: 1, ConceptId: 22, ConceptClassId: "Other", DomainId: "Observation", VocabularyId: "Free Text", ConceptValueAsString: &text, ObservationValueAsConceptName: "abc"},
+		{PersonId: 2, ConceptId: 10, ConceptClassId: "Survey Date", ConceptValueAsString: &otherDate},
+		{PersonId: 2, ConceptId: 22, ConceptClassId: "Other", DomainId: "Observation", VocabularyId: "Other"},
+	}
+	csvLines := controllers.GeneratePartialCSV(testSourceId, cohortData, []int64{10, 22})
+	expectedLines := [][]string{
+		{"sample.id", "ID_10", "ID_22"},
+		{"1", "2024-03-05", "some, text"},
+		{"2", "March 2024", "NA"},
+	}
+	if !reflect.DeepEqual(expectedLines, csvLines) {
+		t.Errorf("Expected %v, found %v", expectedLines, csvLines)
+	}
+}
+
+func TestGetValueKind(t *testing.T) {
+	setUp(t)
+	valueKind, _ := models.GetValueKind("MVP Continuous", "Measurement", "MVP")
+	if valueKind != models.CONTINUOUS {
+		t.Errorf("Expected %s, found %s", models.CONTINUOUS, valueKind)
+	}
+	valueKind, _ = models.GetValueKind("Anything", "Observation", "Free Text")
+	if valueKind != models.TEXT {
+		t.Errorf("Expected %s, found %s", models.TEXT, valueKind)
+	}
+	_, err := models.GetValueKind("Anything", "Observation", "Other")
+	if err == nil {
+		t.Errorf("Expected error for unregistered concept type")
+	}
+}
+
+func TestValidateConceptTypeRules(t *testing.T) {
+	setUp(t)
+	if err := models.ValidateConceptTypeRules(); err != nil {
+		t.Errorf("Expected the mocktest concept types to be valid, found %v", err)
+	}
+	config.GetConfig().Set("concept_types", []map[string]interface{}{{"concept_class_id": "MVP Continuous", "value_kind": "unknown"}})
+	if err := models.ValidateConceptTypeRules(); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Expected an error for the unknown value kind, found %v", err)
+	}
+}
+
+func TestValidateAggregationConfig(t *testing.T) {
+	setUp(t)
+	config.GetConfig().Set("observation_aggregation", map[string]interface{}{"default": "last",
+		"concepts": []map[string]interface{}{{"concept_id": 2000006885, "policy": "mean"}}})
+	if err := models.ValidateAggregationConfig(); err != nil {
+		t.Errorf("Expected the aggregation config to be valid, found %v", err)
+	}
+	config.GetConfig().Set("observation_aggregation", map[string]interface{}{"default": "median"})
+	if err := models.ValidateAggregationConfig(); err == nil || !strings.Contains(err.Error(), "median") {
+		t.Errorf("Expected an error for the unknown policy, found %v", err)
+	}
+	// the default also applies to the nominal concepts:
+	config.GetConfig().Set("observation_aggregation", map[string]interface{}{"default": "mean"})
+	if err := models.ValidateAggregationConfig(); err == nil || !strings.Contains(err.Error(), "default") {
+		t.Errorf("Expected an error for the continuous only default policy, found %v", err)
+	}
+}
+
+func TestValidateDataQualityConfig(t *testing.T) {
+	setUp(t)
+	config.GetConfig().Set("validate", map[string]interface{}{
+		"rules": []map[string]interface{}{{"check": "duplicate_observations", "concept_ids": []int64{2000006885}}}})
+	if err := models.ValidateDataQualityConfig(); err != nil {
+		t.Errorf("Expected the data quality config to be valid, found %v", err)
+	}
+	config.GetConfig().Set("validate", map[string]interface{}{"rules": []map[string]interface{}{{"check": "duplicate_observations"}}})
+	if err := models.ValidateDataQualityConfig(); err == nil || !strings.Contains(err.Error(), "concept_ids") {
+		t.Errorf("Expected an error for the rule without concept_ids, found %v", err)
+	}
+	config.GetConfig().Set("validate", map[string]interface{}{"fail_thresholds": map[string]interface{}{"fatal": 0}})
+	if err := models.ValidateDataQualityConfig(); err == nil || !strings.Contains(err.Error(), "fatal") {
+		t.Errorf("Expected an error for the unknown severity, found %v", err)
+	}
+}
+
 func TestRetriveStatsBySourceIdAndTeamProjectWrongParams(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -584,6 +877,9 @@ func TestRetriveStatsBySourceIdAndTeamProjectCheckMandatoryTeamProject(t *testin
 	if !strings.Contains(result.CustomResponseWriterOut, "team-project is a mandatory parameter") {
 		t.Errorf("Expected error about mandatory team-project")
 	}
+	if result.StatusCode != http.StatusBadRequest || !strings.Contains(result.CustomResponseWriterOut, "\"code\":\"invalid_input\"") {
+		t.Errorf("Expected invalid input error, found status %d and %s", result.StatusCode, result.CustomResponseWriterOut)
+	}
 }
 
 func TestRetriveStatsBySourceIdAndTeamProjectAuthorizationError(t *testing.T) {
@@ -904,6 +1200,104 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndVariablesModelError(t *te
 	}
 }
 
+func TestRetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(t *testing.T) {
+	setUp(t)
+	requestBody := "{\"variables\":[{\"variable_type\": \"concept\", \"concept_id\": 1234}]}"
+	newRequestContext := func(params ...gin.Param) *gin.Context {
+		requestContext := new(gin.Context)
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: "1"})
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
+		requestContext.Params = append(requestContext.Params, gin.Param{Key: "breakdownconceptid", Value: "1"})
+		requestContext.Params = append(requestContext.Params, params...)
+		requestContext.Request = new(http.Request)
+		requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		return requestContext
+	}
+
+	// cross tab by concept:
+	requestContext := newRequestContext(gin.Param{Key: "crosstabconceptid", Value: "2"})
+	conceptController.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	crossTab := struct {
+		CrossTab utils.ContingencyTable `json:"cross_tab"`
+	}{}
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &crossTab)
+	if crossTab.CrossTab.Total != 8 || len(crossTab.CrossTab.Rows) != 2 || len(crossTab.CrossTab.Columns) != 2 ||
+		crossTab.CrossTab.Rows[0].Name != "Concept A" || crossTab.CrossTab.Columns[1].Name != "Concept B" ||
+		crossTab.CrossTab.Rows[0].Cells[0].Count != 3 || crossTab.CrossTab.Rows[0].Cells[1].Count != 1 {
+		t.Errorf("Unexpected result %s", result.CustomResponseWriterOut)
+	}
+	if crossTab.CrossTab.ChiSquareTest == nil || crossTab.CrossTab.FisherExactTest == nil {
+		t.Errorf("Expected chi-square and Fisher's exact test results")
+	}
+
+	// cross tab by cohort pair:
+	requestContext = newRequestContext(gin.Param{Key: "cohort1", Value: "11"}, gin.Param{Key: "cohort2", Value: "12"})
+	conceptController.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	json.Unmarshal([]byte(result.CustomResponseWriterOut), &crossTab)
+	if crossTab.CrossTab.Total != 100 || len(crossTab.CrossTab.Columns) != 2 ||
+		crossTab.CrossTab.Columns[0].Value != 11 || crossTab.CrossTab.Columns[0].Name != "dummy cohort name" ||
+		crossTab.CrossTab.Columns[0].Total != 40 || crossTab.CrossTab.Rows[1].Cells[1].Count != 40 {
+		t.Errorf("Unexpected result %s", result.CustomResponseWriterOut)
+	}
+
+	// invalid cohort pair param:
+	requestContext = newRequestContext(gin.Param{Key: "cohort1", Value: "11"}, gin.Param{Key: "cohort2", Value: "abc"})
+	conceptController.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+
+	// the same request should fail if the teamProject authorization fails:
+	requestContext = newRequestContext(gin.Param{Key: "crosstabconceptid", Value: "2"})
+	conceptControllerWithFailingTeamProjectAuthz.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "access denied") {
+		t.Errorf("Expected 'access denied' as result")
+	}
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+
+	// model error:
+	dummyModelReturnError = true
+	requestContext = newRequestContext(gin.Param{Key: "crosstabconceptid", Value: "2"})
+	conceptController.RetrieveCrossTabStatsBySourceIdAndCohortIdAndVariables(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
+func TestFlushConceptInfoCache(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	conceptController.FlushConceptInfoCache(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "\"flushed_entries\":100") {
+		t.Errorf("Expected all entries flushed, found %s", result.CustomResponseWriterOut)
+	}
+
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: "7"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	conceptController.FlushConceptInfoCache(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "\"flushed_entries\":7") {
+		t.Errorf("Expected entries of source flushed, found %s", result.CustomResponseWriterOut)
+	}
+
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: "abc"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	conceptController.FlushConceptInfoCache(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
 func TestRetrieveInfoBySourceIdAndConceptIds(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -998,7 +1392,10 @@ func TestGenerateAttritionCSV(t *testing.T) {
 	filteredRows := [][]string{
 		{"filtered_val", "4", "2", "2"},
 	}
-	b := controllers.GenerateAttritionCSV(headerAndNonFilteredRow, filteredRows)
+	b, err := controllers.GenerateAttritionCSV(headerAndNonFilteredRow, filteredRows)
+	if err != nil {
+		t.Errorf("Expected no error, found %v", err)
+	}
 	csvLines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
 	if len(csvLines) != 3 {
 		t.Errorf("Expected 1 header line + 2 data lines, found %d lines in total",
@@ -1077,7 +1474,7 @@ func TestGetAttritionRowForConceptIdsAndCohortPairs(t *testing.T) {
 			ProvidedName:        "testB34"},
 	}
 
-	result, _ := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(sourceId, cohortId, conceptIdsAndCohortPairs, breakdownConceptId, sortedConceptValues)
+	result, _ := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(context.Background(), sourceId, cohortId, conceptIdsAndCohortPairs, nil, breakdownConceptId, sortedConceptValues)
 	if len(result) != len(conceptIdsAndCohortPairs) {
 		t.Errorf("Expected %d data lines, found %d lines in total",
 			len(conceptIdsAndCohortPairs),
@@ -1101,6 +1498,65 @@ func TestGetAttritionRowForConceptIdsAndCohortPairs(t *testing.T) {
 	}
 }
 
+func TestGetAttritionRowForConceptIdsAndCohortPairsFailsFast(t *testing.T) {
+	setUp(t)
+	conceptIdsAndCohortPairs := []interface{}{}
+	for i := 0; i < 10; i++ {
+		conceptIdsAndCohortPairs = append(conceptIdsAndCohortPairs, utils.CustomConceptVariableDef{ConceptId: int64(1234), ConceptValues: []int64{}})
+	}
+	// the step with 3 filters fails, and the other steps would take 5 seconds each if not cancelled.
+	// Allow all steps to run at the same time (using a source id not used in other tests, since the
+	// per source limit is only read once per source):
+	config.GetConfig().Set("attrition_max_parallel_steps", 10)
+	config.GetConfig().Set("attrition_max_parallel_steps_per_source", 10)
+	dummyModelReturnErrorForNumberOfFilters = 3
+	start := time.Now()
+	result, err := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(context.Background(), 99, 1, conceptIdsAndCohortPairs, nil, 1, []string{"value1", "value2"})
+	if err == nil || result != nil {
+		t.Errorf("Expected error")
+	}
+	if !strings.Contains(err.Error(), "error for 3 filters") {
+		t.Errorf("Expected the error of the failing step, found %s", err.Error())
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("Expected the other steps to be cancelled")
+	}
+}
+
+func TestGetAttritionRowForConceptIdsAndCohortPairsCancelledRequest(t *testing.T) {
+	setUp(t)
+	conceptIdsAndCohortPairs := []interface{}{
+		utils.CustomConceptVariableDef{ConceptId: int64(1234), ConceptValues: []int64{}},
+		utils.CustomConceptVariableDef{ConceptId: int64(5678), ConceptValues: []int64{}},
+	}
+	// e.g. the client disconnected before the steps started:
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(ctx, 1, 1, conceptIdsAndCohortPairs, nil, 1, []string{"value1", "value2"})
+	if !errors.Is(err, context.Canceled) || result != nil {
+		t.Errorf("Expected a context.Canceled error, found %v and %v", err, result)
+	}
+}
+
+func TestGetAttritionRowForConceptIdsAndCohortPairsSequential(t *testing.T) {
+	setUp(t)
+	config.GetConfig().Set("attrition_max_parallel_steps", 1)
+	conceptIdsAndCohortPairs := []interface{}{
+		utils.CustomConceptVariableDef{ConceptId: int64(1234), ConceptValues: []int64{}},
+		utils.CustomDichotomousVariableDef{CohortDefinitionId1: 1, CohortDefinitionId2: 2, ProvidedName: "testA12"},
+		utils.CustomConceptVariableDef{ConceptId: int64(5678), ConceptValues: []int64{}},
+	}
+	result, _ := conceptController.GetAttritionRowForConceptIdsAndCohortPairs(context.Background(), 1, 1, conceptIdsAndCohortPairs, nil, 1, []string{"value1", "value2"})
+	expectedLines := [][]string{
+		{"Concept A", "10", "4", "6"},
+		{"testA12", "9", "3", "6"},
+		{"Concept B", "8", "3", "5"},
+	}
+	if !reflect.DeepEqual(expectedLines, result) {
+		t.Errorf("Expected %v, found %v", expectedLines, result)
+	}
+}
+
 func TestGenerateCompleteCSV(t *testing.T) {
 	setUp(t)
 
@@ -1126,7 +1582,10 @@ func TestGenerateCompleteCSV(t *testing.T) {
 			ProvidedName:        "test"},
 	}
 
-	b := controllers.GenerateCompleteCSV(partialCsv, personIdToCSVValues, cohortPairs)
+	b, err := controllers.GenerateCompleteCSV(partialCsv, personIdToCSVValues, cohortPairs)
+	if err != nil {
+		t.Errorf("Expected no error, found %v", err)
+	}
 	csvLines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
 
 	expectedLines := []string{
@@ -1313,6 +1772,80 @@ func TestRetrieveAttritionTable(t *testing.T) {
 	}
 }
 
+func TestRetrieveAttritionTableAsJson(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "breakdownconceptid", Value: "2"})
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"variables\":[{\"variable_type\": \"custom_dichotomous\", \"provided_name\": \"testABC\", \"cohort_ids\": [1, 3]}," +
+		"{\"variable_type\": \"concept\", \"concept_id\": 2090006880}," +
+		"{\"variable_type\": \"custom_dichotomous\", \"cohort_ids\": [4, 5]}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	conceptController.RetrieveAttritionTableAsJson(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	attritionTable := controllers.AttritionTable{}
+	err := json.Unmarshal([]byte(result.CustomResponseWriterOut), &attritionTable)
+	if err != nil {
+		t.Errorf("Could not parse result %s", result.CustomResponseWriterOut)
+	}
+	// same numbers as in TestRetrieveAttritionTable:
+	expectedSteps := []struct {
+		name      string
+		remaining int
+		removed   int
+		breakdown []int
+	}{
+		{"dummy cohort name", 13, 0, []int{5, 8}},
+		{"testABC", 10, 3, []int{3, 7}},
+		{"Concept C", 9, 1, []int{3, 6}},
+		{"ID_4_5", 8, 1, []int{2, 6}},
+	}
+	if attritionTable.CohortName != "dummy cohort name" || attritionTable.BreakdownConceptId != 2 || len(attritionTable.Steps) != len(expectedSteps) {
+		t.Fatalf("Unexpected result %s", result.CustomResponseWriterOut)
+	}
+	for i, expectedStep := range expectedSteps {
+		step := attritionTable.Steps[i]
+		if step.Step != i || step.Name != expectedStep.name || step.NpersonsRemaining != expectedStep.remaining ||
+			step.NpersonsRemoved != expectedStep.removed || len(step.Breakdown) != len(expectedStep.breakdown) {
+			t.Errorf("Unexpected step %v", step)
+			continue
+		}
+		for j, expectedRemaining := range expectedStep.breakdown {
+			if step.Breakdown[j].NpersonsRemaining != expectedRemaining {
+				t.Errorf("Expected %d, found %d", expectedRemaining, step.Breakdown[j].NpersonsRemaining)
+			}
+		}
+	}
+	if attritionTable.Steps[0].Variable != nil {
+		t.Errorf("Expected no variable for the cohort step")
+	}
+	step := attritionTable.Steps[1]
+	if step.Variable.VariableType != "custom_dichotomous" || step.Variable.ProvidedName != "testABC" ||
+		!reflect.DeepEqual(step.Variable.CohortIds, []int{1, 3}) ||
+		math.Abs(step.PercentagePersonsRemoved-100*3.0/13) > 1e-9 ||
+		step.Breakdown[0].ValueName != "value1_name" || step.Breakdown[0].NpersonsRemoved != 2 ||
+		math.Abs(step.Breakdown[0].PercentagePersonsRemoved-40) > 1e-9 {
+		t.Errorf("Unexpected step %v", step)
+	}
+	if step := attritionTable.Steps[2]; step.Variable.VariableType != "concept" || step.Variable.ConceptId != 2090006880 {
+		t.Errorf("Unexpected step %v", step)
+	}
+
+	// the same request should fail if the teamProject authorization fails:
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	conceptControllerWithFailingTeamProjectAuthz.RetrieveAttritionTableAsJson(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "access denied") {
+		t.Errorf("Expected 'access denied' as result")
+	}
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
 func TestRetrieveDataDictionary(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -1343,6 +1876,42 @@ func TestFailingRetrieveDataDictionary(t *testing.T) {
 
 }
 
+func TestRetrieveCohortDataDictionary(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataController.RetrieveCohortDataDictionary(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "\"total\":2") {
+		t.Errorf("Expected output containing the data dictionary total, found %s", result.CustomResponseWriterOut)
+	}
+
+	// the same request should fail if the teamProject authorization fails:
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	cohortDataControllerWithFailingTeamProjectAuthz.RetrieveCohortDataDictionary(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "access denied") {
+		t.Errorf("Expected 'access denied' as result")
+	}
+
+	// and should fail if the model fails:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "1"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	cohortDataControllerWithFailingDataDictionary.RetrieveCohortDataDictionary(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
 func TestGenerateDataDictionary(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -1375,6 +1944,40 @@ func TestRetrieveStatsForCohortIdAndConceptIdWithWrongParams(t *testing.T) {
 	}
 }
 
+func TestRetrieveStatsForCohortIdAndConceptIdWithBreakdownAndPercentiles(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "conceptid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{RawQuery: "breakdown-concept-id=2000007027&percentiles=5,95"}}
+	requestBody := "{\"variables\":[{\"variable_type\": \"concept\", \"concept_id\": 2000000324}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataController.RetrieveStatsForCohortIdAndConceptId(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "statsDataByBreakdownValue") ||
+		!strings.Contains(result.CustomResponseWriterOut, "non-Hispanic Black") {
+		t.Errorf("Expected output containing 'statsDataByBreakdownValue' and breakdown value names, found %s", result.CustomResponseWriterOut)
+	}
+
+	// invalid percentiles should result in an aborted request:
+	requestContext = new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "conceptid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{RawQuery: "percentiles=abc"}}
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataController.RetrieveStatsForCohortIdAndConceptId(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to be aborted")
+	}
+}
+
 func TestRetrieveStatsForCohortIdAndConceptIdWithCorrectParams(t *testing.T) {
 	setUp(t)
 	requestContext := new(gin.Context)
@@ -1407,3 +2010,405 @@ func TestRetrieveStatsForCohortIdAndConceptIdWithCorrectParams(t *testing.T) {
 		t.Errorf("Expected request to be aborted")
 	}
 }
+
+func TestRetrieveHistogramForCohortIdAndConceptIdWithInvalidVariables(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "histogramid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = &http.Request{URL: &url.URL{}}
+	requestBody := "{\"variables\":[{\"variable_type\": \"custom_dichotomous\", \"cohort_ids\": [1, 3, 4]}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataController.RetrieveHistogramForCohortIdAndConceptId(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"field_errors\":[{\"field\":\"variables[0].cohort_ids\",\"message\":\"should have exactly two cohort ids\"}]") {
+		t.Errorf("Expected field errors in output, found %d %s", result.StatusCode, result.CustomResponseWriterOut)
+	}
+}
+
+func TestRetrieveVariablesSchema(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	schemaController := new(controllers.SchemaController)
+	schemaController.RetrieveVariablesSchema(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(result.CustomResponseWriterOut), &schema); err != nil {
+		t.Errorf("Expected a JSON Schema, found %s", result.CustomResponseWriterOut)
+	}
+	if schema["$schema"] != "https://json-schema.org/draft/2020-12/schema" ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"const\":\"custom_dichotomous\"") {
+		t.Errorf("Unexpected JSON Schema %s", result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithCohortDefinitionStats(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4, 5], \"windows\": {\"observation_window\": 365, \"outcome_window\": 30}}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(cohortDefinitionController.RetrieveStatsForAnalysisRequest)(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "cohort_definition_and_stats") {
+		t.Errorf("Expected output containing 'cohort_definition_and_stats', found %s", result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithMissingRequiredFields(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(cohortDataController.RetrieveHistogramForAnalysisRequest)(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if result.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"field_errors\":[{\"field\":\"options.concept_id\",\"message\":\"is required for this analysis\"}]") {
+		t.Errorf("Expected field errors in output, found %d %s", result.StatusCode, result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithInvalidRequestBody(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4], \"observation_window\": 365}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(cohortDefinitionController.RetrieveStatsForAnalysisRequest)(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !requestContext.IsAborted() || result.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"field\":\"observation_window\",\"message\":\"unknown field\"") {
+		t.Errorf("Expected unknown field error, found %d %s", result.StatusCode, result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithAttritionTableAsJson(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4], \"options\": {\"breakdown_concept_id\": 2000007027, \"format\": \"json\"}," +
+		"\"variables\": [{\"variable_type\": \"concept\", \"concept_id\": 2090006880}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(conceptController.RetrieveAttritionTableForAnalysisRequest)(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !strings.Contains(result.CustomResponseWriterOut, "\"steps\"") {
+		t.Errorf("Expected attrition table as JSON, found %s", result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithCohortDefinitionStatsAndTemporalVariables(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4], \"windows\": {\"observation_window\": 365}," +
+		"\"variables\": [{\"variable_type\": \"temporal\", \"cohort_id\": 5, \"relation\": \"after\", \"max_days\": 30}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(cohortDefinitionController.RetrieveStatsForAnalysisRequest)(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	// the dummy model removes one person per temporal variable:
+	if !strings.Contains(result.CustomResponseWriterOut, "\"size\":9") {
+		t.Errorf("Expected cohort size 9 in output, found %s", result.CustomResponseWriterOut)
+	}
+
+	// other types of variables are not supported here:
+	requestContext = new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody = "{\"source_id\": 1, \"cohort_ids\": [4], \"windows\": {\"observation_window\": 365}," +
+		"\"variables\": [{\"variable_type\": \"concept\", \"concept_id\": 2090006880}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(cohortDefinitionController.RetrieveStatsForAnalysisRequest)(requestContext)
+	result = requestContext.Writer.(*tests.CustomResponseWriter)
+	if !requestContext.IsAborted() || result.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"field\":\"variables[0].variable_type\",\"message\":\"should be one of [temporal] for this analysis\"") {
+		t.Errorf("Expected variable type error, found %d %s", result.StatusCode, result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithTemporalVariableInCohortOverlap(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4, 5]," +
+		"\"variables\": [{\"variable_type\": \"temporal\", \"cohort_id\": 6, \"relation\": \"during\"}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(cohortDataController.RetrieveCohortOverlapStatsForAnalysisRequest)(requestContext)
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	if !requestContext.IsAborted() || result.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(result.CustomResponseWriterOut, "\"field\":\"variables[0].variable_type\"") {
+		t.Errorf("Expected variable type error, found %d %s", result.StatusCode, result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithAttritionTableAndTemporalVariable(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4], \"options\": {\"breakdown_concept_id\": 2000007027, \"format\": \"json\"}," +
+		"\"variables\": [{\"variable_type\": \"temporal\", \"provided_name\": \"outcome in 30 days\", \"cohort_id\": 5, \"relation\": \"after\", \"max_days\": 30}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(conceptController.RetrieveAttritionTableForAnalysisRequest)(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	attritionTable := controllers.AttritionTable{}
+	err := json.Unmarshal([]byte(result.CustomResponseWriterOut), &attritionTable)
+	if err != nil || len(attritionTable.Steps) != 2 {
+		t.Fatalf("Expected attrition table with 2 steps, found %s", result.CustomResponseWriterOut)
+	}
+	step := attritionTable.Steps[1]
+	if step.Name != "outcome in 30 days" || step.Variable.VariableType != "temporal" || step.Variable.CohortId != 5 ||
+		step.Variable.Anchor != "start" || *step.Variable.MinDays != 0 || *step.Variable.MaxDays != 30 || step.Variable.Occurrence != "any" {
+		t.Errorf("Unexpected attrition step %v %v", step, step.Variable)
+	}
+}
+
+func TestRetrieveHistogramForCohortIdAndConceptIdWithWindows(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "sourceid", Value: strconv.Itoa(tests.GetTestSourceId())})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "cohortid", Value: "4"})
+	requestContext.Params = append(requestContext.Params, gin.Param{Key: "histogramid", Value: "2000006885"})
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"variables\":[{\"variable_type\": \"concept\", \"concept_id\": 2000000324}], \"windows\": {\"observation_window\": 365, \"follow_up_window\": 30}}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	cohortDataController.RetrieveHistogramForCohortIdAndConceptId(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+}
+
+func TestAnalysisHandlerWithUnsupportedWindows(t *testing.T) {
+	setUp(t)
+	var testCases = []struct {
+		handler       func(c *gin.Context, request *utils.AnalysisRequest)
+		requestBody   string
+		expectedField string
+	}{
+		{cohortDataController.RetrieveHistogramForAnalysisRequest,
+			"{\"source_id\": 1, \"cohort_ids\": [4], \"windows\": {\"outcome_window\": 30}, \"options\": {\"concept_id\": 2000006885}}", "windows.outcome_window"},
+		{conceptController.RetrieveAttritionTableForAnalysisRequest,
+			"{\"source_id\": 1, \"cohort_ids\": [4], \"windows\": {\"outcome_window\": 30}, \"options\": {\"breakdown_concept_id\": 2000007027}}", "windows.outcome_window"},
+		{cohortDataController.RetrieveCohortOverlapStatsForAnalysisRequest,
+			"{\"source_id\": 1, \"cohort_ids\": [4, 5], \"windows\": {\"observation_window\": 365}}", "windows.observation_window"},
+	}
+	for _, testCase := range testCases {
+		requestContext := new(gin.Context)
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = new(http.Request)
+		requestContext.Request.Body = io.NopCloser(strings.NewReader(testCase.requestBody))
+		controllers.NewAnalysisHandler(testCase.handler)(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if !requestContext.IsAborted() || result.StatusCode != http.StatusBadRequest ||
+			!strings.Contains(result.CustomResponseWriterOut, "\"field\":\""+testCase.expectedField+"\"") {
+			t.Errorf("Expected unsupported field error for %s, found %d %s", testCase.requestBody, result.StatusCode, result.CustomResponseWriterOut)
+		}
+	}
+}
+
+func TestAnalysisHandlerWithAttritionTableAndWindows(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	requestContext.Request = new(http.Request)
+	requestBody := "{\"source_id\": 1, \"cohort_ids\": [4], \"windows\": {\"observation_window\": 365, \"follow_up_window\": 30}," +
+		"\"options\": {\"breakdown_concept_id\": 2000007027, \"format\": \"json\"}," +
+		"\"variables\": [{\"variable_type\": \"concept\", \"concept_id\": 1234}]}"
+	requestContext.Request.Body = io.NopCloser(strings.NewReader(requestBody))
+	controllers.NewAnalysisHandler(conceptController.RetrieveAttritionTableForAnalysisRequest)(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	attritionTable := controllers.AttritionTable{}
+	err := json.Unmarshal([]byte(result.CustomResponseWriterOut), &attritionTable)
+	if err != nil || len(attritionTable.Steps) != 2 {
+		t.Errorf("Expected attrition table with 2 steps, found %s", result.CustomResponseWriterOut)
+	}
+}
+
+func TestAnalysisHandlerWithAggregationReports(t *testing.T) {
+	setUp(t)
+	var testCases = []struct {
+		handler     func(c *gin.Context, request *utils.AnalysisRequest)
+		requestBody string
+	}{
+		{cohortDataController.RetrieveHistogramForAnalysisRequest,
+			"{\"source_id\": 1, \"cohort_ids\": [4], \"options\": {\"concept_id\": 2000006885}}"},
+		{cohortDataController.RetrieveStatsForAnalysisRequest,
+			"{\"source_id\": 1, \"cohort_ids\": [4], \"options\": {\"concept_id\": 2000006885}}"},
+		{conceptController.RetrieveBreakdownStatsForAnalysisRequest,
+			"{\"source_id\": 1, \"cohort_ids\": [4], \"options\": {\"breakdown_concept_id\": 2000007027}}"},
+	}
+	for _, policy := range []models.AggregationPolicy{models.NO_AGGREGATION, models.AGGREGATE_LAST} {
+		dummyAggregationPolicy = policy
+		for _, testCase := range testCases {
+			requestContext := new(gin.Context)
+			requestContext.Writer = new(tests.CustomResponseWriter)
+			requestContext.Request = new(http.Request)
+			requestContext.Request.Body = io.NopCloser(strings.NewReader(testCase.requestBody))
+			controllers.NewAnalysisHandler(testCase.handler)(requestContext)
+			if requestContext.IsAborted() {
+				t.Errorf("Did not expect this request to abort")
+			}
+			result := requestContext.Writer.(*tests.CustomResponseWriter)
+			hasAggregationReports := strings.Contains(result.CustomResponseWriterOut, "\"aggregation\":[{")
+			if hasAggregationReports != (policy != models.NO_AGGREGATION) {
+				t.Errorf("Expected aggregation reports only for a policy, found %s for policy [%s]", result.CustomResponseWriterOut, policy)
+			}
+			if policy != models.NO_AGGREGATION && !strings.Contains(result.CustomResponseWriterOut, "\"policy\":\"last\",\"persons_with_multiple_observations\":2") {
+				t.Errorf("Expected the policy and the number of persons in the aggregation reports, found %s", result.CustomResponseWriterOut)
+			}
+		}
+	}
+}
+
+type dummyDataQualityModel struct{}
+
+// reports one issue for each rule:
+func (h dummyDataQualityModel) RunDataQualityRules(dataQualityConfig models.DataQualityConfig) (*models.DataQualityReport, error) {
+	if dummyModelReturnError {
+		return nil, fmt.Errorf("error!")
+	}
+	report := models.DataQualityReport{Results: []models.DataQualityResult{}, IssuesBySeverity: map[models.DataQualitySeverity]int64{}}
+	for _, rule := range dataQualityConfig.Rules {
+		report.Results = append(report.Results, models.DataQualityResult{Rule: rule.Name, Check: rule.Check, Severity: rule.Severity, SourceId: testSourceId, Issues: 1})
+		report.IssuesBySeverity[rule.Severity] += 1
+	}
+	report.FailureReasons = report.GetFailureReasons(dataQualityConfig.FailThresholds)
+	report.Failed = len(report.FailureReasons) > 0
+	return &report, nil
+}
+
+var dataQualityController = controllers.NewDataQualityController(*new(dummyDataQualityModel))
+
+func TestRetrieveDataQualityReport(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	dataQualityController.RetrieveDataQualityReport(requestContext)
+	if requestContext.IsAborted() {
+		t.Errorf("Did not expect this request to abort")
+	}
+	result := requestContext.Writer.(*tests.CustomResponseWriter)
+	var report models.DataQualityReport
+	err := json.Unmarshal([]byte(result.CustomResponseWriterOut), &report)
+	if err != nil {
+		t.Fatalf("Expected a JSON report, found %s", result.CustomResponseWriterOut)
+	}
+	// the rules in the mocktest config, with the default name and severity for the first one:
+	expectedResults := []models.DataQualityResult{
+		{Rule: "duplicate_observations", Check: models.DUPLICATE_OBSERVATIONS, Severity: models.SEVERITY_WARNING, SourceId: testSourceId, Issues: 1},
+		{Rule: "bmi_range", Check: models.OUT_OF_RANGE_VALUES, Severity: models.SEVERITY_ERROR, SourceId: testSourceId, Issues: 1},
+	}
+	if !reflect.DeepEqual(report.Results, expectedResults) {
+		t.Errorf("Expected results %v, found %v", expectedResults, report.Results)
+	}
+	// the error threshold in the mocktest config is 0, so the error issue fails the report:
+	if !report.Failed || len(report.FailureReasons) != 1 || !strings.Contains(report.FailureReasons[0], "severity error") {
+		t.Errorf("Expected the report to fail on the error threshold, found %v %v", report.Failed, report.FailureReasons)
+	}
+}
+
+func TestRetrieveDataQualityReportModelError(t *testing.T) {
+	setUp(t)
+	requestContext := new(gin.Context)
+	requestContext.Writer = new(tests.CustomResponseWriter)
+	dummyModelReturnError = true
+	dataQualityController.RetrieveDataQualityReport(requestContext)
+	if !requestContext.IsAborted() {
+		t.Errorf("Expected request to abort")
+	}
+}
+
+type dummyReadinessModel struct {
+	componentStatuses []utils.ComponentStatus
+}
+
+func (h dummyReadinessModel) CheckComponents(ctx context.Context, timeout time.Duration) []utils.ComponentStatus {
+	return h.componentStatuses
+}
+
+type dummyArboristHttpClient struct {
+	statusCode int
+}
+
+func (h dummyArboristHttpClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: h.statusCode}, nil
+}
+
+func TestReadinessStatus(t *testing.T) {
+	setUp(t)
+	okDb := utils.ComponentStatus{Component: "atlas_db", Critical: true, Ok: true}
+	failedDb := utils.ComponentStatus{Component: "atlas_db", Critical: true, Ok: false, Error: "connection refused"}
+	failedDataDictionary := utils.ComponentStatus{Component: "data_dictionary", Critical: false, Ok: false, Error: "data dictionary is not available yet"}
+	var testCases = []struct {
+		componentStatuses  []utils.ComponentStatus
+		arboristStatusCode int
+		expectedStatusCode int
+	}{
+		{[]utils.ComponentStatus{okDb}, http.StatusOK, http.StatusOK},
+		// a non critical component does not make the service unavailable:
+		{[]utils.ComponentStatus{okDb, failedDataDictionary}, http.StatusOK, http.StatusOK},
+		{[]utils.ComponentStatus{failedDb, failedDataDictionary}, http.StatusOK, http.StatusServiceUnavailable},
+		{[]utils.ComponentStatus{okDb}, http.StatusInternalServerError, http.StatusServiceUnavailable},
+	}
+	for _, testCase := range testCases {
+		readinessController := controllers.NewReadinessController(dummyReadinessModel{componentStatuses: testCase.componentStatuses},
+			dummyArboristHttpClient{statusCode: testCase.arboristStatusCode})
+		requestContext := new(gin.Context)
+		requestContext.Writer = new(tests.CustomResponseWriter)
+		requestContext.Request = new(http.Request)
+		readinessController.Status(requestContext)
+		result := requestContext.Writer.(*tests.CustomResponseWriter)
+		if result.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected status %d, found %d %s", testCase.expectedStatusCode, result.StatusCode, result.CustomResponseWriterOut)
+		}
+		// all components are reported, including Arborist:
+		var response struct {
+			Components []utils.ComponentStatus `json:"components"`
+		}
+		_ = json.Unmarshal([]byte(result.CustomResponseWriterOut), &response)
+		if len(response.Components) != len(testCase.componentStatuses)+1 || response.Components[len(response.Components)-1].Component != "arborist" {
+			t.Errorf("Expected the status of all components, found %s", result.CustomResponseWriterOut)
+		}
+		// the error details are not returned:
+		if strings.Contains(result.CustomResponseWriterOut, "connection refused") {
+			t.Errorf("Expected no error details, found %s", result.CustomResponseWriterOut)
+		}
+		for _, component := range response.Components {
+			if !component.Ok && component.Error != controllers.READINESS_CHECK_FAILED_MESSAGE {
+				t.Errorf("Expected a generic error, found %v", component)
+			}
+		}
+	}
+}
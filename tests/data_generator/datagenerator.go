@@ -200,12 +200,20 @@ func AddConceptAndMaybeAddObservations(nextConceptId int64, concept Concept) {
 	var conceptName = concept.ConceptName
 	var conceptClassId = "MVP Continuous"
 	if concept.Id != "" {
-		conceptId = utils.ParseInt64(concept.Id)
+		var err error
+		conceptId, err = utils.ParseInt64(concept.Id)
+		if err != nil {
+			log.Fatalf("Invalid concept id in test data configuration: %v", err)
+		}
 	}
 	if concept.ConceptValueName != "" {
 		conceptName = concept.ConceptValueName
 		// TODO - validate there is only one:
-		conceptId = utils.ParseInt64(concept.PossibleValues[0])
+		var err error
+		conceptId, err = utils.ParseInt64(concept.PossibleValues[0])
+		if err != nil {
+			log.Fatalf("Invalid concept id in test data configuration: %v", err)
+		}
 	}
 	if concept.ValueType == "concept" {
 		conceptClassId = "MVP Nominal"
@@ -1,17 +1,28 @@
 package middlewares_tests
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/uc-cdis/cohort-middleware/config"
 	"github.com/uc-cdis/cohort-middleware/middlewares"
 	"github.com/uc-cdis/cohort-middleware/models"
 	"github.com/uc-cdis/cohort-middleware/tests"
+	"github.com/uc-cdis/cohort-middleware/utils"
 )
 
 func TestMain(m *testing.M) {
@@ -132,6 +143,10 @@ func (h dummyCohortDefinitionDataModel) GetCohortDefinitionStatsByObservationWin
 	return nil, nil
 }
 
+func (h dummyCohortDefinitionDataModel) GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(sourceId int, cohortId int, observationWindow int, temporalVariables []utils.CustomTemporalVariableDef) (*models.CohortDefinitionStats, error) {
+	return nil, nil
+}
+
 func (h dummyCohortDefinitionDataModel) GetCohortDefinitionStatsByObservationWindow1stCohortAndOverlap2ndCohort(sourceId int, cohort1Id int, cohort2Id int, observationWindow1stCohort int) (*models.CohortDefinitionStats, error) {
 	return nil, nil
 }
@@ -343,7 +358,7 @@ func TestTeamProjectValidationNoTeamProjectMatchingAllCohortDefinitions(t *testi
 	}
 }
 
-func TestHasAccessToTeamProjectAbortOnArboristPrepError(t *testing.T) {
+func TestHasAccessToTeamProjectFalseOnArboristPrepError(t *testing.T) {
 	setUp(t)
 	config.Init("mocktest")
 	arboristAuthzResponseCode := 200
@@ -358,14 +373,336 @@ func TestHasAccessToTeamProjectAbortOnArboristPrepError(t *testing.T) {
 	teamProjectAuthz := middlewares.NewTeamProjectAuthz(*new(dummyCohortDefinitionDataModel),
 		dummyHttpClient)
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("panic occurred:", err)
-			if err != "Error while preparing Arborist request" {
-				t.Errorf("Expected error: 'Error while preparing Arborist request'")
+	// no panic, the caller gets false and responds with an access denied error:
+	if teamProjectAuthz.HasAccessToTeamProject(requestContext, "dummyTeam") {
+		t.Errorf("Expected no access")
+	}
+	if dummyHttpClient.nrCalls > 0 {
+		t.Errorf("Expected dummyHttpClient to NOT have been called")
+	}
+	if requestContext.IsAborted() {
+		t.Errorf("Expected the request to be left to the caller")
+	}
+}
+
+func TestErrorHandlerMiddleware(t *testing.T) {
+	setUp(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.ErrorHandlerMiddleware())
+	router.GET("/not-found", func(ctx *gin.Context) {
+		middlewares.AbortWithError(ctx, "Error retrieving concept", utils.NewNotFoundError(errors.New("concept not found")))
+	})
+	router.GET("/panic", func(ctx *gin.Context) {
+		panic("unexpected")
+	})
+	router.GET("/context-error", func(ctx *gin.Context) {
+		_ = ctx.Error(fmt.Errorf("query failed: %w", context.DeadlineExceeded))
+	})
+
+	var testCases = []struct {
+		path           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"/not-found", http.StatusNotFound, "not_found"},
+		{"/panic", http.StatusInternalServerError, "internal_error"},
+		{"/context-error", http.StatusGatewayTimeout, "timeout"},
+	}
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, testCase.path, nil)
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Expected status %d for %s, found %d", testCase.expectedStatus, testCase.path, recorder.Code)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Errorf("Expected JSON body for %s, found %s", testCase.path, recorder.Body.String())
+		}
+		requestId := recorder.Header().Get(middlewares.REQUEST_ID_HEADER)
+		if body["code"] != testCase.expectedCode || body["message"] == "" || body["error"] == "" ||
+			requestId == "" || body["request_id"] != requestId {
+			t.Errorf("Unexpected error body for %s: %v", testCase.path, body)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	arborist := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") == "Bearer denied" {
+			writer.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer arborist.Close()
+	config.GetConfig().Set("arborist_endpoint", arborist.URL)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.ErrorHandlerMiddleware())
+	router.Use(middlewares.AuthMiddleware())
+	router.GET("/cohortdefinitions", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	})
+
+	for authorization, expectedStatus := range map[string]int{"": http.StatusUnauthorized, "Bearer denied": http.StatusUnauthorized, "Bearer ok": http.StatusOK} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/cohortdefinitions", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != expectedStatus {
+			t.Errorf("Expected status %d for %q, found %d", expectedStatus, authorization, recorder.Code)
+		}
+		if expectedStatus == http.StatusUnauthorized {
+			var body map[string]string
+			_ = json.Unmarshal(recorder.Body.Bytes(), &body)
+			if body["code"] != "unauthorized" || body["request_id"] != recorder.Header().Get(middlewares.REQUEST_ID_HEADER) {
+				t.Errorf("Unexpected error body for %q: %s", authorization, recorder.Body.String())
 			}
 		}
-	}()
-	teamProjectAuthz.HasAccessToTeamProject(requestContext, "dummyTeam")
-	t.Errorf("Expected error")
+	}
+}
+
+func TestErrorHandlerMiddlewareKeepsRequestId(t *testing.T) {
+	setUp(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.ErrorHandlerMiddleware())
+	router.GET("/forbidden", func(ctx *gin.Context) {
+		middlewares.AbortWithError(ctx, "access denied", middlewares.ErrAccessDenied)
+	})
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/forbidden", nil)
+	request.Header.Set(middlewares.REQUEST_ID_HEADER, "test-request-id")
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, found %d", recorder.Code)
+	}
+	if recorder.Header().Get(middlewares.REQUEST_ID_HEADER) != "test-request-id" ||
+		!strings.Contains(recorder.Body.String(), "\"request_id\":\"test-request-id\"") ||
+		!strings.Contains(recorder.Body.String(), "\"code\":\"forbidden\"") {
+		t.Errorf("Unexpected response: %s", recorder.Body.String())
+	}
+}
+
+func TestCheckArboristHealth(t *testing.T) {
+	setUp(t)
+	httpClient := &dummyHttpClient{statusCode: 200}
+	err := middlewares.CheckArboristHealth(context.Background(), httpClient)
+	if err != nil || httpClient.nrCalls != 1 {
+		t.Errorf("Expected Arborist to be healthy, found %v", err)
+	}
+	httpClient = &dummyHttpClient{statusCode: 503}
+	err = middlewares.CheckArboristHealth(context.Background(), httpClient)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected an error for the Arborist status, found %v", err)
+	}
+}
+
+func TestMaxBodySizeMiddleware(t *testing.T) {
+	setUp(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.ErrorHandlerMiddleware())
+	router.Use(middlewares.MaxBodySizeMiddleware(10))
+	router.POST("/echo", func(ctx *gin.Context) {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			middlewares.AbortWithError(ctx, "error reading body", err)
+			return
+		}
+		ctx.String(http.StatusOK, string(body))
+	})
+	testCases := []struct {
+		body           string
+		unknownLength  bool
+		expectedStatus int
+	}{
+		{"small", false, http.StatusOK},
+		{"a body that is too large", false, http.StatusRequestEntityTooLarge},
+		// the limit also applies when the size is not known up front:
+		{"a body that is too large", true, http.StatusRequestEntityTooLarge},
+	}
+	for _, testCase := range testCases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(testCase.body))
+		if testCase.unknownLength {
+			request.ContentLength = -1
+		}
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Expected status %d for %q, found %d", testCase.expectedStatus, testCase.body, recorder.Code)
+		}
+		if testCase.expectedStatus == http.StatusRequestEntityTooLarge && !strings.Contains(recorder.Body.String(), "\"code\":\"request_too_large\"") {
+			t.Errorf("Unexpected response: %s", recorder.Body.String())
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	if settings := middlewares.GetRateLimitSettings(middlewares.DEFAULT_ROUTE_CLASS); settings.RequestsPerMinute != 0 {
+		t.Errorf("Expected no default rate limit, found %v", settings)
+	}
+	settings := middlewares.GetRateLimitSettings(middlewares.EXPORT_ROUTE_CLASS)
+	if settings.RequestsPerMinute != 6 || settings.Burst != 2 {
+		t.Errorf("Unexpected export rate limit settings %v", settings)
+	}
+	limiter := middlewares.NewRateLimiter(middlewares.EXPORT_ROUTE_CLASS, settings)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.Now = func() time.Time { return now }
+	// the burst is allowed, then one request per 10 seconds:
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("user:1"); !allowed {
+			t.Errorf("Expected request %d of the burst to be allowed", i)
+		}
+	}
+	allowed, retryAfter := limiter.Allow("user:1")
+	if allowed || retryAfter != 10*time.Second {
+		t.Errorf("Expected the request to be rejected for 10s, found %v, %v", allowed, retryAfter)
+	}
+	// other users have their own bucket:
+	if allowed, _ := limiter.Allow("user:2"); !allowed {
+		t.Errorf("Expected the request of another user to be allowed")
+	}
+	now = now.Add(10 * time.Second)
+	if allowed, _ := limiter.Allow("user:1"); !allowed {
+		t.Errorf("Expected the request to be allowed after the refill")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	setUp(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middlewares.ErrorHandlerMiddleware())
+	router.Use(middlewares.RateLimitMiddleware(middlewares.NewRateLimiter(middlewares.EXPORT_ROUTE_CLASS,
+		middlewares.RateLimitSettings{RequestsPerMinute: 1, Burst: 1})))
+	router.GET("/export", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	})
+	// a token with {"sub":"42"} as payload:
+	token := "Bearer header." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"42"}`)) + ".signature"
+	statuses := []int{}
+	for _, authorization := range []string{token, token, "Bearer other"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/export", nil)
+		request.Header.Set("Authorization", authorization)
+		router.ServeHTTP(recorder, request)
+		statuses = append(statuses, recorder.Code)
+		if recorder.Code == http.StatusTooManyRequests &&
+			(recorder.Header().Get(middlewares.RETRY_AFTER_HEADER) != "60" || !strings.Contains(recorder.Body.String(), "\"code\":\"too_many_requests\"")) {
+			t.Errorf("Unexpected rate limit response %v: %s", recorder.Header(), recorder.Body.String())
+		}
+	}
+	// the request without a valid token is limited by client IP, separately from user 42:
+	if !reflect.DeepEqual(statuses, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK}) {
+		t.Errorf("Unexpected statuses %v", statuses)
+	}
+}
+
+func TestSourceConcurrencyLimiter(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	settings := middlewares.GetHeavyQuerySettings()
+	if settings.MaxConcurrentPerSource != 2 || settings.MaxQueuedPerSource != 1 ||
+		settings.QueueTimeoutSeconds != middlewares.DEFAULT_HEAVY_QUERY_QUEUE_TIMEOUT_SECONDS {
+		t.Errorf("Unexpected heavy query settings %v", settings)
+	}
+	settings.QueueTimeoutSeconds = 0
+	limiter := middlewares.NewSourceConcurrencyLimiter(settings)
+	release1, err1 := limiter.Acquire(context.Background(), 1)
+	_, err2 := limiter.Acquire(context.Background(), 1)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Expected two slots on the source, found %v, %v", err1, err2)
+	}
+	// other sources have their own slots:
+	if _, err := limiter.Acquire(context.Background(), 2); err != nil {
+		t.Errorf("Expected a slot on the other source, found %v", err)
+	}
+	// the third query on source 1 waits in the queue, until it times out:
+	_, err := limiter.Acquire(context.Background(), 1)
+	if err == nil || utils.GetErrorCode(err) != utils.UPSTREAM_UNAVAILABLE {
+		t.Errorf("Expected an upstream unavailable error, found %v", err)
+	}
+	// a released slot can be used again:
+	release1()
+	if _, err := limiter.Acquire(context.Background(), 1); err != nil {
+		t.Errorf("Expected the released slot to be available, found %v", err)
+	}
+}
+
+func TestGetHeavyQuerySettingsDefaultQueue(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	config.GetConfig().Set("heavy_queries", map[string]interface{}{"max_concurrent_per_source": 3})
+	// the queue defaults to the number of concurrent queries:
+	if settings := middlewares.GetHeavyQuerySettings(); settings.MaxConcurrentPerSource != 3 || settings.MaxQueuedPerSource != 3 {
+		t.Errorf("Unexpected heavy query settings %v", settings)
+	}
+	// but can be disabled explicitly:
+	config.GetConfig().Set("heavy_queries", map[string]interface{}{"max_concurrent_per_source": 3, "max_queued_per_source": 0})
+	if settings := middlewares.GetHeavyQuerySettings(); settings.MaxQueuedPerSource != 0 {
+		t.Errorf("Unexpected heavy query settings %v", settings)
+	}
+}
+
+func TestValidateHeavyQueryAndRateLimitSettings(t *testing.T) {
+	setUp(t)
+	config.Init("mocktest")
+	if err := middlewares.ValidateHeavyQuerySettings(); err != nil {
+		t.Errorf("Expected no error, found %v", err)
+	}
+	if err := middlewares.ValidateRateLimitSettings(); err != nil {
+		t.Errorf("Expected no error, found %v", err)
+	}
+	config.GetConfig().Set("heavy_queries", map[string]interface{}{"max_concurrent_per_source": "many"})
+	if err := middlewares.ValidateHeavyQuerySettings(); err == nil {
+		t.Errorf("Expected an error for invalid heavy_queries")
+	}
+	// the invalid settings are not used:
+	if settings := middlewares.GetHeavyQuerySettings(); settings.MaxConcurrentPerSource != 0 {
+		t.Errorf("Expected no limit, found %v", settings)
+	}
+	config.GetConfig().Set("rate_limits", map[string]interface{}{"export": map[string]interface{}{"requests_per_minute": -1}})
+	if err := middlewares.ValidateRateLimitSettings(); err == nil {
+		t.Errorf("Expected an error for invalid rate_limits")
+	}
+	if settings := middlewares.GetRateLimitSettings(middlewares.EXPORT_ROUTE_CLASS); settings.RequestsPerMinute != 0 {
+		t.Errorf("Expected no limit, found %v", settings)
+	}
+}
+
+func TestHeavyQueryMiddleware(t *testing.T) {
+	setUp(t)
+	gin.SetMode(gin.TestMode)
+	limiter := middlewares.NewSourceConcurrencyLimiter(middlewares.HeavyQuerySettings{MaxConcurrentPerSource: 1, MaxQueuedPerSource: 0, RetryAfterSeconds: 5})
+	queryStarted := make(chan bool)
+	queryDone := make(chan bool)
+	router := gin.New()
+	router.Use(middlewares.ErrorHandlerMiddleware())
+	router.Use(middlewares.HeavyQueryMiddleware(limiter))
+	router.POST("/v2/cohort-data", func(ctx *gin.Context) {
+		body, _ := io.ReadAll(ctx.Request.Body)
+		if !strings.Contains(string(body), "source_id") {
+			t.Errorf("Expected the handler to get the full body, found %s", body)
+		}
+		queryStarted <- true
+		<-queryDone
+		ctx.String(http.StatusOK, "ok")
+	})
+	firstRecorder := httptest.NewRecorder()
+	go router.ServeHTTP(firstRecorder, httptest.NewRequest(http.MethodPost, "/v2/cohort-data", strings.NewReader(`{"source_id": 1}`)))
+	<-queryStarted
+	// the source id is read from the body, and the source has no slot left:
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v2/cohort-data", strings.NewReader(`{"source_id": 1}`)))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get(middlewares.RETRY_AFTER_HEADER) != "5" {
+		t.Errorf("Expected a 503 with Retry-After, found %d %v", recorder.Code, recorder.Header())
+	}
+	close(queryDone)
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -87,20 +88,19 @@ var cohortDataModel = new(models.CohortData)
 var versionModel = new(models.Version)
 var sourceModel = new(models.Source)
 var dataDictionaryModel = new(models.DataDictionary)
+var dataQualityModel = new(models.DataQuality)
 
 func TestGetConceptId(t *testing.T) {
 	setUp(t)
-	conceptId := models.GetConceptId("ID_12345")
-	if conceptId != 12345 {
+	conceptId, err := models.GetConceptId("ID_12345")
+	if conceptId != 12345 || err != nil {
 		t.Error()
 	}
-	// the GetConceptId below should result in panic/error:
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic")
-		}
-	}()
-	models.GetConceptId("AD_12345")
+	// the GetConceptId below should result in an invalid input error:
+	_, err = models.GetConceptId("AD_12345")
+	if utils.GetErrorCode(err) != utils.INVALID_INPUT {
+		t.Errorf("Expected invalid input error, found %v", err)
+	}
 
 }
 
@@ -114,13 +114,11 @@ func TestGetPrefixedConceptId(t *testing.T) {
 
 func TestGetConceptValueNotNullCheckBasedOnConceptTypeError(t *testing.T) {
 	setUp(t)
-	// the call below should result in panic/error:
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("The code did not panic")
-		}
-	}()
-	models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, -1)
+	// the call below should result in a not found error:
+	_, err := models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, -1)
+	if utils.GetErrorCode(err) != utils.NOT_FOUND {
+		t.Errorf("Expected not found error, found %v", err)
+	}
 }
 
 func TestGetConceptValueNotNullCheckBasedOnConceptTypeError2(t *testing.T) {
@@ -128,27 +126,25 @@ func TestGetConceptValueNotNullCheckBasedOnConceptTypeError2(t *testing.T) {
 	// add dummy concept:
 	conceptId := tests.AddInvalidTypeConcept(models.Omop)
 
-	// the call below should result in a specific panic/error on the concept type not being supported:
-	defer func() {
-		r := recover()
-		if r == nil || !strings.HasPrefix(r.(string), "error: concept type not supported") {
-			t.Errorf("The code did not panic with expected error")
-		}
-		// cleanup:
-		tests.RemoveConcept(models.Omop, conceptId)
-	}()
-	models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, conceptId)
+	// cleanup:
+	defer tests.RemoveConcept(models.Omop, conceptId)
+	// the call below should result in a specific error on the concept type not being supported:
+	_, err := models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, conceptId)
+	if err == nil || !strings.HasPrefix(err.Error(), "error: concept type not supported") ||
+		utils.GetErrorCode(err) != utils.INVALID_INPUT {
+		t.Errorf("Expected invalid input error on concept type, found %v", err)
+	}
 }
 
 func TestGetConceptValueNotNullCheckBasedOnConceptTypeSuccess(t *testing.T) {
 	setUp(t)
 	// check success scenarios:
-	result := models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, hareConceptId)
-	if result != "observation.value_as_concept_id is not null and observation.value_as_concept_id != 0" {
+	result, err := models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, hareConceptId)
+	if err != nil || result != "observation.value_as_concept_id is not null and observation.value_as_concept_id != 0" {
 		t.Errorf("Unexpected result. Found %s", result)
 	}
-	result = models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, histogramConceptId)
-	if result != "observation.value_as_number is not null" {
+	result, err = models.GetConceptValueNotNullCheckBasedOnConceptType("observation", testSourceId, histogramConceptId)
+	if err != nil || result != "observation.value_as_number is not null" {
 		t.Errorf("Unexpected result. Found %s", result)
 	}
 }
@@ -172,6 +168,39 @@ func TestRetrieveInfoBySourceIdAndConceptIds(t *testing.T) {
 	}
 }
 
+func TestRetrieveInfoBySourceIdAndConceptIdsUsingCache(t *testing.T) {
+	setUp(t)
+	conceptModel.FlushInfoCache()
+	conceptsInfo, _ := conceptModel.RetrieveInfoBySourceIdAndConceptIds(testSourceId, allConceptIds[0:1])
+	// changing the result should not change the cached entry:
+	expectedConceptName := conceptsInfo[0].ConceptName
+	conceptsInfo[0].ConceptName = "changed"
+	// the second call should add the other concepts to the cache, and return the same as without cache:
+	conceptsInfo, _ = conceptModel.RetrieveInfoBySourceIdAndConceptIds(testSourceId, allConceptIds)
+	if len(conceptsInfo) != len(allConceptIds) {
+		t.Errorf("Found %d", len(conceptsInfo))
+	}
+	for _, conceptInfo := range conceptsInfo {
+		if conceptInfo.ConceptId == allConceptIds[0] && conceptInfo.ConceptName != expectedConceptName {
+			t.Errorf("Expected %s, found %s", expectedConceptName, conceptInfo.ConceptName)
+		}
+	}
+	// unknown concepts should still result in an error:
+	_, err := conceptModel.RetrieveInfoBySourceIdAndConceptIds(testSourceId, append(allConceptIds, -1))
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+	if conceptModel.FlushInfoCacheBySourceId(testSourceId+1) != 0 {
+		t.Errorf("Expected no entries for other source")
+	}
+	if conceptModel.FlushInfoCacheBySourceId(testSourceId) != len(allConceptIds) {
+		t.Errorf("Expected %d entries", len(allConceptIds))
+	}
+	if conceptModel.FlushInfoCache() != 0 {
+		t.Errorf("Expected empty cache")
+	}
+}
+
 func TestRetrieveInfoBySourceIdAndConceptTypes(t *testing.T) {
 	setUp(t)
 	// get all concepts:
@@ -228,7 +257,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsN
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
 	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
 		smallestCohort.Id,
-		allConceptIds, filterCohortPairs, allConceptIds[0])
+		allConceptIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, allConceptIds[0])
 	// none of the subjects has a value in all the concepts, so we expect len==0 here:
 	if len(stats) != 0 {
 		t.Errorf("Expected no results, found %d", len(stats))
@@ -425,7 +454,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndTwoCohortPai
 	}
 	breakdownConceptId := hareConceptId // not normally the case...but we'll use the same here just for the test...
 	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
-		populationCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
+		populationCohort.Id, filterIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, breakdownConceptId)
 	// we expect results, and we expect the total of persons to be 6, since only 6 of the persons
 	// in largestCohort have a HARE value (and smallestCohort does not overlap with largest):
 	countPersons := 0
@@ -450,7 +479,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndTwoCohortPai
 			ProvidedName:        "test2"},
 	}
 	stats, _ = conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
-		populationCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
+		populationCohort.Id, filterIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, breakdownConceptId)
 	countPersons = 0
 	for _, stat := range stats {
 		countPersons += stat.NpersonsInCohortWithValue
@@ -472,7 +501,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 	}
 	breakdownConceptId := hareConceptId // not normally the case...but we'll use the same here just for the test...
 	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
-		extendedCopyOfSecondLargestCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
+		extendedCopyOfSecondLargestCohort.Id, filterIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, breakdownConceptId)
 	// we expect values since secondLargestCohort has multiple subjects with hare info:
 	if len(stats) < 4 {
 		t.Errorf("Expected at least 4 results, found %d", len(stats))
@@ -492,7 +521,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 	// test without the filterCohortPairs, should return the same result:
 	filterCohortPairs = []utils.CustomDichotomousVariableDef{}
 	stats2, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
-		extendedCopyOfSecondLargestCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
+		extendedCopyOfSecondLargestCohort.Id, filterIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, breakdownConceptId)
 	// very rough check (ideally we would check the individual stats as well...TODO?):
 	if len(stats) > len(stats2) {
 		t.Errorf("First query is more restrictive, so its stats should not be larger than stats2 of second query. Got %d and %d", len(stats), len(stats2))
@@ -508,7 +537,7 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 			ProvidedName:        "test"},
 	}
 	stats3, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
-		secondLargestCohort.Id, filterIds, filterCohortPairs, breakdownConceptId)
+		secondLargestCohort.Id, filterIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, breakdownConceptId)
 	if len(stats3) != 2 {
 		t.Errorf("Expected only two items in resultset, found %d", len(stats3))
 	}
@@ -521,6 +550,47 @@ func TestRetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairsW
 	}
 }
 
+func TestRetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(t *testing.T) {
+	setUp(t)
+	filterIds := []int64{hareConceptId}
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
+	// cross tab of hare by hare (artificial...but the counts should then match the breakdown stats on the diagonal):
+	crossTabCells, _ := conceptModel.RetrieveCrossTabStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+		secondLargestCohort.Id, filterIds, filterCohortPairs, hareConceptId, hareConceptId)
+	stats, _ := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+		secondLargestCohort.Id, filterIds, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, hareConceptId)
+	if len(crossTabCells) == 0 || len(crossTabCells) != len(stats) {
+		t.Errorf("Expected %d cells, found %d", len(stats), len(crossTabCells))
+	}
+	for _, crossTabCell := range crossTabCells {
+		if crossTabCell.RowValueAsConceptId != crossTabCell.ColumnValue {
+			t.Errorf("Expected only cells on the diagonal")
+		}
+	}
+
+	// cross tab of hare by cohort pair secondLargestCohort and largestCohort, which overlap on 2 persons,
+	// but only 1 of them has a HARE value:
+	columnCohortPair := utils.CustomDichotomousVariableDef{
+		CohortDefinitionId1: secondLargestCohort.Id,
+		CohortDefinitionId2: largestCohort.Id,
+		ProvidedName:        "test"}
+	crossTabCells, _ = conceptModel.RetrieveCrossTabStatsByCohortPairBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId,
+		secondLargestCohort.Id, filterIds, filterCohortPairs, hareConceptId, columnCohortPair)
+	countPersons := 0
+	for _, crossTabCell := range crossTabCells {
+		if crossTabCell.ColumnValue != int64(secondLargestCohort.Id) && crossTabCell.ColumnValue != int64(largestCohort.Id) {
+			t.Errorf("Unexpected column value %d", crossTabCell.ColumnValue)
+		}
+		countPersons = countPersons + crossTabCell.NpersonsInCohortWithValues
+	}
+	if countPersons == 0 {
+		t.Errorf("Expected persons in resultset")
+	}
+	if len(filterCohortPairs) != 0 {
+		t.Errorf("Expected filterCohortPairs to be left unchanged")
+	}
+}
+
 func TestRetrieveBreakdownStatsBySourceIdAndCohortIdWithResults(t *testing.T) {
 	setUp(t)
 	breakdownConceptId := hareConceptId
@@ -749,6 +819,46 @@ func TestGetCohortName(t *testing.T) {
 
 }
 
+func TestGetCohortDefinitionStatsByObservationWindowAndTemporalVariables(t *testing.T) {
+	setUp(t)
+	// every cohort entry starts during itself, so nobody is filtered out by this:
+	temporalVariables := []utils.CustomTemporalVariableDef{
+		{CohortDefinitionId: secondLargestCohort.Id, Relation: utils.RELATION_DURING, Occurrence: utils.OCCURRENCE_ANY},
+	}
+	cohortDefinitionAndStats, err := cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(testSourceId, secondLargestCohort.Id, 300, temporalVariables)
+	if err != nil || cohortDefinitionAndStats.CohortSize != secondLargestCohort.CohortSize {
+		t.Errorf("Expected cohort size %d, got %v %v", secondLargestCohort.CohortSize, cohortDefinitionAndStats, err)
+	}
+
+	// nobody enters the cohort more than 30000 days after entering it:
+	temporalVariables = []utils.CustomTemporalVariableDef{
+		{CohortDefinitionId: secondLargestCohort.Id, Anchor: utils.ANCHOR_START, Relation: utils.RELATION_AFTER, MinDays: 30000, Occurrence: utils.OCCURRENCE_FIRST},
+	}
+	cohortDefinitionAndStats, err = cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindowAndTemporalVariables(testSourceId, secondLargestCohort.Id, 300, temporalVariables)
+	if err != nil || cohortDefinitionAndStats.CohortSize != 0 {
+		t.Errorf("Expected cohort size == 0, got %v %v", cohortDefinitionAndStats, err)
+	}
+}
+
+func TestRetrieveCohortSizeWithObservationPeriodFilter(t *testing.T) {
+	setUp(t)
+	// same as in TestGetCohortDefinitionStatsByObservationWindow, everybody has 300 days of observation before index:
+	observationPeriodFilter := &utils.ObservationPeriodFilter{ObservationWindow: 300}
+	cohortSize, err := cohortDataModel.RetrieveCohortSizeBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, secondLargestCohort.Id,
+		[]utils.CustomConceptVariableDef{}, []utils.CustomDichotomousVariableDef{}, []utils.CustomTemporalVariableDef{}, observationPeriodFilter)
+	if err != nil || cohortSize != secondLargestCohort.CohortSize {
+		t.Errorf("Expected cohort size %d, got %d %v", secondLargestCohort.CohortSize, cohortSize, err)
+	}
+
+	// nobody is observed for more than 30000 days after index:
+	observationPeriodFilter = &utils.ObservationPeriodFilter{ObservationWindow: 300, FollowUpWindow: 30000}
+	cohortSize, err = cohortDataModel.RetrieveCohortSizeBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, secondLargestCohort.Id,
+		[]utils.CustomConceptVariableDef{}, []utils.CustomDichotomousVariableDef{}, []utils.CustomTemporalVariableDef{}, observationPeriodFilter)
+	if err != nil || cohortSize != 0 {
+		t.Errorf("Expected cohort size == 0, got %d %v", cohortSize, err)
+	}
+}
+
 func TestGetCohortDefinitionStatsByObservationWindow(t *testing.T) {
 	setUp(t)
 	cohortDefinitionAndStats, _ := cohortDefinitionModel.GetCohortDefinitionStatsByObservationWindow(testSourceId, secondLargestCohort.Id, 300)
@@ -934,7 +1044,7 @@ func TestRetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(t
 	setUp(t)
 	filterConceptIdsAndValues := []utils.CustomConceptVariableDef{}
 	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
-	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs)
+	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil)
 	// everyone in the largestCohort has the histogramConceptId, but one person has NULL in the value_as_number:
 	if len(data) != largestCohort.CohortSize-1 {
 		t.Errorf("expected %d histogram data but got %d", largestCohort.CohortSize, len(data))
@@ -948,13 +1058,70 @@ func TestRetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(t
 			ProvidedName:        "test"},
 	}
 	// then we expect histogram data for the overlapping population only (which is 5 for extendedCopyOfSecondLargestCohort and largestCohort):
-	data, _ = cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs)
+	data, _ = cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil)
 	if len(data) != 5 {
 		t.Errorf("expected 5 histogram data but got %d", len(data))
 	}
 
 }
 
+func TestValidateDerivedConceptIds(t *testing.T) {
+	setUp(t)
+	// the test data has no concepts with the ids of the derived variables:
+	if err := models.ValidateDerivedConceptIds(); err != nil {
+		t.Errorf("Expected no error, found %v", err)
+	}
+}
+
+func TestRetrieveHistogramDataForDerivedAgeAtCohortStart(t *testing.T) {
+	setUp(t)
+	filterConceptIdsAndValues := []utils.CustomConceptVariableDef{}
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
+	data, err := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, models.AGE_AT_COHORT_START_CONCEPT_ID, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil)
+	// everyone in the largestCohort has a year of birth, so everyone has an age:
+	if err != nil || len(data) != largestCohort.CohortSize {
+		t.Errorf("expected %d ages but got %d %v", largestCohort.CohortSize, len(data), err)
+	}
+	for _, item := range data {
+		if item.ConceptId != models.AGE_AT_COHORT_START_CONCEPT_ID || item.ConceptValueAsNumber == nil || *item.ConceptValueAsNumber < 0 {
+			t.Errorf("unexpected age %v", item)
+		}
+	}
+
+	// the derived variable can also be used as a filter:
+	filterConceptIdsAndValues = []utils.CustomConceptVariableDef{{ConceptId: models.SEX_CONCEPT_ID}}
+	filteredData, err := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, models.AGE_AT_COHORT_START_CONCEPT_ID, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil)
+	if err != nil || len(filteredData) != len(data) {
+		t.Errorf("expected %d ages but got %d %v", len(data), len(filteredData), err)
+	}
+}
+
+func TestRetrieveBreakdownStatsForDerivedSex(t *testing.T) {
+	setUp(t)
+	stats, err := conceptModel.RetrieveBreakdownStatsBySourceIdAndCohortId(testSourceId, largestCohort.Id, models.SEX_CONCEPT_ID)
+	if err != nil || len(stats) == 0 {
+		t.Fatalf("expected sex breakdown, got %v %v", stats, err)
+	}
+	totalPersons := 0
+	for _, item := range stats {
+		totalPersons += item.NpersonsInCohortWithValue
+		if item.ValueName == "" {
+			t.Errorf("expected the name of the gender concept %d", item.ValueAsConceptId)
+		}
+	}
+	if totalPersons != largestCohort.CohortSize {
+		t.Errorf("expected %d persons, got %d", largestCohort.CohortSize, totalPersons)
+	}
+	conceptInfo, err := conceptModel.RetrieveInfoBySourceIdAndConceptId(testSourceId, models.SEX_CONCEPT_ID)
+	if err != nil || conceptInfo.ConceptCode != "sex" {
+		t.Errorf("unexpected concept info %v %v", conceptInfo, err)
+	}
+	valueKind, err := models.GetValueKind(conceptInfo.ConceptType, conceptInfo.DomainId, conceptInfo.VocabularyId)
+	if err != nil || valueKind != models.NOMINAL {
+		t.Errorf("expected nominal value kind, got %v %v", valueKind, err)
+	}
+}
+
 func TestRetrieveHistogramDataBySourceIdAndConceptId(t *testing.T) {
 	setUp(t)
 	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndConceptId(testSourceId, histogramConceptId)
@@ -964,6 +1131,87 @@ func TestRetrieveHistogramDataBySourceIdAndConceptId(t *testing.T) {
 	}
 }
 
+func TestRetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(t *testing.T) {
+	setUp(t)
+	filterConceptIdsAndValues := []utils.CustomConceptVariableDef{}
+	filterCohortPairs := []utils.CustomDichotomousVariableDef{}
+	data, _ := cohortDataModel.RetrieveHistogramDataBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil)
+	conceptValues := []float64{}
+	for _, personData := range data {
+		conceptValues = append(conceptValues, float64(*personData.ConceptValueAsNumber))
+	}
+
+	for _, options := range []*utils.HistogramOptions{
+		utils.GetDefaultHistogramOptions(),
+		{Strategy: utils.FIXED_BIN_COUNT, NumberOfBins: 3, ClipPercentiles: []float64{10, 90}},
+		{Strategy: utils.BREAKS, Breaks: []float64{0, 10, 20}},
+	} {
+		expectedHistogram, expectedMetadata := utils.GenerateHistogramDataWithOptions(conceptValues, options)
+
+		// in memory, since there are only a few values:
+		histogram, metadata, err := cohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, options)
+		if err != nil || !reflect.DeepEqual(expectedHistogram, histogram) || !reflect.DeepEqual(expectedMetadata, metadata) {
+			t.Errorf("Expected %v and %v but got %v and %v (error: %v)", expectedHistogram, expectedMetadata, histogram, metadata, err)
+		}
+
+		// force the DB path, which should result in the same bin edges and counts:
+		models.MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM = 0
+		histogram, metadata, err = cohortDataModel.RetrieveHistogramBySourceIdAndCohortIdAndConceptIdsAndCohortPairs(testSourceId, largestCohort.Id, histogramConceptId, filterConceptIdsAndValues, filterCohortPairs, []utils.CustomTemporalVariableDef{}, nil, options)
+		models.MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM = 1000
+		if err != nil {
+			t.Errorf("Did not expect an error, but got %v", err)
+		}
+		if len(histogram) != len(expectedHistogram) || metadata.NumberOfOutliersExcluded != expectedMetadata.NumberOfOutliersExcluded {
+			t.Errorf("Expected %v and %v but got %v and %v", expectedHistogram, expectedMetadata, histogram, metadata)
+		}
+		for i := range histogram {
+			if i < len(expectedHistogram) && (histogram[i].Start != expectedHistogram[i].Start || histogram[i].End != expectedHistogram[i].End) {
+				t.Errorf("Expected the same bin edges as %v but got %v", expectedHistogram, histogram)
+			}
+		}
+		totalCount := 0
+		for _, histogramColumn := range histogram {
+			totalCount += histogramColumn.NumberOfPeople
+		}
+		if totalCount+metadata.NumberOfOutliersExcluded != len(conceptValues) {
+			t.Errorf("Expected %d values in total, but got %d", len(conceptValues), totalCount+metadata.NumberOfOutliersExcluded)
+		}
+	}
+}
+
+func TestRetrieveHistogramAndValueSummaryBySourceIdAndConceptId(t *testing.T) {
+	setUp(t)
+	models.MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM = 0
+	histogram, summary, err := cohortDataModel.RetrieveHistogramAndValueSummaryBySourceIdAndConceptId(testSourceId, histogramConceptId, utils.GetDefaultHistogramOptions())
+	models.MIN_NUMBER_OF_VALUES_FOR_SQL_HISTOGRAM = 1000
+	if err != nil || len(histogram) == 0 {
+		t.Errorf("Expected a histogram, but got %v (error: %v)", histogram, err)
+	}
+	if summary == nil || summary.NumberOfValues != 16 || summary.Min > summary.Median || summary.Median > summary.Max {
+		t.Errorf("Unexpected value summary %v", summary)
+	}
+	histogram, summary, _ = cohortDataModel.RetrieveHistogramAndValueSummaryBySourceIdAndCohortIdAndConceptId(testSourceId, largestCohort.Id, histogramConceptId, utils.GetDefaultHistogramOptions())
+	if len(histogram) == 0 || summary.NumberOfValues != largestCohort.CohortSize-1 {
+		t.Errorf("Unexpected histogram %v or value summary %v", histogram, summary)
+	}
+}
+
+func TestRetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(t *testing.T) {
+	setUp(t)
+	// we know that the test dataset has at least one patient with more than one HARE:
+	count, err := cohortDataModel.RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(testSourceId, hareConceptId)
+	if err != nil {
+		t.Errorf("Did not expect an error, but got %v", err)
+	}
+	if count == 0 {
+		t.Errorf("Expected at least one person with multiple observations")
+	}
+	count, _ = cohortDataModel.RetrieveCountOfPersonsWithMultipleObservationsBySourceIdAndConceptId(testSourceId, 456789999) // some random concept id not in db
+	if count != 0 {
+		t.Errorf("Expected 0 persons with multiple observations, but got %d", count)
+	}
+}
+
 func TestQueryFilterByConceptIdsHelper(t *testing.T) {
 	// This test checks whether the query succeeds when the mainObservationTableAlias
 	// argument passed to QueryFilterByConceptIdsHelper (last argument)
@@ -979,7 +1227,7 @@ func TestQueryFilterByConceptIdsHelper(t *testing.T) {
 	// Subtest1: correct alias "observation":
 	query := omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observation" + omopDataSource.GetViewDirective()).
 		Select("observation.person_id")
-	query = models.QueryFilterByConceptIdsHelper(query, testSourceId, filterConceptIds, omopDataSource, "", "observation.person_id")
+	query = models.QueryFilterByConceptIdsHelper(query, testSourceId, filterConceptIds, omopDataSource, "", 0, "observation.person_id")
 	meta_result := query.Scan(&personIds)
 	if meta_result.Error != nil {
 		t.Errorf("Did NOT expect an error")
@@ -987,7 +1235,7 @@ func TestQueryFilterByConceptIdsHelper(t *testing.T) {
 	// Subtest2: incorrect alias "observation"...should fail:
 	query = omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observationWRONG").
 		Select("*")
-	query = models.QueryFilterByConceptIdsHelper(query, testSourceId, filterConceptIds, omopDataSource, "", "observation.person_id")
+	query = models.QueryFilterByConceptIdsHelper(query, testSourceId, filterConceptIds, omopDataSource, "", 0, "observation.person_id")
 	meta_result = query.Scan(&personIds)
 	if meta_result.Error == nil {
 		t.Errorf("Expected an error")
@@ -1009,7 +1257,7 @@ func TestQueryFilterByConceptIdsAndValuesHelper(t *testing.T) {
 	// Subtest1: correct alias "observation":
 	query := omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observation" + omopDataSource.GetViewDirective()).
 		Select("observation.person_id")
-	query = models.QueryFilterByConceptIdsAndValuesHelper(query, testSourceId, filterConceptIdsAndValues, omopDataSource, "", "observation.person_id")
+	query = models.QueryFilterByConceptIdsAndValuesHelper(query, testSourceId, filterConceptIdsAndValues, omopDataSource, "", 0, "observation.person_id")
 	meta_result := query.Scan(&personIds)
 	if meta_result.Error != nil {
 		t.Errorf("Did NOT expect an error")
@@ -1017,7 +1265,7 @@ func TestQueryFilterByConceptIdsAndValuesHelper(t *testing.T) {
 	// Subtest2: incorrect alias "observation"...should fail:
 	query = omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observationWRONG").
 		Select("*")
-	query = models.QueryFilterByConceptIdsAndValuesHelper(query, testSourceId, filterConceptIdsAndValues, omopDataSource, "", "observation.person_id")
+	query = models.QueryFilterByConceptIdsAndValuesHelper(query, testSourceId, filterConceptIdsAndValues, omopDataSource, "", 0, "observation.person_id")
 	meta_result = query.Scan(&personIds)
 	if meta_result.Error == nil {
 		t.Errorf("Expected an error")
@@ -1027,7 +1275,7 @@ func TestQueryFilterByConceptIdsAndValuesHelper(t *testing.T) {
 
 	query = omopDataSource.Db.Table(omopDataSource.Schema + ".observation_continuous as observation").
 		Select("*")
-	query = models.QueryFilterByConceptIdsAndValuesHelper(query, testSourceId, filterConceptIdsAndValues, omopDataSource, "", "observation.person_id")
+	query = models.QueryFilterByConceptIdsAndValuesHelper(query, testSourceId, filterConceptIdsAndValues, omopDataSource, "", 0, "observation.person_id")
 	meta_result = query.Scan(&personIds)
 	if meta_result.Error != nil {
 		t.Errorf("Should have succeeded")
@@ -1049,7 +1297,7 @@ func TestRetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(t *test
 	for _, cohortDefinition := range cohortDefinitions {
 
 		cohortData, _ := cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(
-			testSourceId, cohortDefinition.Id, allConceptIds)
+			testSourceId, cohortDefinition.Id, allConceptIds, []utils.CustomTemporalVariableDef{}, nil)
 
 		// count nr observation records for cohort through an independent simpler query:
 		totalObservationsCohort := tests.GetCountWhere(tests.GetOmopDataSourceForSourceId(tests.GetTestSourceId()), "observation",
@@ -1130,7 +1378,7 @@ func TestErrorForRetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId
 	// set last action to restore back:
 	// run test:
 	_, error := cohortDataModel.RetrieveDataBySourceIdAndCohortIdAndConceptIdsOrderedByPersonId(
-		testSourceId, cohortDefinitions[0].Id, allConceptIds)
+		testSourceId, cohortDefinitions[0].Id, allConceptIds, []utils.CustomTemporalVariableDef{}, nil)
 	if error == nil {
 		t.Errorf("Expected error")
 	}
@@ -1272,6 +1520,44 @@ func TestGetSourceById2(t *testing.T) {
 	}
 }
 
+func TestDataSourceRegistryCredentialsChange(t *testing.T) {
+	setUp(t)
+	source, _ := sourceModel.GetSourceByIdWithConnection(testSourceId)
+	registry := utils.NewDataSourceRegistry()
+	registry.DrainPeriod = 100 * time.Millisecond
+	defer registry.Close()
+	sourceConnection := utils.SourceConnection{SourceId: source.SourceId, SourceConnection: source.SourceConnection,
+		Username: source.Username, Password: source.Password} // pragma: allowlist secret
+	dataSource, err := registry.Get(sourceConnection, "misc")
+	if err != nil {
+		t.Fatalf("Did not expect an error, but got %v", err)
+	}
+	// the same credentials reuse the same pool:
+	if sameDataSource, _ := registry.Get(sourceConnection, "misc"); sameDataSource != dataSource || registry.Size() != 1 {
+		t.Errorf("Expected the same data source")
+	}
+	// a wrong password is rejected, and the pool opened with the old one is removed from the registry:
+	wrongSourceConnection := sourceConnection
+	wrongSourceConnection.Password = "wrong" + source.Password // pragma: allowlist secret
+	otherDataSource, err := registry.Get(wrongSourceConnection, "misc")
+	if otherDataSource != nil || utils.GetErrorCode(err) != utils.UPSTREAM_UNAVAILABLE || registry.Size() != 0 {
+		t.Errorf("Expected an upstream unavailable error and no data sources, found %v and %d data sources", err, registry.Size())
+	}
+	// but it stays open for the queries that still use it, until the drain period is over:
+	if err := dataSource.Db.Exec("SELECT 1").Error; err != nil {
+		t.Errorf("Expected the old data source to still be open, found %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := dataSource.Db.Exec("SELECT 1").Error; err == nil {
+		t.Errorf("Expected the old data source to be closed after the drain period")
+	}
+	// the right password opens a new pool:
+	newDataSource, err := registry.Get(sourceConnection, "misc")
+	if err != nil || newDataSource == dataSource || registry.Size() != 1 {
+		t.Errorf("Expected a new data source, found %v (error: %v)", newDataSource, err)
+	}
+}
+
 func TestGetCohortDefinitionById(t *testing.T) {
 	allCohortDefinitions, _ := cohortDefinitionModel.GetAllCohortDefinitions()
 	foundCohortDefinition, _ := cohortDefinitionModel.GetCohortDefinitionById(allCohortDefinitions[0].Id)
@@ -1360,13 +1646,13 @@ func TestCheckIfDataDictionaryIsFilled(t *testing.T) {
 	var dataSourceModel = new(models.Source)
 	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
 
-	filled := dataDictionaryModel.CheckIfDataDictionaryIsFilled(miscDataSource)
-	if filled != false {
+	filled, err := dataDictionaryModel.CheckIfDataDictionaryIsFilled(miscDataSource)
+	if filled != false || err != nil {
 		t.Errorf("Flag should be false")
 	}
 	dataDictionaryModel.GenerateDataDictionary()
-	filled = dataDictionaryModel.CheckIfDataDictionaryIsFilled(miscDataSource)
-	if filled != true {
+	filled, err = dataDictionaryModel.CheckIfDataDictionaryIsFilled(miscDataSource)
+	if filled != true || err != nil {
 		t.Errorf("Flag should be true")
 	}
 }
@@ -1381,6 +1667,92 @@ func TestGenerateDataDictionary(t *testing.T) {
 	}
 }
 
+func TestGenerateDataDictionaryValueStats(t *testing.T) {
+	setUp(t)
+	dataDictionaryModel.GenerateDataDictionary()
+	var source = new(models.Source)
+	sources, _ := source.GetAllSources()
+	var dataSourceModel = new(models.Source)
+	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
+
+	var histogramEntry *models.DataDictionaryResult
+	miscDataSource.Db.Table(miscDataSource.Schema+".data_dictionary_result").
+		Where("concept_id = ?", histogramConceptId).Scan(&histogramEntry)
+	if histogramEntry == nil || histogramEntry.NumberOfDistinctValues == 0 ||
+		histogramEntry.FirstQuartileValue > histogramEntry.MedianValue || histogramEntry.MedianValue > histogramEntry.ThirdQuartileValue {
+		t.Errorf("Expected quantile stats for concept %d, found %v", histogramConceptId, histogramEntry)
+	}
+	var hareEntry *models.DataDictionaryResult
+	miscDataSource.Db.Table(miscDataSource.Schema+".data_dictionary_result").
+		Where("concept_id = ?", hareConceptId).Scan(&hareEntry)
+	if hareEntry == nil || hareEntry.ModeValue == "" || hareEntry.NumberOfPeopleWithMultipleValues == 0 {
+		t.Errorf("Expected mode and multiple values count for concept %d, found %v", hareConceptId, hareEntry)
+	}
+}
+
+func TestGetNumberOfDistinctValuesAndMode(t *testing.T) {
+	setUp(t)
+	nominalValueData := []*models.NominalGroupData{
+		{Name: "non-Hispanic Black", PersonCount: 4, ValueAsString: "AFR", ValueAsConceptID: 2000007030},
+		{Name: "non-Hispanic Asian", PersonCount: 3, ValueAsString: "ASN", ValueAsConceptID: 2000007029},
+		{Name: "", PersonCount: 9, ValueAsString: "", ValueAsConceptID: 0},
+	}
+	numberOfDistinctValues, modeValue := models.GetNumberOfDistinctValuesAndMode(nominalValueData)
+	if numberOfDistinctValues != 2 || modeValue != "non-Hispanic Black" {
+		t.Errorf("Expected 2 distinct values and mode 'non-Hispanic Black', found %d and '%s'", numberOfDistinctValues, modeValue)
+	}
+}
+
+func TestGetCohortDataDictionary(t *testing.T) {
+	setUp(t)
+	data, err := dataDictionaryModel.GetCohortDataDictionary(testSourceId, largestCohort.Id)
+	if err != nil || data == nil || data.Data == nil {
+		t.Errorf("Get Cohort Data Dictionary should have succeeded, got error %v", err)
+	}
+	if data.Total == 0 {
+		t.Errorf("Expected total to be the number of persons in the cohort, found %d", data.Total)
+	}
+	// a second call should return the cached result:
+	data2, _ := dataDictionaryModel.GetCohortDataDictionary(testSourceId, largestCohort.Id)
+	if data2 != data {
+		t.Errorf("Expected cached result")
+	}
+	// concurrent calls (which may share a computation) still work when the cache is disabled:
+	config.GetConfig().Set("cohort_data_dictionary_cache_size", 0)
+	defer config.GetConfig().Set("cohort_data_dictionary_cache_size", 50)
+	results := make(chan *models.DataDictionaryModel, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			result, _ := dataDictionaryModel.GetCohortDataDictionary(testSourceId, thirdLargestCohort.Id)
+			results <- result
+		}()
+	}
+	data3, data4 := <-results, <-results
+	if data3 == nil || data4 == nil || data3 == data {
+		t.Errorf("Expected a new result for the other cohort")
+	}
+	if data5, _ := dataDictionaryModel.GetCohortDataDictionary(testSourceId, thirdLargestCohort.Id); data5 == data3 || data5 == data4 {
+		t.Errorf("Expected the result not to be cached")
+	}
+	// a cohort that has not been generated should fail:
+	_, err = dataDictionaryModel.GetCohortDataDictionary(testSourceId, 999999)
+	if err == nil {
+		t.Errorf("Expected error for cohort without generation info")
+	}
+}
+
+func TestGetCohortGenerationTimestamp(t *testing.T) {
+	setUp(t)
+	_, err := cohortDefinitionModel.GetCohortGenerationTimestamp(testSourceId, largestCohort.Id)
+	if err != nil {
+		t.Errorf("Did not expect an error, but got %v", err)
+	}
+	_, err = cohortDefinitionModel.GetCohortGenerationTimestamp(testSourceId, 999999)
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
 func TestWriteToDB(t *testing.T) {
 	setUp(t)
 	var source = new(models.Source)
@@ -1389,9 +1761,9 @@ func TestWriteToDB(t *testing.T) {
 	miscDataSource := dataSourceModel.GetDataSource(sources[0].SourceId, models.Misc)
 
 	resultList := append([]*models.DataDictionaryResult{}, &models.DataDictionaryResult{ConceptID: 123})
-	success := dataDictionaryModel.WriteResultToDB(miscDataSource, resultList)
-	//Write succeeded without panicking
-	if success != true {
+	err := dataDictionaryModel.WriteResultToDB(miscDataSource, resultList)
+	//Write succeeded without errors
+	if err != nil {
 		t.Errorf("Write failed")
 	}
 }
@@ -1407,3 +1779,68 @@ func TestExecSQLError(t *testing.T) {
 	t.Errorf("Panic should have occurred due to SQL Error")
 
 }
+
+func TestRetrieveAggregationReportsWithoutAggregationPolicy(t *testing.T) {
+	setUp(t)
+	// the test config has no observation_aggregation, so all observations are used and nothing is reported:
+	if policy := models.GetAggregationPolicy(hareConceptId); policy != models.NO_AGGREGATION {
+		t.Errorf("expected no aggregation policy, found %s", policy)
+	}
+	aggregationReports, err := cohortDataModel.RetrieveAggregationReportsBySourceIdAndCohortIdAndConceptIds(testSourceId, largestCohort.Id, []int64{hareConceptId})
+	if err != nil || len(aggregationReports) != 0 {
+		t.Errorf("expected no aggregation reports, found %v %v", aggregationReports, err)
+	}
+}
+
+func TestValidateAggregationConceptTypes(t *testing.T) {
+	setUp(t)
+	defer config.GetConfig().Set("observation_aggregation", nil)
+	config.GetConfig().Set("observation_aggregation", map[string]interface{}{
+		"concepts": []map[string]interface{}{{"concept_id": histogramConceptId, "policy": "mean"}}})
+	if err := models.ValidateAggregationConceptTypes(); err != nil {
+		t.Errorf("Expected mean to be valid for a continuous concept, found %v", err)
+	}
+	config.GetConfig().Set("observation_aggregation", map[string]interface{}{
+		"concepts": []map[string]interface{}{{"concept_id": hareConceptId, "policy": "mean"}}})
+	if err := models.ValidateAggregationConceptTypes(); err == nil {
+		t.Errorf("Expected an error for mean on a nominal concept")
+	}
+}
+
+func TestRunDataQualityRules(t *testing.T) {
+	setUp(t)
+	minValue := float64(-1000000)
+	dataQualityConfig := models.DataQualityConfig{
+		Rules: []models.DataQualityRule{
+			{Name: "single_hare", Check: models.DUPLICATE_OBSERVATIONS, Severity: models.SEVERITY_WARNING, ConceptIds: []int64{hareConceptId}},
+			{Name: "no_values_below_min", Check: models.OUT_OF_RANGE_VALUES, Severity: models.SEVERITY_ERROR, ConceptIds: []int64{histogramConceptId}, MinValue: &minValue},
+			{Name: "orphans", Check: models.ORPHAN_PERSON_IDS, Severity: models.SEVERITY_INFO},
+			{Name: "unknown_concepts", Check: models.UNKNOWN_CONCEPTS, Severity: models.SEVERITY_INFO},
+		},
+		FailThresholds: map[models.DataQualitySeverity]int64{models.SEVERITY_ERROR: 0},
+	}
+	report, err := dataQualityModel.RunDataQualityRules(dataQualityConfig)
+	if err != nil || len(report.Results) != len(dataQualityConfig.Rules) {
+		t.Fatalf("expected one result per rule, found %v %v", report, err)
+	}
+	for _, result := range report.Results {
+		if result.Error != "" {
+			t.Errorf("rule %s could not be checked: %s", result.Rule, result.Error)
+		}
+	}
+	// the test data has no values below the minimum:
+	if report.IssuesBySeverity[models.SEVERITY_ERROR] != 0 || report.Failed {
+		t.Errorf("expected no error issues, found %v", report)
+	}
+}
+
+func TestDataQualityReportFailureReasons(t *testing.T) {
+	setUp(t)
+	report := models.DataQualityReport{IssuesBySeverity: map[models.DataQualitySeverity]int64{models.SEVERITY_WARNING: 5, models.SEVERITY_ERROR: 1}}
+	if failureReasons := report.GetFailureReasons(map[models.DataQualitySeverity]int64{models.SEVERITY_WARNING: 5}); len(failureReasons) != 0 {
+		t.Errorf("expected no failure at the threshold, found %v", failureReasons)
+	}
+	if failureReasons := report.GetFailureReasons(map[models.DataQualitySeverity]int64{models.SEVERITY_WARNING: 4, models.SEVERITY_ERROR: 0}); len(failureReasons) != 2 {
+		t.Errorf("expected 2 failures above the thresholds, found %v", failureReasons)
+	}
+}
@@ -109,7 +109,7 @@ CREATE TABLE omop.concept
 );
 
 CREATE VIEW omop.OBSERVATION_CONTINUOUS AS
-SELECT ob.person_id, ob.observation_concept_id, ob.value_as_string, ob.value_as_number, ob.value_as_concept_id
+SELECT ob.person_id, ob.observation_concept_id, ob.value_as_string, ob.value_as_number, ob.value_as_concept_id, ob.observation_date
 FROM omop.observation ob
 INNER JOIN omop.concept concept ON concept.CONCEPT_ID=ob.OBSERVATION_CONCEPT_ID
 WHERE concept.CONCEPT_CLASS_ID='MVP Continuous' or concept.CONCEPT_ID=2000007027;
@@ -134,6 +134,14 @@ CREATE TABLE misc.DATA_DICTIONARY_RESULT
     max_value float,
     mean_value float,
     standard_deviation float,
+    median_value float,
+    first_quartile_value float,
+    third_quartile_value float,
+    first_percentile_value float,
+    ninety_ninth_percentile_value float,
+    number_of_distinct_values integer,
+    mode_value character varying(255),
+    number_of_people_with_multiple_values integer,
     value_summary JSON --For sql server use varbinary(max)
 );
 ALTER TABLE misc.DATA_DICTIONARY_RESULT  ADD CONSTRAINT xpk_DATA_DICTIONARY_RESULT PRIMARY KEY ( concept_id ) ;
@@ -0,0 +1,326 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const CSV_FORMAT = "csv"
+const JSON_FORMAT = "json"
+
+// The request body of the /v2 analysis endpoints, e.g.:
+//
+//	{"source_id": 1,
+//	 "cohort_ids": [4, 5],
+//	 "windows": {"observation_window": 365, "outcome_window": 30},
+//	 "variables": [{"variable_type": "concept", "concept_id": 2000006885}],
+//	 "options": {"second_cohort_entry_first": true}}
+//
+// The first of the cohort_ids is the main cohort of the analysis. Which of the windows and
+// options are required depends on the analysis (see CheckRequiredFields). New options can be
+// added to AnalysisOptions without adding new routes.
+type AnalysisRequest struct {
+	SourceId  int              `json:"source_id"`
+	CohortIds []int            `json:"cohort_ids"`
+	Windows   *AnalysisWindows `json:"windows,omitempty"`
+	Variables []VariableDef    `json:"variables,omitempty"`
+	Options   *AnalysisOptions `json:"options,omitempty"`
+}
+
+// The time windows, in days, relative to the start of the main cohort. The observation_window (look back)
+// and follow_up_window (minimum follow-up after the cohort start) keep only the persons whose observation
+// period covers them (see GetObservationPeriodFilter).
+type AnalysisWindows struct {
+	ObservationWindow *int `json:"observation_window,omitempty"`
+	OutcomeWindow     *int `json:"outcome_window,omitempty"`
+	FollowUpWindow    *int `json:"follow_up_window,omitempty"`
+}
+
+// Returns the field errors found in the windows, with the field names prefixed by the given path.
+func (w AnalysisWindows) Validate(path string) []FieldError {
+	fieldErrors := []FieldError{}
+	windowFields := []string{"observation_window", "outcome_window", "follow_up_window"}
+	for i, window := range []*int{w.ObservationWindow, w.OutcomeWindow, w.FollowUpWindow} {
+		if window != nil && *window < 0 {
+			fieldErrors = append(fieldErrors, FieldError{Field: path + "." + windowFields[i], Message: "should not be negative"})
+		}
+	}
+	return fieldErrors
+}
+
+// The observation period that the persons in the main cohort should have: starting at least ObservationWindow
+// days before their cohort start date, and ending more than FollowUpWindow days after it (or just after it
+// when FollowUpWindow is 0).
+type ObservationPeriodFilter struct {
+	ObservationWindow int
+	FollowUpWindow    int
+}
+
+type AnalysisOptions struct {
+	ConceptId              *int64               `json:"concept_id,omitempty"`
+	BreakdownConceptId     *int64               `json:"breakdown_concept_id,omitempty"`
+	CrossTabConceptId      *int64               `json:"cross_tab_concept_id,omitempty"`
+	CrossTabCohortIds      []int                `json:"cross_tab_cohort_ids,omitempty"`
+	SecondCohortEntryFirst bool                 `json:"second_cohort_entry_first,omitempty"`
+	Percentiles            []float64            `json:"percentiles,omitempty"`
+	Histogram              *HistogramOptionsDef `json:"histogram,omitempty"`
+	Format                 string               `json:"format,omitempty"`
+}
+
+// The JSON equivalent of the histogram binning query parameters (see ParseHistogramOptionsQueryArgs).
+type HistogramOptionsDef struct {
+	Binning         string    `json:"binning,omitempty"`
+	BinCount        int       `json:"bin_count,omitempty"`
+	BinWidth        float64   `json:"bin_width,omitempty"`
+	Breaks          []float64 `json:"breaks,omitempty"`
+	ClipPercentiles []float64 `json:"clip_percentiles,omitempty"`
+}
+
+func (d HistogramOptionsDef) ToHistogramOptions() *HistogramOptions {
+	options := GetDefaultHistogramOptions()
+	if d.Binning != "" {
+		options.Strategy = d.Binning
+	}
+	options.NumberOfBins = d.BinCount
+	options.BinWidth = d.BinWidth
+	options.Breaks = d.Breaks
+	options.ClipPercentiles = d.ClipPercentiles
+	return options
+}
+
+// Decodes the given request body into an AnalysisRequest. Unknown fields are not allowed.
+// Returns a ValidationError listing all fields that are missing or invalid.
+func DecodeAnalysisRequest(body io.Reader) (*AnalysisRequest, error) {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	var request AnalysisRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		return nil, getDecodeValidationError(err)
+	}
+	if decoder.More() {
+		return nil, &ValidationError{FieldErrors: []FieldError{{Message: "unexpected data after the request body"}}}
+	}
+	fieldErrors := request.Validate(GetMaxVariablesPerRequest())
+	if len(fieldErrors) > 0 {
+		return nil, &ValidationError{FieldErrors: fieldErrors}
+	}
+	return &request, nil
+}
+
+// Returns the field errors found in the request, if any. Fields that are only required by
+// some of the analyses are checked by CheckRequiredFields.
+func (r AnalysisRequest) Validate(maxVariables int) []FieldError {
+	fieldErrors := []FieldError{}
+	addError := func(field string, message string) {
+		fieldErrors = append(fieldErrors, FieldError{Field: field, Message: message})
+	}
+	if r.SourceId <= 0 {
+		addError("source_id", "should be a positive number")
+	}
+	if len(r.CohortIds) == 0 {
+		addError("cohort_ids", "should have at least one cohort id")
+	}
+	for i, cohortId := range r.CohortIds {
+		if cohortId <= 0 {
+			addError(fmt.Sprintf("cohort_ids[%d]", i), "should be a positive number")
+		}
+	}
+	if r.Windows != nil {
+		fieldErrors = append(fieldErrors, r.Windows.Validate("windows")...)
+	}
+	if len(r.Variables) > maxVariables {
+		addError("variables", fmt.Sprintf("should have at most %d variables", maxVariables))
+	}
+	for i, variable := range r.Variables {
+		fieldErrors = append(fieldErrors, variable.Validate(fmt.Sprintf("variables[%d]", i))...)
+	}
+	if r.Options != nil {
+		fieldErrors = append(fieldErrors, r.Options.Validate("options")...)
+	}
+	return fieldErrors
+}
+
+// Returns the field errors found in the options, with the field names prefixed by the given path.
+func (o AnalysisOptions) Validate(path string) []FieldError {
+	fieldErrors := []FieldError{}
+	addError := func(field string, message string) {
+		fieldErrors = append(fieldErrors, FieldError{Field: path + "." + field, Message: message})
+	}
+	conceptIdFields := []string{"concept_id", "breakdown_concept_id", "cross_tab_concept_id"}
+	for i, conceptId := range []*int64{o.ConceptId, o.BreakdownConceptId, o.CrossTabConceptId} {
+		if conceptId != nil && *conceptId <= 0 {
+			addError(conceptIdFields[i], "should be a positive number")
+		}
+	}
+	if o.CrossTabCohortIds != nil {
+		if len(o.CrossTabCohortIds) != 2 || o.CrossTabCohortIds[0] <= 0 || o.CrossTabCohortIds[1] <= 0 {
+			addError("cross_tab_cohort_ids", "should have exactly two positive cohort ids")
+		}
+		if o.CrossTabConceptId != nil {
+			addError("cross_tab_cohort_ids", "is not allowed together with cross_tab_concept_id")
+		}
+	}
+	for i, percentile := range o.Percentiles {
+		if percentile <= 0 || percentile > 100 {
+			addError(fmt.Sprintf("percentiles[%d]", i), "should be a number in the range (0, 100]")
+		}
+	}
+	if o.Histogram != nil {
+		for _, fieldError := range ValidateHistogramOptions(o.Histogram.ToHistogramOptions()) {
+			addError("histogram."+fieldError.Field, fieldError.Message)
+		}
+	}
+	if o.Format != "" && o.Format != CSV_FORMAT && o.Format != JSON_FORMAT {
+		addError("format", fmt.Sprintf("should be one of [%s %s]", CSV_FORMAT, JSON_FORMAT))
+	}
+	return fieldErrors
+}
+
+// Returns a ValidationError if the request does not have between minCohorts and maxCohorts
+// cohort ids (a maxCohorts of -1 means there is no maximum), or if any of the given
+// fields is missing. Supported fields are "windows.observation_window", "windows.outcome_window",
+// "windows.follow_up_window", "options.concept_id", "options.breakdown_concept_id" and "options.cross_tab"
+// (for either options.cross_tab_concept_id or options.cross_tab_cohort_ids).
+func (r AnalysisRequest) CheckRequiredFields(minCohorts int, maxCohorts int, fields ...string) error {
+	fieldErrors := []FieldError{}
+	if len(r.CohortIds) < minCohorts || (maxCohorts != -1 && len(r.CohortIds) > maxCohorts) {
+		message := fmt.Sprintf("should have between %d and %d cohort ids for this analysis", minCohorts, maxCohorts)
+		if minCohorts == maxCohorts {
+			message = fmt.Sprintf("should have exactly %d cohort ids for this analysis", minCohorts)
+		} else if maxCohorts == -1 {
+			message = fmt.Sprintf("should have at least %d cohort ids for this analysis", minCohorts)
+		}
+		fieldErrors = append(fieldErrors, FieldError{Field: "cohort_ids", Message: message})
+	}
+	for _, field := range fields {
+		isSet, err := r.isFieldSet(field)
+		if err != nil {
+			return err
+		}
+		if !isSet && field == "options.cross_tab" {
+			fieldErrors = append(fieldErrors, FieldError{Field: "options.cross_tab_concept_id", Message: "or options.cross_tab_cohort_ids is required for this analysis"})
+		} else if !isSet {
+			fieldErrors = append(fieldErrors, FieldError{Field: field, Message: "is required for this analysis"})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return &ValidationError{FieldErrors: fieldErrors}
+	}
+	return nil
+}
+
+// Returns a ValidationError if any of the given fields is set, since not every analysis supports
+// every field. Supports the same fields as CheckRequiredFields.
+func (r AnalysisRequest) CheckUnsupportedFields(fields ...string) error {
+	fieldErrors := []FieldError{}
+	for _, field := range fields {
+		isSet, err := r.isFieldSet(field)
+		if err != nil {
+			return err
+		}
+		if isSet {
+			fieldErrors = append(fieldErrors, FieldError{Field: field, Message: "is not supported by this analysis"})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return &ValidationError{FieldErrors: fieldErrors}
+	}
+	return nil
+}
+
+func (r AnalysisRequest) isFieldSet(field string) (bool, error) {
+	windows := r.Windows
+	if windows == nil {
+		windows = &AnalysisWindows{}
+	}
+	options := r.GetOptions()
+	switch field {
+	case "windows.observation_window":
+		return windows.ObservationWindow != nil, nil
+	case "windows.outcome_window":
+		return windows.OutcomeWindow != nil, nil
+	case "windows.follow_up_window":
+		return windows.FollowUpWindow != nil, nil
+	case "options.concept_id":
+		return options.ConceptId != nil, nil
+	case "options.breakdown_concept_id":
+		return options.BreakdownConceptId != nil, nil
+	case "options.cross_tab":
+		return options.CrossTabConceptId != nil || options.CrossTabCohortIds != nil, nil
+	default:
+		return false, NewInternalError(fmt.Errorf("unsupported field %s", field))
+	}
+}
+
+// Returns a ValidationError if any of the variables is not of one of the given types, since not
+// every analysis supports every type of variable.
+func (r AnalysisRequest) CheckVariableTypes(variableTypes ...string) error {
+	fieldErrors := []FieldError{}
+	for i, variable := range r.Variables {
+		if !ContainsString(variableTypes, variable.VariableType) {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("variables[%d].variable_type", i),
+				Message: fmt.Sprintf("should be one of %v for this analysis", variableTypes)})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return &ValidationError{FieldErrors: fieldErrors}
+	}
+	return nil
+}
+
+// Returns the options of the request, or empty options if none were given.
+func (r AnalysisRequest) GetOptions() *AnalysisOptions {
+	if r.Options == nil {
+		return &AnalysisOptions{}
+	}
+	return r.Options
+}
+
+// Returns the id of the main cohort of the analysis.
+func (r AnalysisRequest) GetCohortId() int {
+	return r.CohortIds[0]
+}
+
+// Returns the variables as a single list of CustomConceptVariableDef, CustomDichotomousVariableDef and
+// CustomTemporalVariableDef items, like ParseConceptIdsAndDichotomousDefsAsSingleList.
+func (r AnalysisRequest) GetConceptIdsAndCohortPairs() []interface{} {
+	conceptIdsAndCohortPairs := make([]interface{}, 0)
+	for _, variable := range r.Variables {
+		conceptIdsAndCohortPairs = append(conceptIdsAndCohortPairs, variable.ToConceptOrCohortPairDef())
+	}
+	return conceptIdsAndCohortPairs
+}
+
+// Returns the observation period filter for the main cohort given by windows.observation_window and
+// windows.follow_up_window (both 0 when not given), or nil if neither of them was given.
+func (r AnalysisRequest) GetObservationPeriodFilter() *ObservationPeriodFilter {
+	if r.Windows == nil || (r.Windows.ObservationWindow == nil && r.Windows.FollowUpWindow == nil) {
+		return nil
+	}
+	filter := &ObservationPeriodFilter{}
+	if r.Windows.ObservationWindow != nil {
+		filter.ObservationWindow = *r.Windows.ObservationWindow
+	}
+	if r.Windows.FollowUpWindow != nil {
+		filter.FollowUpWindow = *r.Windows.FollowUpWindow
+	}
+	return filter
+}
+
+// Returns the histogram options of the request, or the default histogram options if none were given.
+func (r AnalysisRequest) GetHistogramOptions() *HistogramOptions {
+	if r.GetOptions().Histogram == nil {
+		return GetDefaultHistogramOptions()
+	}
+	return r.GetOptions().Histogram.ToHistogramOptions()
+}
+
+// Returns the requested percentiles, or DEFAULT_PERCENTILES if none were given.
+func (r AnalysisRequest) GetPercentiles() []float64 {
+	if len(r.GetOptions().Percentiles) == 0 {
+		return DEFAULT_PERCENTILES
+	}
+	return r.GetOptions().Percentiles
+}
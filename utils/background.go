@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+var backgroundJobs sync.WaitGroup
+
+// Runs the given job (e.g. the data dictionary generation) in a goroutine that outlives the request
+// that started it, and keeps track of it, so that a graceful shutdown can wait for it to finish (see
+// WaitForBackgroundJobs).
+func RunInBackground(name string, job func()) {
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Recovered from panic in background job %s: %v", name, r)
+			}
+		}()
+		job()
+	}()
+}
+
+// Waits for the background jobs started with RunInBackground to finish, or until the context is done,
+// in which case the context error is returned.
+func WaitForBackgroundJobs(ctx context.Context) error {
+	done := make(chan bool)
+	go func() {
+		backgroundJobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"math"
+)
+
+type ContingencyTableHeader struct {
+	Value int64  `json:"value"`
+	Name  string `json:"name"`
+	Total int    `json:"persons_count"`
+}
+
+type ContingencyTableCell struct {
+	Count            int     `json:"persons_count"`
+	RowPercentage    float64 `json:"row_percentage"`
+	ColumnPercentage float64 `json:"column_percentage"`
+	TotalPercentage  float64 `json:"total_percentage"`
+}
+
+type ContingencyTableRow struct {
+	ContingencyTableHeader
+	Cells []ContingencyTableCell `json:"cells"`
+}
+
+type IndependenceTestResult struct {
+	Method           string  `json:"method"`
+	Statistic        float64 `json:"statistic"`
+	DegreesOfFreedom int     `json:"degrees_of_freedom"`
+	PValue           float64 `json:"p_value"`
+}
+
+type ContingencyTable struct {
+	Columns         []ContingencyTableHeader `json:"columns"`
+	Rows            []ContingencyTableRow    `json:"rows"`
+	Total           int                      `json:"persons_count"`
+	ChiSquareTest   *IndependenceTestResult  `json:"chi_square_test"`
+	FisherExactTest *IndependenceTestResult  `json:"fisher_exact_test,omitempty"`
+}
+
+// Generates a contingency table for the given rows and columns, where counts[i][j] is the
+// number of persons with the value of row i and the value of column j. Adds the row, column
+// and grand totals, the percentages of each cell, and the result of a chi-square test of
+// independence. For 2x2 tables the result of Fisher's exact test is added as well.
+func GenerateContingencyTable(rows []ContingencyTableHeader, columns []ContingencyTableHeader, counts [][]int) *ContingencyTable {
+	result := new(ContingencyTable)
+	result.Columns = columns
+	for j := range result.Columns {
+		result.Columns[j].Total = 0
+		for i := range rows {
+			result.Columns[j].Total += counts[i][j]
+		}
+		result.Total += result.Columns[j].Total
+	}
+	result.Rows = []ContingencyTableRow{}
+	for i, row := range rows {
+		row.Total = 0
+		for j := range columns {
+			row.Total += counts[i][j]
+		}
+		tableRow := ContingencyTableRow{ContingencyTableHeader: row, Cells: []ContingencyTableCell{}}
+		for j, column := range result.Columns {
+			tableRow.Cells = append(tableRow.Cells, ContingencyTableCell{
+				Count:            counts[i][j],
+				RowPercentage:    percentage(counts[i][j], row.Total),
+				ColumnPercentage: percentage(counts[i][j], column.Total),
+				TotalPercentage:  percentage(counts[i][j], result.Total),
+			})
+		}
+		result.Rows = append(result.Rows, tableRow)
+	}
+
+	result.ChiSquareTest = ChiSquareTest(counts)
+	if len(rows) == 2 && len(columns) == 2 {
+		result.FisherExactTest = FisherExactTest(counts[0][0], counts[0][1], counts[1][0], counts[1][1])
+	}
+	return result
+}
+
+func percentage(count int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(count) / float64(total)
+}
+
+// Runs Pearson's chi-square test of independence (https://en.wikipedia.org/wiki/Pearson%27s_chi-squared_test)
+// on the given table of counts. Rows and columns without any counts are ignored. Returns nil if less than
+// 2 rows or 2 columns remain.
+func ChiSquareTest(counts [][]int) *IndependenceTestResult {
+	rowTotals := []float64{}
+	nonEmptyRows := [][]int{}
+	for _, row := range counts {
+		rowTotal := 0
+		for _, count := range row {
+			rowTotal += count
+		}
+		if rowTotal > 0 {
+			rowTotals = append(rowTotals, float64(rowTotal))
+			nonEmptyRows = append(nonEmptyRows, row)
+		}
+	}
+	if len(nonEmptyRows) < 2 {
+		return nil
+	}
+	columnTotals := []float64{}
+	nonEmptyColumnIndexes := []int{}
+	total := 0.0
+	for j := range nonEmptyRows[0] {
+		columnTotal := 0
+		for _, row := range nonEmptyRows {
+			columnTotal += row[j]
+		}
+		if columnTotal > 0 {
+			columnTotals = append(columnTotals, float64(columnTotal))
+			nonEmptyColumnIndexes = append(nonEmptyColumnIndexes, j)
+			total += float64(columnTotal)
+		}
+	}
+	if len(nonEmptyColumnIndexes) < 2 {
+		return nil
+	}
+
+	statistic := 0.0
+	for i, row := range nonEmptyRows {
+		for jj, j := range nonEmptyColumnIndexes {
+			expected := rowTotals[i] * columnTotals[jj] / total
+			difference := float64(row[j]) - expected
+			statistic += difference * difference / expected
+		}
+	}
+	degreesOfFreedom := (len(nonEmptyRows) - 1) * (len(nonEmptyColumnIndexes) - 1)
+	return &IndependenceTestResult{
+		Method:           "Chi-square",
+		Statistic:        statistic,
+		DegreesOfFreedom: degreesOfFreedom,
+		PValue:           ChiSquarePValue(statistic, degreesOfFreedom),
+	}
+}
+
+// Returns the probability of finding a chi-square statistic at least as large as the given one, for
+// the given degrees of freedom (i.e. the upper tail of the chi-square distribution).
+func ChiSquarePValue(statistic float64, degreesOfFreedom int) float64 {
+	if statistic <= 0 {
+		return 1
+	}
+	return 1 - regularizedLowerIncompleteGamma(float64(degreesOfFreedom)/2, statistic/2)
+}
+
+// Returns P(a, x), the regularized lower incomplete gamma function, using its series
+// expansion for x < a+1 and its continued fraction (Lentz's method) otherwise.
+func regularizedLowerIncompleteGamma(a float64, x float64) float64 {
+	const maxIterations = 1000
+	const epsilon = 1e-15
+	const tiny = 1e-300
+	if x <= 0 {
+		return 0
+	}
+	lnGammaA, _ := math.Lgamma(a)
+	factor := math.Exp(-x + a*math.Log(x) - lnGammaA)
+	if x < a+1 {
+		term := 1 / a
+		sum := term
+		for n := 1; n < maxIterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*epsilon {
+				break
+			}
+		}
+		return sum * factor
+	}
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < maxIterations; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return 1 - factor*h
+}
+
+// Runs the two-sided Fisher's exact test (https://en.wikipedia.org/wiki/Fisher%27s_exact_test) on the
+// 2x2 table [[a, b], [c, d]]. The p-value is the sum of the probabilities of all tables with the same
+// row and column totals that are at most as likely as the given table.
+func FisherExactTest(a int, b int, c int, d int) *IndependenceTestResult {
+	n := a + b + c + d
+	row1Total := a + b
+	column1Total := a + c
+	if n == 0 {
+		return nil
+	}
+	observedProbability := hypergeometricProbability(a, row1Total, column1Total, n)
+	pValue := 0.0
+	minA := max(0, row1Total+column1Total-n)
+	maxA := min(row1Total, column1Total)
+	for k := minA; k <= maxA; k++ {
+		probability := hypergeometricProbability(k, row1Total, column1Total, n)
+		// small tolerance to deal with rounding errors:
+		if probability <= observedProbability*(1+1e-7) {
+			pValue += probability
+		}
+	}
+	return &IndependenceTestResult{
+		Method:           "Fisher's exact",
+		Statistic:        observedProbability,
+		DegreesOfFreedom: 1,
+		PValue:           math.Min(pValue, 1),
+	}
+}
+
+// Returns the probability of finding k in the top-left cell of a 2x2 table with the given first row
+// total, first column total and grand total n.
+func hypergeometricProbability(k int, row1Total int, column1Total int, n int) float64 {
+	return math.Exp(lnBinomial(row1Total, k) + lnBinomial(n-row1Total, column1Total-k) - lnBinomial(n, column1Total))
+}
+
+func lnBinomial(n int, k int) float64 {
+	lnGammaN, _ := math.Lgamma(float64(n + 1))
+	lnGammaK, _ := math.Lgamma(float64(k + 1))
+	lnGammaNMinusK, _ := math.Lgamma(float64(n - k + 1))
+	return lnGammaN - lnGammaK - lnGammaNMinusK
+}
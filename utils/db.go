@@ -2,10 +2,16 @@ package utils
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/uc-cdis/cohort-middleware/config"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
@@ -19,49 +25,298 @@ type DbAndSchema struct {
 }
 
 type SourceConnection struct {
+	// the id of the source, used to find its pool settings (see GetPoolSettings):
+	SourceId         int    `json:",omitempty"`
 	SourceConnection string `json:",omitempty"`
 	Username         string `json:",omitempty"`
 	Password         string `json:",omitempty"`
 }
 
-var dataSourceDbMap = make(map[string]*DbAndSchema)
+// The connection pool settings of a data source. The zero values keep the database/sql defaults.
+type PoolSettings struct {
+	SourceId                     int `mapstructure:"source_id"`
+	MaxOpenConnections           int `mapstructure:"max_open_connections"`
+	MaxIdleConnections           int `mapstructure:"max_idle_connections"`
+	ConnectionMaxLifetimeSeconds int `mapstructure:"connection_max_lifetime_seconds"`
+}
+
+// How often a connection pool is checked (pinged) before it is used again, in seconds (see
+// data_source_pool.validation_interval_seconds in the config).
+const DEFAULT_POOL_VALIDATION_INTERVAL_SECONDS = 30
+
+// Returns the pool settings of the given source from the data_source_pool entry in the config, e.g.:
+//
+//	data_source_pool:
+//	  max_open_connections: 20
+//	  max_idle_connections: 5
+//	  connection_max_lifetime_seconds: 1800
+//	  sources:
+//	    - source_id: 2
+//	      max_open_connections: 50
+//
+// The settings of the source in "sources" override the default settings.
+func GetPoolSettings(sourceId int) PoolSettings {
+	var poolSettings PoolSettings
+	conf := config.GetConfig()
+	if conf == nil || !conf.IsSet("data_source_pool") {
+		return poolSettings
+	}
+	_ = conf.UnmarshalKey("data_source_pool", &poolSettings)
+	var sourcePoolSettings []PoolSettings
+	_ = conf.UnmarshalKey("data_source_pool.sources", &sourcePoolSettings)
+	for _, sourceSettings := range sourcePoolSettings {
+		if sourceSettings.SourceId != sourceId {
+			continue
+		}
+		if sourceSettings.MaxOpenConnections != 0 {
+			poolSettings.MaxOpenConnections = sourceSettings.MaxOpenConnections
+		}
+		if sourceSettings.MaxIdleConnections != 0 {
+			poolSettings.MaxIdleConnections = sourceSettings.MaxIdleConnections
+		}
+		if sourceSettings.ConnectionMaxLifetimeSeconds != 0 {
+			poolSettings.ConnectionMaxLifetimeSeconds = sourceSettings.ConnectionMaxLifetimeSeconds
+		}
+	}
+	poolSettings.SourceId = sourceId
+	return poolSettings
+}
+
+func getPoolValidationInterval() time.Duration {
+	conf := config.GetConfig()
+	if conf != nil && conf.IsSet("data_source_pool.validation_interval_seconds") {
+		return time.Duration(conf.GetInt("data_source_pool.validation_interval_seconds")) * time.Second
+	}
+	return DEFAULT_POOL_VALIDATION_INTERVAL_SECONDS * time.Second
+}
+
+type dataSourceRegistryEntry struct {
+	dataSource      *DbAndSchema
+	credentialsHash string
+	lastValidated   time.Time
+}
+
+// How long a connection pool that is removed from the registry is kept open, so that the queries that are
+// still running on it can finish. This is the longest query timeout (see AddSpecificTimeoutToQuery).
+const DEFAULT_DATA_SOURCE_DRAIN_PERIOD = 600 * time.Second
+
+// The open connection pools of the data sources, by connection string and schema. The registry is safe
+// for concurrent use. Pools are only added once their connection is validated, and a pool that fails its
+// periodic validation, or whose credentials changed (e.g. after a password rotation), is replaced by a
+// new one. The replaced pool is only closed after the DrainPeriod, as other requests may still use it.
+type DataSourceRegistry struct {
+	DrainPeriod time.Duration
+	mutex       sync.Mutex
+	dataSources map[string]*dataSourceRegistryEntry
+	draining    map[*DbAndSchema]*time.Timer
+}
+
+func NewDataSourceRegistry() *DataSourceRegistry {
+	return &DataSourceRegistry{DrainPeriod: DEFAULT_DATA_SOURCE_DRAIN_PERIOD,
+		dataSources: make(map[string]*dataSourceRegistryEntry), draining: make(map[*DbAndSchema]*time.Timer)}
+}
 
-func GetDataSourceDB(source SourceConnection, dbSchema string) *DbAndSchema {
+var dataSourceRegistry = NewDataSourceRegistry()
+
+// Returns the data source for the given connection and schema from the registry (see DataSourceRegistry.Get).
+func GetDataSourceDB(source SourceConnection, dbSchema string) (*DbAndSchema, error) {
+	return dataSourceRegistry.Get(source, dbSchema)
+}
+
+// Closes all the data sources in the registry (see DataSourceRegistry.Close).
+func CloseDataSources() error {
+	return dataSourceRegistry.Close()
+}
+
+// Returns the data source for the given connection and schema, opening and validating a new connection pool
+// if there is none yet, or if the existing one can no longer be pinged. Returns an upstream unavailable error
+// if the connection string is invalid or the database can not be reached. Failed connections are not kept,
+// so that the next request tries again.
+func (r *DataSourceRegistry) Get(source SourceConnection, dbSchema string) (*DbAndSchema, error) {
 	sourceAndSchemaKey := "source:" + source.SourceConnection + ",schema:" + dbSchema
-	if dataSourceDbMap[sourceAndSchemaKey] != nil {
-		// return the already initialized object:
-		return dataSourceDbMap[sourceAndSchemaKey]
+	credentialsHash := hashCredentials(source)
+	r.mutex.Lock()
+	entry := r.dataSources[sourceAndSchemaKey]
+	r.mutex.Unlock()
+	if entry != nil && entry.credentialsHash != credentialsHash {
+		log.Printf("Credentials of source %d changed, reconnecting.", source.SourceId)
+		r.evict(sourceAndSchemaKey, entry)
+		entry = nil
+	}
+	if entry != nil {
+		if time.Since(entry.lastValidated) < getPoolValidationInterval() {
+			return entry.dataSource, nil
+		}
+		err := pingDataSource(entry.dataSource)
+		if err == nil {
+			r.mutex.Lock()
+			entry.lastValidated = time.Now()
+			r.mutex.Unlock()
+			return entry.dataSource, nil
+		}
+		log.Printf("Error: connection to source %d failed, reconnecting. Error: %s", source.SourceId, err.Error())
+		r.evict(sourceAndSchemaKey, entry)
+	}
+
+	// open a new connection (without holding the lock, as this can take a while):
+	dataSource, err := openDataSourceDB(source, dbSchema)
+	if err != nil {
+		return nil, NewUpstreamUnavailableError(err)
 	}
-	// otherwise, open a new connection:
-	dsn := GenerateDsn(source)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existingEntry := r.dataSources[sourceAndSchemaKey]; existingEntry != nil && existingEntry.credentialsHash == credentialsHash {
+		// another request opened the same data source in the meantime:
+		closeDataSource(dataSource)
+		return existingEntry.dataSource, nil
+	} else if existingEntry != nil {
+		r.closeAfterDrainPeriod(existingEntry.dataSource)
+	}
+	r.dataSources[sourceAndSchemaKey] = &dataSourceRegistryEntry{dataSource: dataSource, credentialsHash: credentialsHash, lastValidated: time.Now()}
+	return dataSource, nil
+}
+
+// Returns a hash of the username and password of the given source, so that the registry can tell when
+// they change without keeping the password itself.
+func hashCredentials(source SourceConnection) string {
+	hash := sha256.Sum256([]byte(source.Username + "\x00" + source.Password))
+	return hex.EncodeToString(hash[:])
+}
+
+// Removes the given entry from the registry, if it was not replaced yet, and closes its connection pool
+// after the drain period.
+func (r *DataSourceRegistry) evict(sourceAndSchemaKey string, entry *dataSourceRegistryEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.dataSources[sourceAndSchemaKey] == entry {
+		delete(r.dataSources, sourceAndSchemaKey)
+		r.closeAfterDrainPeriod(entry.dataSource)
+	}
+}
+
+// Closes the given connection pool, which is no longer in the registry, once the drain period is over.
+// Expects the mutex to be locked.
+func (r *DataSourceRegistry) closeAfterDrainPeriod(dataSource *DbAndSchema) {
+	if _, isDraining := r.draining[dataSource]; isDraining {
+		return
+	}
+	r.draining[dataSource] = time.AfterFunc(r.DrainPeriod, func() {
+		r.mutex.Lock()
+		_, isDraining := r.draining[dataSource]
+		delete(r.draining, dataSource)
+		r.mutex.Unlock()
+		if isDraining {
+			closeDataSource(dataSource)
+		}
+	})
+}
+
+// Closes all the connection pools in the registry, including the ones that are still draining, and empties it.
+func (r *DataSourceRegistry) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var errs []error
+	for sourceAndSchemaKey, entry := range r.dataSources {
+		errs = append(errs, closeDataSource(entry.dataSource))
+		delete(r.dataSources, sourceAndSchemaKey)
+	}
+	for dataSource, timer := range r.draining {
+		timer.Stop()
+		errs = append(errs, closeDataSource(dataSource))
+		delete(r.draining, dataSource)
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the number of connection pools in the registry.
+func (r *DataSourceRegistry) Size() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.dataSources)
+}
+
+// Opens the connection pool for the given source and schema, applies the pool settings of the source,
+// and pings the database to validate the connection.
+func openDataSourceDB(source SourceConnection, dbSchema string) (*DbAndSchema, error) {
+	dsn, err := GenerateDsn(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string for source %d: %w", source.SourceId, err)
+	}
+	jdbcUrl, _ := ParseJdbcUrl(source.SourceConnection)
 	dataSourceDb := new(DbAndSchema)
-	if strings.Contains(source.SourceConnection, "postgresql") {
+	var dialector gorm.Dialector
+	if jdbcUrl.Vendor == POSTGRESQL {
 		log.Printf("connecting to cohorts 'postgresql' db...")
 		// workaround for schema names in postgres (can't be uppercase):
 		dbSchema = strings.ToLower(dbSchema)
-		dataSource, _ := gorm.Open(postgres.Open(dsn),
-			&gorm.Config{
-				NamingStrategy: schema.NamingStrategy{
-					TablePrefix:   dbSchema + ".",
-					SingularTable: true,
-				}})
-		dataSourceDb.Db = dataSource
+		dialector = postgres.Open(dsn)
 		dataSourceDb.Vendor = "postgresql"
 	} else {
 		log.Printf("connecting to cohorts 'sqlserver' db...")
-		dataSource, _ := gorm.Open(sqlserver.Open(dsn),
-			&gorm.Config{
-				NamingStrategy: schema.NamingStrategy{
-					TablePrefix:   dbSchema + ".",
-					SingularTable: true,
-				}})
-		// TODO - should throw error if db connection fails! Currently fails "silently" by printing error to log and then just returning ...
-		dataSourceDb.Db = dataSource
+		dialector = sqlserver.Open(dsn)
 		dataSourceDb.Vendor = "sqlserver"
 	}
+	dataSource, err := gorm.Open(dialector,
+		&gorm.Config{
+			DisableAutomaticPing: true,
+			NamingStrategy: schema.NamingStrategy{
+				TablePrefix:   dbSchema + ".",
+				SingularTable: true,
+			}})
+	if err != nil {
+		return nil, fmt.Errorf("could not open connection to source %d: %w", source.SourceId, err)
+	}
+	dataSourceDb.Db = dataSource
 	dataSourceDb.Schema = dbSchema
-	dataSourceDbMap[sourceAndSchemaKey] = dataSourceDb
-	return dataSourceDb
+	sqlDb, err := dataSource.DB()
+	if err != nil {
+		return nil, fmt.Errorf("could not open connection to source %d: %w", source.SourceId, err)
+	}
+	poolSettings := GetPoolSettings(source.SourceId)
+	if poolSettings.MaxOpenConnections != 0 {
+		sqlDb.SetMaxOpenConns(poolSettings.MaxOpenConnections)
+	}
+	if poolSettings.MaxIdleConnections != 0 {
+		sqlDb.SetMaxIdleConns(poolSettings.MaxIdleConnections)
+	}
+	if poolSettings.ConnectionMaxLifetimeSeconds != 0 {
+		sqlDb.SetConnMaxLifetime(time.Duration(poolSettings.ConnectionMaxLifetimeSeconds) * time.Second)
+	}
+	err = pingDataSource(dataSourceDb)
+	if err != nil {
+		closeDataSource(dataSourceDb)
+		return nil, fmt.Errorf("could not connect to source %d: %w", source.SourceId, err)
+	}
+	return dataSourceDb, nil
+}
+
+// The timeout of the pings that validate the connections.
+const PING_TIMEOUT = 5 * time.Second
+
+func pingDataSource(dataSource *DbAndSchema) error {
+	sqlDb, err := dataSource.Db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
+	defer cancel()
+	return sqlDb.PingContext(ctx)
+}
+
+func closeDataSource(dataSource *DbAndSchema) error {
+	sqlDb, err := dataSource.Db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.Close()
+}
+
+// Returns a DbAndSchema whose queries all fail with the given error. Used when a data source
+// cannot be connected to, so that the error surfaces when the data source is queried.
+func GetFailingDataSourceDB(dbSchema string, err error) *DbAndSchema {
+	dataSource, _ := gorm.Open(postgres.Open(""), &gorm.Config{DisableAutomaticPing: true})
+	_ = dataSource.AddError(err)
+	return &DbAndSchema{Db: dataSource, Schema: dbSchema, Vendor: POSTGRESQL}
 }
 
 // Adds a default timeout to a query
@@ -73,7 +328,17 @@ func AddTimeoutToQuery(query *gorm.DB) (*gorm.DB, context.CancelFunc) {
 
 // Adds a specific timeout to a query
 func AddSpecificTimeoutToQuery(query *gorm.DB, timeout time.Duration) (*gorm.DB, context.CancelFunc) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return AddSpecificTimeoutAndParentContextToQuery(context.Background(), query, timeout)
+}
+
+// Adds the default timeout to a query, and makes it stop as well when the given parent context is cancelled
+func AddTimeoutAndParentContextToQuery(parentCtx context.Context, query *gorm.DB) (*gorm.DB, context.CancelFunc) {
+	return AddSpecificTimeoutAndParentContextToQuery(parentCtx, query, 180*time.Second)
+}
+
+// Adds a specific timeout to a query, and makes it stop as well when the given parent context is cancelled
+func AddSpecificTimeoutAndParentContextToQuery(parentCtx context.Context, query *gorm.DB, timeout time.Duration) (*gorm.DB, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
 	query = query.WithContext(ctx)
 	return query, cancel
 }
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrorCode identifies the kind of error in the JSON error responses.
+type ErrorCode string
+
+const (
+	NOT_FOUND            ErrorCode = "not_found"
+	INVALID_INPUT        ErrorCode = "invalid_input"
+	UNAUTHORIZED         ErrorCode = "unauthorized"
+	FORBIDDEN            ErrorCode = "forbidden"
+	UPSTREAM_UNAVAILABLE ErrorCode = "upstream_unavailable"
+	TIMEOUT              ErrorCode = "timeout"
+	REQUEST_TOO_LARGE    ErrorCode = "request_too_large"
+	TOO_MANY_REQUESTS    ErrorCode = "too_many_requests"
+	INTERNAL_ERROR       ErrorCode = "internal_error"
+)
+
+var errorCodeHttpStatus = map[ErrorCode]int{
+	NOT_FOUND:            http.StatusNotFound,
+	INVALID_INPUT:        http.StatusBadRequest,
+	UNAUTHORIZED:         http.StatusUnauthorized,
+	FORBIDDEN:            http.StatusForbidden,
+	UPSTREAM_UNAVAILABLE: http.StatusServiceUnavailable,
+	TIMEOUT:              http.StatusGatewayTimeout,
+	REQUEST_TOO_LARGE:    http.StatusRequestEntityTooLarge,
+	TOO_MANY_REQUESTS:    http.StatusTooManyRequests,
+	INTERNAL_ERROR:       http.StatusInternalServerError,
+}
+
+// A domain error, wrapping the original error together with its ErrorCode.
+type AppError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *AppError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// A field of the request that is missing or invalid.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// An INVALID_INPUT error, listing the invalid fields of the request.
+type ValidationError struct {
+	FieldErrors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, fieldError := range e.FieldErrors {
+		if fieldError.Field == "" {
+			messages = append(messages, fieldError.Message)
+		} else {
+			messages = append(messages, fieldError.Field+" "+fieldError.Message)
+		}
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+func newAppError(code ErrorCode, err error) error {
+	if err == nil {
+		err = errors.New(string(code))
+	}
+	return &AppError{Code: code, Err: err}
+}
+
+func NewNotFoundError(err error) error {
+	return newAppError(NOT_FOUND, err)
+}
+
+func NewInvalidInputError(err error) error {
+	return newAppError(INVALID_INPUT, err)
+}
+
+func NewUnauthorizedError(err error) error {
+	return newAppError(UNAUTHORIZED, err)
+}
+
+func NewForbiddenError(err error) error {
+	return newAppError(FORBIDDEN, err)
+}
+
+func NewUpstreamUnavailableError(err error) error {
+	return newAppError(UPSTREAM_UNAVAILABLE, err)
+}
+
+func NewTimeoutError(err error) error {
+	return newAppError(TIMEOUT, err)
+}
+
+func NewRequestTooLargeError(err error) error {
+	return newAppError(REQUEST_TOO_LARGE, err)
+}
+
+func NewTooManyRequestsError(err error) error {
+	return newAppError(TOO_MANY_REQUESTS, err)
+}
+
+func NewInternalError(err error) error {
+	return newAppError(INTERNAL_ERROR, err)
+}
+
+// Returns the ErrorCode of the given error. Errors that are not an AppError are
+// classified based on well known errors (query timeouts, records not found, request
+// bodies over the size limit), and default to INTERNAL_ERROR.
+func GetErrorCode(err error) ErrorCode {
+	var appError *AppError
+	var validationError *ValidationError
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &appError):
+		return appError.Code
+	case errors.As(err, &validationError):
+		return INVALID_INPUT
+	case errors.As(err, &maxBytesError):
+		return REQUEST_TOO_LARGE
+	case errors.Is(err, context.DeadlineExceeded):
+		return TIMEOUT
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return NOT_FOUND
+	default:
+		return INTERNAL_ERROR
+	}
+}
+
+// Returns the HTTP status code that corresponds to the ErrorCode of the given error.
+func GetHttpStatusForError(err error) int {
+	return errorCodeHttpStatus[GetErrorCode(err)]
+}
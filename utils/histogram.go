@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"sort"
@@ -16,51 +17,290 @@ type HistogramColumn struct {
 
 const MAX_NUM_BINS = 50
 
+// the supported binning strategies:
+const (
+	FREEDMAN_DIACONIS = "freedman-diaconis"
+	STURGES           = "sturges"
+	SCOTT             = "scott"
+	FIXED_BIN_COUNT   = "fixed-count"
+	FIXED_BIN_WIDTH   = "fixed-width"
+	BREAKS            = "breaks"
+)
+
+var BINNING_STRATEGIES = []string{FREEDMAN_DIACONIS, STURGES, SCOTT, FIXED_BIN_COUNT, FIXED_BIN_WIDTH, BREAKS}
+
+// Options that control how the histogram bins are calculated. NumberOfBins is only used by
+// the FIXED_BIN_COUNT strategy, BinWidth only by FIXED_BIN_WIDTH and Breaks only by BREAKS.
+// If ClipPercentiles is set (e.g. [1, 99]), the values outside of this percentile range are
+// excluded before binning.
+type HistogramOptions struct {
+	Strategy        string
+	NumberOfBins    int
+	BinWidth        float64
+	Breaks          []float64
+	ClipPercentiles []float64
+}
+
+// Metadata about how the histogram bins were calculated. BinWidth is the width of the bins that
+// were generated, which differs from the requested FIXED_BIN_WIDTH width when that width would need
+// more than MAX_NUM_BINS bins. BinWidthAdjusted is set in that case.
+type HistogramMetadata struct {
+	Strategy                 string   `json:"strategy"`
+	NumberOfBins             int      `json:"binCount"`
+	BinWidth                 float64  `json:"binWidth"`
+	BinWidthAdjusted         bool     `json:"binWidthAdjusted"`
+	NumberOfOutliersExcluded int      `json:"outliersExcluded"`
+	ClipLowerBound           *float64 `json:"clipLowerBound,omitempty"`
+	ClipUpperBound           *float64 `json:"clipUpperBound,omitempty"`
+}
+
+func GetDefaultHistogramOptions() *HistogramOptions {
+	return &HistogramOptions{Strategy: FREEDMAN_DIACONIS}
+}
+
+// Returns the field errors found in the histogram options, if any. The field names are the
+// ones used in the JSON requests (e.g. "bin_count").
+func ValidateHistogramOptions(options *HistogramOptions) []FieldError {
+	fieldErrors := []FieldError{}
+	switch options.Strategy {
+	case FIXED_BIN_COUNT:
+		if options.NumberOfBins < 1 || options.NumberOfBins > MAX_NUM_BINS {
+			fieldErrors = append(fieldErrors, FieldError{Field: "bin_count", Message: fmt.Sprintf("should be a number between 1 and %d", MAX_NUM_BINS)})
+		}
+	case FIXED_BIN_WIDTH:
+		if options.BinWidth <= 0 {
+			fieldErrors = append(fieldErrors, FieldError{Field: "bin_width", Message: "should be a positive number"})
+		}
+	case BREAKS:
+		if len(options.Breaks) < 2 || len(options.Breaks) > MAX_NUM_BINS+1 || !sort.Float64sAreSorted(options.Breaks) {
+			fieldErrors = append(fieldErrors, FieldError{Field: "breaks", Message: fmt.Sprintf("should be a sorted list of 2 to %d numbers", MAX_NUM_BINS+1)})
+		} else {
+			for i := 1; i < len(options.Breaks); i++ {
+				if options.Breaks[i] == options.Breaks[i-1] {
+					fieldErrors = append(fieldErrors, FieldError{Field: "breaks", Message: "should not contain duplicates"})
+					break
+				}
+			}
+		}
+	case FREEDMAN_DIACONIS, STURGES, SCOTT:
+	default:
+		fieldErrors = append(fieldErrors, FieldError{Field: "binning", Message: fmt.Sprintf("should be one of %v", BINNING_STRATEGIES)})
+	}
+	if options.ClipPercentiles != nil && (len(options.ClipPercentiles) != 2 || options.ClipPercentiles[0] <= 0 ||
+		options.ClipPercentiles[1] > 100 || options.ClipPercentiles[0] >= options.ClipPercentiles[1]) {
+		fieldErrors = append(fieldErrors, FieldError{Field: "clip_percentiles", Message: "should be a lower and upper percentile in the range (0, 100], e.g. 1,99"})
+	}
+	return fieldErrors
+}
+
 func GenerateHistogramData(conceptValues []float64) []HistogramColumn {
+	histogram, _ := GenerateHistogramDataWithOptions(conceptValues, GetDefaultHistogramOptions())
+	return histogram
+}
+
+// Generates the histogram bins for the given values using the binning strategy and clipping set in options.
+// Returns the bins and some metadata about how the bins were calculated.
+func GenerateHistogramDataWithOptions(conceptValues []float64, options *HistogramOptions) ([]HistogramColumn, *HistogramMetadata) {
 
 	if len(conceptValues) == 0 {
-		return nil
+		return nil, nil
+	}
+	sort.Float64s(conceptValues)
+	numberOfValues := len(conceptValues)
+	var clipLowerBound, clipUpperBound *float64
+	if len(options.ClipPercentiles) == 2 {
+		lowerBound, _ := stats.PercentileNearestRank(conceptValues, options.ClipPercentiles[0])
+		upperBound, _ := stats.PercentileNearestRank(conceptValues, options.ClipPercentiles[1])
+		clipLowerBound, clipUpperBound = &lowerBound, &upperBound
+		clippedValues := []float64{}
+		for _, value := range conceptValues {
+			if value >= lowerBound && value <= upperBound {
+				clippedValues = append(clippedValues, value)
+			}
+		}
+		conceptValues = clippedValues
+	}
+
+	histogram, metadata := GenerateEmptyHistogramBins(GenerateValueSummary(conceptValues), options)
+	metadata.ClipLowerBound = clipLowerBound
+	metadata.ClipUpperBound = clipUpperBound
+	metadata.NumberOfOutliersExcluded = numberOfValues - len(conceptValues)
+	metadata.NumberOfOutliersExcluded += addValuesToHistogramBins(conceptValues, histogram, metadata)
+
+	return histogram, metadata
+}
+
+// Returns the histogram bins, all with a person count of 0, for values with the given summary,
+// using the binning strategy set in options. The metadata returned does not include any clipping
+// or outlier information yet.
+func GenerateEmptyHistogramBins(summary *ValueSummary, options *HistogramOptions) ([]HistogramColumn, *HistogramMetadata) {
+	metadata := &HistogramMetadata{Strategy: options.Strategy}
+	histogram := []HistogramColumn{}
+	if options.Strategy == BREAKS {
+		for i := 0; i < len(options.Breaks)-1; i++ {
+			histogram = append(histogram, HistogramColumn{
+				Start:          options.Breaks[i],
+				End:            options.Breaks[i+1],
+				NumberOfPeople: 0,
+			})
+		}
+		metadata.NumberOfBins = len(histogram)
+		return histogram, metadata
 	}
-	numBins, width := GetBinsAndWidthAndSortValues(conceptValues) //conceptValues will get sorted as a side-effect, which is useful in this case
-	startValue := conceptValues[0]
-	binIndexToHistogramColumn := make(map[int]HistogramColumn)
 
+	numBins, width := GetBinsAndWidthForValueSummary(summary, options)
+	metadata.NumberOfBins = numBins
+	metadata.BinWidth = width
+	metadata.BinWidthAdjusted = options.Strategy == FIXED_BIN_WIDTH && width != options.BinWidth
 	for binIndex := 0; binIndex < numBins; binIndex++ {
-		binStart := (float64(binIndex) * width) + startValue
+		binStart := (float64(binIndex) * width) + summary.Min
 		binEnd := binStart + width
-		binIndexToHistogramColumn[binIndex] = HistogramColumn{
+		histogram = append(histogram, HistogramColumn{
 			Start:          binStart,
 			End:            binEnd,
 			NumberOfPeople: 0,
+		})
+	}
+	return histogram, metadata
+}
+
+// Adds each of the given (sorted) values to the person count of the histogram bin it falls in. For
+// BREAKS, each bin includes its start and excludes its end, except for the last bin, which also
+// includes its end. Returns the number of values that fell outside of the bins.
+func addValuesToHistogramBins(sortedValues []float64, histogram []HistogramColumn, metadata *HistogramMetadata) int {
+	numberOfValuesOutsideBins := 0
+	if metadata.Strategy == BREAKS {
+		lastBinIndex := len(histogram) - 1
+		for _, value := range sortedValues {
+			if value < histogram[0].Start || value > histogram[lastBinIndex].End {
+				numberOfValuesOutsideBins++
+				continue
+			}
+			// first bin that ends after value (or the last bin, which also includes its end):
+			binIndex := sort.Search(lastBinIndex, func(i int) bool { return histogram[i].End > value })
+			histogram[binIndex].NumberOfPeople += 1
 		}
+		return numberOfValuesOutsideBins
 	}
 
-	for _, value := range conceptValues {
-		valueBinIndex := int((value - startValue) / width)
-		if histogramColumn, ok := binIndexToHistogramColumn[valueBinIndex]; ok {
-			histogramColumn.NumberOfPeople += 1
-			binIndexToHistogramColumn[valueBinIndex] = histogramColumn
+	numBins := len(histogram)
+	startValue := histogram[0].Start
+	for _, value := range sortedValues {
+		valueBinIndex := int((value - startValue) / metadata.BinWidth)
+		if valueBinIndex == numBins {
+			// the max value falls exactly on the end of the last bin:
+			valueBinIndex = numBins - 1
+		}
+		if valueBinIndex >= 0 && valueBinIndex < numBins {
+			histogram[valueBinIndex].NumberOfPeople += 1
+		} else {
+			numberOfValuesOutsideBins++
 		}
 	}
+	return numberOfValuesOutsideBins
+}
 
-	histogram := []HistogramColumn{}
-	for binIndex := 0; binIndex < numBins; binIndex++ {
-		histogram = append(histogram, binIndexToHistogramColumn[binIndex])
+// Sets the person count of each histogram bin to the count found for its index in binCounts.
+// Returns the sum of the counts that did not match any bin.
+func SetHistogramBinCounts(histogram []HistogramColumn, binCounts map[int]int) int {
+	numberOfValuesOutsideBins := 0
+	for binIndex, count := range binCounts {
+		if binIndex >= 0 && binIndex < len(histogram) {
+			histogram[binIndex].NumberOfPeople = count
+		} else {
+			numberOfValuesOutsideBins += count
+		}
+	}
+	return numberOfValuesOutsideBins
+}
+
+// Generates one histogram per group of values, all sharing the same bin edges, so that the histograms
+// can be stacked or overlaid. The bin edges (and clip bounds, if any) are calculated over the values of
+// all groups together, using the strategy set in options.
+func GenerateHistogramDataForGroups(valuesPerGroup [][]float64, options *HistogramOptions) ([][]HistogramColumn, *HistogramMetadata) {
+	allValues := []float64{}
+	for _, groupValues := range valuesPerGroup {
+		allValues = append(allValues, groupValues...)
+	}
+	sharedBins, metadata := GenerateHistogramDataWithOptions(allValues, options)
+	histograms := [][]HistogramColumn{}
+	if metadata == nil {
+		// no values in any of the groups:
+		for range valuesPerGroup {
+			histograms = append(histograms, nil)
+		}
+		return histograms, nil
+	}
+	for _, groupValues := range valuesPerGroup {
+		histograms = append(histograms, countValuesPerBin(groupValues, sharedBins, metadata))
 	}
+	return histograms, metadata
+}
 
+// Returns a copy of the given bins with the number of values that fall in each bin. Values outside
+// of the clip bounds set in metadata are not counted.
+func countValuesPerBin(values []float64, bins []HistogramColumn, metadata *HistogramMetadata) []HistogramColumn {
+	histogram := []HistogramColumn{}
+	for _, bin := range bins {
+		histogram = append(histogram, HistogramColumn{Start: bin.Start, End: bin.End, NumberOfPeople: 0})
+	}
+	lastBinIndex := len(histogram) - 1
+	for _, value := range values {
+		if metadata.ClipLowerBound != nil && (value < *metadata.ClipLowerBound || value > *metadata.ClipUpperBound) {
+			continue
+		}
+		if lastBinIndex < 0 || value < histogram[0].Start || value > histogram[lastBinIndex].End {
+			continue
+		}
+		// first bin that ends after value (or the last bin, which also includes its end):
+		binIndex := sort.Search(lastBinIndex, func(i int) bool { return histogram[i].End > value })
+		histogram[binIndex].NumberOfPeople += 1
+	}
 	return histogram
 }
 
 // Sorts the given values, and returns the number of bins, the width of the bins using FreedmanDiaconis
 func GetBinsAndWidthAndSortValues(values []float64) (int, float64) {
+	return GetBinsAndWidthForStrategy(values, GetDefaultHistogramOptions())
+}
+
+// Sorts the given values, and returns the number of bins and the width of the bins using the
+// strategy set in options.
+func GetBinsAndWidthForStrategy(values []float64, options *HistogramOptions) (int, float64) {
+	sort.Float64s(values)
+	return GetBinsAndWidthForValueSummary(GenerateValueSummary(values), options)
+}
 
-	width := FreedmanDiaconis(values) // values will get sorted as a side-effect, which is useful in this case
-	startValue := values[0]
-	endValue := values[len(values)-1]
+// Returns the number of bins and the width of the bins for values with the given summary, using the
+// strategy set in options. Falls back to a single bin if the strategy results in a width of 0
+// (e.g. when the values have no variation).
+func GetBinsAndWidthForValueSummary(summary *ValueSummary, options *HistogramOptions) (int, float64) {
+
+	startValue := summary.Min
+	endValue := summary.Max
+
+	width := 0.0
+	switch options.Strategy {
+	case STURGES:
+		numBins := int(math.Ceil(math.Log2(float64(summary.NumberOfValues)))) + 1
+		width = (endValue - startValue) / float64(numBins)
+	case SCOTT:
+		width = scottWidth(summary.Sd, summary.NumberOfValues)
+	case FIXED_BIN_COUNT:
+		width = (endValue - startValue) / float64(options.NumberOfBins)
+	case FIXED_BIN_WIDTH:
+		width = options.BinWidth
+	default:
+		width = freedmanDiaconisWidth(summary.ThirdQuartile-summary.FirstQuartile, summary.NumberOfValues)
+	}
 
 	numBins := 0
 	if width > 0 {
 		numBins = int((endValue-startValue)/width) + 1
+		if options.Strategy == STURGES || options.Strategy == FIXED_BIN_COUNT {
+			// the max value falls on the end of the last bin, so no need for the extra bin:
+			numBins = int(math.Round((endValue - startValue) / width))
+		}
 	} else {
 		numBins = 1
 		width = endValue + 1 - startValue
@@ -80,15 +320,32 @@ func GetBinsAndWidthAndSortValues(values []float64) (int, float64) {
 // Can return 0 if IQR(values) is 0.
 func FreedmanDiaconis(values []float64) float64 {
 
-	valuesInterQuartileRange := IQR(values) // values will get sorted as a side-effect, which is useful in this case
-	n := len(values)
-	width := (2 * valuesInterQuartileRange) / math.Cbrt(float64(n))
+	valuesInterQuartileRange := IQR(values) // values will get sorted as a side-effect, which is useful in this case
+	return freedmanDiaconisWidth(valuesInterQuartileRange, len(values))
+}
+
+func freedmanDiaconisWidth(interQuartileRange float64, n int) float64 {
+	width := (2 * interQuartileRange) / math.Cbrt(float64(n))
 
 	log.Printf("here is the width for freedman diaconis calculation %v", width)
 
 	return width
 }
 
+// This function returns the bin width upon Scott's normal reference rule: https://en.wikipedia.org/wiki/Histogram#Scott's_normal_reference_rule
+// Can return 0 if the values have no variation.
+func Scott(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	sdValue, _ := stats.StandardDeviationSample(values)
+	return scottWidth(sdValue, len(values))
+}
+
+func scottWidth(sd float64, n int) float64 {
+	return 3.49 * sd / math.Cbrt(float64(n))
+}
+
 func IQR(values []float64) float64 {
 	sort.Float64s(values)
 	valuesInterQuartileRange, _ := stats.InterQuartileRange(values)
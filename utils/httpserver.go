@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+)
+
+// The default grace period for in-flight requests and background jobs at shutdown, a bit
+// shorter than the default Kubernetes termination grace period of 30 seconds.
+const DEFAULT_SHUTDOWN_GRACE_PERIOD_SECONDS = 25
+
+// The settings of the HTTP server (see GetServerSettings).
+type ServerSettings struct {
+	Address string
+	// zero means no timeout:
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// zero means the net/http default of 1 MB:
+	MaxHeaderBytes int
+	// zero means no limit:
+	MaxBodyBytes int64
+	// the server uses TLS if both are set:
+	TlsCertPath         string
+	TlsKeyPath          string
+	ShutdownGracePeriod time.Duration
+}
+
+// Returns the HTTP server settings in the optional "server" config key, e.g.:
+//
+//	server:
+//	  address: ':8080'
+//	  read_timeout_seconds: 60
+//	  write_timeout_seconds: 600
+//	  idle_timeout_seconds: 120
+//	  max_header_bytes: 1048576
+//	  max_body_bytes: 10485760
+//	  tls_cert_path: /etc/tls/tls.crt
+//	  tls_key_path: /etc/tls/tls.key
+//	  shutdown_grace_period_seconds: 25
+//
+// The address defaults to ":$PORT", or ":8080" if the PORT environment variable is not set (as in gin).
+func GetServerSettings() ServerSettings {
+	settings := ServerSettings{
+		Address:             ":8080",
+		ShutdownGracePeriod: DEFAULT_SHUTDOWN_GRACE_PERIOD_SECONDS * time.Second,
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		settings.Address = ":" + port
+	}
+	conf := config.GetConfig()
+	if conf == nil || !conf.IsSet("server") {
+		return settings
+	}
+	if conf.IsSet("server.address") {
+		settings.Address = conf.GetString("server.address")
+	}
+	settings.ReadTimeout = time.Duration(conf.GetInt("server.read_timeout_seconds")) * time.Second
+	settings.WriteTimeout = time.Duration(conf.GetInt("server.write_timeout_seconds")) * time.Second
+	settings.IdleTimeout = time.Duration(conf.GetInt("server.idle_timeout_seconds")) * time.Second
+	settings.MaxHeaderBytes = conf.GetInt("server.max_header_bytes")
+	settings.MaxBodyBytes = conf.GetInt64("server.max_body_bytes")
+	settings.TlsCertPath = conf.GetString("server.tls_cert_path")
+	settings.TlsKeyPath = conf.GetString("server.tls_key_path")
+	if conf.IsSet("server.shutdown_grace_period_seconds") {
+		settings.ShutdownGracePeriod = time.Duration(conf.GetInt("server.shutdown_grace_period_seconds")) * time.Second
+	}
+	return settings
+}
+
+// Returns a server for the given handler, with the given settings.
+func NewHttpServer(handler http.Handler, settings ServerSettings) *http.Server {
+	return &http.Server{
+		Addr:           settings.Address,
+		Handler:        handler,
+		ReadTimeout:    settings.ReadTimeout,
+		WriteTimeout:   settings.WriteTimeout,
+		IdleTimeout:    settings.IdleTimeout,
+		MaxHeaderBytes: settings.MaxHeaderBytes,
+	}
+}
+
+func (settings ServerSettings) UsesTls() bool {
+	return settings.TlsCertPath != "" && settings.TlsKeyPath != ""
+}
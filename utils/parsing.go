@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -34,6 +35,117 @@ func ParseBigNumericArg(c *gin.Context, paramName string) (int64, error) {
 	}
 }
 
+// Returns the value of the given (optional) query parameter, or "" if it is not set.
+func getQueryArg(c *gin.Context, paramName string) string {
+	if c.Request == nil || c.Request.URL == nil {
+		return ""
+	}
+	return c.Query(paramName)
+}
+
+// Parses an optional numeric query parameter. Returns -1 if the parameter is not set.
+func ParseOptionalBigNumericQueryArg(c *gin.Context, paramName string) (int64, error) {
+	numericArgValue := getQueryArg(c, paramName)
+	if numericArgValue == "" {
+		return -1, nil
+	}
+	if numericId, err := strconv.ParseInt(numericArgValue, 10, 64); err != nil {
+		log.Printf("bad request - %s should be a number", paramName)
+		return -1, fmt.Errorf("bad request - %s should be a number", paramName)
+	} else {
+		return numericId, nil
+	}
+}
+
+// Parses an optional query parameter with a comma separated list of percentiles, e.g. "?percentiles=5,50,95".
+// Returns defaultPercentiles if the parameter is not set.
+func ParsePercentilesQueryArg(c *gin.Context, paramName string, defaultPercentiles []float64) ([]float64, error) {
+	percentilesArgValue := getQueryArg(c, paramName)
+	if percentilesArgValue == "" {
+		return defaultPercentiles, nil
+	}
+	percentiles := []float64{}
+	for _, percentileStr := range strings.Split(percentilesArgValue, ",") {
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(percentileStr), 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			log.Printf("bad request - %s should be a list of numbers in the range (0, 100]", paramName)
+			return nil, fmt.Errorf("bad request - %s should be a list of numbers in the range (0, 100]", paramName)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, nil
+}
+
+// Parses an optional query parameter with a comma separated list of numbers. Returns nil if the parameter is not set.
+func parseFloatListQueryArg(c *gin.Context, paramName string) ([]float64, error) {
+	listArgValue := getQueryArg(c, paramName)
+	if listArgValue == "" {
+		return nil, nil
+	}
+	values := []float64{}
+	for _, valueStr := range strings.Split(listArgValue, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(valueStr), 64)
+		if err != nil {
+			log.Printf("bad request - %s should be a list of numbers", paramName)
+			return nil, fmt.Errorf("bad request - %s should be a list of numbers", paramName)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Parses an optional query parameter with a comma separated list of integers, e.g. "?cohort-ids=1,2".
+// Returns nil if the parameter is not set.
+func ParseOptionalIntListQueryArg(c *gin.Context, paramName string) ([]int, error) {
+	listArgValue := getQueryArg(c, paramName)
+	if listArgValue == "" {
+		return nil, nil
+	}
+	values := []int{}
+	for _, valueStr := range strings.Split(listArgValue, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(valueStr))
+		if err != nil {
+			log.Printf("bad request - %s should be a list of numbers", paramName)
+			return nil, fmt.Errorf("bad request - %s should be a list of numbers", paramName)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Parses the optional histogram binning query parameters, e.g. "?binning=fixed-count&bin-count=10&clip-percentiles=1,99".
+// Supported parameters are "binning" (one of BINNING_STRATEGIES, defaults to FREEDMAN_DIACONIS), "bin-count" (for
+// FIXED_BIN_COUNT), "bin-width" (for FIXED_BIN_WIDTH), "breaks" (for BREAKS) and "clip-percentiles".
+func ParseHistogramOptionsQueryArgs(c *gin.Context) (*HistogramOptions, error) {
+	options := GetDefaultHistogramOptions()
+	if strategy := getQueryArg(c, "binning"); strategy != "" {
+		options.Strategy = strategy
+	}
+	var err error
+	switch options.Strategy {
+	case FIXED_BIN_COUNT:
+		// a value that is not a number is reported by ValidateHistogramOptions below:
+		options.NumberOfBins, _ = strconv.Atoi(getQueryArg(c, "bin-count"))
+	case FIXED_BIN_WIDTH:
+		options.BinWidth, _ = strconv.ParseFloat(getQueryArg(c, "bin-width"), 64)
+	case BREAKS:
+		options.Breaks, err = parseFloatListQueryArg(c, "breaks")
+		if err != nil {
+			return nil, err
+		}
+	}
+	options.ClipPercentiles, err = parseFloatListQueryArg(c, "clip-percentiles")
+	if err != nil {
+		return nil, err
+	}
+	fieldErrors := ValidateHistogramOptions(options)
+	if len(fieldErrors) > 0 {
+		// report the first error using the query parameter name, e.g. "bin-count":
+		return nil, fmt.Errorf("bad request - %s %s", strings.ReplaceAll(fieldErrors[0].Field, "_", "-"), fieldErrors[0].Message)
+	}
+	return options, nil
+}
+
 func Pos(value int64, list []int64) int {
 	for p, v := range list {
 		if v == value {
@@ -61,21 +173,26 @@ func Contains(list []int, value int) bool {
 	return false
 }
 
-func ParseInt64(strValue string) int64 {
-	value, error := strconv.ParseInt(strValue, 10, 64)
-	if error != nil {
-		panic(fmt.Sprintf("Invalid numeric value. Error: %v", error))
+func ParseInt64(strValue string) (int64, error) {
+	value, err := strconv.ParseInt(strValue, 10, 64)
+	if err != nil {
+		return 0, NewInvalidInputError(fmt.Errorf("invalid numeric value. Error: %v", err))
 	}
-	return value
+	return value, nil
 }
 
 func ContainsNonNil(errors []error) bool {
+	return GetFirstNonNil(errors) != nil
+}
+
+// Returns the first non-nil error in the given list, or nil if there is none.
+func GetFirstNonNil(errors []error) error {
 	for _, item := range errors {
 		if item != nil {
-			return true
+			return item
 		}
 	}
-	return false
+	return nil
 }
 
 // Takes in a list of strings and attempts to transform them to int64,
@@ -128,60 +245,42 @@ func GetCohortPairKey(firstCohortDefinitionId int, secondCohortDefinitionId int)
 //
 // ]}
 // It returns the list with all concept_id values and custom dichotomous variable definitions.
+// The payload is validated against the VariablesRequest definition (see DecodeVariablesRequest).
 func ParseConceptIdsAndDichotomousDefsAsSingleList(c *gin.Context) ([]interface{}, error) {
-	if c.Request == nil || c.Request.Body == nil {
-		return nil, errors.New("bad request - no request body")
-	}
-	decoder := json.NewDecoder(c.Request.Body)
-	request := make(map[string][]map[string]interface{})
-	err := decoder.Decode(&request)
+	variables, err := ParseVariablesRequestBody(c)
 	if err != nil {
-		log.Printf("Error: %s", err)
 		return nil, err
 	}
 
-	variables := request["variables"]
 	conceptIdsAndCohortPairs := make([]interface{}, 0)
-
-	// TODO - this parsing will throw a lot of "null pointer" errors since it does not validate if specific entries are found in the json before
-	// accessing them...needs to be fixed to throw better errors:
 	for _, variable := range variables {
-		if variable["variable_type"] == "concept" {
-			convertedConceptValues := []int64{}
-			values, ok := variable["values"].([]interface{})
-			// If the values are passed as parameter, add to list
-			if ok {
-				for _, val := range values {
-					convertedConceptValues = append(convertedConceptValues, int64(val.(float64)))
-				}
-			}
-			conceptVariableDef := CustomConceptVariableDef{
-				ConceptId:     int64(variable["concept_id"].(float64)),
-				ConceptValues: convertedConceptValues,
-			}
-			conceptIdsAndCohortPairs = append(conceptIdsAndCohortPairs, conceptVariableDef)
-		}
-		if variable["variable_type"] == "custom_dichotomous" {
-			cohortPair := []int{}
-			convertedCohortIds := variable["cohort_ids"].([]interface{})
-			for _, convertedCohortId := range convertedCohortIds {
-				cohortPair = append(cohortPair, int(convertedCohortId.(float64)))
-			}
-			providedName := GetCohortPairKey(cohortPair[0], cohortPair[1])
-			if variable["provided_name"] != nil {
-				providedName = variable["provided_name"].(string)
-			}
-			customDichotomousVariableDef := CustomDichotomousVariableDef{
-				CohortDefinitionId1: cohortPair[0],
-				CohortDefinitionId2: cohortPair[1],
-				ProvidedName:        providedName,
-			}
-			conceptIdsAndCohortPairs = append(conceptIdsAndCohortPairs, customDichotomousVariableDef)
-		}
+		conceptIdsAndCohortPairs = append(conceptIdsAndCohortPairs, variable.ToConceptOrCohortPairDef())
 	}
 	return conceptIdsAndCohortPairs, nil
 }
 
+// Returns the (validated) variables in the request body (see DecodeVariablesRequest).
+func ParseVariablesRequestBody(c *gin.Context) ([]VariableDef, error) {
+	request, err := ParseVariablesRequest(c)
+	if err != nil {
+		return nil, err
+	}
+	return request.Variables, nil
+}
+
+// Returns the (validated) VariablesRequest in the request body, with the variables and the optional windows.
+func ParseVariablesRequest(c *gin.Context) (*VariablesRequest, error) {
+	if c.Request == nil || c.Request.Body == nil {
+		return nil, NewInvalidInputError(errors.New("bad request - no request body"))
+	}
+	request, err := DecodeVariablesRequest(c.Request.Body)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return nil, err
+	}
+	return request, nil
+}
+
 // deprecated: for backwards compatibility
 func ParseConceptDefsAndDichotomousDefs(c *gin.Context) ([]CustomConceptVariableDef, []CustomDichotomousVariableDef, error) {
 	conceptIdsAndCohortPairs, err := ParseConceptIdsAndDichotomousDefsAsSingleList(c)
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The status of a component checked by the readiness endpoint. If a critical component is
+// not ok, the service is not ready.
+type ComponentStatus struct {
+	Component  string `json:"component"`
+	Critical   bool   `json:"critical"`
+	Ok         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Runs the given check with the given timeout and returns the status of the component. The check should
+// stop when its context is done, but the status is returned at the timeout even if it does not (e.g. while
+// a new DB connection is opened), so that a single component can not block the readiness endpoint.
+func CheckComponent(ctx context.Context, component string, critical bool, timeout time.Duration, check func(ctx context.Context) error) ComponentStatus {
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		result <- check(checkCtx)
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-checkCtx.Done():
+		err = errors.New("timed out after " + timeout.String())
+	}
+	status := ComponentStatus{Component: component, Critical: critical, Ok: err == nil, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Returns true if none of the critical components failed.
+func IsReady(componentStatuses []ComponentStatus) bool {
+	for _, componentStatus := range componentStatuses {
+		if componentStatus.Critical && !componentStatus.Ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+)
+
+// Decrypts an encrypted password.
+type PasswordDecrypter func(encryptedPassword string) (string, error)
+
+// The supported algorithms for source_password_decryption.
+const (
+	PBE_WITH_MD5_AND_DES = "PBEWithMD5AndDES"
+)
+
+// The default number of key derivation iterations of jasypt (which Atlas uses to encrypt passwords).
+const DEFAULT_JASYPT_ITERATIONS = 1000
+
+const jasyptSaltSize = 8
+
+var sourcePasswordDecrypter PasswordDecrypter
+var sourcePasswordDecrypterOnce sync.Once
+
+// Returns the decrypter of the source passwords (i.e. the password column of Atlas's source table),
+// configured with the optional source_password_decryption key, e.g.:
+//
+//	source_password_decryption:
+//	  algorithm: PBEWithMD5AndDES
+//	  key: ${ATLAS_ENCRYPTION_KEY}
+//	  iterations: 1000
+//
+// Only the passwords in the "ENC(...)" form are decrypted, other passwords are returned as they are.
+// Returns nil if no decryption is configured. With an invalid entry (ValidateSourcePasswordDecryption
+// stops the startup for it), only the "ENC(...)" passwords fail, with an internal error.
+func GetSourcePasswordDecrypter() PasswordDecrypter {
+	sourcePasswordDecrypterOnce.Do(func() {
+		decrypter, err := newSourcePasswordDecrypter()
+		if err != nil {
+			log.Printf("ERROR: %s", err.Error())
+			decrypter = func(password string) (string, error) {
+				if !isEncryptedValue(password) {
+					return password, nil
+				}
+				return "", NewInternalError(err)
+			}
+		}
+		sourcePasswordDecrypter = decrypter
+	})
+	return sourcePasswordDecrypter
+}
+
+// Returns an error if the source_password_decryption entry in the config is invalid.
+func ValidateSourcePasswordDecryption() error {
+	_, err := newSourcePasswordDecrypter()
+	return err
+}
+
+func newSourcePasswordDecrypter() (PasswordDecrypter, error) {
+	conf := config.GetConfig()
+	if conf == nil {
+		return nil, nil
+	}
+	decryptionConfig := conf.Sub("source_password_decryption")
+	if decryptionConfig == nil {
+		return nil, nil
+	}
+	algorithm := decryptionConfig.GetString("algorithm")
+	if algorithm == "" {
+		algorithm = PBE_WITH_MD5_AND_DES
+	}
+	if algorithm != PBE_WITH_MD5_AND_DES {
+		return nil, fmt.Errorf("unsupported source_password_decryption algorithm %q, should be %s", algorithm, PBE_WITH_MD5_AND_DES)
+	}
+	key := decryptionConfig.GetString("key")
+	if key == "" {
+		return nil, fmt.Errorf("no key found for source_password_decryption")
+	}
+	iterations := DEFAULT_JASYPT_ITERATIONS
+	if decryptionConfig.IsSet("iterations") {
+		iterations = decryptionConfig.GetInt("iterations")
+	}
+	if iterations <= 0 {
+		return nil, fmt.Errorf("invalid source_password_decryption iterations %d", iterations)
+	}
+	decrypter := NewJasyptDecrypter(key, iterations)
+	return func(password string) (string, error) {
+		if !isEncryptedValue(password) {
+			return password, nil
+		}
+		return decrypter(password)
+	}, nil
+}
+
+func isEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, "ENC(") && strings.HasSuffix(value, ")")
+}
+
+// Returns a decrypter of the values encrypted by jasypt's StandardPBEStringEncryptor with the PBEWithMD5AndDES
+// algorithm, i.e. the base64 encoding of an 8 byte random salt followed by the DES-CBC encrypted value. The value
+// can also be wrapped in "ENC(...)". Returns an internal error if the value can not be decrypted, as that is caused
+// by the server config (the key) or the stored value, and not by the request.
+func NewJasyptDecrypter(key string, iterations int) PasswordDecrypter {
+	return func(encryptedValue string) (string, error) {
+		if isEncryptedValue(encryptedValue) {
+			encryptedValue = encryptedValue[len("ENC(") : len(encryptedValue)-1]
+		}
+		encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedValue)
+		if err != nil {
+			return "", NewInternalError(fmt.Errorf("encrypted value is not valid base64: %w", err))
+		}
+		if len(encryptedBytes) <= jasyptSaltSize || (len(encryptedBytes)-jasyptSaltSize)%des.BlockSize != 0 {
+			return "", NewInternalError(fmt.Errorf("encrypted value has an invalid length"))
+		}
+		salt, cipherText := encryptedBytes[:jasyptSaltSize], encryptedBytes[jasyptSaltSize:]
+		// PBKDF1 key derivation with MD5, as in PKCS #5 v1.5:
+		derivedKey := md5.Sum(append([]byte(key), salt...))
+		for i := 1; i < iterations; i++ {
+			derivedKey = md5.Sum(derivedKey[:])
+		}
+		block, err := des.NewCipher(derivedKey[:8])
+		if err != nil {
+			return "", NewInternalError(err)
+		}
+		plainText := make([]byte, len(cipherText))
+		cipher.NewCBCDecrypter(block, derivedKey[8:]).CryptBlocks(plainText, cipherText)
+		// remove the PKCS #5 padding, which is invalid if the key is wrong:
+		padding := int(plainText[len(plainText)-1])
+		if padding == 0 || padding > des.BlockSize ||
+			!bytes.Equal(plainText[len(plainText)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+			return "", NewInternalError(fmt.Errorf("encrypted value could not be decrypted, check the decryption key"))
+		}
+		return string(plainText[:len(plainText)-padding]), nil
+	}
+}
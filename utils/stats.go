@@ -2,20 +2,41 @@ package utils
 
 import (
 	"log"
+	"math"
+	"strconv"
 
 	"github.com/montanaflynn/stats"
 )
 
 type ConceptStats struct {
-	CohortId       int     `json:"cohortId"`
-	ConceptId      int64   `json:"conceptId"`
-	NumberOfPeople int     `json:"personCount"`
-	Min            float64 `json:"min"`
-	Max            float64 `json:"max"`
-	Avg            float64 `json:"avg"`
-	Sd             float64 `json:"sd"`
+	CohortId              int                  `json:"cohortId"`
+	ConceptId             int64                `json:"conceptId"`
+	NumberOfPeople        int                  `json:"personCount"`
+	Min                   float64              `json:"min"`
+	Max                   float64              `json:"max"`
+	Avg                   float64              `json:"avg"`
+	Sd                    float64              `json:"sd"`
+	Median                float64              `json:"median"`
+	Iqr                   float64              `json:"iqr"`
+	Percentiles           map[string]float64   `json:"percentiles"`
+	Skewness              float64              `json:"skewness"`
+	Kurtosis              float64              `json:"kurtosis"`
+	NumberOfMissingPeople int                  `json:"missingPersonCount"`
+	NormalityTest         *NormalityTestResult `json:"normalityTest"`
 }
 
+type NormalityTestResult struct {
+	Method    string  `json:"method"`
+	Statistic float64 `json:"statistic"`
+	PValue    float64 `json:"pValue"`
+	IsNormal  bool    `json:"isNormal"`
+}
+
+var DEFAULT_PERCENTILES = []float64{5, 25, 75, 95}
+
+// significance level used to decide if the normality hypothesis is rejected:
+const NORMALITY_TEST_ALPHA = 0.05
+
 func GenerateStatsData(cohortId int, conceptId int64, conceptValues []float64) *ConceptStats {
 
 	if len(conceptValues) == 0 {
@@ -42,3 +63,146 @@ func GenerateStatsData(cohortId int, conceptId int64, conceptValues []float64) *
 
 	return result
 }
+
+// Same as GenerateStatsData, but also adds the median, IQR, the given percentiles, skewness, kurtosis,
+// and the result of a normality test. The number of people is the number of distinct persons that have
+// the values (numberOfPeopleWithValue), which can be less than the number of values when persons have
+// multiple observations, and the number of missing people is the number of the other persons in the
+// cohort (cohortSize).
+func GenerateExtendedStatsData(cohortId int, conceptId int64, conceptValues []float64, percentiles []float64, cohortSize int, numberOfPeopleWithValue int) *ConceptStats {
+	result := GenerateStatsData(cohortId, conceptId, conceptValues)
+	if result == nil {
+		return nil
+	}
+	result.NumberOfPeople = numberOfPeopleWithValue
+	result.NumberOfMissingPeople = cohortSize - numberOfPeopleWithValue
+
+	medianValue, _ := stats.Median(conceptValues)
+	result.Median = medianValue
+
+	result.Iqr = IQR(conceptValues) // conceptValues will get sorted as a side-effect
+
+	result.Percentiles = make(map[string]float64)
+	for _, percentile := range percentiles {
+		percentileValue, _ := stats.PercentileNearestRank(conceptValues, percentile)
+		result.Percentiles[strconv.FormatFloat(percentile, 'f', -1, 64)] = percentileValue
+	}
+
+	result.Skewness, result.Kurtosis = SkewnessAndKurtosis(conceptValues)
+	result.NormalityTest = JarqueBeraTest(conceptValues)
+	return result
+}
+
+// Returns the (population) skewness and excess kurtosis of the given values.
+// Returns 0 for both if the values have no variation.
+func SkewnessAndKurtosis(values []float64) (float64, float64) {
+	meanValue, _ := stats.Mean(values)
+	var m2, m3, m4 float64
+	for _, value := range values {
+		deviation := value - meanValue
+		m2 += deviation * deviation
+		m3 += deviation * deviation * deviation
+		m4 += deviation * deviation * deviation * deviation
+	}
+	n := float64(len(values))
+	m2, m3, m4 = m2/n, m3/n, m4/n
+	if m2 == 0 {
+		return 0, 0
+	}
+	skewness := m3 / math.Pow(m2, 1.5)
+	kurtosis := m4/(m2*m2) - 3
+	return skewness, kurtosis
+}
+
+// Runs the Jarque-Bera test (https://en.wikipedia.org/wiki/Jarque%E2%80%93Bera_test) on the given values.
+// The test statistic follows a chi-squared distribution with 2 degrees of freedom, for which the
+// p-value is simply exp(-statistic/2). Returns nil if the values have no variation.
+func JarqueBeraTest(values []float64) *NormalityTestResult {
+	sdValue, _ := stats.StandardDeviation(values)
+	if len(values) == 0 || sdValue == 0 {
+		return nil
+	}
+	skewness, kurtosis := SkewnessAndKurtosis(values)
+	n := float64(len(values))
+	statistic := n / 6 * (skewness*skewness + kurtosis*kurtosis/4)
+	pValue := math.Exp(-statistic / 2)
+	return &NormalityTestResult{
+		Method:    "Jarque-Bera",
+		Statistic: statistic,
+		PValue:    pValue,
+		IsNormal:  pValue >= NORMALITY_TEST_ALPHA,
+	}
+}
+
+type ValueDistributionStats struct {
+	Median                 float64
+	FirstQuartile          float64
+	ThirdQuartile          float64
+	FirstPercentile        float64
+	NinetyNinthPercentile  float64
+	NumberOfDistinctValues int64
+}
+
+// Returns the median, quartiles, 1st and 99th percentiles and the number of distinct
+// values found in conceptValues. Returns nil if conceptValues is empty.
+func GenerateValueDistributionStats(conceptValues []float64) *ValueDistributionStats {
+
+	if len(conceptValues) == 0 {
+		log.Printf("Data size is zero. Returning nil.")
+		return nil
+	}
+
+	result := new(ValueDistributionStats)
+	medianValue, _ := stats.Median(conceptValues)
+	result.Median = medianValue
+
+	// stats.Quartile needs at least 2 values, so fall back to the median otherwise. These are the
+	// same quartiles as the ones used by IQR, and calculated in the DB (see models.retrieveValueSummary):
+	quartiles := stats.Quartiles{Q1: medianValue, Q2: medianValue, Q3: medianValue}
+	if len(conceptValues) > 1 {
+		quartiles, _ = stats.Quartile(conceptValues)
+	}
+	result.FirstQuartile = quartiles.Q1
+	result.ThirdQuartile = quartiles.Q3
+
+	firstPercentile, _ := stats.PercentileNearestRank(conceptValues, 1)
+	result.FirstPercentile = firstPercentile
+
+	ninetyNinthPercentile, _ := stats.PercentileNearestRank(conceptValues, 99)
+	result.NinetyNinthPercentile = ninetyNinthPercentile
+
+	distinctValues := make(map[float64]bool)
+	for _, value := range conceptValues {
+		distinctValues[value] = true
+	}
+	result.NumberOfDistinctValues = int64(len(distinctValues))
+
+	return result
+}
+
+// Summary of a set of values, with everything needed to calculate histogram bins for them.
+// Can be calculated in memory (see GenerateValueSummary) or in the DB.
+type ValueSummary struct {
+	NumberOfValues int
+	Min            float64
+	Max            float64
+	Sd             float64 // sample standard deviation
+	ValueDistributionStats
+}
+
+// Returns the summary of the given values. Returns nil if values is empty.
+func GenerateValueSummary(values []float64) *ValueSummary {
+	distributionStats := GenerateValueDistributionStats(values)
+	if distributionStats == nil {
+		return nil
+	}
+	result := new(ValueSummary)
+	result.NumberOfValues = len(values)
+	result.Min, _ = stats.Min(values)
+	result.Max, _ = stats.Max(values)
+	if len(values) > 1 {
+		result.Sd, _ = stats.StandardDeviationSample(values)
+	}
+	result.ValueDistributionStats = *distributionStats
+	return result
+}
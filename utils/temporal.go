@@ -0,0 +1,171 @@
+package utils
+
+import "fmt"
+
+const TEMPORAL_VARIABLE_TYPE = "temporal"
+
+// the anchors, relations and occurrences supported by temporal variables:
+const (
+	ANCHOR_START       = "start"
+	ANCHOR_END         = "end"
+	RELATION_BEFORE    = "before"
+	RELATION_AFTER     = "after"
+	RELATION_DURING    = "during"
+	OCCURRENCE_FIRST   = "first"
+	OCCURRENCE_ANY     = "any"
+	DEFAULT_ANCHOR     = ANCHOR_START
+	DEFAULT_OCCURRENCE = OCCURRENCE_ANY
+)
+
+var TEMPORAL_ANCHORS = []string{ANCHOR_START, ANCHOR_END}
+var TEMPORAL_RELATIONS = []string{RELATION_BEFORE, RELATION_AFTER, RELATION_DURING}
+var TEMPORAL_OCCURRENCES = []string{OCCURRENCE_FIRST, OCCURRENCE_ANY}
+
+// fields that define a temporal variable: it keeps the persons of the main cohort that have an entry in
+// the cohort CohortDefinitionId that starts in the given relation to the entry in the main cohort:
+//   - RELATION_BEFORE: between MaxDays (if set) and MinDays days before the Anchor (start or end) of the main cohort entry
+//   - RELATION_AFTER: between MinDays and MaxDays (if set) days after the Anchor of the main cohort entry
+//   - RELATION_DURING: between the start and the end of the main cohort entry
+//
+// With OCCURRENCE_FIRST only the first entry of the person in the cohort CohortDefinitionId is considered,
+// with OCCURRENCE_ANY all its entries are. For example, the persons that entered cohort 5 within 30 days after
+// entering the main cohort are {CohortDefinitionId: 5, Anchor: "start", Relation: "after", MinDays: 0, MaxDays: 30}.
+type CustomTemporalVariableDef struct {
+	CohortDefinitionId int
+	Anchor             string
+	Relation           string
+	MinDays            int
+	MaxDays            *int
+	Occurrence         string
+	ProvidedName       string
+}
+
+func GetTemporalVariableKey(cohortDefinitionId int, relation string, anchor string) string {
+	return fmt.Sprintf("ID_%v_%s_%s", cohortDefinitionId, relation, anchor)
+}
+
+// Returns the temporal variables in the given list of variables (see ParseConceptIdsAndDichotomousDefsAsSingleList).
+func GetTemporalVariables(conceptIdsAndCohortPairs []interface{}) []CustomTemporalVariableDef {
+	temporalVariables := []CustomTemporalVariableDef{}
+	for _, item := range conceptIdsAndCohortPairs {
+		if temporalVariable, ok := item.(CustomTemporalVariableDef); ok {
+			temporalVariables = append(temporalVariables, temporalVariable)
+		}
+	}
+	return temporalVariables
+}
+
+// Returns the ids of the cohorts used in the given temporal variables.
+func GetTemporalVariablesCohortIds(temporalVariables []CustomTemporalVariableDef) []int {
+	cohortIds := []int{}
+	for _, temporalVariable := range temporalVariables {
+		cohortIds = append(cohortIds, temporalVariable.CohortDefinitionId)
+	}
+	return cohortIds
+}
+
+// Returns the field errors found in the temporal variable fields of v, with the field names prefixed by the given path.
+func (v VariableDef) validateTemporalFields(path string) []FieldError {
+	fieldErrors := []FieldError{}
+	addError := func(field string, message string) {
+		fieldErrors = append(fieldErrors, FieldError{Field: path + "." + field, Message: message})
+	}
+	if v.CohortId == nil {
+		addError("cohort_id", "is required")
+	} else if *v.CohortId <= 0 {
+		addError("cohort_id", "should be a positive number")
+	}
+	if v.Relation == "" {
+		addError("relation", "is required")
+	} else if !ContainsString(TEMPORAL_RELATIONS, v.Relation) {
+		addError("relation", fmt.Sprintf("should be one of %v", TEMPORAL_RELATIONS))
+	}
+	if v.Anchor != "" && !ContainsString(TEMPORAL_ANCHORS, v.Anchor) {
+		addError("anchor", fmt.Sprintf("should be one of %v", TEMPORAL_ANCHORS))
+	}
+	if v.Occurrence != "" && !ContainsString(TEMPORAL_OCCURRENCES, v.Occurrence) {
+		addError("occurrence", fmt.Sprintf("should be one of %v", TEMPORAL_OCCURRENCES))
+	}
+	if v.Relation == RELATION_DURING {
+		// the main cohort entry itself is the window, so anchor and offsets do not apply:
+		if v.Anchor != "" {
+			addError("anchor", "is not allowed for relation during")
+		}
+		if v.MinDays != nil {
+			addError("min_days", "is not allowed for relation during")
+		}
+		if v.MaxDays != nil {
+			addError("max_days", "is not allowed for relation during")
+		}
+	}
+	if v.MinDays != nil && *v.MinDays < 0 {
+		addError("min_days", "should not be negative")
+	}
+	if v.MaxDays != nil && *v.MaxDays < 0 {
+		addError("max_days", "should not be negative")
+	} else if v.MaxDays != nil && v.MinDays != nil && *v.MaxDays < *v.MinDays {
+		addError("max_days", "should not be smaller than min_days")
+	}
+	if v.ProvidedName != nil && *v.ProvidedName == "" {
+		addError("provided_name", "should not be empty")
+	}
+	if v.ConceptId != nil {
+		addError("concept_id", "is not allowed for variable_type temporal")
+	}
+	if v.Values != nil {
+		addError("values", "is not allowed for variable_type temporal")
+	}
+	if v.CohortIds != nil {
+		addError("cohort_ids", "is not allowed for variable_type temporal")
+	}
+	return fieldErrors
+}
+
+// Returns the names of the temporal variable fields that are set in v.
+func (v VariableDef) getTemporalFieldsSet() []string {
+	fields := []string{}
+	if v.CohortId != nil {
+		fields = append(fields, "cohort_id")
+	}
+	if v.Anchor != "" {
+		fields = append(fields, "anchor")
+	}
+	if v.Relation != "" {
+		fields = append(fields, "relation")
+	}
+	if v.MinDays != nil {
+		fields = append(fields, "min_days")
+	}
+	if v.MaxDays != nil {
+		fields = append(fields, "max_days")
+	}
+	if v.Occurrence != "" {
+		fields = append(fields, "occurrence")
+	}
+	return fields
+}
+
+// Converts the (validated) temporal variable into a CustomTemporalVariableDef, filling in the defaults.
+func (v VariableDef) toTemporalVariableDef() CustomTemporalVariableDef {
+	temporalVariable := CustomTemporalVariableDef{
+		CohortDefinitionId: *v.CohortId,
+		Anchor:             v.Anchor,
+		Relation:           v.Relation,
+		MaxDays:            v.MaxDays,
+		Occurrence:         v.Occurrence,
+	}
+	if temporalVariable.Anchor == "" {
+		temporalVariable.Anchor = DEFAULT_ANCHOR
+	}
+	if temporalVariable.Occurrence == "" {
+		temporalVariable.Occurrence = DEFAULT_OCCURRENCE
+	}
+	if v.MinDays != nil {
+		temporalVariable.MinDays = *v.MinDays
+	}
+	temporalVariable.ProvidedName = GetTemporalVariableKey(temporalVariable.CohortDefinitionId, temporalVariable.Relation, temporalVariable.Anchor)
+	if v.ProvidedName != nil {
+		temporalVariable.ProvidedName = *v.ProvidedName
+	}
+	return temporalVariable
+}
@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/uc-cdis/cohort-middleware/config"
+)
+
+const CONCEPT_VARIABLE_TYPE = "concept"
+const CUSTOM_DICHOTOMOUS_VARIABLE_TYPE = "custom_dichotomous"
+
+// Default maximum number of variables in a single request. Can be overridden
+// in the config with max_variables_per_request.
+const DEFAULT_MAX_VARIABLES_PER_REQUEST = 100
+
+// The request body with the list of variables, e.g.:
+//
+//	{"variables": [
+//		{"variable_type": "concept", "concept_id": 2000006885, "values": [2000007028, 2000007029]},
+//		{"variable_type": "custom_dichotomous", "provided_name": "name1", "cohort_ids": [1, 3]},
+//		{"variable_type": "temporal", "cohort_id": 5, "anchor": "start", "relation": "after", "min_days": 0, "max_days": 30}
+//	 ],
+//	 "windows": {"observation_window": 365, "follow_up_window": 30}}
+//
+// The optional windows restrict the cohort to the persons with enough observation time around their
+// cohort start date (see AnalysisWindows). See GetVariablesRequestJsonSchema for the full definition.
+type VariablesRequest struct {
+	Variables []VariableDef    `json:"variables"`
+	Windows   *AnalysisWindows `json:"windows,omitempty"`
+}
+
+type VariableDef struct {
+	VariableType string  `json:"variable_type"`
+	ConceptId    *int64  `json:"concept_id,omitempty"`
+	Values       []int64 `json:"values,omitempty"`
+	ProvidedName *string `json:"provided_name,omitempty"`
+	CohortIds    []int   `json:"cohort_ids,omitempty"`
+	// temporal variable fields (see CustomTemporalVariableDef):
+	CohortId   *int   `json:"cohort_id,omitempty"`
+	Anchor     string `json:"anchor,omitempty"`
+	Relation   string `json:"relation,omitempty"`
+	MinDays    *int   `json:"min_days,omitempty"`
+	MaxDays    *int   `json:"max_days,omitempty"`
+	Occurrence string `json:"occurrence,omitempty"`
+}
+
+func GetMaxVariablesPerRequest() int {
+	conf := config.GetConfig()
+	if conf != nil && conf.IsSet("max_variables_per_request") {
+		return conf.GetInt("max_variables_per_request")
+	}
+	return DEFAULT_MAX_VARIABLES_PER_REQUEST
+}
+
+// Decodes the given request body into a VariablesRequest. Unknown fields are not allowed.
+// Returns a ValidationError listing all fields that are missing or invalid.
+func DecodeVariablesRequest(body io.Reader) (*VariablesRequest, error) {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	var request VariablesRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		return nil, getDecodeValidationError(err)
+	}
+	if decoder.More() {
+		return nil, &ValidationError{FieldErrors: []FieldError{{Message: "unexpected data after the request body"}}}
+	}
+	fieldErrors := request.Validate(GetMaxVariablesPerRequest())
+	if len(fieldErrors) > 0 {
+		return nil, &ValidationError{FieldErrors: fieldErrors}
+	}
+	return &request, nil
+}
+
+// Translates a JSON decoding error into a ValidationError, naming the offending field where possible.
+func getDecodeValidationError(err error) error {
+	var typeError *json.UnmarshalTypeError
+	var syntaxError *json.SyntaxError
+	switch {
+	case errors.As(err, &typeError):
+		return &ValidationError{FieldErrors: []FieldError{
+			{Field: getFieldPath(typeError.Field), Message: fmt.Sprintf("should be of type %s", getJsonTypeName(typeError.Type.Kind().String()))}}}
+	case errors.As(err, &syntaxError):
+		return &ValidationError{FieldErrors: []FieldError{
+			{Message: fmt.Sprintf("invalid JSON at offset %d: %s", syntaxError.Offset, syntaxError.Error())}}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return &ValidationError{FieldErrors: []FieldError{
+			{Field: strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\""), Message: "unknown field"}}}
+	case errors.Is(err, io.EOF):
+		return &ValidationError{FieldErrors: []FieldError{{Message: "empty request body"}}}
+	default:
+		return &ValidationError{FieldErrors: []FieldError{{Message: err.Error()}}}
+	}
+}
+
+// Translates a field path like "variables.0.concept_id" into "variables[0].concept_id".
+func getFieldPath(jsonFieldPath string) string {
+	return arrayIndexInFieldPath.ReplaceAllString(jsonFieldPath, "[$1]")
+}
+
+var arrayIndexInFieldPath = regexp.MustCompile(`\.(\d+)`)
+
+func getJsonTypeName(goKind string) string {
+	switch {
+	case strings.HasPrefix(goKind, "int"), strings.HasPrefix(goKind, "float"):
+		return "integer"
+	case goKind == "slice":
+		return "array"
+	case goKind == "struct", goKind == "ptr":
+		return "object"
+	default:
+		return goKind
+	}
+}
+
+// Returns the field errors found in the request, if any.
+func (r VariablesRequest) Validate(maxVariables int) []FieldError {
+	fieldErrors := []FieldError{}
+	if r.Variables == nil {
+		return append(fieldErrors, FieldError{Field: "variables", Message: "is required"})
+	}
+	if len(r.Variables) > maxVariables {
+		fieldErrors = append(fieldErrors, FieldError{Field: "variables", Message: fmt.Sprintf("should have at most %d variables", maxVariables)})
+	}
+	for i, variable := range r.Variables {
+		fieldErrors = append(fieldErrors, variable.Validate(fmt.Sprintf("variables[%d]", i))...)
+	}
+	if r.Windows != nil {
+		fieldErrors = append(fieldErrors, r.Windows.Validate("windows")...)
+	}
+	return fieldErrors
+}
+
+// Returns the field errors found in the variable, with the field names prefixed by the given path.
+func (v VariableDef) Validate(path string) []FieldError {
+	fieldErrors := []FieldError{}
+	addError := func(field string, message string) {
+		fieldErrors = append(fieldErrors, FieldError{Field: path + "." + field, Message: message})
+	}
+	if v.VariableType != TEMPORAL_VARIABLE_TYPE {
+		for _, field := range v.getTemporalFieldsSet() {
+			addError(field, "is only allowed for variable_type temporal")
+		}
+	}
+	switch v.VariableType {
+	case CONCEPT_VARIABLE_TYPE:
+		if v.ConceptId == nil {
+			addError("concept_id", "is required")
+		} else if *v.ConceptId <= 0 {
+			addError("concept_id", "should be a positive number")
+		}
+		for j, value := range v.Values {
+			if value <= 0 {
+				addError(fmt.Sprintf("values[%d]", j), "should be a positive number")
+			}
+		}
+		if v.CohortIds != nil {
+			addError("cohort_ids", "is not allowed for variable_type concept")
+		}
+		if v.ProvidedName != nil {
+			addError("provided_name", "is not allowed for variable_type concept")
+		}
+	case CUSTOM_DICHOTOMOUS_VARIABLE_TYPE:
+		if v.CohortIds == nil {
+			addError("cohort_ids", "is required")
+		} else if len(v.CohortIds) != 2 {
+			addError("cohort_ids", "should have exactly two cohort ids")
+		} else if v.CohortIds[0] == v.CohortIds[1] {
+			addError("cohort_ids", "should have two distinct cohort ids")
+		}
+		for j, cohortId := range v.CohortIds {
+			if cohortId <= 0 {
+				addError(fmt.Sprintf("cohort_ids[%d]", j), "should be a positive number")
+			}
+		}
+		if v.ProvidedName != nil && strings.TrimSpace(*v.ProvidedName) == "" {
+			addError("provided_name", "should not be empty")
+		}
+		if v.ConceptId != nil {
+			addError("concept_id", "is not allowed for variable_type custom_dichotomous")
+		}
+		if v.Values != nil {
+			addError("values", "is not allowed for variable_type custom_dichotomous")
+		}
+	case TEMPORAL_VARIABLE_TYPE:
+		fieldErrors = append(fieldErrors, v.validateTemporalFields(path)...)
+	case "":
+		addError("variable_type", "is required")
+	default:
+		addError("variable_type", fmt.Sprintf("should be one of [%s %s %s]", CONCEPT_VARIABLE_TYPE, CUSTOM_DICHOTOMOUS_VARIABLE_TYPE, TEMPORAL_VARIABLE_TYPE))
+	}
+	return fieldErrors
+}
+
+// Converts the (validated) variable into a CustomConceptVariableDef, CustomDichotomousVariableDef or CustomTemporalVariableDef.
+func (v VariableDef) ToConceptOrCohortPairDef() interface{} {
+	if v.VariableType == TEMPORAL_VARIABLE_TYPE {
+		return v.toTemporalVariableDef()
+	}
+	if v.VariableType == CONCEPT_VARIABLE_TYPE {
+		conceptValues := []int64{}
+		conceptValues = append(conceptValues, v.Values...)
+		return CustomConceptVariableDef{
+			ConceptId:     *v.ConceptId,
+			ConceptValues: conceptValues,
+		}
+	}
+	providedName := GetCohortPairKey(v.CohortIds[0], v.CohortIds[1])
+	if v.ProvidedName != nil {
+		providedName = *v.ProvidedName
+	}
+	return CustomDichotomousVariableDef{
+		CohortDefinitionId1: v.CohortIds[0],
+		CohortDefinitionId2: v.CohortIds[1],
+		ProvidedName:        providedName,
+	}
+}
+
+// Returns the JSON Schema of the VariablesRequest, for clients to validate their requests against.
+func GetVariablesRequestJsonSchema() map[string]interface{} {
+	positiveInteger := map[string]interface{}{"type": "integer", "minimum": 1}
+	nonNegativeInteger := map[string]interface{}{"type": "integer", "minimum": 0}
+	return map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "Variables request",
+		"type":                 "object",
+		"required":             []string{"variables"},
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"variables": map[string]interface{}{
+				"type":     "array",
+				"maxItems": GetMaxVariablesPerRequest(),
+				"items": map[string]interface{}{
+					"oneOf": []interface{}{
+						map[string]interface{}{
+							"type":                 "object",
+							"required":             []string{"variable_type", "concept_id"},
+							"additionalProperties": false,
+							"properties": map[string]interface{}{
+								"variable_type": map[string]interface{}{"const": CONCEPT_VARIABLE_TYPE},
+								"concept_id":    positiveInteger,
+								"values":        map[string]interface{}{"type": "array", "items": positiveInteger},
+							},
+						},
+						map[string]interface{}{
+							"type":                 "object",
+							"required":             []string{"variable_type", "cohort_ids"},
+							"additionalProperties": false,
+							"properties": map[string]interface{}{
+								"variable_type": map[string]interface{}{"const": CUSTOM_DICHOTOMOUS_VARIABLE_TYPE},
+								"provided_name": map[string]interface{}{"type": "string", "minLength": 1},
+								"cohort_ids": map[string]interface{}{
+									"type":        "array",
+									"items":       positiveInteger,
+									"minItems":    2,
+									"maxItems":    2,
+									"uniqueItems": true,
+								},
+							},
+						},
+						map[string]interface{}{
+							"type":                 "object",
+							"required":             []string{"variable_type", "cohort_id", "relation"},
+							"additionalProperties": false,
+							"properties": map[string]interface{}{
+								"variable_type": map[string]interface{}{"const": TEMPORAL_VARIABLE_TYPE},
+								"provided_name": map[string]interface{}{"type": "string", "minLength": 1},
+								"cohort_id":     positiveInteger,
+								"anchor":        map[string]interface{}{"enum": TEMPORAL_ANCHORS},
+								"relation":      map[string]interface{}{"enum": TEMPORAL_RELATIONS},
+								"min_days":      nonNegativeInteger,
+								"max_days":      nonNegativeInteger,
+								"occurrence":    map[string]interface{}{"enum": TEMPORAL_OCCURRENCES},
+							},
+						},
+					},
+				},
+			},
+			"windows": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"properties": map[string]interface{}{
+					"observation_window": nonNegativeInteger,
+					"outcome_window":     nonNegativeInteger,
+					"follow_up_window":   nonNegativeInteger,
+				},
+			},
+		},
+	}
+}